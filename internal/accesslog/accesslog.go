@@ -0,0 +1,203 @@
+// Package accesslog implements asynchronous access log of STUN transactions.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	mathRand "math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Entry is single STUN transaction.
+type Entry struct {
+	Time     time.Time     `json:"ts"`
+	Client   string        `json:"client"`
+	Method   string        `json:"method"`
+	Username string        `json:"username,omitempty"`
+	Code     int           `json:"code"`
+	Latency  time.Duration `json:"latency"`
+}
+
+// Format of access log lines.
+type Format byte
+
+// Supported formats.
+const (
+	// Text format is space-separated list of entry fields.
+	Text Format = iota
+	// JSON format is single JSON object per line.
+	JSON
+)
+
+// ParseFormat returns format from its name.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "text", "":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	default:
+		return Text, fmt.Errorf("unknown format %s", s)
+	}
+}
+
+// Options contain possible settings for Logger.
+type Options struct {
+	Log    *zap.Logger // for internal errors
+	Writer io.Writer
+	Format Format
+	Rate   float64 // sampling rate from 0 to 1, all entries are logged if 0
+	Queue  int     // maximum count of pending lines
+}
+
+// Logger writes access log entries in background, so Log never blocks
+// on underlying writer.
+type Logger struct {
+	log      *zap.Logger
+	w        io.Writer
+	format   Format
+	rate     float64
+	queue    chan []byte
+	wg       sync.WaitGroup
+	closed   bool
+	closeMux sync.RWMutex
+	randMux  sync.Mutex
+	rand     *mathRand.Rand
+}
+
+func (l *Logger) sample() bool {
+	if l.rate <= 0 || l.rate >= 1 {
+		return true
+	}
+	l.randMux.Lock()
+	v := l.rand.Float64()
+	l.randMux.Unlock()
+	return v < l.rate
+}
+
+func (l *Logger) encode(e Entry) []byte {
+	if l.format == JSON {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			l.log.Error("failed to encode", zap.Error(err))
+			return nil
+		}
+		return append(buf, '\n')
+	}
+	username := e.Username
+	if username == "" {
+		username = "-"
+	}
+	buf := make([]byte, 0, 128)
+	buf = e.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, ' ')
+	buf = append(buf, e.Client...)
+	buf = append(buf, ' ')
+	buf = append(buf, e.Method...)
+	buf = append(buf, ' ')
+	buf = append(buf, username...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(e.Code), 10)
+	buf = append(buf, ' ')
+	buf = append(buf, e.Latency.String()...)
+	return append(buf, '\n')
+}
+
+// Sampled reports whether next entry should be logged, allowing to skip
+// preparing the entry.
+func (l *Logger) Sampled() bool {
+	return l != nil && l.sample()
+}
+
+// Log encodes entry and queues it for writing. Entry is dropped if queue
+// is full.
+func (l *Logger) Log(e Entry) {
+	buf := l.encode(e)
+	if buf == nil {
+		return
+	}
+	l.closeMux.RLock()
+	defer l.closeMux.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- buf:
+	default:
+		l.log.Warn("access log entry dropped: queue is full")
+	}
+}
+
+func (l *Logger) loop() {
+	defer l.wg.Done()
+	for buf := range l.queue {
+		if _, err := l.w.Write(buf); err != nil {
+			l.log.Error("failed to write", zap.Error(err))
+		}
+	}
+}
+
+// Close writes all pending entries and closes underlying writer
+// if it implements io.Closer.
+func (l *Logger) Close() error {
+	l.closeMux.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.closeMux.Unlock()
+	l.wg.Wait()
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// New initializes and starts new Logger.
+func New(o Options) *Logger {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Queue == 0 {
+		o.Queue = 4096
+	}
+	l := &Logger{
+		log:    o.Log,
+		w:      o.Writer,
+		format: o.Format,
+		rate:   o.Rate,
+		queue:  make(chan []byte, o.Queue),
+		rand:   mathRand.New(mathRand.NewSource(time.Now().UnixNano())), // #nosec
+	}
+	l.wg.Add(1)
+	go l.loop()
+	return l
+}
+
+// Open opens or creates file with provided path and returns Logger that
+// appends entries to it. The "stdout" and "stderr" paths are special.
+func Open(path string, o Options) (*Logger, error) {
+	switch path {
+	case "stdout":
+		o.Writer = nopCloser{os.Stdout}
+	case "stderr":
+		o.Writer = nopCloser{os.Stderr}
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640) // #nosec
+		if err != nil {
+			return nil, err
+		}
+		o.Writer = f
+	}
+	return New(o), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
@@ -0,0 +1,123 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mux    sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out Format
+	}{
+		{"", Text},
+		{"text", Text},
+		{"json", JSON},
+	} {
+		f, err := ParseFormat(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != tc.out {
+			t.Errorf("%q: unexpected format", tc.in)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("should error")
+	}
+}
+
+var testEntry = Entry{
+	Time:     time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+	Client:   "127.0.0.1:1234",
+	Method:   "Allocate request",
+	Username: "user",
+	Code:     401,
+	Latency:  time.Millisecond,
+}
+
+func TestLogger_Text(t *testing.T) {
+	buf := new(syncBuffer)
+	l := New(Options{Writer: buf})
+	l.Log(testEntry)
+	l.Log(Entry{Time: testEntry.Time, Client: "127.0.0.1:1", Method: "Binding request"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !buf.closed {
+		t.Error("writer should be closed")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines count %d", len(lines))
+	}
+	if lines[0] != "2001-01-01T00:00:00Z 127.0.0.1:1234 Allocate request user 401 1ms" {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+	if lines[1] != "2001-01-01T00:00:00Z 127.0.0.1:1 Binding request - 0 0s" {
+		t.Errorf("unexpected line %q", lines[1])
+	}
+	// Should not panic.
+	l.Log(testEntry)
+}
+
+func TestLogger_JSON(t *testing.T) {
+	buf := new(syncBuffer)
+	l := New(Options{Writer: buf, Format: JSON})
+	l.Log(testEntry)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(buf.buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e != testEntry {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestLogger_Sampled(t *testing.T) {
+	var nilLogger *Logger
+	if nilLogger.Sampled() {
+		t.Error("nil logger should not sample")
+	}
+	l := New(Options{Writer: ioutil.Discard, Rate: 0.5})
+	defer l.Close()
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if l.Sampled() {
+			sampled++
+		}
+	}
+	if sampled < 300 || sampled > 700 {
+		t.Errorf("unexpected sampled count %d", sampled)
+	}
+	all := New(Options{Writer: ioutil.Discard})
+	defer all.Close()
+	if !all.Sampled() {
+		t.Error("should sample all")
+	}
+}
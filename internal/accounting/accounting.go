@@ -0,0 +1,126 @@
+// Package accounting implements per-allocation accounting records.
+package accounting
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reason is the reason of allocation end.
+type Reason byte
+
+// Possible allocation end reasons.
+const (
+	// Expired means that allocation was not refreshed in time.
+	Expired Reason = iota + 1
+	// Deleted means that allocation was refreshed with zero lifetime.
+	Deleted
+	// Killed means that allocation was removed by administrator.
+	Killed
+	// Failed means that allocation was removed due to error.
+	Failed
+)
+
+var reasonToStr = map[Reason]string{
+	Expired: "expired",
+	Deleted: "deleted",
+	Killed:  "killed",
+	Failed:  "error",
+}
+
+func (r Reason) String() string {
+	return reasonToStr[r]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r Reason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *Reason) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*r = 0
+		return nil
+	}
+	for k, v := range reasonToStr {
+		if v == string(text) {
+			*r = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reason %q", text)
+}
+
+// Record is an accounting record that is written when allocation ends.
+type Record struct {
+	Username        string    `json:"username,omitempty"`
+	Realm           string    `json:"realm,omitempty"`
+	Client          string    `json:"client"`
+	Server          string    `json:"server"`
+	Proto           string    `json:"proto"`
+	Relayed         string    `json:"relayed"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Reason          Reason    `json:"reason"`
+	ToPeerBytes     uint64    `json:"to_peer_bytes"`
+	ToPeerPackets   uint64    `json:"to_peer_packets"`
+	FromPeerBytes   uint64    `json:"from_peer_bytes"`
+	FromPeerPackets uint64    `json:"from_peer_packets"`
+	Peers           []string  `json:"peers,omitempty"`
+}
+
+// Sink represents destination of accounting records.
+type Sink interface {
+	Account(r Record) error
+}
+
+type discard struct{}
+
+func (discard) Account(r Record) error { return nil }
+
+// Discard is Sink that drops all records.
+var Discard Sink = discard{}
+
+type tee []Sink
+
+func (t tee) Account(r Record) error {
+	var firstErr error
+	for _, s := range t {
+		if err := s.Account(r); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes all sinks that implement io.Closer, returning first error
+// if any.
+func (t tee) Close() error {
+	var firstErr error
+	for _, s := range t {
+		c, ok := s.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Tee returns Sink that writes records to all provided sinks, returning
+// first error if any. Returned Sink implements io.Closer if there are
+// multiple sinks.
+func Tee(sinks ...Sink) Sink {
+	switch len(sinks) {
+	case 0:
+		return Discard
+	case 1:
+		return sinks[0]
+	default:
+		return tee(sinks)
+	}
+}
@@ -0,0 +1,117 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type sinkFunc func(r Record) error
+
+func (f sinkFunc) Account(r Record) error { return f(r) }
+
+func TestReason_String(t *testing.T) {
+	for r, s := range map[Reason]string{
+		Expired: "expired",
+		Deleted: "deleted",
+		Killed:  "killed",
+		Failed:  "error",
+	} {
+		if r.String() != s {
+			t.Errorf("%d: %q != %q", r, r, s)
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	if Tee() != Discard {
+		t.Error("blank tee should be discard")
+	}
+	var got int
+	counter := sinkFunc(func(r Record) error {
+		got++
+		return nil
+	})
+	if err := Tee(counter).Account(Record{}); err != nil {
+		t.Error(err)
+	}
+	errSink := sinkFunc(func(r Record) error {
+		return errors.New("failed")
+	})
+	if err := Tee(counter, errSink, counter).Account(Record{}); err == nil {
+		t.Error("should error")
+	}
+	if got != 3 {
+		t.Errorf("unexpected count %d", got)
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	buf := new(bytes.Buffer)
+	j := NewJSONLines(buf)
+	for _, r := range []Record{
+		{Username: "a", Reason: Expired, ToPeerBytes: 100},
+		{Username: "b", Reason: Deleted, Peers: []string{"127.0.0.1:1"}},
+	} {
+		if err := j.Account(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Error(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte{'\n'})
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines count %d", len(lines))
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(lines[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["reason"] != "expired" {
+		t.Errorf("unexpected reason %v", v["reason"])
+	}
+	if v["to_peer_bytes"] != float64(100) {
+		t.Errorf("unexpected bytes %v", v["to_peer_bytes"])
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan Record, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec Record
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			t.Error(err)
+		}
+		got <- rec
+	}))
+	defer s.Close()
+	w := NewWebhook(WebhookOptions{
+		URL:    s.URL,
+		Client: s.Client(),
+	})
+	if err := w.Account(Record{Username: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-got:
+		if r.Username != "user" {
+			t.Errorf("unexpected username %q", r.Username)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("timed out")
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := w.Account(Record{Username: "user"}); err != ErrClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+}
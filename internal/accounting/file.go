@@ -0,0 +1,52 @@
+package accounting
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONLines writes records as JSON lines to underlying writer.
+type JSONLines struct {
+	mux sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// Account implements Sink.
+func (j *JSONLines) Account(r Record) error {
+	j.mux.Lock()
+	err := j.enc.Encode(r)
+	j.mux.Unlock()
+	return err
+}
+
+// Close closes underlying writer if it implements io.Closer.
+func (j *JSONLines) Close() error {
+	c, ok := j.w.(io.Closer)
+	if !ok {
+		return nil
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return c.Close()
+}
+
+// NewJSONLines initializes and returns new JSONLines sink for w.
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// OpenFile opens or creates file with provided name and returns JSONLines
+// sink that appends records to it.
+func OpenFile(name string) (*JSONLines, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLines(f), nil
+}
@@ -0,0 +1,121 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrQueueFull means that record was dropped because webhook queue is full.
+var ErrQueueFull = errors.New("accounting queue is full")
+
+// ErrClosed means that record was dropped because webhook is closed.
+var ErrClosed = errors.New("accounting webhook is closed")
+
+// Webhook sends every record as JSON via HTTP POST request to URL.
+//
+// Records are queued and sent asynchronously, so Account never blocks on
+// network.
+type Webhook struct {
+	log    *zap.Logger
+	url    string
+	client *http.Client
+	queue  chan Record
+	wg     sync.WaitGroup
+
+	closed   bool
+	closeMux sync.RWMutex
+}
+
+// Account implements Sink.
+func (w *Webhook) Account(r Record) error {
+	w.closeMux.RLock()
+	defer w.closeMux.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	select {
+	case w.queue <- r:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (w *Webhook) send(r Record) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if closeErr := res.Body.Close(); closeErr != nil {
+		w.log.Warn("failed to close body", zap.Error(closeErr))
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("unexpected status: " + res.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) loop() {
+	defer w.wg.Done()
+	for r := range w.queue {
+		if err := w.send(r); err != nil {
+			w.log.Error("failed to send record", zap.Error(err))
+		}
+	}
+}
+
+// Close stops accepting new records and waits until queued records are sent.
+func (w *Webhook) Close() error {
+	w.closeMux.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closeMux.Unlock()
+	w.wg.Wait()
+	return nil
+}
+
+// WebhookOptions contain possible settings for Webhook.
+type WebhookOptions struct {
+	Log     *zap.Logger
+	URL     string
+	Client  *http.Client // http.Client with Timeout if nil
+	Timeout time.Duration
+	Queue   int // maximum count of pending records
+}
+
+// NewWebhook initializes and starts new Webhook.
+func NewWebhook(o WebhookOptions) *Webhook {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: o.Timeout}
+	}
+	if o.Queue == 0 {
+		o.Queue = 1024
+	}
+	w := &Webhook{
+		log:    o.Log,
+		url:    o.URL,
+		client: o.Client,
+		queue:  make(chan Record, o.Queue),
+	}
+	w.wg.Add(1)
+	go w.loop()
+	return w
+}
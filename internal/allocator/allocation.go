@@ -4,11 +4,18 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/gortc/gortcd/internal/accounting"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/gortcd/internal/icmp"
 	"github.com/gortc/turn"
 )
 
@@ -18,6 +25,13 @@ type PeerHandler interface {
 	HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr)
 }
 
+// ICMPHandler is optional interface of PeerHandler that handles ICMP
+// errors that are received in response to data sent to peer, if reading
+// of them is supported, see icmp package.
+type ICMPHandler interface {
+	HandlePeerICMP(e icmp.Error, t turn.FiveTuple, a turn.Addr)
+}
+
 // Permission as described in "Permissions" section, mimics the
 // address-restricted filtering mechanism of NAT's.
 //
@@ -42,27 +56,194 @@ func (p *Permission) conflicts(n turn.ChannelNumber, peer turn.Addr) bool {
 	return !p.Addr.Equal(peer) || p.Binding == n
 }
 
+// Usage contains traffic counters of allocation and is safe for
+// concurrent use.
+type Usage struct {
+	ToPeerBytes     uint64
+	ToPeerPackets   uint64
+	FromPeerBytes   uint64
+	FromPeerPackets uint64
+}
+
+func (u *Usage) sent(n int) {
+	if u == nil {
+		return
+	}
+	atomic.AddUint64(&u.ToPeerBytes, uint64(n))
+	atomic.AddUint64(&u.ToPeerPackets, 1)
+}
+
+func (u *Usage) received(n int) {
+	if u == nil {
+		return
+	}
+	atomic.AddUint64(&u.FromPeerBytes, uint64(n))
+	atomic.AddUint64(&u.FromPeerPackets, 1)
+}
+
+// Load returns copy of current counter values.
+func (u *Usage) Load() Usage {
+	if u == nil {
+		return Usage{}
+	}
+	return Usage{
+		ToPeerBytes:     atomic.LoadUint64(&u.ToPeerBytes),
+		ToPeerPackets:   atomic.LoadUint64(&u.ToPeerPackets),
+		FromPeerBytes:   atomic.LoadUint64(&u.FromPeerBytes),
+		FromPeerPackets: atomic.LoadUint64(&u.FromPeerPackets),
+	}
+}
+
+// Session contains details about allocation owner.
+type Session struct {
+	Username string
+	Realm    string
+}
+
 // Allocation as described in "Allocations" section.
 //
 // See RFC 5766 Section 2.2
 type Allocation struct {
 	Tuple       turn.FiveTuple
+	Session     Session
 	Permissions []Permission
+	Peers       []turn.Addr    // all peers that ever had permission
 	RelayedAddr turn.Addr      // relayed transport address
 	Conn        net.PacketConn // on RelayedAddr
 	Callback    PeerHandler    // for data from Conn
+	Started     time.Time      // time of creation
 	Timeout     time.Time      // time-to-expiry
-	Buf         []byte         // read buffer
-	Log         *zap.Logger
+	Usage       *Usage         // shared between copies
+	Capture     *capture.Hub   // optional
+	PeerRule    PeerRule       // optional, data from forbidden peers is dropped
+	// ToPeerLimit and FromPeerLimit are optional bandwidth caps, data that
+	// exceeds them is dropped.
+	ToPeerLimit   *limiter
+	FromPeerLimit *limiter
+	// Route is current tuple that is shared between copies, so data from
+	// peers is passed by new tuple after allocation is moved. Tuple is
+	// used if nil.
+	Route *Route
+	// DontFragment controls DF bit of packets sent to peers, shared
+	// between copies. DF can't be set if nil.
+	DontFragment *dontFragment
+	Buf          []byte // read buffer
+	Log          *zap.Logger
+}
+
+// Route holds current five-tuple of allocation.
+type Route struct {
+	mux   sync.RWMutex
+	tuple turn.FiveTuple
+}
+
+// NewRoute returns Route with provided tuple.
+func NewRoute(tuple turn.FiveTuple) *Route {
+	return &Route{tuple: tuple}
+}
+
+// Load returns current tuple.
+func (r *Route) Load() turn.FiveTuple {
+	r.mux.RLock()
+	t := r.tuple
+	r.mux.RUnlock()
+	return t
+}
+
+func (r *Route) store(tuple turn.FiveTuple) {
+	r.mux.Lock()
+	r.tuple = tuple
+	r.mux.Unlock()
+}
+
+// tuple returns current tuple of allocation.
+func (a *Allocation) tuple() turn.FiveTuple {
+	if a.Route == nil {
+		return a.Tuple
+	}
+	return a.Route.Load()
+}
+
+func (a *Allocation) addPeer(peer turn.Addr) {
+	for i := range a.Peers {
+		if a.Peers[i].Equal(peer) {
+			return
+		}
+	}
+	a.Peers = append(a.Peers, peer)
+}
+
+func (a *Allocation) record(end time.Time, reason accounting.Reason) accounting.Record {
+	u := a.Usage.Load()
+	r := accounting.Record{
+		Username:        a.Session.Username,
+		Realm:           a.Session.Realm,
+		Client:          a.Tuple.Client.String(),
+		Server:          a.Tuple.Server.String(),
+		Proto:           a.Tuple.Proto.String(),
+		Start:           a.Started,
+		End:             end,
+		Reason:          reason,
+		ToPeerBytes:     u.ToPeerBytes,
+		ToPeerPackets:   u.ToPeerPackets,
+		FromPeerBytes:   u.FromPeerBytes,
+		FromPeerPackets: u.FromPeerPackets,
+	}
+	if a.Conn != nil {
+		r.Relayed = a.RelayedAddr.String()
+	}
+	for _, p := range a.Peers {
+		r.Peers = append(r.Peers, p.String())
+	}
+	return r
+}
+
+// allowed reports whether data from peer is allowed by PeerRule.
+func (a *Allocation) allowed(peer turn.Addr) bool {
+	if a.PeerRule != nil && filter.ActionFor(a.PeerRule(a.Session), peer, turn.ProtoUDP) != filter.Allow {
+		// Rule can be changed after permission is created.
+		if ce := a.Log.Check(zapcore.DebugLevel, "peer is forbidden"); ce != nil {
+			ce.Write(zap.Stringer("peer", peer))
+		}
+		return false
+	}
+	return true
+}
+
+// readICMP passes queued ICMP errors to handler, returning count of read
+// errors.
+func (a *Allocation) readICMP(h ICMPHandler) int {
+	n, err := icmp.Read(a.Conn, func(e icmp.Error, peer turn.Addr) {
+		if ce := a.Log.Check(zapcore.DebugLevel, "icmp"); ce != nil {
+			ce.Write(zap.Stringer("peer", peer), zap.Stringer("e", e))
+		}
+		if !a.allowed(peer) {
+			return
+		}
+		h.HandlePeerICMP(e, a.tuple(), peer)
+	})
+	if err != nil {
+		a.Log.Debug("failed to read icmp", zap.Error(err))
+	}
+	return n
 }
 
 // ReadUntilClosed starts network loop that passes all received data to
 // PeerHandler. Stops on connection close or any error.
+//
+// ICMP errors are passed too if PeerHandler implements ICMPHandler.
 func (a *Allocation) ReadUntilClosed() {
 	a.Log.Debug("start")
 	defer func() {
 		a.Log.Debug("stop")
 	}()
+	icmpHandler, _ := a.Callback.(ICMPHandler)
+	if icmpHandler != nil {
+		if err := icmp.Enable(a.Conn); err != nil {
+			a.Log.Debug("icmp is not enabled", zap.Error(err))
+			icmpHandler = nil
+		}
+	}
 	for {
 		if err := a.Conn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
 			a.Log.Warn("SetReadDeadline failed", zap.Error(err))
@@ -70,10 +251,18 @@ func (a *Allocation) ReadUntilClosed() {
 		}
 		n, addr, err := a.Conn.ReadFrom(a.Buf)
 		if err != nil && err != io.EOF {
+			if icmpHandler != nil && a.readICMP(icmpHandler) > 0 {
+				// Queued ICMP error is also reported by read.
+				continue
+			}
 			netErr, ok := err.(net.Error)
 			if ok && (netErr.Temporary() || netErr.Timeout()) {
 				continue
 			}
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				// Allocation is removed.
+				break
+			}
 			a.Log.Error("read",
 				zap.Error(err),
 			)
@@ -82,10 +271,20 @@ func (a *Allocation) ReadUntilClosed() {
 		if ce := a.Log.Check(zapcore.DebugLevel, "read"); ce != nil {
 			ce.Write(zap.Int("n", n))
 		}
+		a.Usage.received(n)
 		udpAddr := addr.(*net.UDPAddr)
-		a.Callback.HandlePeerData(a.Buf[:n], a.Tuple, turn.Addr{
+		peer := turn.Addr{
 			IP:   udpAddr.IP,
 			Port: udpAddr.Port,
-		})
+		}
+		tuple := a.tuple()
+		a.Capture.Packet(tuple.Client, peer, a.RelayedAddr, a.Buf[:n])
+		if !a.allowed(peer) {
+			continue
+		}
+		if !a.FromPeerLimit.allow(n, time.Now()) {
+			continue
+		}
+		a.Callback.HandlePeerData(a.Buf[:n], tuple, peer)
 	}
 }
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/gortc/gortcd/internal/icmp"
 	"github.com/gortc/turn"
 )
 
@@ -107,6 +109,14 @@ func (h peerHandlerFunc) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr)
 	h(d, t, a)
 }
 
+type icmpHandlerFunc func(e icmp.Error, t turn.FiveTuple, a turn.Addr)
+
+func (icmpHandlerFunc) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr) {}
+
+func (h icmpHandlerFunc) HandlePeerICMP(e icmp.Error, t turn.FiveTuple, a turn.Addr) {
+	h(e, t, a)
+}
+
 type netConnMock struct {
 	readFrom         func(b []byte) (n int, addr net.Addr, err error)
 	writeTo          func(b []byte, addr net.Addr) (n int, err error)
@@ -181,6 +191,95 @@ func TestAllocation_ReadUntilClosed(t *testing.T) {
 			t.Error("callback not called")
 		}
 	})
+	t.Run("Route", func(t *testing.T) {
+		var (
+			readFromCalled bool
+			got            turn.FiveTuple
+			moved          = turn.FiveTuple{
+				Client: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 201},
+				Proto:  turn.ProtoUDP,
+			}
+		)
+		a := &Allocation{
+			Log:   zap.NewNop(),
+			Route: NewRoute(turn.FiveTuple{}),
+			Conn: &netConnMock{
+				setReadDeadline: func(t time.Time) error {
+					return nil
+				},
+				readFrom: func(b []byte) (n int, addr net.Addr, err error) {
+					if readFromCalled {
+						return 0, &net.UDPAddr{}, io.ErrUnexpectedEOF
+					}
+					readFromCalled = true
+					return 10, &net.UDPAddr{}, nil
+				},
+			},
+			Callback: peerHandlerFunc(func(d []byte, tuple turn.FiveTuple, a turn.Addr) {
+				got = tuple
+			}),
+			Buf: make([]byte, 1024),
+		}
+		a.Route.store(moved)
+		a.ReadUntilClosed()
+		if !got.Equal(moved) {
+			t.Errorf("data passed by %s, expected %s", got, moved)
+		}
+	})
+	t.Run("ICMP", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("ICMP errors are supported only on linux")
+		}
+		closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerAddr := closed.LocalAddr().(*net.UDPAddr)
+		if err = closed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan icmp.Error, 1)
+		a := &Allocation{
+			Log:  zap.NewNop(),
+			Conn: conn,
+			Callback: icmpHandlerFunc(func(e icmp.Error, tuple turn.FiveTuple, a turn.Addr) {
+				if a.Port != peerAddr.Port {
+					t.Errorf("unexpected peer %s", a)
+				}
+				got <- e
+			}),
+			Buf: make([]byte, 1024),
+		}
+		done := make(chan struct{})
+		go func() {
+			a.ReadUntilClosed()
+			close(done)
+		}()
+		// Sending until read loop enables ICMP errors.
+		var e icmp.Error
+	Send:
+		for {
+			if _, err = conn.WriteTo([]byte("hello"), peerAddr); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case e = <-got:
+				break Send
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+		if e.Type != 3 || e.Code != 3 {
+			t.Errorf("unexpected ICMP error %s", e)
+		}
+		if err = conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	})
 	t.Run("Deadline error", func(t *testing.T) {
 		deadlineSet := false
 		a := &Allocation{
@@ -12,24 +12,48 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/gortc/gortcd/internal/accounting"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/filter"
 	"github.com/gortc/turn"
 )
 
 // Options contain possible settings for Allocator.
 type Options struct {
-	Log    *zap.Logger
-	Conn   RelayedAddrAllocator
-	Labels prometheus.Labels
+	Log        *zap.Logger
+	Conn       RelayedAddrAllocator
+	Labels     prometheus.Labels
+	Accounting accounting.Sink // records are discarded if nil
+	Capture    *capture.Hub    // optional
+	PeerRule   PeerRule        // peers are not filtered if nil
+	// Bandwidth returns cap of relayed bytes per second in each direction
+	// for allocation of session, not limited if nil or 0.
+	Bandwidth func(s Session) int
+	// MaxAllocations returns allocations quota of realm of session, not
+	// limited if nil or 0.
+	MaxAllocations func(s Session) int
 }
 
+// PeerRule returns peer filtering rule for allocation session.
+type PeerRule func(s Session) filter.Rule
+
 // NewAllocator initializes and returns new *Allocator.
 func NewAllocator(o Options) *Allocator {
 	if o.Log == nil {
 		o.Log = zap.NewNop()
 	}
+	if o.Accounting == nil {
+		o.Accounting = accounting.Discard
+	}
 	return &Allocator{
-		log:   o.Log,
-		raddr: o.Conn,
+		log:        o.Log,
+		raddr:      o.Conn,
+		accounting: o.Accounting,
+		capture:    o.Capture,
+		peerRule:   o.PeerRule,
+		bandwidth:  o.Bandwidth,
+		quota:      o.MaxAllocations,
+		realmUsage: make(map[string]Usage),
 		metrics: map[string]*prometheus.Desc{
 			"allocation_count": prometheus.NewDesc("gortcd_allocation_count",
 				"Total number of allocations.", []string{}, o.Labels),
@@ -37,17 +61,48 @@ func NewAllocator(o Options) *Allocator {
 				"Total number of permissions.", []string{}, o.Labels),
 			"binding_count": prometheus.NewDesc("gortcd_binding_count",
 				"Total number of bindings.", []string{}, o.Labels),
+			"relay_allocation_count": prometheus.NewDesc("gortcd_relay_allocation_count",
+				"Number of allocations per relay address.", []string{"relay"}, o.Labels),
+			"realm_allocation_count": prometheus.NewDesc("gortcd_realm_allocation_count",
+				"Number of allocations per realm.", []string{"realm"}, o.Labels),
+			"realm_bytes": prometheus.NewDesc("gortcd_realm_relayed_bytes_total",
+				"Total relayed bytes per realm.", []string{"realm", "direction"}, o.Labels),
 		},
 	}
 }
 
 // Allocator handles allocation.
 type Allocator struct {
-	log       *zap.Logger
-	allocsMux sync.RWMutex
-	allocs    []Allocation
-	raddr     RelayedAddrAllocator
-	metrics   map[string]*prometheus.Desc
+	log        *zap.Logger
+	allocsMux  sync.RWMutex
+	allocs     []Allocation
+	raddr      RelayedAddrAllocator
+	metrics    map[string]*prometheus.Desc
+	accounting accounting.Sink
+	capture    *capture.Hub
+	peerRule   PeerRule
+	bandwidth  func(s Session) int
+	quota      func(s Session) int
+	realmMux   sync.Mutex
+	realmUsage map[string]Usage // of removed allocations
+}
+
+// limiters returns bandwidth limiters for allocation of session.
+func (a *Allocator) limiters(s Session) (toPeer, fromPeer *limiter) {
+	if a.bandwidth == nil {
+		return nil, nil
+	}
+	rate := a.bandwidth(s)
+	return newLimiter(rate), newLimiter(rate)
+}
+
+// allowPeer reports whether peer rule for session allows peer address.
+func (a *Allocator) allowPeer(s Session, peer turn.Addr) bool {
+	if a.peerRule == nil {
+		return true
+	}
+	// Relayed transport is always UDP.
+	return filter.ActionFor(a.peerRule(s), peer, turn.ProtoUDP) == filter.Allow
 }
 
 // Describe implements Collector.
@@ -60,6 +115,23 @@ func (a *Allocator) Describe(c chan<- *prometheus.Desc) {
 // Collect implements Collector.
 func (a *Allocator) Collect(c chan<- prometheus.Metric) {
 	s := a.Stats()
+	for realm, r := range s.Realms {
+		c <- prometheus.MustNewConstMetric(
+			a.metrics["realm_allocation_count"],
+			prometheus.GaugeValue,
+			float64(r.Allocations), realm,
+		)
+		c <- prometheus.MustNewConstMetric(
+			a.metrics["realm_bytes"],
+			prometheus.CounterValue,
+			float64(r.Usage.ToPeerBytes), realm, "to_peer",
+		)
+		c <- prometheus.MustNewConstMetric(
+			a.metrics["realm_bytes"],
+			prometheus.CounterValue,
+			float64(r.Usage.FromPeerBytes), realm, "from_peer",
+		)
+	}
 	for _, m := range []prometheus.Metric{
 		prometheus.MustNewConstMetric(
 			a.metrics["allocation_count"],
@@ -79,17 +151,50 @@ func (a *Allocator) Collect(c chan<- prometheus.Metric) {
 	} {
 		c <- m
 	}
+	for ip, n := range a.relayCounts() {
+		c <- prometheus.MustNewConstMetric(
+			a.metrics["relay_allocation_count"],
+			prometheus.GaugeValue,
+			float64(n), ip,
+		)
+	}
+}
+
+// relayCounts returns allocations count per relayed IP.
+func (a *Allocator) relayCounts() map[string]int {
+	counts := make(map[string]int)
+	a.allocsMux.RLock()
+	for i := range a.allocs {
+		if a.allocs[i].RelayedAddr.Port == 0 {
+			// Port is not allocated yet.
+			continue
+		}
+		counts[a.allocs[i].RelayedAddr.IP.String()]++
+	}
+	a.allocsMux.RUnlock()
+	return counts
 }
 
 // ErrPermissionNotFound means that requested allocation (client,addr) is not found.
 var ErrPermissionNotFound = errors.New("permission not found")
 
+// ErrPeerForbidden means that peer address is not allowed by peer rule
+// of allocation session.
+var ErrPeerForbidden = errors.New("peer is forbidden")
+
 // SendBound uses existing allocation identified by tuple with bound channel number n
 // to send data.
+//
+// Returns ErrPeerForbidden if peer rule does not allow bound peer address.
 func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data []byte) (int, error) {
 	var (
-		conn net.PacketConn
-		addr turn.Addr
+		conn    net.PacketConn
+		addr    turn.Addr
+		relayed turn.Addr
+		usage   *Usage
+		session Session
+		limit   *limiter
+		df      *dontFragment
 	)
 	a.log.Debug("searching for bound allocation",
 		zap.Stringer("tuple", tuple),
@@ -105,6 +210,11 @@ func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data [
 				continue
 			}
 			conn = a.allocs[i].Conn
+			relayed = a.allocs[i].RelayedAddr
+			usage = a.allocs[i].Usage
+			session = a.allocs[i].Session
+			limit = a.allocs[i].ToPeerLimit
+			df = a.allocs[i].DontFragment
 			// Copy p.Addr to turn.Addr.
 			addr = turn.Addr{
 				Port: p.Addr.Port,
@@ -117,6 +227,12 @@ func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data [
 	if conn == nil {
 		return 0, ErrPermissionNotFound
 	}
+	if !a.allowPeer(session, addr) {
+		return 0, ErrPeerForbidden
+	}
+	if !limit.allow(len(data), time.Now()) {
+		return 0, ErrBandwidthExceeded
+	}
 	a.log.Debug("sending data",
 		zap.Stringer("tuple", tuple),
 		zap.Stringer("addr", addr),
@@ -127,18 +243,40 @@ func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data [
 			Port: addr.Port,
 		}),
 	)
-	return conn.WriteTo(data, &net.UDPAddr{
+	written, err := df.writeTo(conn, data, &net.UDPAddr{
 		IP:   addr.IP,
 		Port: addr.Port,
-	})
+	}, false)
+	if err == nil {
+		usage.sent(written)
+		a.capture.Packet(tuple.Client, relayed, addr, data)
+	}
+	return written, err
 }
 
 // Send uses existing allocation for client to write data to remote turn.Addr.
 //
-// Returns ErrPermissionNotFound if no allocation found for (client,addr).
+// Returns ErrPermissionNotFound if no allocation found for (client,addr)
+// and ErrPeerForbidden if peer rule does not allow peer address.
 func (a *Allocator) Send(tuple turn.FiveTuple, peer turn.Addr, data []byte) (int, error) {
+	return a.send(tuple, peer, data, false)
+}
+
+// SendDontFragment is same as Send, but sets DF bit of sent packet.
+//
+// Returns ErrDontFragmentNotSupported if DF bit can't be set.
+func (a *Allocator) SendDontFragment(tuple turn.FiveTuple, peer turn.Addr, data []byte) (int, error) {
+	return a.send(tuple, peer, data, true)
+}
+
+func (a *Allocator) send(tuple turn.FiveTuple, peer turn.Addr, data []byte, setDF bool) (int, error) {
 	var (
-		conn net.PacketConn
+		conn    net.PacketConn
+		relayed turn.Addr
+		usage   *Usage
+		session Session
+		limit   *limiter
+		df      *dontFragment
 	)
 	a.log.Debug("searching for allocation",
 		zap.Stringer("t", tuple),
@@ -154,25 +292,78 @@ func (a *Allocator) Send(tuple turn.FiveTuple, peer turn.Addr, data []byte) (int
 				continue
 			}
 			conn = a.allocs[i].Conn
+			relayed = a.allocs[i].RelayedAddr
+			usage = a.allocs[i].Usage
+			session = a.allocs[i].Session
+			limit = a.allocs[i].ToPeerLimit
+			df = a.allocs[i].DontFragment
 		}
 	}
 	a.allocsMux.RUnlock()
 	if conn == nil {
 		return 0, ErrPermissionNotFound
 	}
+	if !a.allowPeer(session, peer) {
+		return 0, ErrPeerForbidden
+	}
+	if !limit.allow(len(data), time.Now()) {
+		return 0, ErrBandwidthExceeded
+	}
 	a.log.Debug("sending data",
 		zap.Stringer("tuple", tuple),
 		zap.Stringer("addr", peer),
 		zap.Int("len", len(data)),
 	)
-	return conn.WriteTo(data, &net.UDPAddr{
+	n, err := df.writeTo(conn, data, &net.UDPAddr{
 		IP:   peer.IP,
 		Port: peer.Port,
-	})
+	}, setDF)
+	if err == nil {
+		usage.sent(n)
+		a.capture.Packet(tuple.Client, relayed, peer, data)
+	}
+	return n, err
 }
 
-// Remove de-allocates and removes allocation.
+// Remove de-allocates and removes allocation on client request.
 func (a *Allocator) Remove(t turn.FiveTuple) error {
+	return a.remove(t, accounting.Deleted)
+}
+
+// Kill de-allocates and removes allocation on administrator request.
+func (a *Allocator) Kill(t turn.FiveTuple) error {
+	return a.remove(t, accounting.Killed)
+}
+
+// Fail de-allocates and removes allocation that can't be completed due
+// to error, e.g. after it was created.
+func (a *Allocator) Fail(t turn.FiveTuple) error {
+	return a.remove(t, accounting.Failed)
+}
+
+// dealloc closes relayed connections of removed allocations and writes
+// accounting records for them.
+func (a *Allocator) dealloc(allocs []Allocation, t time.Time, reason accounting.Reason) {
+	for i := range allocs {
+		if err := a.raddr.Remove(allocs[i].RelayedAddr, allocs[i].Tuple.Proto); err != nil {
+			a.log.Warn("failed to remove allocation", zap.Error(err))
+		}
+	}
+	a.account(allocs, t, reason)
+}
+
+func (a *Allocator) account(allocs []Allocation, t time.Time, reason accounting.Reason) {
+	for i := range allocs {
+		if err := a.accounting.Account(allocs[i].record(t, reason)); err != nil {
+			a.log.Error("failed to write accounting record",
+				zap.Stringer("tuple", allocs[i].Tuple),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (a *Allocator) remove(t turn.FiveTuple, reason accounting.Reason) error {
 	var (
 		newAllocs []Allocation
 		toDealloc []Allocation
@@ -187,15 +378,23 @@ func (a *Allocator) Remove(t turn.FiveTuple) error {
 	}
 	n := copy(a.allocs, newAllocs)
 	a.allocs = a.allocs[:n]
+	a.addRealmUsage(toDealloc)
 	a.allocsMux.Unlock()
 	if len(toDealloc) == 0 {
 		return ErrAllocationMismatch
 	}
-	for i := range toDealloc {
-		if err := a.raddr.Remove(toDealloc[i].Tuple.Server, toDealloc[i].Tuple.Proto); err != nil {
-			a.log.Warn("failed to remove allocation", zap.Error(err))
-		}
-	}
+	a.dealloc(toDealloc, time.Now(), reason)
+	return nil
+}
+
+// Close de-allocates and removes all allocations.
+func (a *Allocator) Close() error {
+	a.allocsMux.Lock()
+	toDealloc := a.allocs
+	a.allocs = nil
+	a.addRealmUsage(toDealloc)
+	a.allocsMux.Unlock()
+	a.dealloc(toDealloc, time.Now(), accounting.Killed)
 	return nil
 }
 
@@ -226,13 +425,10 @@ func (a *Allocator) Prune(t time.Time) {
 	}
 	n := copy(a.allocs, newAllocs)
 	a.allocs = a.allocs[:n]
+	a.addRealmUsage(toDealloc)
 	a.allocsMux.Unlock()
 
-	for i := range toDealloc {
-		if err := a.raddr.Remove(toDealloc[i].Tuple.Server, toDealloc[i].Tuple.Proto); err != nil {
-			a.log.Warn("failed to remove allocation", zap.Error(err))
-		}
-	}
+	a.dealloc(toDealloc, t, accounting.Expired)
 }
 
 // RelayedAddrAllocator represents allocator for relayed turn.Addresses on
@@ -240,14 +436,29 @@ func (a *Allocator) Prune(t time.Time) {
 type RelayedAddrAllocator interface {
 	New(proto turn.Protocol) (turn.Addr, net.PacketConn, error)
 	Remove(addr turn.Addr, proto turn.Protocol) error
+	// Adopt starts managing existing conn on addr, e.g. inherited
+	// from previous process, returning connection that should be used
+	// instead.
+	Adopt(addr turn.Addr, proto turn.Protocol, conn net.PacketConn) net.PacketConn
 }
 
 // ErrAllocationMismatch is a 437 (Allocation Mismatch) error
 var ErrAllocationMismatch = errors.New("5-tuple is currently in use")
 
+// ErrQuotaReached is a 486 (Allocation Quota Reached) error.
+var ErrQuotaReached = errors.New("allocation quota reached")
+
 // New creates new allocation for provided client and proto. Any data received
 // by allocated socket is passed to callback.
 func (a *Allocator) New(tuple turn.FiveTuple, timeout time.Time, callback PeerHandler) (turn.Addr, error) {
+	return a.NewWithSession(tuple, Session{}, timeout, callback)
+}
+
+// NewWithSession is same as New, but also associates allocation with
+// provided session.
+func (a *Allocator) NewWithSession(
+	tuple turn.FiveTuple, session Session, timeout time.Time, callback PeerHandler,
+) (turn.Addr, error) {
 	l := a.log.Named("allocation").With(zap.Stringer("tuple", tuple))
 	l.Debug("new", zap.Time("timeout", timeout))
 	switch tuple.Proto {
@@ -256,8 +467,13 @@ func (a *Allocator) New(tuple turn.FiveTuple, timeout time.Time, callback PeerHa
 	default:
 		return turn.Addr{}, errors.Errorf("proto %s not implemented", tuple.Proto)
 	}
+	quota := 0
+	if a.quota != nil {
+		quota = a.quota(session)
+	}
 	a.allocsMux.Lock()
-	// Searching for existing allocation.
+	// Searching for existing allocation, counting allocations of realm.
+	count := 0
 	for i := range a.allocs {
 		if a.allocs[i].Tuple.Equal(tuple) {
 			a.allocsMux.Unlock()
@@ -265,14 +481,32 @@ func (a *Allocator) New(tuple turn.FiveTuple, timeout time.Time, callback PeerHa
 			// returning allocation mismatch error.
 			return turn.Addr{}, ErrAllocationMismatch
 		}
+		if a.allocs[i].Session.Realm == session.Realm {
+			count++
+		}
+	}
+	if quota > 0 && count >= quota {
+		// Checked under same lock as allocation is added, so concurrent
+		// requests can't exceed quota.
+		a.allocsMux.Unlock()
+		return turn.Addr{}, ErrQuotaReached
 	}
 	// Not found, creating new allocation.
 	allocation := Allocation{
 		Log:      l,
 		Tuple:    tuple,
+		Session:  session,
 		Callback: callback,
+		Started:  time.Now(),
 		Timeout:  timeout,
+		Usage:    new(Usage),
+		Capture:  a.capture,
+		PeerRule: a.peerRule,
+		Route:    NewRoute(tuple),
+
+		DontFragment: new(dontFragment),
 	}
+	allocation.ToPeerLimit, allocation.FromPeerLimit = a.limiters(session)
 	a.allocs = append(a.allocs, allocation)
 	a.allocsMux.Unlock()
 
@@ -282,6 +516,16 @@ func (a *Allocator) New(tuple turn.FiveTuple, timeout time.Time, callback PeerHa
 			zap.Stringer("tuple", tuple),
 			zap.Error(err),
 		)
+		a.allocsMux.Lock()
+		for i := range a.allocs {
+			if !a.allocs[i].Tuple.Equal(tuple) {
+				continue
+			}
+			a.allocs = append(a.allocs[:i], a.allocs[i+1:]...)
+			break
+		}
+		a.allocsMux.Unlock()
+		a.account([]Allocation{allocation}, time.Now(), accounting.Failed)
 		return turn.Addr{}, errors.Wrap(err, "failed to allocate")
 	}
 	l = l.With(zap.Stringer("raddr", raddr))
@@ -334,6 +578,7 @@ func (a *Allocator) CreatePermission(tuple turn.FiveTuple, peer turn.Addr, timeo
 		if !updated {
 			// Creating new permission instead.
 			a.allocs[i].Permissions = append(a.allocs[i].Permissions, permission)
+			a.allocs[i].addPeer(peer)
 		}
 		break
 	}
@@ -406,6 +651,7 @@ func (a *Allocator) ChannelBind(
 				Binding: n,
 				Timeout: timeout,
 			})
+			a.allocs[i].addPeer(peer)
 		}
 		found = true
 		break
@@ -439,6 +685,48 @@ func (a *Allocator) Bound(tuple turn.FiveTuple, peer turn.Addr) (turn.ChannelNum
 	return 0, ErrAllocationMismatch
 }
 
+// DontFragment sets DF bit for all packets that are sent to peers by
+// allocation for provided 5-tuple.
+//
+// Returns ErrDontFragmentNotSupported if DF bit can't be set.
+func (a *Allocator) DontFragment(tuple turn.FiveTuple) error {
+	var (
+		conn net.PacketConn
+		df   *dontFragment
+	)
+	a.allocsMux.RLock()
+	for i := range a.allocs {
+		if a.allocs[i].Tuple.Equal(tuple) {
+			conn = a.allocs[i].Conn
+			df = a.allocs[i].DontFragment
+			break
+		}
+	}
+	a.allocsMux.RUnlock()
+	if conn == nil {
+		return ErrAllocationNotFound
+	}
+	return df.enable(conn)
+}
+
+// HasPermission reports whether allocation for provided 5-tuple has
+// permission for peer.
+func (a *Allocator) HasPermission(tuple turn.FiveTuple, peer turn.Addr) bool {
+	a.allocsMux.RLock()
+	defer a.allocsMux.RUnlock()
+	for i := range a.allocs {
+		if !a.allocs[i].Tuple.Equal(tuple) {
+			continue
+		}
+		for k := range a.allocs[i].Permissions {
+			if a.allocs[i].Permissions[k].Addr.Equal(peer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Refresh updates existing allocation timeout.
 func (a *Allocator) Refresh(tuple turn.FiveTuple, timeout time.Time) error {
 	// TODO: handle permission not found error.
@@ -454,14 +742,54 @@ func (a *Allocator) Refresh(tuple turn.FiveTuple, timeout time.Time) error {
 	return nil
 }
 
+// ErrAllocationNotFound means that there is no allocation for 5-tuple.
+var ErrAllocationNotFound = errors.New("allocation not found")
+
+// Move changes 5-tuple of allocation, keeping its relayed address,
+// permissions and channel bindings, e.g. when client changes network.
+// Returns ErrAllocationMismatch if new 5-tuple is in use.
+func (a *Allocator) Move(from, to turn.FiveTuple) error {
+	a.allocsMux.Lock()
+	defer a.allocsMux.Unlock()
+	index := -1
+	for i := range a.allocs {
+		if a.allocs[i].Tuple.Equal(to) {
+			return ErrAllocationMismatch
+		}
+		if a.allocs[i].Tuple.Equal(from) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrAllocationNotFound
+	}
+	allocation := &a.allocs[index]
+	allocation.Tuple = to
+	if allocation.Route != nil {
+		allocation.Route.store(to)
+	}
+	allocation.Log.Debug("moved", zap.Stringer("to", to))
+	return nil
+}
+
 // Stats contains allocator statistics.
 type Stats struct {
 	// Allocations is the total number of allocations.
-	Allocations int
+	Allocations int `json:"allocations"`
 	// Permissions is the total number of permissions in all allocations.
-	Permissions int
+	Permissions int `json:"permissions"`
 	// Bindings is the total number of channel bindings in all allocations.
-	Bindings int
+	Bindings int `json:"bindings"`
+	// Realms are statistics per realm of allocation session.
+	Realms map[string]RealmStats `json:"realms,omitempty"`
+}
+
+// Count returns the total number of allocations.
+func (a *Allocator) Count() int {
+	a.allocsMux.RLock()
+	n := len(a.allocs)
+	a.allocsMux.RUnlock()
+	return n
 }
 
 // Stats returns current statistics.
@@ -469,6 +797,7 @@ func (a *Allocator) Stats() Stats {
 	a.allocsMux.Lock()
 	s := Stats{
 		Allocations: len(a.allocs),
+		Realms:      a.realmStats(),
 	}
 	for i := range a.allocs {
 		s.Permissions += len(a.allocs[i].Permissions)
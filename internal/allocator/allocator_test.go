@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/gortc/gortcd/internal/accounting"
 	"github.com/gortc/turn"
 )
 
@@ -303,3 +304,255 @@ func TestAllocator_ChannelBind(t *testing.T) {
 	}
 	a.Remove(tuple)
 }
+
+type recordsSink struct {
+	records []accounting.Record
+}
+
+func (s *recordsSink) Account(r accounting.Record) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func TestAllocator_Accounting(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(recordsSink)
+	a := NewAllocator(Options{Conn: p, Accounting: sink})
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	session := Session{Username: "user", Realm: "realm"}
+	if _, err = a.NewWithSession(tuple, session, now.Add(time.Second*10), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Second*5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Second * 7))
+	if len(sink.records) != 0 {
+		t.Fatal("unexpected record")
+	}
+	a.Prune(now.Add(time.Second * 11))
+	if len(sink.records) != 1 {
+		t.Fatal("no record")
+	}
+	r := sink.records[0]
+	if r.Reason != accounting.Expired {
+		t.Errorf("unexpected reason %s", r.Reason)
+	}
+	if r.Username != "user" || r.Realm != "realm" {
+		t.Errorf("unexpected session %s@%s", r.Username, r.Realm)
+	}
+	if r.ToPeerBytes != 150 || r.ToPeerPackets != 2 {
+		t.Errorf("unexpected usage %d bytes, %d packets", r.ToPeerBytes, r.ToPeerPackets)
+	}
+	if len(r.Peers) != 1 || r.Peers[0] != peer.String() {
+		t.Errorf("unexpected peers %v", r.Peers)
+	}
+	if !r.End.Equal(now.Add(time.Second * 11)) {
+		t.Errorf("unexpected end %s", r.End)
+	}
+	t.Run("Remove", func(t *testing.T) {
+		if _, err = a.New(tuple, now.Add(time.Second*10), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = a.Remove(tuple); err != nil {
+			t.Fatal(err)
+		}
+		if r := sink.records[len(sink.records)-1]; r.Reason != accounting.Deleted {
+			t.Errorf("unexpected reason %s", r.Reason)
+		}
+	})
+	t.Run("Kill", func(t *testing.T) {
+		if _, err = a.New(tuple, now.Add(time.Second*10), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = a.Kill(tuple); err != nil {
+			t.Fatal(err)
+		}
+		if r := sink.records[len(sink.records)-1]; r.Reason != accounting.Killed {
+			t.Errorf("unexpected reason %s", r.Reason)
+		}
+	})
+	t.Run("Fail", func(t *testing.T) {
+		if _, err = a.New(tuple, now.Add(time.Second*10), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = a.Fail(tuple); err != nil {
+			t.Fatal(err)
+		}
+		if r := sink.records[len(sink.records)-1]; r.Reason != accounting.Failed {
+			t.Errorf("unexpected reason %s", r.Reason)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		pErr, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+			IP:   net.IPv4(127, 1, 0, 0),
+			Port: 5000,
+		}, &dummyErrNetPortAlloc{err: net.InvalidAddrError("invalid")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errSink := new(recordsSink)
+		aErr := NewAllocator(Options{Conn: pErr, Accounting: errSink})
+		if _, err := aErr.New(tuple, now, nil); err == nil {
+			t.Fatal("should error")
+		}
+		if len(errSink.records) != 1 || errSink.records[0].Reason != accounting.Failed {
+			t.Error("no error record")
+		}
+		if aErr.Stats().Allocations != 0 {
+			t.Error("failed allocation should be removed")
+		}
+	})
+}
+
+func TestAllocator_Move(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	newTuple := func(port int) turn.FiveTuple {
+		return turn.FiveTuple{
+			Client: turn.Addr{Port: port, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+	}
+	var (
+		from  = newTuple(200)
+		to    = newTuple(201)
+		other = newTuple(202)
+		peer  = turn.Addr{Port: 203, IP: net.IPv4(127, 0, 0, 1)}
+		n     = turn.ChannelNumber(0x4000)
+	)
+	relayed, err := a.New(from, now.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(from, n, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.New(other, now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Move(from, other); err != ErrAllocationMismatch {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = a.Move(to, newTuple(204)); err != ErrAllocationNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = a.Move(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if bound, boundErr := a.Bound(to, peer); boundErr != nil || bound != n {
+		t.Errorf("binding should be moved: %v", boundErr)
+	}
+	if _, boundErr := a.Bound(from, peer); boundErr == nil {
+		t.Error("binding should not be found by previous tuple")
+	}
+	for _, s := range a.Export() {
+		if s.Tuple.Equal(to) && !s.RelayedAddr.Equal(relayed) {
+			t.Errorf("relayed address changed to %s", s.RelayedAddr)
+		}
+		if s.Tuple.Equal(from) {
+			t.Error("allocation by previous tuple")
+		}
+	}
+	a.allocsMux.RLock()
+	for i := range a.allocs {
+		if a.allocs[i].Tuple.Equal(to) && !a.allocs[i].tuple().Equal(to) {
+			t.Error("route should be updated")
+		}
+	}
+	a.allocsMux.RUnlock()
+}
+
+func TestAllocator_DontFragment(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	var (
+		tuple = turn.FiveTuple{
+			Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+		other = turn.FiveTuple{
+			Client: turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+		peer = turn.Addr{Port: 203, IP: net.IPv4(127, 0, 0, 1)}
+	)
+	if _, err = a.New(tuple, now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.DontFragment(other); err != ErrAllocationNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Socket options can't be set for dummy connection.
+	if err = a.DontFragment(tuple); err != ErrDontFragmentNotSupported {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = a.SendDontFragment(tuple, peer, []byte("hello")); err != ErrDontFragmentNotSupported {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = a.Send(tuple, peer, []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	for _, s := range a.Export() {
+		if s.DontFragment {
+			t.Error("DF should not be set")
+		}
+	}
+	t.Run("Restore", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Wrapped connection does not provide socket.
+		wrapped := struct{ net.PacketConn }{conn}
+		if err = a.Restore(AllocationState{
+			Tuple:        other,
+			Timeout:      now.Add(time.Minute),
+			DontFragment: true,
+		}, wrapped, nil); err != ErrDontFragmentNotSupported {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(a.Export()) != 1 {
+			t.Error("allocation should not be restored")
+		}
+	})
+}
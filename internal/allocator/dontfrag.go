@@ -0,0 +1,73 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrDontFragmentNotSupported means that DF bit can't be set for packets
+// sent by relayed connection.
+var ErrDontFragmentNotSupported = errors.New("DONT-FRAGMENT is not supported")
+
+// dontFragment controls DF bit of relayed connection, serializing writes
+// that toggle it for single packets. Shared between copies.
+type dontFragment struct {
+	mux    sync.RWMutex
+	always bool // DF is set for all packets
+}
+
+// enabled reports whether DF is set for all packets.
+func (d *dontFragment) enabled() bool {
+	if d == nil {
+		return false
+	}
+	d.mux.RLock()
+	always := d.always
+	d.mux.RUnlock()
+	return always
+}
+
+// enable sets DF for all packets sent by conn.
+func (d *dontFragment) enable(conn net.PacketConn) error {
+	if d == nil {
+		return ErrDontFragmentNotSupported
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err := setDontFragment(conn, true); err != nil {
+		return err
+	}
+	d.always = true
+	return nil
+}
+
+// writeTo writes b to addr, setting DF only for that packet if df is true.
+func (d *dontFragment) writeTo(conn net.PacketConn, b []byte, addr net.Addr, df bool) (int, error) {
+	if d == nil {
+		if df {
+			return 0, ErrDontFragmentNotSupported
+		}
+		return conn.WriteTo(b, addr)
+	}
+	d.mux.RLock()
+	if !df || d.always {
+		n, err := conn.WriteTo(b, addr)
+		d.mux.RUnlock()
+		return n, err
+	}
+	d.mux.RUnlock()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.always {
+		if err := setDontFragment(conn, true); err != nil {
+			return 0, err
+		}
+		defer func() {
+			// Error is ignored, connection is already used for packet
+			// with DF, so next toggle will fail too.
+			_ = setDontFragment(conn, false)
+		}()
+	}
+	return conn.WriteTo(b, addr)
+}
@@ -0,0 +1,48 @@
+//+build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+)
+
+// DontFragmentSupported is true if DF bit can be set for relayed packets
+// on this platform.
+const DontFragmentSupported = true
+
+// setDontFragment sets DF bit for all packets sent by conn if on is true,
+// restoring default path MTU discovery that can fragment packets exceeding
+// known path MTU otherwise.
+func setDontFragment(conn net.PacketConn, on bool) error {
+	c, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrDontFragmentNotSupported
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v4, v6 := syscall.IP_PMTUDISC_WANT, syscall.IPV6_PMTUDISC_WANT
+	if on {
+		v4, v6 = syscall.IP_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DO
+	}
+	var sockErr error
+	if err = raw.Control(func(fd uintptr) {
+		domain, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		if domain == syscall.AF_INET6 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6); sockErr != nil {
+				return
+			}
+			// Dual-stack socket can also send to IPv4-mapped peers.
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
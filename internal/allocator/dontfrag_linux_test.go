@@ -0,0 +1,108 @@
+//+build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+func TestDontFragment(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	mtuDiscover := func(t *testing.T) int {
+		t.Helper()
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			v      int
+			optErr error
+		)
+		if err = raw.Control(func(fd uintptr) {
+			v, optErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if optErr != nil {
+			t.Fatal(optErr)
+		}
+		return v
+	}
+	t.Run("Restore", func(t *testing.T) {
+		p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+			IP:   net.IPv4(127, 1, 0, 2),
+			Port: 5000,
+		}, &DummyNetPortAlloc{currentPort: 5100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := NewAllocator(Options{Conn: p})
+		addr := conn.LocalAddr().(*net.UDPAddr)
+		if err = a.Restore(AllocationState{
+			Tuple: turn.FiveTuple{
+				Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+				Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+				Proto:  turn.ProtoUDP,
+			},
+			RelayedAddr:  turn.Addr{IP: addr.IP, Port: addr.Port},
+			Timeout:      time.Now().Add(time.Minute),
+			DontFragment: true,
+		}, conn, nil); err != nil {
+			t.Fatal(err)
+		}
+		if v := mtuDiscover(t); v != syscall.IP_PMTUDISC_DO {
+			t.Errorf("DF should be set for restored connection, got %d", v)
+		}
+		if err = setDontFragment(conn, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+	d := new(dontFragment)
+	t.Run("Packet", func(t *testing.T) {
+		if _, err := d.writeTo(conn, []byte("hello"), peer.LocalAddr(), true); err != nil {
+			t.Fatal(err)
+		}
+		if v := mtuDiscover(t); v != syscall.IP_PMTUDISC_WANT {
+			t.Errorf("DF should be unset after write, got %d", v)
+		}
+	})
+	t.Run("Always", func(t *testing.T) {
+		if err := d.enable(conn); err != nil {
+			t.Fatal(err)
+		}
+		if !d.enabled() {
+			t.Error("should be enabled")
+		}
+		if _, err := d.writeTo(conn, []byte("hello"), peer.LocalAddr(), true); err != nil {
+			t.Fatal(err)
+		}
+		if v := mtuDiscover(t); v != syscall.IP_PMTUDISC_DO {
+			t.Errorf("DF should be set, got %d", v)
+		}
+	})
+	t.Run("Nil", func(t *testing.T) {
+		var d *dontFragment
+		if _, err := d.writeTo(conn, []byte("hello"), peer.LocalAddr(), true); err != ErrDontFragmentNotSupported {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := d.enable(conn); err != ErrDontFragmentNotSupported {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
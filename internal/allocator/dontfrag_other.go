@@ -0,0 +1,13 @@
+//+build !linux
+
+package allocator
+
+import "net"
+
+// DontFragmentSupported is true if DF bit can be set for relayed packets
+// on this platform.
+const DontFragmentSupported = false
+
+func setDontFragment(conn net.PacketConn, on bool) error {
+	return ErrDontFragmentNotSupported
+}
@@ -31,10 +31,52 @@ type NetAllocator struct {
 	allocsMux sync.RWMutex
 	allocs    []NetAllocation
 	newAllocs []NetAllocation
-	ports     NetPortAllocator
+	relays    []relay
+	policy    RelayPolicy
+	listener  int // index of relay with listener address or 0
+	next      int // next relay for round-robin
 
-	log         *zap.Logger
+	log *zap.Logger
+}
+
+type relay struct {
+	Relay
 	defaultAddr string
+	used        int // current allocations count
+}
+
+// Relay is address on which relayed ports are allocated.
+type Relay struct {
+	IP       net.IP
+	External net.IP // advertised to clients instead of IP if set
+	Ports    NetPortAllocator
+}
+
+// RelayPolicy selects relay address for new allocation.
+type RelayPolicy byte
+
+// Possible relay policies.
+const (
+	// RelayRoundRobin selects relays in turn.
+	RelayRoundRobin RelayPolicy = iota
+	// RelaySameAsListener selects relay with IP of listener that received
+	// Allocate request, falling back to the first one.
+	RelaySameAsListener
+	// RelayLeastUsed selects relay with minimum count of allocations.
+	RelayLeastUsed
+)
+
+func (p RelayPolicy) String() string {
+	switch p {
+	case RelayRoundRobin:
+		return "round-robin"
+	case RelaySameAsListener:
+		return "same-as-listener"
+	case RelayLeastUsed:
+		return "least-used"
+	default:
+		return "unknown"
+	}
 }
 
 // NetPortAllocator allocates ports.
@@ -42,18 +84,136 @@ type NetPortAllocator interface {
 	AllocatePort(proto turn.Protocol, network, defaultAddr string) (NetAllocation, error)
 }
 
-// New allocates new free port from internal port allocator.
+// FreePorts returns count of ports that can be allocated or -1 if internal
+// port allocator of any relay is not limited.
+func (a *NetAllocator) FreePorts() int {
+	free := 0
+	for _, r := range a.relays {
+		c, ok := r.Ports.(interface{ FreePorts() int })
+		if !ok {
+			return -1
+		}
+		free += c.FreePorts()
+	}
+	return free
+}
+
+// External returns address that is advertised to clients for relayed ip.
+func (a *NetAllocator) External(ip net.IP) net.IP {
+	if i := a.relayOf(ip); i >= 0 && a.relays[i].External != nil {
+		return a.relays[i].External
+	}
+	return ip
+}
+
+func (a *NetAllocator) relayOf(ip net.IP) int {
+	for i := range a.relays {
+		if a.relays[i].IP.Equal(ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick returns index of relay for new allocation.
+func (a *NetAllocator) pick() int {
+	// Assuming a.allocsMux is locked.
+	switch a.policy {
+	case RelaySameAsListener:
+		return a.listener
+	case RelayLeastUsed:
+		best := 0
+		for i := range a.relays {
+			if a.relays[i].used < a.relays[best].used {
+				best = i
+			}
+		}
+		return best
+	default:
+		i := a.next
+		a.next = (a.next + 1) % len(a.relays)
+		return i
+	}
+}
+
+func (a *NetAllocator) track(n NetAllocation) {
+	// Assuming a.allocsMux is locked.
+	a.allocs = append(a.allocs, n)
+	if i := a.relayOf(n.Addr.IP); i >= 0 {
+		a.relays[i].used++
+	}
+}
+
+// New allocates new free port from internal port allocator of relay that
+// is selected by policy. Other relays are tried if ports of selected one
+// are exhausted, except for RelaySameAsListener policy.
 func (a *NetAllocator) New(proto turn.Protocol) (turn.Addr, net.PacketConn, error) {
-	n, err := a.ports.AllocatePort(proto, "udp4", a.defaultAddr)
+	a.allocsMux.Lock()
+	start := a.pick()
+	a.allocsMux.Unlock()
+	var (
+		n   NetAllocation
+		err error
+	)
+	for i := 0; i < len(a.relays); i++ {
+		r := a.relays[(start+i)%len(a.relays)]
+		n, err = r.Ports.AllocatePort(proto, "udp4", r.defaultAddr)
+		if err != ErrNoFreePorts || a.policy == RelaySameAsListener {
+			break
+		}
+	}
 	if err != nil {
 		return turn.Addr{}, nil, err
 	}
 	a.allocsMux.Lock()
-	a.allocs = append(a.allocs, n)
+	a.track(n)
 	a.allocsMux.Unlock()
 	return n.Addr, n.Conn, nil
 }
 
+// Listen binds connection on addr that is not tracked until adopted,
+// using internal port allocator of relay if it manages the port.
+func (a *NetAllocator) Listen(addr turn.Addr) (net.PacketConn, error) {
+	if i := a.relayOf(addr.IP); i >= 0 {
+		if p, ok := a.relays[i].Ports.(interface {
+			AllocateAddr(addr turn.Addr) (NetAllocation, error)
+		}); ok {
+			n, err := p.AllocateAddr(addr)
+			return n.Conn, err
+		}
+	}
+	return net.ListenUDP("udp4", &net.UDPAddr{
+		IP:   addr.IP,
+		Port: addr.Port,
+	})
+}
+
+// Adopt implements RelayedAddrAllocator. Connection is adopted by
+// internal port allocator of relay if it manages the port, so port is
+// returned to it on removal.
+func (a *NetAllocator) Adopt(addr turn.Addr, proto turn.Protocol, conn net.PacketConn) net.PacketConn {
+	if i := a.relayOf(addr.IP); i >= 0 {
+		if p, ok := a.relays[i].Ports.(interface {
+			Adopt(addr turn.Addr, conn net.PacketConn) (NetAllocation, error)
+		}); ok {
+			n, err := p.Adopt(addr, conn)
+			if err != nil {
+				a.log.Warn("failed to adopt port", zap.Stringer("addr", addr), zap.Error(err))
+			} else {
+				conn = n.Conn
+			}
+		}
+	}
+	a.allocsMux.Lock()
+	a.track(NetAllocation{
+		Addr:  addr,
+		Proto: proto,
+		Conn:  conn,
+	})
+	a.allocsMux.Unlock()
+	return conn
+}
+
 // Remove de-allocates ports for provided addr and proto.
 func (a *NetAllocator) Remove(addr turn.Addr, proto turn.Protocol) error {
 	var (
@@ -71,6 +231,9 @@ func (a *NetAllocator) Remove(addr turn.Addr, proto turn.Protocol) error {
 			continue
 		}
 		toRemove = append(toRemove, alloc)
+		if i := a.relayOf(alloc.Addr.IP); i >= 0 {
+			a.relays[i].used--
+		}
 	}
 	if len(toRemove) == 0 {
 		a.newAllocs = a.newAllocs[:0]
@@ -93,17 +256,48 @@ func (a *NetAllocator) Remove(addr turn.Addr, proto turn.Protocol) error {
 // NewNetAllocator initializes new port allocation manager, addr currently supports
 // only *UDPAddr.
 func NewNetAllocator(l *zap.Logger, addr net.Addr, ports NetPortAllocator) (*NetAllocator, error) {
-	var defaultAddr string
-	switch tAddr := addr.(type) {
-	case *net.UDPAddr:
-		defaultAddr = tAddr.IP.String() + ":0"
-	default:
+	tAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
 		return nil, errors.New("unsupported addr")
 	}
-	a := NetAllocator{
-		log:         l,
-		defaultAddr: defaultAddr,
-		ports:       ports,
+	return NewRelayAllocator(RelayOptions{
+		Log:    l,
+		Relays: []Relay{{IP: tAddr.IP, Ports: ports}},
+	})
+}
+
+// RelayOptions contain possible settings for NewRelayAllocator.
+type RelayOptions struct {
+	Log      *zap.Logger
+	Relays   []Relay
+	Policy   RelayPolicy
+	Listener net.IP // listener address for RelaySameAsListener policy
+}
+
+// NewRelayAllocator initializes new port allocation manager that allocates
+// ports on multiple relay addresses.
+func NewRelayAllocator(o RelayOptions) (*NetAllocator, error) {
+	if len(o.Relays) == 0 {
+		return nil, errors.New("no relays")
+	}
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	a := &NetAllocator{
+		log:    o.Log,
+		policy: o.Policy,
+	}
+	for _, r := range o.Relays {
+		if r.Ports == nil {
+			return nil, errors.New("no port allocator for relay")
+		}
+		a.relays = append(a.relays, relay{
+			Relay:       r,
+			defaultAddr: (&net.UDPAddr{IP: r.IP}).String(),
+		})
+	}
+	if i := a.relayOf(o.Listener); i >= 0 {
+		a.listener = i
 	}
-	return &a, nil
+	return a, nil
 }
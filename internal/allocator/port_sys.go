@@ -1,13 +1,31 @@
 package allocator
 
 import (
+	"errors"
+	mathRand "math/rand"
 	"net"
 
 	"github.com/gortc/turn"
 )
 
+// ErrNoFreePorts means that all ports of range are allocated.
+var ErrNoFreePorts = errors.New("no free ports")
+
+// maxPortAttempts is maximum count of ports of range that are tried for
+// single allocation, so allocation fails fast if large range is nearly
+// exhausted instead of trying every port of it.
+const maxPortAttempts = 64
+
 // SystemPortAllocator allocates port directly on system.
-type SystemPortAllocator struct{}
+//
+// Ports are allocated from range [MinPort, MaxPort] if MaxPort is set,
+// ephemeral ports are used otherwise. Every port of range is tried only
+// if range is not larger than maxPortAttempts, otherwise ErrNoFreePorts
+// can be returned while some ports are still free.
+type SystemPortAllocator struct {
+	MinPort int
+	MaxPort int
+}
 
 // AllocatePort returns new requested initialized NetAllocation.
 func (s SystemPortAllocator) AllocatePort(
@@ -17,6 +35,31 @@ func (s SystemPortAllocator) AllocatePort(
 	if err != nil {
 		return NetAllocation{}, err
 	}
+	if s.MaxPort == 0 {
+		return listenPort(proto, addr)
+	}
+	if s.MinPort > s.MaxPort {
+		return NetAllocation{}, errors.New("minPort is larger that maxPort")
+	}
+	// Trying ports of range starting from random one, so allocations
+	// are not predictable and busy ports are skipped. Ports of large
+	// range are picked randomly, because busy ones are often adjacent.
+	size := s.MaxPort - s.MinPort + 1
+	start := mathRand.Intn(size) // #nosec
+	for i := 0; i < size && i < maxPortAttempts; i++ {
+		offset := start + i
+		if size > maxPortAttempts && i > 0 {
+			offset = mathRand.Intn(size) // #nosec
+		}
+		addr.Port = s.MinPort + offset%size
+		if a, listenErr := listenPort(proto, addr); listenErr == nil {
+			return a, nil
+		}
+	}
+	return NetAllocation{}, ErrNoFreePorts
+}
+
+func listenPort(proto turn.Protocol, addr *net.UDPAddr) (NetAllocation, error) {
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
 		return NetAllocation{}, err
@@ -7,7 +7,9 @@ import (
 	"math/big"
 	mathRand "math/rand"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 
 	"go.uber.org/zap"
 
@@ -23,21 +25,81 @@ type pooledPort struct {
 
 // SystemPortPooledAllocator pre-allocates pool of ports.
 type SystemPortPooledAllocator struct {
-	log     *zap.Logger
-	network string
-	ip      net.IP
-	minPort int
-	maxPort int
-	ports   []pooledPort
-	free    []int
-	mux     sync.RWMutex
-	rand    io.Reader
+	log      *zap.Logger
+	network  string
+	ip       net.IP
+	minPort  int
+	maxPort  int
+	ports    []pooledPort
+	free     []int
+	reserved map[int]bool // ports that are not bound on init
+	mux      sync.RWMutex
+	rand     io.Reader
+}
+
+// PooledOptions contain possible settings for SystemPortPooledAllocator.
+type PooledOptions struct {
+	Log     *zap.Logger
+	Network string // "udp4" if blank
+	IP      net.IP
+	MinPort int
+	MaxPort int
+	// Inherited are connections of idle ports that are passed from
+	// previous process, see Detach. They are pooled instead of binding
+	// new ones.
+	Inherited []*net.UDPConn
+	// Reserved are ports of inherited allocations that are not bound,
+	// they are added to pool by Adopt.
+	Reserved []int
+}
+
+// NewSystemPortPooledAllocator initializes pool, pre-allocating ports from
+// range [MinPort, MaxPort] on IP. Ports that are busy are not pooled.
+func NewSystemPortPooledAllocator(o PooledOptions) (*SystemPortPooledAllocator, error) {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Network == "" {
+		o.Network = "udp4"
+	}
+	a := &SystemPortPooledAllocator{
+		log:     o.Log,
+		network: o.Network,
+		ip:      o.IP,
+		minPort: o.MinPort,
+		maxPort: o.MaxPort,
+		rand:    rand.Reader,
+	}
+	for _, port := range o.Reserved {
+		if a.reserved == nil {
+			a.reserved = make(map[int]bool)
+		}
+		a.reserved[port] = true
+	}
+	if err := a.init(o.Inherited...); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AllocatePort implements NetPortAllocator, network and defaultAddr are
+// ignored in favor of pool settings.
+func (a *SystemPortPooledAllocator) AllocatePort(
+	proto turn.Protocol, network, defaultAddr string,
+) (NetAllocation, error) {
+	if proto != turn.ProtoUDP {
+		return NetAllocation{}, errors.New("only udp is supported")
+	}
+	return a.allocate()
 }
 
 // Close de-allocates all ports.
 func (a *SystemPortPooledAllocator) Close() error {
 	a.mux.Lock()
 	for i := range a.ports {
+		if a.ports[i].conn == nil {
+			continue
+		}
 		if err := a.ports[i].conn.Close(); err != nil {
 			a.log.Warn("failed to close conn while shutdown", zap.Error(err))
 		}
@@ -47,19 +109,47 @@ func (a *SystemPortPooledAllocator) Close() error {
 	return nil
 }
 
+// FreePorts returns count of ports that are not allocated.
+func (a *SystemPortPooledAllocator) FreePorts() int {
+	a.mux.RLock()
+	free := 0
+	for i := range a.ports {
+		if !a.ports[i].allocated {
+			free++
+		}
+	}
+	a.mux.RUnlock()
+	return free
+}
+
 type wrappedConn struct {
 	net.PacketConn
 	allocator *SystemPortPooledAllocator
 	port      int
 }
 
+// File returns copy of underlying file, allowing to pass
+// connection to another process.
+func (w *wrappedConn) File() (*os.File, error) {
+	return w.PacketConn.(*net.UDPConn).File()
+}
+
+// SyscallConn returns raw underlying connection, allowing to set socket
+// options.
+func (w *wrappedConn) SyscallConn() (syscall.RawConn, error) {
+	return w.PacketConn.(*net.UDPConn).SyscallConn()
+}
+
 func (w *wrappedConn) Close() error {
 	w.allocator.dealloc(w.port)
 	return nil
 }
 
-func (a *SystemPortPooledAllocator) randomFree() pooledPort {
+func (a *SystemPortPooledAllocator) randomFree() (int, bool) {
 	// Assuming a.mux is locked.
+	if len(a.free) == 0 {
+		return 0, false
+	}
 	max := big.NewInt(int64(len(a.free)))
 	i := 0
 	// Trying to get cryptographically random port.
@@ -68,14 +158,13 @@ func (a *SystemPortPooledAllocator) randomFree() pooledPort {
 		i = int(n.Int64())
 	} else {
 		// Falling back to pseudo-random.
-		i = mathRand.Intn(len(a.free))
+		i = mathRand.Intn(len(a.free)) // #nosec
 	}
-	return a.ports[i]
+	return a.free[i], true
 }
 
 func (a *SystemPortPooledAllocator) allocate() (NetAllocation, error) {
 	a.mux.Lock()
-	var p pooledPort
 	a.free = a.free[:0]
 	for i := range a.ports {
 		if a.ports[i].allocated {
@@ -83,11 +172,14 @@ func (a *SystemPortPooledAllocator) allocate() (NetAllocation, error) {
 		}
 		a.free = append(a.free, i)
 	}
-	p = a.randomFree()
-	a.mux.Unlock()
-	if p.conn == nil {
-		return NetAllocation{}, errors.New("out of capacity")
+	i, ok := a.randomFree()
+	if !ok {
+		a.mux.Unlock()
+		return NetAllocation{}, ErrNoFreePorts
 	}
+	a.ports[i].allocated = true
+	p := a.ports[i]
+	a.mux.Unlock()
 	return NetAllocation{
 		Addr: turn.Addr{
 			Port: p.port,
@@ -97,23 +189,128 @@ func (a *SystemPortPooledAllocator) allocate() (NetAllocation, error) {
 		Conn: &wrappedConn{
 			allocator:  a,
 			PacketConn: p.conn,
+			port:       p.port,
+		},
+	}, nil
+}
+
+// AllocateAddr allocates port of addr from pool, e.g. to restore allocation
+// on same relayed address.
+func (a *SystemPortPooledAllocator) AllocateAddr(addr turn.Addr) (NetAllocation, error) {
+	if !addr.IP.Equal(a.ip) {
+		return NetAllocation{}, errors.New("ip is not pooled")
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for i := range a.ports {
+		p := a.ports[i]
+		if p.port != addr.Port {
+			continue
+		}
+		if p.allocated {
+			return NetAllocation{}, errors.New("port is allocated")
+		}
+		a.ports[i].allocated = true
+		return NetAllocation{
+			Addr:  turn.Addr{Port: p.port, IP: a.ip},
+			Proto: turn.ProtoUDP,
+			Conn: &wrappedConn{
+				allocator:  a,
+				PacketConn: p.conn,
+				port:       p.port,
+			},
+		}, nil
+	}
+	return NetAllocation{}, errors.New("port is not pooled")
+}
+
+// Adopt adds port of addr that is bound by conn to pool as allocated, e.g.
+// relayed port of allocation inherited from previous process, so port is
+// returned to pool on close of returned connection.
+func (a *SystemPortPooledAllocator) Adopt(addr turn.Addr, conn net.PacketConn) (NetAllocation, error) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return NetAllocation{}, errors.New("unexpected conn type")
+	}
+	if !addr.IP.Equal(a.ip) {
+		return NetAllocation{}, errors.New("ip is not pooled")
+	}
+	if addr.Port < a.minPort || addr.Port > a.maxPort {
+		return NetAllocation{}, errors.New("port is out of pool range")
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for i := range a.ports {
+		if a.ports[i].port == addr.Port {
+			return NetAllocation{}, errors.New("port is already pooled")
+		}
+	}
+	a.ports = append(a.ports, pooledPort{
+		port:      addr.Port,
+		addr:      &net.UDPAddr{IP: a.ip, Port: addr.Port},
+		conn:      udpConn,
+		allocated: true,
+	})
+	return NetAllocation{
+		Addr:  turn.Addr{Port: addr.Port, IP: a.ip},
+		Proto: turn.ProtoUDP,
+		Conn: &wrappedConn{
+			allocator:  a,
+			PacketConn: udpConn,
+			port:       addr.Port,
 		},
 	}, nil
 }
 
+// Detach returns files of idle ports, closing pool, so they can be passed
+// to new process and pooled there as inherited. Allocated ports are not
+// returned, they should be passed with corresponding allocations.
+func (a *SystemPortPooledAllocator) Detach() []*os.File {
+	var files []*os.File
+	a.mux.Lock()
+	for i := range a.ports {
+		p := a.ports[i]
+		if p.conn == nil {
+			continue
+		}
+		if !p.allocated {
+			f, err := p.conn.File()
+			if err != nil {
+				a.log.Warn("failed to get file of idle port", zap.Int("port", p.port), zap.Error(err))
+			} else {
+				files = append(files, f)
+			}
+		}
+		if err := p.conn.Close(); err != nil {
+			a.log.Warn("failed to close conn while detach", zap.Error(err))
+		}
+	}
+	a.ports = a.ports[:0]
+	a.mux.Unlock()
+	a.log.Info("detached", zap.Int("idle", len(files)))
+	return files
+}
+
+// dealloc closes connection of allocated port, so pending reads are
+// interrupted, and returns port to pool with new connection.
 func (a *SystemPortPooledAllocator) dealloc(port int) {
 	a.mux.Lock()
 	for i := range a.ports {
 		if a.ports[i].port != port {
 			continue
 		}
+		if !a.ports[i].allocated {
+			break
+		}
 		port := a.ports[i]
 		if err := port.conn.Close(); err != nil {
 			a.log.Warn("failed to close on dealloc", zap.Error(err))
 		}
 		newConn, err := net.ListenUDP(a.network, port.addr)
 		if err != nil {
+			// Port is not returned to pool.
 			a.log.Warn("failed to listen on dealloc", zap.Error(err))
+			a.ports[i].conn = nil
 			break
 		}
 		a.ports[i].allocated = false
@@ -123,20 +320,43 @@ func (a *SystemPortPooledAllocator) dealloc(port int) {
 	a.mux.Unlock()
 }
 
-func (a *SystemPortPooledAllocator) init() error {
+func (a *SystemPortPooledAllocator) init(inherited ...*net.UDPConn) error {
 	if a.minPort > a.maxPort {
 		return errors.New("minPort is larger that maxPort")
 	}
+	byPort := make(map[int]*net.UDPConn, len(inherited))
+	for _, conn := range inherited {
+		laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok || laddr.Port < a.minPort || laddr.Port > a.maxPort || !laddr.IP.Equal(a.ip) {
+			a.log.Warn("inherited conn is not in pool, closing", zap.Stringer("addr", conn.LocalAddr()))
+			if err := conn.Close(); err != nil {
+				a.log.Warn("failed to close inherited conn", zap.Error(err))
+			}
+			continue
+		}
+		byPort[laddr.Port] = conn
+	}
 	a.mux.Lock()
 	for port := a.minPort; port <= a.maxPort; port++ {
 		addr := &net.UDPAddr{
 			IP:   a.ip,
 			Port: port,
 		}
+		if conn, ok := byPort[port]; ok {
+			a.ports = append(a.ports, pooledPort{
+				port: port,
+				addr: addr,
+				conn: conn,
+			})
+			continue
+		}
+		if a.reserved[port] {
+			continue
+		}
 		conn, err := net.ListenUDP(a.network, addr)
 		if err != nil {
-			a.log.Error("failed to pre-allocate", zap.Error(err))
-			return err
+			a.log.Warn("failed to pre-allocate", zap.Int("port", port), zap.Error(err))
+			continue
 		}
 		a.ports = append(a.ports, pooledPort{
 			port: port,
@@ -145,9 +365,9 @@ func (a *SystemPortPooledAllocator) init() error {
 		})
 	}
 	ports := len(a.ports)
-	a.log.Info("pre-allocated", zap.Int("pool", ports))
+	a.log.Info("pre-allocated", zap.Int("pool", ports), zap.Int("inherited", len(byPort)))
 	a.mux.Unlock()
-	if ports == 0 {
+	if ports == 0 && len(a.reserved) == 0 {
 		return errors.New("failed to initialize pool")
 	}
 	return nil
@@ -8,6 +8,8 @@ import (
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/gortc/turn"
 )
 
 func TestSystemPortPooledAllocator_AllocatePort(t *testing.T) {
@@ -40,3 +42,59 @@ func TestSystemPortPooledAllocator_AllocatePort(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSystemPortPooledAllocator_exhaustion(t *testing.T) {
+	a, err := NewSystemPortPooledAllocator(PooledOptions{
+		IP:      net.IPv4(127, 0, 0, 1),
+		MinPort: 34020,
+		MaxPort: 34022,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var (
+		allocs []NetAllocation
+		seen   = make(map[int]bool)
+	)
+	for i := 0; i < 3; i++ {
+		alloc, allocErr := a.AllocatePort(turn.ProtoUDP, "udp4", "")
+		if allocErr != nil {
+			t.Fatal(allocErr)
+		}
+		if seen[alloc.Addr.Port] {
+			t.Fatalf("port %d allocated twice", alloc.Addr.Port)
+		}
+		seen[alloc.Addr.Port] = true
+		allocs = append(allocs, alloc)
+	}
+	if n := a.FreePorts(); n != 0 {
+		t.Errorf("unexpected free ports %d", n)
+	}
+	if _, err = a.AllocatePort(turn.ProtoUDP, "udp4", ""); err != ErrNoFreePorts {
+		t.Fatalf("unexpected error %v", err)
+	}
+	port := allocs[1].Addr.Port
+	if err = allocs[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := a.AllocatePort(turn.ProtoUDP, "udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Addr.Port != port {
+		t.Errorf("expected released port %d, got %d", port, alloc.Addr.Port)
+	}
+	if _, err = a.AllocateAddr(alloc.Addr); err == nil {
+		t.Error("allocated port should not be allocated by addr")
+	}
+	if err = alloc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if alloc, err = a.AllocateAddr(turn.Addr{IP: a.ip, Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Addr.Port != port {
+		t.Errorf("unexpected port %d", alloc.Addr.Port)
+	}
+}
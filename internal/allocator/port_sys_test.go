@@ -1,6 +1,7 @@
 package allocator
 
 import (
+	"net"
 	"testing"
 
 	"github.com/gortc/turn"
@@ -23,6 +24,63 @@ func TestSystemPortAllocator_AllocatePort(t *testing.T) {
 			t.Fatal("should not succeed")
 		}
 	})
+	t.Run("Range", func(t *testing.T) {
+		r := SystemPortAllocator{MinPort: 34030, MaxPort: 34031}
+		var allocs []NetAllocation
+		defer func() {
+			for _, alloc := range allocs {
+				alloc.Close()
+			}
+		}()
+		for i := 0; i < 2; i++ {
+			alloc, err := r.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alloc.Addr.Port < r.MinPort || alloc.Addr.Port > r.MaxPort {
+				t.Errorf("port %d is out of range", alloc.Addr.Port)
+			}
+			allocs = append(allocs, alloc)
+		}
+		if _, err := r.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0"); err != ErrNoFreePorts {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("LargeRange", func(t *testing.T) {
+		r := SystemPortAllocator{MinPort: 34200, MaxPort: 34200 + maxPortAttempts*3}
+		var allocs []NetAllocation
+		defer func() {
+			for _, alloc := range allocs {
+				alloc.Close()
+			}
+		}()
+		for port := r.MinPort; port <= r.MaxPort; port++ {
+			alloc, err := listenPort(turn.ProtoUDP, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+			if err != nil {
+				t.Skipf("port %d: %v", port, err)
+			}
+			allocs = append(allocs, alloc)
+		}
+		if _, err := r.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0"); err != ErrNoFreePorts {
+			t.Errorf("unexpected error %v", err)
+		}
+		// Free port should be found while range is not exhausted.
+		if err := allocs[len(allocs)/2].Close(); err != nil {
+			t.Fatal(err)
+		}
+		allocs = append(allocs[:len(allocs)/2], allocs[len(allocs)/2+1:]...)
+		found := false
+		for i := 0; i < 50 && !found; i++ {
+			alloc, err := r.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0")
+			if err == nil {
+				found = true
+				allocs = append(allocs, alloc)
+			}
+		}
+		if !found {
+			t.Error("free port not found")
+		}
+	})
 	t.Run("Conflict", func(t *testing.T) {
 		alloc, err := a.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0")
 		if err != nil {
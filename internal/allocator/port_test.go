@@ -135,3 +135,108 @@ func TestNetAllocation(t *testing.T) {
 	p.Remove(a2, turn.ProtoUDP)
 	p.Remove(a3, turn.ProtoUDP)
 }
+
+func TestNewRelayAllocator(t *testing.T) {
+	var (
+		first  = net.IPv4(127, 0, 0, 1)
+		second = net.IPv4(127, 0, 0, 2)
+	)
+	newAllocator := func(t *testing.T, policy RelayPolicy, ports NetPortAllocator) *NetAllocator {
+		t.Helper()
+		a, err := NewRelayAllocator(RelayOptions{
+			Relays: []Relay{
+				{IP: first, Ports: ports},
+				{IP: second, External: net.IPv4(203, 0, 113, 2), Ports: ports},
+			},
+			Policy:   policy,
+			Listener: second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	allocate := func(t *testing.T, a *NetAllocator) turn.Addr {
+		t.Helper()
+		addr, _, err := a.New(turn.ProtoUDP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	t.Run("NoRelays", func(t *testing.T) {
+		if _, err := NewRelayAllocator(RelayOptions{}); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("RoundRobin", func(t *testing.T) {
+		a := newAllocator(t, RelayRoundRobin, SystemPortAllocator{})
+		for i, ip := range []net.IP{first, second, first} {
+			addr := allocate(t, a)
+			defer a.Remove(addr, turn.ProtoUDP)
+			if !addr.IP.Equal(ip) {
+				t.Errorf("%d: unexpected relay %s", i, addr.IP)
+			}
+		}
+	})
+	t.Run("SameAsListener", func(t *testing.T) {
+		a := newAllocator(t, RelaySameAsListener, SystemPortAllocator{})
+		for i := 0; i < 2; i++ {
+			addr := allocate(t, a)
+			defer a.Remove(addr, turn.ProtoUDP)
+			if !addr.IP.Equal(second) {
+				t.Errorf("%d: unexpected relay %s", i, addr.IP)
+			}
+		}
+	})
+	t.Run("LeastUsed", func(t *testing.T) {
+		a := newAllocator(t, RelayLeastUsed, SystemPortAllocator{})
+		released := allocate(t, a)
+		if !released.IP.Equal(first) {
+			t.Errorf("unexpected relay %s", released.IP)
+		}
+		addr := allocate(t, a)
+		defer a.Remove(addr, turn.ProtoUDP)
+		if !addr.IP.Equal(second) {
+			t.Errorf("unexpected relay %s", addr.IP)
+		}
+		if err := a.Remove(released, turn.ProtoUDP); err != nil {
+			t.Fatal(err)
+		}
+		addr = allocate(t, a)
+		defer a.Remove(addr, turn.ProtoUDP)
+		if !addr.IP.Equal(first) {
+			t.Errorf("released relay should be used, got %s", addr.IP)
+		}
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		a := newAllocator(t, RelaySameAsListener, SystemPortAllocator{MinPort: 34050, MaxPort: 34050})
+		addr := allocate(t, a)
+		defer a.Remove(addr, turn.ProtoUDP)
+		if _, _, err := a.New(turn.ProtoUDP); err != ErrNoFreePorts {
+			t.Errorf("unexpected error %v", err)
+		}
+		a = newAllocator(t, RelayRoundRobin, SystemPortAllocator{MinPort: 34051, MaxPort: 34051})
+		for i := 0; i < 2; i++ {
+			// Second allocation should fall back to other relay
+			// after round-robin selects exhausted one.
+			if i == 1 {
+				a.next = 0
+			}
+			addr := allocate(t, a)
+			defer a.Remove(addr, turn.ProtoUDP)
+		}
+		if _, _, err := a.New(turn.ProtoUDP); err != ErrNoFreePorts {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("External", func(t *testing.T) {
+		a := newAllocator(t, RelayRoundRobin, SystemPortAllocator{})
+		if ip := a.External(second); !ip.Equal(net.IPv4(203, 0, 113, 2)) {
+			t.Errorf("unexpected external %s", ip)
+		}
+		if ip := a.External(first); !ip.Equal(first) {
+			t.Errorf("unexpected external %s", ip)
+		}
+	})
+}
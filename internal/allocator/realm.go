@@ -0,0 +1,121 @@
+package allocator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RealmStats contains statistics of allocations of realm.
+type RealmStats struct {
+	// Allocations is the number of current allocations.
+	Allocations int `json:"allocations"`
+	// Usage is relayed traffic of current and removed allocations.
+	Usage Usage `json:"usage"`
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{
+		ToPeerBytes:     u.ToPeerBytes + o.ToPeerBytes,
+		ToPeerPackets:   u.ToPeerPackets + o.ToPeerPackets,
+		FromPeerBytes:   u.FromPeerBytes + o.FromPeerBytes,
+		FromPeerPackets: u.FromPeerPackets + o.FromPeerPackets,
+	}
+}
+
+// Add returns sum of realm statistics.
+func (s RealmStats) Add(o RealmStats) RealmStats {
+	return RealmStats{
+		Allocations: s.Allocations + o.Allocations,
+		Usage:       s.Usage.add(o.Usage),
+	}
+}
+
+// RealmCount returns the number of allocations of realm.
+func (a *Allocator) RealmCount(realm string) int {
+	n := 0
+	a.allocsMux.RLock()
+	for i := range a.allocs {
+		if a.allocs[i].Session.Realm == realm {
+			n++
+		}
+	}
+	a.allocsMux.RUnlock()
+	return n
+}
+
+// realmStats returns statistics per realm. Should be called under lock.
+func (a *Allocator) realmStats() map[string]RealmStats {
+	a.realmMux.Lock()
+	stats := make(map[string]RealmStats, len(a.realmUsage))
+	for realm, u := range a.realmUsage {
+		stats[realm] = RealmStats{Usage: u}
+	}
+	a.realmMux.Unlock()
+	for i := range a.allocs {
+		realm := a.allocs[i].Session.Realm
+		stats[realm] = stats[realm].Add(RealmStats{
+			Allocations: 1,
+			Usage:       a.allocs[i].Usage.Load(),
+		})
+	}
+	return stats
+}
+
+// addRealmUsage adds usage of removed allocations to realm totals.
+// Should be called under lock, so totals are not decreased in between.
+func (a *Allocator) addRealmUsage(allocs []Allocation) {
+	a.realmMux.Lock()
+	for i := range allocs {
+		realm := allocs[i].Session.Realm
+		a.realmUsage[realm] = a.realmUsage[realm].add(allocs[i].Usage.Load())
+	}
+	a.realmMux.Unlock()
+}
+
+// ErrBandwidthExceeded means that data exceeds bandwidth cap of allocation.
+var ErrBandwidthExceeded = errors.New("bandwidth exceeded")
+
+// limiter is token bucket that limits relayed bytes per second, allowing
+// bursts of up to one second of traffic. Nil limiter allows everything.
+type limiter struct {
+	mux    sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+	}
+}
+
+// allow reports whether n bytes can be relayed at t, consuming tokens
+// if so.
+func (l *limiter) allow(n int, t time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if t.After(l.last) {
+		if !l.last.IsZero() {
+			l.tokens += t.Sub(l.last).Seconds() * l.rate
+		}
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = t
+	}
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
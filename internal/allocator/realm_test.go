@@ -0,0 +1,167 @@
+package allocator
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+func TestLimiter(t *testing.T) {
+	if newLimiter(0) != nil {
+		t.Error("limiter should be nil if rate is zero")
+	}
+	var nilLimiter *limiter
+	if !nilLimiter.allow(1000, time.Now()) {
+		t.Error("nil limiter should allow everything")
+	}
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimiter(100)
+	for _, tc := range []struct {
+		n       int
+		t       time.Time
+		allowed bool
+	}{
+		{100, now, true}, // burst of one second
+		{1, now, false},
+		{50, now.Add(time.Millisecond * 500), true},
+		{1, now.Add(time.Millisecond * 500), false},
+		{10, now.Add(-time.Second), false}, // time going backwards
+		{100, now.Add(time.Second * 10), true},
+		{1, now.Add(time.Second * 10), false},
+	} {
+		if l.allow(tc.n, tc.t) != tc.allowed {
+			t.Errorf("%d at %s should be allowed: %v", tc.n, tc.t, tc.allowed)
+		}
+	}
+}
+
+func TestAllocator_Realms(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{
+		Conn: p,
+		Bandwidth: func(s Session) int {
+			if s.Realm == "limited" {
+				return 100
+			}
+			return 0
+		},
+	})
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	newTuple := func(port int) turn.FiveTuple {
+		return turn.FiveTuple{
+			Client: turn.Addr{Port: port, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+	}
+	for i, realm := range []string{"limited", "limited", "other"} {
+		tuple := newTuple(200 + i)
+		session := Session{Username: "user", Realm: realm}
+		if _, err = a.NewWithSession(tuple, session, now.Add(time.Second*10), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = a.CreatePermission(tuple, peer, now.Add(time.Second*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := a.RealmCount("limited"); n != 2 {
+		t.Errorf("unexpected count %d", n)
+	}
+	if _, err = a.Send(newTuple(200), peer, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Send(newTuple(200), peer, make([]byte, 100)); err != ErrBandwidthExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Bandwidth is limited per allocation.
+	if _, err = a.Send(newTuple(201), peer, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Send(newTuple(202), peer, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Remove(newTuple(201)); err != nil {
+		t.Fatal(err)
+	}
+	stats := a.Stats().Realms
+	if s := stats["limited"]; s.Allocations != 1 || s.Usage.ToPeerBytes != 200 || s.Usage.ToPeerPackets != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if s := stats["other"]; s.Allocations != 1 || s.Usage.ToPeerBytes != 1000 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	a.Prune(now.Add(time.Second * 11))
+	if s := a.Stats().Realms["limited"]; s.Allocations != 0 || s.Usage.ToPeerBytes != 200 {
+		t.Errorf("unexpected stats after prune %+v", s)
+	}
+}
+
+func TestAllocator_MaxAllocations(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{
+		Conn: p,
+		MaxAllocations: func(s Session) int {
+			if s.Realm == "limited" {
+				return 2
+			}
+			return 0
+		},
+	})
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	var (
+		wg      sync.WaitGroup
+		created int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			tuple := turn.FiveTuple{
+				Client: turn.Addr{Port: port, IP: net.IPv4(127, 0, 0, 1)},
+				Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+				Proto:  turn.ProtoUDP,
+			}
+			session := Session{Username: "user", Realm: "limited"}
+			switch _, err := a.NewWithSession(tuple, session, now.Add(time.Second*10), nil); err {
+			case nil:
+				atomic.AddInt32(&created, 1)
+			case ErrQuotaReached:
+				// Expected.
+			default:
+				t.Error(err)
+			}
+		}(200 + i)
+	}
+	wg.Wait()
+	if created != 2 {
+		t.Errorf("unexpected allocations created: %d", created)
+	}
+	// Quota is per realm.
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.NewWithSession(tuple, Session{Realm: "other"}, now.Add(time.Second*10), nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,119 @@
+package allocator
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+// AllocationState is serializable state of allocation, see Allocator.Detach
+// and Allocator.Restore.
+type AllocationState struct {
+	Tuple       turn.FiveTuple `json:"tuple"`
+	Session     Session        `json:"session"`
+	RelayedAddr turn.Addr      `json:"relayed"`
+	Permissions []Permission   `json:"permissions,omitempty"`
+	Peers       []turn.Addr    `json:"peers,omitempty"`
+	Started     time.Time      `json:"started"`
+	Timeout     time.Time      `json:"timeout"`
+	Usage       Usage          `json:"usage"`
+	// DontFragment is true if DF bit is set for all packets to peers.
+	DontFragment bool `json:"dont_fragment,omitempty"`
+}
+
+func (a *Allocation) state() AllocationState {
+	return AllocationState{
+		Tuple:       a.Tuple,
+		Session:     a.Session,
+		RelayedAddr: a.RelayedAddr,
+		Permissions: append([]Permission(nil), a.Permissions...),
+		Peers:       append([]turn.Addr(nil), a.Peers...),
+		Started:     a.Started,
+		Timeout:     a.Timeout,
+		Usage:       a.Usage.Load(),
+
+		DontFragment: a.DontFragment.enabled(),
+	}
+}
+
+// Export returns state of all allocations.
+func (a *Allocator) Export() []AllocationState {
+	a.allocsMux.RLock()
+	states := make([]AllocationState, 0, len(a.allocs))
+	for i := range a.allocs {
+		states = append(states, a.allocs[i].state())
+	}
+	a.allocsMux.RUnlock()
+	return states
+}
+
+// Detach removes all allocations without closing relayed connections and
+// writing accounting records, returning allocation states and relayed
+// connections in same order.
+//
+// Relayed connections are still managed by RelayedAddrAllocator.
+func (a *Allocator) Detach() ([]AllocationState, []net.PacketConn) {
+	a.allocsMux.Lock()
+	allocs := a.allocs
+	a.allocs = nil
+	a.allocsMux.Unlock()
+	var (
+		states = make([]AllocationState, len(allocs))
+		conns  = make([]net.PacketConn, len(allocs))
+	)
+	for i := range allocs {
+		states[i] = allocs[i].state()
+		conns[i] = allocs[i].Conn
+	}
+	return states, conns
+}
+
+// Restore adds allocation from state with existing relayed connection,
+// e.g. inherited from previous process, and starts reading from it.
+func (a *Allocator) Restore(s AllocationState, conn net.PacketConn, callback PeerHandler) error {
+	usage := s.Usage
+	allocation := Allocation{
+		Tuple:        s.Tuple,
+		Session:      s.Session,
+		Permissions:  s.Permissions,
+		Peers:        s.Peers,
+		RelayedAddr:  s.RelayedAddr,
+		Conn:         conn,
+		Callback:     callback,
+		Started:      s.Started,
+		Timeout:      s.Timeout,
+		Usage:        &usage,
+		Capture:      a.capture,
+		PeerRule:     a.peerRule,
+		Route:        NewRoute(s.Tuple),
+		Buf:          make([]byte, 2048),
+		DontFragment: &dontFragment{always: s.DontFragment},
+		Log: a.log.Named("allocation").With(
+			zap.Stringer("tuple", s.Tuple),
+			zap.Stringer("raddr", s.RelayedAddr),
+		),
+	}
+	if s.DontFragment {
+		// Socket option is inherited with connection during handoff, but
+		// connection is bound again on snapshot restore.
+		if err := setDontFragment(conn, true); err != nil {
+			return err
+		}
+	}
+	allocation.ToPeerLimit, allocation.FromPeerLimit = a.limiters(s.Session)
+	a.allocsMux.Lock()
+	for i := range a.allocs {
+		if a.allocs[i].Tuple.Equal(s.Tuple) {
+			a.allocsMux.Unlock()
+			return ErrAllocationMismatch
+		}
+	}
+	allocation.Conn = a.raddr.Adopt(s.RelayedAddr, s.Tuple.Proto, conn)
+	a.allocs = append(a.allocs, allocation)
+	a.allocsMux.Unlock()
+	go allocation.ReadUntilClosed()
+	return nil
+}
@@ -91,3 +91,64 @@ func (n *NonceAuth) Check(
 	return current.value, ErrStaleNonce
 
 }
+
+// NonceState is serializable state of nonce.
+type NonceState struct {
+	Tuple      turn.FiveTuple `json:"tuple"`
+	Value      string         `json:"value"`
+	ValidUntil time.Time      `json:"valid_until"`
+}
+
+// Export returns state of all nonces.
+func (n *NonceAuth) Export() []NonceState {
+	n.mux.Lock()
+	states := make([]NonceState, len(n.nonces))
+	for i := range n.nonces {
+		states[i] = NonceState{
+			Tuple:      n.nonces[i].tuple,
+			Value:      string(n.nonces[i].value),
+			ValidUntil: n.nonces[i].validUntil,
+		}
+	}
+	n.mux.Unlock()
+	return states
+}
+
+func (n *NonceAuth) has(tuple turn.FiveTuple) bool {
+	// Assuming n.mux is locked.
+	for i := range n.nonces {
+		if n.nonces[i].tuple.Equal(tuple) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore adds nonces from states, skipping ones for existing tuples.
+func (n *NonceAuth) Restore(states []NonceState) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for _, s := range states {
+		if n.has(s.Tuple) {
+			continue
+		}
+		n.nonces = append(n.nonces, nonce{
+			tuple:      s.Tuple,
+			value:      stun.Nonce(s.Value),
+			validUntil: s.ValidUntil,
+		})
+	}
+}
+
+// Remove removes nonce of tuple, e.g. after allocation is moved to
+// another tuple, so nonce is rotated if tuple is used again.
+func (n *NonceAuth) Remove(tuple turn.FiveTuple) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for i := range n.nonces {
+		if n.nonces[i].tuple.Equal(tuple) {
+			n.nonces = append(n.nonces[:i], n.nonces[i+1:]...)
+			return
+		}
+	}
+}
@@ -49,4 +49,13 @@ func TestNonceAuth_Check(t *testing.T) {
 	if _, checkErr := a.Check(tuple, realNonce, now.Add(time.Minute*31).Add(time.Minute)); checkErr != ErrStaleNonce {
 		t.Error(checkErr)
 	}
+	t.Run("Remove", func(t *testing.T) {
+		a.Remove(tuple)
+		if a.has(tuple) {
+			t.Fatal("nonce should be removed")
+		}
+		if _, checkErr := a.Check(tuple, newNonce, now.Add(time.Minute*33)); checkErr != ErrStaleNonce {
+			t.Error(checkErr)
+		}
+	})
 }
@@ -0,0 +1,159 @@
+// Package capture implements in-process packet capture in pcapng format.
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+// Filter selects captured packets. Blank filter matches any packet.
+type Filter struct {
+	// Client matches packets of clients from subnet, including data relayed
+	// for their allocations.
+	Client *net.IPNet
+	// Allocation matches packets of single allocation, identified by client
+	// transport address.
+	Allocation *turn.Addr
+}
+
+func (f Filter) match(client turn.Addr) bool {
+	if f.Client != nil && !f.Client.Contains(client.IP) {
+		return false
+	}
+	if f.Allocation != nil && !f.Allocation.Equal(client) {
+		return false
+	}
+	return true
+}
+
+// Limits bound the capture.
+type Limits struct {
+	Duration time.Duration
+	Bytes    int64
+}
+
+type packet struct {
+	time     time.Time
+	src, dst net.UDPAddr
+	data     []byte
+}
+
+type session struct {
+	filter  Filter
+	packets chan packet
+}
+
+// Hub passes packets to running capture sessions.
+//
+// Nil Hub is valid and does nothing.
+type Hub struct {
+	active   int32
+	mux      sync.RWMutex
+	sessions map[*session]struct{}
+}
+
+// NewHub initializes and returns new Hub.
+func NewHub() *Hub {
+	return &Hub{
+		sessions: make(map[*session]struct{}),
+	}
+}
+
+// Active reports whether any capture is running.
+func (h *Hub) Active() bool {
+	return h != nil && atomic.LoadInt32(&h.active) > 0
+}
+
+func copyUDPAddr(dst *net.UDPAddr, a turn.Addr) {
+	dst.IP = append(dst.IP[:0], a.IP...)
+	dst.Port = a.Port
+}
+
+// Packet captures UDP datagram with data from src to dst that belongs to
+// client. Data is copied, so it can be reused after Packet returns.
+func (h *Hub) Packet(client, src, dst turn.Addr, data []byte) {
+	if !h.Active() {
+		return
+	}
+	now := time.Now()
+	h.mux.RLock()
+	for s := range h.sessions {
+		if !s.filter.match(client) {
+			continue
+		}
+		p := packet{
+			time: now,
+			data: append([]byte(nil), data...),
+		}
+		copyUDPAddr(&p.src, src)
+		copyUDPAddr(&p.dst, dst)
+		select {
+		case s.packets <- p:
+		default:
+			// Dropping packet, the capture consumer is too slow.
+		}
+	}
+	h.mux.RUnlock()
+}
+
+func (h *Hub) add(s *session) {
+	h.mux.Lock()
+	h.sessions[s] = struct{}{}
+	atomic.AddInt32(&h.active, 1)
+	h.mux.Unlock()
+}
+
+func (h *Hub) remove(s *session) {
+	h.mux.Lock()
+	delete(h.sessions, s)
+	atomic.AddInt32(&h.active, -1)
+	h.mux.Unlock()
+}
+
+// ErrNoLimits means that capture is requested without limits.
+var ErrNoLimits = errors.New("capture duration and size should be limited")
+
+// Capture writes matching packets to w in pcapng format until duration or
+// size limit is reached or ctx is done.
+func (h *Hub) Capture(ctx context.Context, w io.Writer, f Filter, l Limits) error {
+	if l.Duration <= 0 || l.Bytes <= 0 {
+		return ErrNoLimits
+	}
+	pw, err := NewWriter(w)
+	if err != nil {
+		return err
+	}
+	s := &session{
+		filter:  f,
+		packets: make(chan packet, 1024),
+	}
+	h.add(s)
+	defer h.remove(s)
+	timer := time.NewTimer(l.Duration)
+	defer timer.Stop()
+	for {
+		select {
+		case p := <-s.packets:
+			if err := pw.WritePacket(p.time, &p.src, &p.dst, p.data); err != nil {
+				return err
+			}
+			if pw.Written() >= l.Bytes {
+				return nil
+			}
+			if flusher, ok := w.(interface{ Flush() }); ok {
+				flusher.Flush()
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+// readBlocks returns pcapng blocks as type to body list.
+func readBlocks(t *testing.T, b []byte) (types []uint32, bodies [][]byte) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatal("short block")
+		}
+		blockType := binary.LittleEndian.Uint32(b)
+		total := binary.LittleEndian.Uint32(b[4:])
+		if int(total) > len(b) || total%4 != 0 {
+			t.Fatalf("bad block length %d", total)
+		}
+		if binary.LittleEndian.Uint32(b[total-4:]) != total {
+			t.Fatal("trailing length mismatch")
+		}
+		types = append(types, blockType)
+		bodies = append(bodies, b[8:total-4])
+		b = b[total:]
+	}
+	return types, bodies
+}
+
+func TestWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src, dst *net.UDPAddr
+		ipLen    int
+	}{
+		{
+			src:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			dst:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 3478},
+			ipLen: 20,
+		},
+		{
+			src:   &net.UDPAddr{IP: net.IPv6loopback, Port: 1234},
+			dst:   &net.UDPAddr{IP: net.IPv6loopback, Port: 3478},
+			ipLen: 40,
+		},
+	} {
+		if err = w.WritePacket(time.Now(), tc.src, tc.dst, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Written() != int64(buf.Len()) {
+		t.Error("written mismatch")
+	}
+	types, bodies := readBlocks(t, buf.Bytes())
+	if len(types) != 4 {
+		t.Fatalf("unexpected blocks count %d", len(types))
+	}
+	for i, v := range []uint32{
+		blockSectionHeader, blockInterfaceDescription, blockEnhancedPacket, blockEnhancedPacket,
+	} {
+		if types[i] != v {
+			t.Errorf("unexpected block %d type 0x%x", i, types[i])
+		}
+	}
+	for i, ipLen := range []int{20, 40} {
+		body := bodies[2+i]
+		capLen := int(binary.LittleEndian.Uint32(body[12:]))
+		if capLen != ipLen+8+5 {
+			t.Errorf("unexpected captured length %d", capLen)
+		}
+		pkt := body[20 : 20+capLen]
+		if !bytes.Equal(pkt[ipLen+8:], []byte("hello")) {
+			t.Error("payload mismatch")
+		}
+		if binary.BigEndian.Uint16(pkt[ipLen+2:]) != 3478 {
+			t.Error("bad destination port")
+		}
+	}
+	// Verifying IPv4 header checksum.
+	ipv4 := bodies[2][20:40]
+	if fold(checksum(0, ipv4)) != 0 {
+		t.Error("bad IPv4 header checksum")
+	}
+}
+
+func TestHub(t *testing.T) {
+	var nilHub *Hub
+	nilHub.Packet(turn.Addr{}, turn.Addr{}, turn.Addr{}, nil)
+	h := NewHub()
+	if h.Active() {
+		t.Error("should not be active")
+	}
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		client = turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+		other  = turn.Addr{IP: net.IPv4(192, 168, 0, 1), Port: 1000}
+		server = turn.Addr{IP: net.IPv4(10, 1, 0, 1), Port: 3478}
+		w      = &notifyWriter{writes: make(chan struct{}, 10)}
+		done   = make(chan error)
+	)
+	if err = h.Capture(context.Background(), w, Filter{}, Limits{}); err != ErrNoLimits {
+		t.Errorf("unexpected error %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- h.Capture(ctx, w, Filter{Client: subnet}, Limits{
+			Duration: time.Minute,
+			Bytes:    1024 * 1024,
+		})
+	}()
+	for !h.Active() {
+		time.Sleep(time.Millisecond)
+	}
+	h.Packet(client, client, server, []byte("a"))
+	h.Packet(other, other, server, []byte("b"))
+	h.Packet(client, server, client, []byte("c"))
+	// Header and two matching packets.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-w.writes:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+	}
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if h.Active() {
+		t.Error("should not be active")
+	}
+	types, _ := readBlocks(t, w.buf.Bytes())
+	if len(types) != 4 {
+		t.Errorf("unexpected blocks count %d", len(types))
+	}
+}
+
+type notifyWriter struct {
+	buf    bytes.Buffer
+	writes chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	w.writes <- struct{}{}
+	return n, err
+}
+
+func TestHub_Limits(t *testing.T) {
+	h := NewHub()
+	buf := new(bytes.Buffer)
+	done := make(chan error)
+	go func() {
+		done <- h.Capture(context.Background(), buf, Filter{}, Limits{
+			Duration: time.Minute,
+			Bytes:    100,
+		})
+	}()
+	for !h.Active() {
+		time.Sleep(time.Millisecond)
+	}
+	a := turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	h.Packet(a, a, a, make([]byte, 200))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("size limit not reached")
+	}
+}
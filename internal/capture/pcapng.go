@@ -0,0 +1,168 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// pcapng block types, see draft-tuexen-opsawg-pcapng.
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+	byteOrderMagic            = 0x1A2B3C4D
+	linkTypeRaw               = 101 // raw IPv4 or IPv6 packets
+	snapLen                   = 65535
+	protoUDP                  = 17
+)
+
+// Writer writes packets in pcapng format, synthesizing IP and UDP headers
+// so that captured payloads can be decoded by common tools.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+	n   int64 // total bytes written
+}
+
+// NewWriter writes pcapng section header and interface description to w
+// and returns new Writer.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w}
+	b := pw.buf[:0]
+	// Section Header Block.
+	b = appendUint32(b, blockSectionHeader)
+	b = appendUint32(b, 28)
+	b = appendUint32(b, byteOrderMagic)
+	b = appendUint16(b, 1) // major version
+	b = appendUint16(b, 0) // minor version
+	b = appendUint32(b, 0xFFFFFFFF)
+	b = appendUint32(b, 0xFFFFFFFF) // section length is not specified
+	b = appendUint32(b, 28)
+	// Interface Description Block.
+	b = appendUint32(b, blockInterfaceDescription)
+	b = appendUint32(b, 20)
+	b = appendUint16(b, linkTypeRaw)
+	b = appendUint16(b, 0)
+	b = appendUint32(b, snapLen)
+	b = appendUint32(b, 20)
+	pw.buf = b
+	if err := pw.flush(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Written returns total count of bytes written.
+func (pw *Writer) Written() int64 { return pw.n }
+
+func (pw *Writer) flush() error {
+	n, err := pw.w.Write(pw.buf)
+	pw.n += int64(n)
+	pw.buf = pw.buf[:0]
+	return err
+}
+
+// WritePacket writes UDP datagram with data from src to dst captured at t.
+func (pw *Writer) WritePacket(t time.Time, src, dst *net.UDPAddr, data []byte) error {
+	pkt := appendUDPPacket(nil, src, dst, data)
+	padded := (len(pkt) + 3) &^ 3
+	total := uint32(32 + padded)
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	b := pw.buf[:0]
+	b = appendUint32(b, blockEnhancedPacket)
+	b = appendUint32(b, total)
+	b = appendUint32(b, 0) // interface id
+	b = appendUint32(b, uint32(ts>>32))
+	b = appendUint32(b, uint32(ts))
+	b = appendUint32(b, uint32(len(pkt)))
+	b = appendUint32(b, uint32(len(pkt)))
+	b = append(b, pkt...)
+	for i := len(pkt); i < padded; i++ {
+		b = append(b, 0)
+	}
+	b = appendUint32(b, total)
+	pw.buf = b
+	return pw.flush()
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// appendUDPPacket appends IPv4 or IPv6 packet with UDP datagram to b.
+func appendUDPPacket(b []byte, src, dst *net.UDPAddr, data []byte) []byte {
+	udpLen := 8 + len(data)
+	var (
+		srcIP  = src.IP.To4()
+		dstIP  = dst.IP.To4()
+		pseudo uint32
+	)
+	if srcIP != nil && dstIP != nil {
+		start := len(b)
+		b = append(b,
+			0x45, 0, 0, 0, // version, IHL, DSCP, total length
+			0, 0, 0x40, 0, // identification, flags (DF), fragment offset
+			64, protoUDP, 0, 0, // TTL, protocol, checksum
+		)
+		binary.BigEndian.PutUint16(b[start+2:], uint16(20+udpLen))
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		binary.BigEndian.PutUint16(b[start+10:], fold(checksum(0, b[start:])))
+		pseudo = checksum(0, srcIP)
+		pseudo = checksum(pseudo, dstIP)
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		if srcIP == nil {
+			srcIP = net.IPv6zero
+		}
+		if dstIP == nil {
+			dstIP = net.IPv6zero
+		}
+		start := len(b)
+		b = append(b,
+			0x60, 0, 0, 0, // version, traffic class, flow label
+			0, 0, protoUDP, 64, // payload length, next header, hop limit
+		)
+		binary.BigEndian.PutUint16(b[start+4:], uint16(udpLen))
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		pseudo = checksum(0, srcIP)
+		pseudo = checksum(pseudo, dstIP)
+	}
+	pseudo += protoUDP + uint32(udpLen)
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[start:], uint16(src.Port))
+	binary.BigEndian.PutUint16(b[start+2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(b[start+4:], uint16(udpLen))
+	b = append(b, data...)
+	sum := fold(checksum(pseudo, b[start:]))
+	if sum == 0 {
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(b[start+6:], sum)
+	return b
+}
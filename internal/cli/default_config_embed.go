@@ -12,6 +12,14 @@ server:
     level: "info"
     disableCaller: true
     disableStacktrace: true
+  # access log, one line per STUN transaction
+  # access_log:
+  #   # file path, "stdout" or "stderr"
+  #   path: /var/log/gortcd/access.log
+  #   # "text" or "json"
+  #   format: text
+  #   # fraction of transactions to log, logging all by default
+  #   sampling: 1
   # use REUSEPORT sockets if available, dramatically
   # improves the performance on multi-threaded systems.
   reuseport: true
@@ -20,6 +28,22 @@ server:
   workers: 100
   listen:
     - 0.0.0.0:3478
+  # RFC 5780 NAT behavior discovery: Binding responses are sent from
+  # alternate IP and/or port on CHANGE-REQUEST, so addresses should
+  # differ by both IP and port; all four combinations are listened
+  # discovery:
+  #   primary: 203.0.113.1:3478
+  #   alternate: 203.0.113.2:3479
+  # RFC 8016 mobility: Allocate requests with MOBILITY-TICKET get
+  # ticket that moves allocation to new 5-tuple on Refresh, e.g.
+  # after client switched network; 405 (Mobility Forbidden) is
+  # returned if disabled
+  # mobility:
+  #   enabled: true
+  #   # hex-encoded AES key of 16, 24 or 32 bytes that encrypts
+  #   # tickets, random if not set, so tickets are invalidated on
+  #   # restart
+  #   key: 000102030405060708090a0b0c0d0e0f
   # default realm
   realm: gortc.io
   # the SOFTWARE attribute value;
@@ -27,6 +51,89 @@ server:
   software: gortcd
   # verify the FINGERPRINT attribute
   check_fingerprint: true
+  # respond to RFC 3489 Binding requests without magic cookie with
+  # MAPPED-ADDRESS, SOURCE-ADDRESS and CHANGED-ADDRESS for classic
+  # STUN clients; ignored if auth.stun is enabled
+  legacy: false
+  # graceful shutdown on SIGTERM, SIGINT or /drain API request:
+  # new allocations are rejected, existing are relayed until they
+  # expire or timeout is reached
+  drain:
+    timeout: 5m
+  # zero-downtime binary upgrade: new process connects to unix socket
+  # of running one and inherits listening and relayed sockets with
+  # allocations and nonces, then old process exits
+  # upgrade:
+  #   socket: /run/gortcd/upgrade.sock
+  # periodically save allocations and nonces to file, so they are
+  # restored on same relayed ports after crash-restart; file is
+  # removed on clean shutdown
+  # snapshot:
+  #   path: /var/lib/gortcd/snapshot.json
+  #   interval: 10s
+  # new allocations are rejected if there are more allocations
+  # on listener; limit is applied to every listener separately,
+  # not limited if 0
+  # max_allocations: 10000
+  # cap of relayed bytes per second in each direction for every
+  # allocation, data that exceeds it is dropped; not limited if 0
+  # bandwidth: 1048576
+  # tenants with own settings, falling back to server-wide ones;
+  # realm of request is selected by REALM presented by client if
+  # known, then by ORIGIN attribute (RFC 8016), then by listener
+  # address, using default realm otherwise; credentials are set in
+  # auth.static and peer policies in filter.realms
+  # realms:
+  #   - name: customer.example.com
+  #     software: customer-turn
+  #     default_lifetime: 10m
+  #     max_lifetime: 1h
+  #     # quota per listener, 486 (Allocation Quota Reached) is
+  #     # returned if reached
+  #     max_allocations: 1000
+  #     bandwidth: 131072
+  #     listeners: [203.0.113.10:3478]
+  #     origins: [https://customer.example.com]
+  # allocations rejected during drain or overload are redirected
+  # to alternate server with 300 (Try Alternate), only if auth
+  # is not public; 508 (Insufficient Capacity) is returned otherwise
+  # redirect:
+  #   # "round-robin", "client-hash" or "least-loaded"
+  #   policy: round-robin
+  #   servers:
+  #     - 203.0.113.1:3478
+  #     - 203.0.113.2:3478
+  #   # management API stats endpoints of servers, same order,
+  #   # required for least-loaded policy
+  #   stats:
+  #     - http://203.0.113.1:3257/stats
+  #     - http://203.0.113.2:3257/stats
+  #   interval: 5s
+  # share allocations between relays behind anycast or ECMP: packets
+  # of client that land on node not holding its allocation are
+  # forwarded to owner node, that responds to client directly;
+  # relayed addresses should be unique per node
+  # cluster:
+  #   # unique node id, hostname is used if empty
+  #   id: relay-1
+  #   # address for packets forwarded between nodes
+  #   forward: 0.0.0.0:3479
+  #   # forwarding address that is reachable by other nodes,
+  #   # address of forward is used if empty; forwarded packets are
+  #   # accepted only from advertised addresses of nodes
+  #   advertise: 10.0.0.1:3479
+  #   # allocation ownership is shared via backend that is served
+  #   # by one of nodes, it should be reachable only by nodes
+  #   backend:
+  #     # serve backend on this node
+  #     listen: 10.0.0.1:3480
+  #     # or use backend served by another node
+  #     # url: http://10.0.0.1:3480
+  #     # shared secret of nodes, required; used as bearer token of
+  #     # backend requests and to authenticate forwarded packets
+  #     token: ""
+  #     # ownership lookups of remote backend are cached
+  #     cache: 1s
 
   # export pprof metrics
   # pprof: "localhost:3256"
@@ -34,7 +141,34 @@ server:
   # prometheus:
     # addr: "localhost:3255"
 
+  # trace STUN transactions
+  # trace:
+  #   # sampling rate, from 0 (disabled) to 1 (every transaction)
+  #   rate: 0.01
+  #   # "stdout" or "otlp" (OTLP/HTTP with JSON encoding)
+  #   exporter: otlp
+  #   otlp:
+  #     url: "http://localhost:4318/v1/traces"
+
 # Management API.
+# Endpoints:
+#   /reload  - reload configuration
+#   /capture - stream pcapng packet capture, e.g.
+#              /capture?client=10.0.0.0/8&duration=30s&size=10485760
+#              or /capture?allocation=1.2.3.4:5678 for single allocation
+#   /drain   - start graceful shutdown
+#   /stats   - allocation statistics in JSON, including per-realm usage
+#   /healthz - liveness probe, always 200 OK
+#   /readyz  - readiness probe, 503 if any listener is not serving or is
+#              draining, relay ports or workers are exhausted, or STUN
+#              Binding self-test from loopback fails (allow it in client
+#              filter)
+#   /blocklist/{client,peer} - temporary deny entries that are checked
+#              before filter rules, GET lists entries with hit counts,
+#              POST ?net=1.2.3.0/24&ttl=1h&reason=abuse adds entry (ttl is
+#              optional) and kills allocations of matching clients or with
+#              permissions for matching peers, DELETE ?net=1.2.3.0/24
+#              removes entry
 api:
   addr: "localhost:3257"
 
@@ -56,18 +190,87 @@ auth:
 #  static:
 #    - username: webrtc
 #      password: turnpassword
+#      policy: internal # optional peer filtering policy, see filter.policies
+
+# Accounting records, written when allocation ends.
+# accounting:
+#   # append records as JSON lines to file
+#   file: /var/log/gortcd/accounting.jsonl
+#   # send every record via HTTP POST as JSON
+#   webhook:
+#     url: "http://localhost:8080/accounting"
+#     timeout: 5s
+#     queue: 1024
+
+# Relayed addresses.
+# relay:
+#   # range of relayed ports, e.g. ports that are open in firewall;
+#   # ephemeral ports are used if not set
+#   min_port: 49152
+#   max_port: 65535
+#   # "on-demand" binds random free port of range on allocation,
+#   # trying at most 64 ports, so it can fail on nearly exhausted
+#   # range; "pool" binds all ports of range on start, per listener
+#   mode: on-demand
+#   # address to bind relayed ports on, listener address by default
+#   ip: 10.0.0.5
+#   # address of relayed ports advertised to clients, e.g. public
+#   # address of 1:1 NAT; "auto" discovers it by STUN Binding request
+#   # from relay ip to stun_server
+#   external_ip: 203.0.113.5
+#   stun_server: stun.example.org:3478
+#   stun_timeout: 5s
+#   # multiple relay addresses, in addition to ip
+#   addrs:
+#     - ip: 10.0.0.7
+#       external_ip: auto
+#   # selection of relay address for allocation: "round-robin",
+#   # "same-as-listener" or "least-used"
+#   policy: round-robin
+#   # per-listener overrides of relay addresses
+#   listeners:
+#     - listen: 10.0.0.6:3478
+#       ip: 10.0.0.6
+#       external_ip: 203.0.113.6
 
 filter:
+  # Prefix list files of rules are re-read on reload and when they are
+  # changed on disk, which is checked with this interval (0 disables).
+  watch_interval: 10s
   # Rules for filtering peer addresses (the target address of relayed data).
   # If address is filtered, the client will get 403 (Forbidden) error during
   # STUN transaction.
   peer:
     # Default filtering action, if no matches in rules.
     action: allow
+    # Named sets of addresses that are denied after rules, relayed data
+    # from and to them is also dropped. Available sets are "loopback",
+    # "private", "link-local" (incl. cloud metadata 169.254.169.254),
+    # "multicast", "unspecified", "broadcast" and "self" (listener and
+    # relay addresses of server). Relaying to internal networks is denied
+    # by default; to allow internal peers explicitly, add "allow" rules
+    # for them, that are checked before sets, e.g. with "net: 10.0.0.0/8"
+    # or "set: private" (see rules below), or remove "private" from this
+    # list.
+    deny: [loopback, private, link-local, multicast, unspecified, broadcast, self]
+    # Named sets that are allowed after rules.
+    # allow: []
   # Put here your filtering rules.
   #  rules:
   #    - action: deny # can be "allow", "deny", or "pass" (no-op).
   #      net: 127.0.0.1/32 # should be CIDR
+  #    - action: allow
+  #      set: private # named set instead of net
+  #    - action: deny
+  #      ports: 25 # any address if no net, set or file, requires ports or proto
+  #    - action: deny
+  #      file: /etc/gortcd/bogons.txt # one CIDR or IP per line, "#" comments
+  # Rules can be restricted to ports and transport protocol, e.g. to
+  # allow only UDP ports 1024-65535 on 10.0.0.0/8:
+  #    - action: allow
+  #      net: 10.0.0.0/8
+  #      ports: 1024-65535 # list is comma-separated, e.g. "80,443"
+  #      proto: udp # "udp" or "tcp", relayed transport is always udp
   # E.g. to allow only two networks, use following:
   # peer:
   #   action: deny
@@ -78,8 +281,27 @@ filter:
   #       action: allow
   # Attempts to relay data to address that is not in those networks
   # will result in 403 error.
+  # Blocklist entries are persisted to file if path is set:
+  # blocklist: /var/lib/gortcd/peer-blocklist.json
 
   client:
     # same as "peer" section, but for client addresses.
     action: allow
+
+  # Named peer filtering policies that are attached to credentials
+  # with "policy" key or to all users of realm. Rules of policy are
+  # checked before "peer" rules, so they can allow or deny addresses
+  # only for authenticated users of policy, e.g. to allow internal users
+  # relaying into 10.0.0.0/8 when "private" set is denied for others.
+  # Policy of user takes precedence over policy of realm.
+  # policies:
+  #   internal:
+  #     rules:
+  #       - action: allow
+  #         net: 10.0.0.0/8
+  #     # named sets are also supported
+  #     deny: [link-local]
+  # realms:
+  #   - realm: corp.example.org
+  #     policy: internal
 `
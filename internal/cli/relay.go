@@ -0,0 +1,256 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/stun"
+)
+
+// relayConfig is relayed addresses with per-listener overrides.
+type relayConfig struct {
+	defaults  []allocator.Relay // listener address if empty
+	listeners map[string][]allocator.Relay
+}
+
+func (c relayConfig) get(listener string) []allocator.Relay {
+	if r, ok := c.listeners[listener]; ok {
+		return r
+	}
+	return c.defaults
+}
+
+// sharePools initializes port pool for each relay address, sharing it
+// between listeners, and returns pools by relay ip.
+//
+// Idle ports that are passed from previous process are pooled instead of
+// binding new ones and are removed from idle, while ports of inherited
+// allocations are not bound, being adopted by pool on restore.
+func (c relayConfig) sharePools(
+	l *zap.Logger, o server.Options,
+	inherited map[string]inheritedListener, idle map[string][]*os.File,
+) (map[string]*allocator.SystemPortPooledAllocator, error) {
+	reserved := make(map[string][]int)
+	for _, i := range inherited {
+		for _, a := range i.state.Allocations {
+			key := a.RelayedAddr.IP.String()
+			reserved[key] = append(reserved[key], a.RelayedAddr.Port)
+		}
+	}
+	pools := make(map[string]*allocator.SystemPortPooledAllocator)
+	share := func(relays []allocator.Relay) error {
+		for i := range relays {
+			key := relays[i].IP.String()
+			if p, ok := pools[key]; ok {
+				relays[i].Ports = p
+				continue
+			}
+			poolLog := l.With(zap.String("relay", key))
+			p, err := allocator.NewSystemPortPooledAllocator(allocator.PooledOptions{
+				Log:       poolLog,
+				IP:        relays[i].IP,
+				MinPort:   o.MinPort,
+				MaxPort:   o.MaxPort,
+				Inherited: inheritedConns(poolLog, idle[key]),
+				Reserved:  reserved[key],
+			})
+			delete(idle, key)
+			if err != nil {
+				return fmt.Errorf("relay %s: %v", key, err)
+			}
+			pools[key] = p
+			relays[i].Ports = p
+		}
+		return nil
+	}
+	err := share(c.defaults)
+	for _, relays := range c.listeners {
+		if err != nil {
+			break
+		}
+		err = share(relays)
+	}
+	if err != nil {
+		for _, p := range pools {
+			_ = p.Close() // #nosec
+		}
+		return nil, err
+	}
+	return pools, nil
+}
+
+// inheritedConns returns connections of inherited files, closing them.
+func inheritedConns(l *zap.Logger, files []*os.File) []*net.UDPConn {
+	var conns []*net.UDPConn
+	for _, f := range files {
+		c, err := net.FilePacketConn(f)
+		if closeErr := f.Close(); closeErr != nil {
+			l.Warn("failed to close inherited file", zap.Error(closeErr))
+		}
+		if err != nil {
+			l.Warn("failed to inherit port", zap.Error(err))
+			continue
+		}
+		conn, ok := c.(*net.UDPConn)
+		if !ok {
+			_ = c.Close() // #nosec
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+type rawRelayAddr struct {
+	Listen     string `mapstructure:"listen"`
+	IP         string `mapstructure:"ip"`
+	ExternalIP string `mapstructure:"external_ip"`
+}
+
+func parseRelayPolicy(s string) (allocator.RelayPolicy, error) {
+	for _, p := range []allocator.RelayPolicy{
+		allocator.RelayRoundRobin,
+		allocator.RelaySameAsListener,
+		allocator.RelayLeastUsed,
+	} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown relay policy %q", s)
+}
+
+// getRelayConfig parses relayed addresses from configuration,
+// discovering external addresses that are set to "auto".
+func getRelayConfig(l *zap.Logger) (relayConfig, error) {
+	c := relayConfig{
+		listeners: make(map[string][]allocator.Relay),
+	}
+	var (
+		server  = viper.GetString("relay.stun_server")
+		timeout = viper.GetDuration("relay.stun_timeout")
+		rawAddr []rawRelayAddr
+	)
+	if err := viper.UnmarshalKey("relay.addrs", &rawAddr); err != nil {
+		return c, err
+	}
+	if ip := viper.GetString("relay.ip"); ip != "" {
+		rawAddr = append(rawAddr, rawRelayAddr{
+			IP:         ip,
+			ExternalIP: viper.GetString("relay.external_ip"),
+		})
+	}
+	for _, raw := range rawAddr {
+		r, err := parseRelay(l, raw, server, timeout)
+		if err != nil {
+			return c, err
+		}
+		c.defaults = append(c.defaults, r)
+	}
+	var rawListeners []rawRelayAddr
+	if err := viper.UnmarshalKey("relay.listeners", &rawListeners); err != nil {
+		return c, err
+	}
+	for _, raw := range rawListeners {
+		if raw.Listen == "" {
+			return c, errors.New("listen address is required for relay override")
+		}
+		r, err := parseRelay(l, raw, server, timeout)
+		if err != nil {
+			return c, fmt.Errorf("listener %s: %v", raw.Listen, err)
+		}
+		key := normalize(raw.Listen)
+		c.listeners[key] = append(c.listeners[key], r)
+	}
+	return c, nil
+}
+
+func parseIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad ip %q", s)
+	}
+	return ip, nil
+}
+
+func parseRelay(
+	l *zap.Logger, raw rawRelayAddr, server string, timeout time.Duration,
+) (allocator.Relay, error) {
+	var (
+		r   allocator.Relay
+		err error
+	)
+	if r.IP, err = parseIP(raw.IP); err != nil {
+		return r, err
+	}
+	if r.IP == nil {
+		return r, errors.New("relay ip is required")
+	}
+	if raw.ExternalIP != "auto" {
+		r.External, err = parseIP(raw.ExternalIP)
+		return r, err
+	}
+	if server == "" {
+		return r, errors.New("stun server is required for auto external ip")
+	}
+	if r.External, err = discoverExternalIP(server, r.IP, timeout); err != nil {
+		return r, fmt.Errorf("failed to discover external ip: %v", err)
+	}
+	l.Info("discovered external ip",
+		zap.Stringer("ip", r.IP),
+		zap.Stringer("external", r.External),
+	)
+	return r, nil
+}
+
+// discoverExternalIP returns mapped address of local ip from STUN Binding
+// request to server.
+func discoverExternalIP(server string, local net.IP, timeout time.Duration) (net.IP, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: local}, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // #nosec
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if _, err = conn.Write(req.Raw); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1024)
+	res := new(stun.Message)
+	for {
+		n, readErr := conn.Read(buf)
+		if readErr != nil {
+			return nil, readErr
+		}
+		res.Raw = buf[:n]
+		if decodeErr := res.Decode(); decodeErr != nil {
+			continue
+		}
+		if res.TransactionID != req.TransactionID {
+			continue
+		}
+		var mapped stun.XORMappedAddress
+		if getErr := mapped.GetFrom(res); getErr != nil {
+			return nil, getErr
+		}
+		return mapped.IP, nil
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/mitchellh/go-homedir"
@@ -25,25 +29,53 @@ import (
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
 
+	"github.com/gortc/gortcd/internal/accesslog"
+	"github.com/gortc/gortcd/internal/accounting"
+	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/cluster"
+	"github.com/gortc/gortcd/internal/discovery"
 	"github.com/gortc/gortcd/internal/filter"
 	"github.com/gortc/gortcd/internal/manage"
+	"github.com/gortc/gortcd/internal/mobility"
+	"github.com/gortc/gortcd/internal/redirect"
 	"github.com/gortc/gortcd/internal/reload"
 	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/gortcd/internal/snapshot"
+	"github.com/gortc/gortcd/internal/trace"
 	"github.com/gortc/ice"
 	"github.com/gortc/stun"
+	"github.com/gortc/turn"
 )
 
 // ListenUDPAndServe listens on laddr and process incoming packets.
 func ListenUDPAndServe(serverNet, laddr string, u *server.Updater) error {
+	return listenUDPAndServe(serverNet, laddr, u, nil, nil, nil)
+}
+
+// listenUDPAndServe is ListenUDPAndServe that binds relayed ports on
+// provided relays, uses inherited listener and restores its allocations
+// if provided, or restores allocations from snapshot otherwise.
+func listenUDPAndServe(
+	serverNet, laddr string, u *server.Updater, relays []allocator.Relay,
+	inherited *inheritedListener, snap *server.ListenerState,
+) error {
 	var (
 		c   net.PacketConn
 		err error
 	)
 	opt := u.Get()
-	if reuseport.Available() && opt.ReusePort {
+	opt.Relays = relays
+	switch {
+	case inherited != nil:
+		c, err = net.FilePacketConn(inherited.listener)
+		if closeErr := inherited.listener.Close(); closeErr != nil {
+			opt.Log.Warn("failed to close inherited listener file", zap.Error(closeErr))
+		}
+	case reuseport.Available() && opt.ReusePort:
 		c, err = reuseport.ListenPacket(serverNet, laddr)
-	} else {
+	default:
 		c, err = net.ListenPacket(serverNet, laddr)
 	}
 	if err != nil {
@@ -54,6 +86,14 @@ func ListenUDPAndServe(serverNet, laddr string, u *server.Updater) error {
 	if err != nil {
 		return err
 	}
+	switch {
+	case inherited != nil:
+		if err = s.Restore(inherited.state, inherited.files); err != nil {
+			return err
+		}
+	case snap != nil:
+		s.RestoreSnapshot(*snap, time.Now())
+	}
 	u.Subscribe(s)
 	return s.Serve()
 }
@@ -73,6 +113,7 @@ type staticCredElem struct {
 	Password string `mapstructure:"password"`
 	Key      string `mapstructure:"key"`
 	Realm    string `mapstructure:"realm"`
+	Policy   string `mapstructure:"policy"`
 }
 
 // getZapConfig decodes zap logging configuration from
@@ -138,10 +179,57 @@ func getZapConfig() (zap.Config, error) {
 	return raw.Server.Log, yaml.Unmarshal(buf, &raw)
 }
 
-func parseFilteringRules(parentLogger *zap.Logger, key string) (*filter.List, error) {
+func parseFilterAction(s string) (filter.Action, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return filter.Allow, nil
+	case "drop", "forbid", "deny", "block":
+		return filter.Deny, nil
+	case "pass", "none", "":
+		return filter.Pass, nil
+	default:
+		return filter.Pass, fmt.Errorf("unknown action %s", s)
+	}
+}
+
+// parseFilteringRules parses rules with default action, see parseRules.
+func parseFilteringRules(parentLogger *zap.Logger, key string, self *filter.Self, files ruleFiles) (*filter.List, error) {
 	l := parentLogger.Named(key)
+	rules, err := parseRules(l, key, self, files)
+	if err != nil {
+		return nil, err
+	}
+	defaultAction := filter.Allow
+	switch strings.ToLower(viper.GetString("filter." + key + ".action")) {
+	case "allow", "":
+		// Same as default.
+	case "drop", "forbid", "deny", "block":
+		defaultAction = filter.Deny
+	case "pass", "none":
+		return nil, errors.New("default action cannot be pass")
+	default:
+		return nil, errors.New("unknown default action")
+	}
+	l.Info("default action set", zap.Stringer("action", defaultAction))
+	f := filter.NewFilter(defaultAction, rules...)
+	return f, nil
+}
+
+// errBlankRule means that rule has no net, set, file, ports or proto,
+// which is probably a typo that would otherwise apply action to any
+// address.
+var errBlankRule = errors.New("rule should have net, set, file, ports or proto")
+
+// parseRules parses rules of "filter.<key>" section, followed by named
+// sets from "deny" and "allow" lists. Stamps of prefix list files are
+// added to files.
+func parseRules(l *zap.Logger, key string, self *filter.Self, files ruleFiles) ([]filter.Rule, error) {
 	type rawRuleItem struct {
 		Net    string `mapstructure:"net"`
+		Set    string `mapstructure:"set"`
+		File   string `mapstructure:"file"`
+		Ports  string `mapstructure:"ports"`
+		Proto  string `mapstructure:"proto"`
 		Action string `mapstructure:"action"`
 	}
 	var rawRules []rawRuleItem
@@ -149,71 +237,521 @@ func parseFilteringRules(parentLogger *zap.Logger, key string) (*filter.List, er
 		l.Error("failed to parse rules", zap.Error(keyErr))
 		return nil, keyErr
 	}
+	for _, action := range []string{"deny", "allow"} {
+		for _, set := range viper.GetStringSlice("filter." + key + "." + action) {
+			rawRules = append(rawRules, rawRuleItem{Set: set, Action: action})
+		}
+	}
 	var rules []filter.Rule
 	for _, rawRule := range rawRules {
+		action, actionErr := parseFilterAction(rawRule.Action)
+		if actionErr != nil {
+			l.Error("failed to parse action", zap.String("action", rawRule.Action))
+			return nil, actionErr
+		}
 		var (
-			action filter.Action
+			rule    filter.Rule
+			ruleErr error
 		)
-		switch strings.ToLower(rawRule.Action) {
-		case "allow":
-			action = filter.Allow
-		case "drop", "forbid", "deny", "block":
-			action = filter.Deny
-		case "pass", "none", "":
-			action = filter.Pass
+		switch {
+		case rawRule.Set != "":
+			if rule, ruleErr = filter.SetRule(action, rawRule.Set, self); ruleErr != nil {
+				l.Error("failed to parse set",
+					zap.Error(ruleErr), zap.Strings("available", filter.Sets()),
+				)
+				return nil, ruleErr
+			}
+		case rawRule.File != "":
+			files[rawRule.File] = stampOf(rawRule.File)
+			prefixes, loadErr := filter.LoadPrefixList(action, rawRule.File)
+			if loadErr != nil {
+				l.Error("failed to load prefix list", zap.Error(loadErr))
+				return nil, loadErr
+			}
+			l.Info("loaded prefix list",
+				zap.String("path", rawRule.File), zap.Int("prefixes", prefixes.Len()),
+			)
+			rule = prefixes
+		case rawRule.Net != "":
+			if rule, ruleErr = filter.StaticNetRule(action, rawRule.Net); ruleErr != nil {
+				l.Error("failed to parse subnet",
+					zap.Error(ruleErr), zap.String("net", rawRule.Net),
+				)
+				return nil, ruleErr
+			}
+		case rawRule.Ports != "" || rawRule.Proto != "":
+			// Any address, restricted by ports or proto below.
+			rule = filter.StaticRule(action)
 		default:
-			l.Error("failed to parse action", zap.String("action", rawRule.Action))
-			return nil, fmt.Errorf("unknown action %s", rawRule.Action)
-		}
-		rule, ruleErr := filter.StaticNetRule(action, rawRule.Net)
-		if ruleErr != nil {
-			l.Error("failed to parse subnet",
-				zap.Error(ruleErr), zap.String("net", rawRule.Net),
+			l.Error("rule without address should have ports or proto",
+				zap.String("action", rawRule.Action),
 			)
-			return nil, ruleErr
+			return nil, errBlankRule
+		}
+		var cond filter.Condition
+		if rawRule.Ports != "" {
+			if cond.Ports, ruleErr = filter.ParsePorts(rawRule.Ports); ruleErr != nil {
+				l.Error("failed to parse ports", zap.Error(ruleErr))
+				return nil, ruleErr
+			}
+		}
+		if rawRule.Proto != "" {
+			if cond.Proto, ruleErr = filter.ParseProto(rawRule.Proto); ruleErr != nil {
+				l.Error("failed to parse proto", zap.Error(ruleErr))
+				return nil, ruleErr
+			}
+		}
+		if len(cond.Ports) > 0 || cond.Proto != 0 {
+			rule = filter.Restrict(rule, cond)
 		}
 		l.Info("added rule",
 			zap.Stringer("action", action),
 			zap.String("net", rawRule.Net),
+			zap.String("set", rawRule.Set),
+			zap.String("file", rawRule.File),
+			zap.String("ports", rawRule.Ports),
+			zap.String("proto", rawRule.Proto),
 		)
 		rules = append(rules, rule)
 	}
-	defaultAction := filter.Allow
-	switch strings.ToLower(viper.GetString("filter." + key + ".action")) {
-	case "allow", "":
-		// Same as default.
-	case "drop", "forbid", "deny", "block":
-		defaultAction = filter.Deny
-	case "pass", "none":
-		return nil, errors.New("default action cannot be pass")
+	return rules, nil
+}
+
+// parsePeerPolicies parses named peer filtering policies from
+// "filter.policies" and attaches them to static credentials and to
+// realms from "filter.realms".
+func parsePeerPolicies(parentLogger *zap.Logger, self *filter.Self, files ruleFiles) ([]server.PeerPolicy, error) {
+	l := parentLogger.Named("policies")
+	rules := make(map[string]filter.Rule)
+	for name := range viper.GetStringMap("filter.policies") {
+		policyRules, err := parseRules(l.Named(name), "policies."+name, self, files)
+		if err != nil {
+			return nil, err
+		}
+		// Passed addresses are filtered by peer rules.
+		rules[name] = filter.NewFilter(filter.Pass, policyRules...)
+	}
+	getRule := func(name string) (filter.Rule, error) {
+		// Keys are case-insensitive.
+		r, ok := rules[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("policy %q not found", name)
+		}
+		return r, nil
+	}
+	var policies []server.PeerPolicy
+	var rawCredentials []staticCredElem
+	if keyErr := viper.UnmarshalKey("auth.static", &rawCredentials); keyErr != nil {
+		return nil, keyErr
+	}
+	for _, cred := range rawCredentials {
+		if cred.Policy == "" {
+			continue
+		}
+		if cred.Realm == "" {
+			cred.Realm = viper.GetString("server.realm")
+		}
+		r, err := getRule(cred.Policy)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("attached policy",
+			zap.String("policy", cred.Policy),
+			zap.String("username", cred.Username),
+			zap.String("realm", cred.Realm),
+		)
+		policies = append(policies, server.PeerPolicy{
+			Username: cred.Username,
+			Realm:    cred.Realm,
+			Rule:     r,
+		})
+	}
+	var rawRealms []struct {
+		Realm  string `mapstructure:"realm"`
+		Policy string `mapstructure:"policy"`
+	}
+	if keyErr := viper.UnmarshalKey("filter.realms", &rawRealms); keyErr != nil {
+		return nil, keyErr
+	}
+	for _, realm := range rawRealms {
+		r, err := getRule(realm.Policy)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("attached policy",
+			zap.String("policy", realm.Policy),
+			zap.String("realm", realm.Realm),
+		)
+		policies = append(policies, server.PeerPolicy{
+			Realm: realm.Realm,
+			Rule:  r,
+		})
+	}
+	return policies, nil
+}
+
+// parseRealms parses tenants from "server.realms".
+func parseRealms(l *zap.Logger) ([]server.Realm, error) {
+	var rawRealms []struct {
+		Name            string        `mapstructure:"name"`
+		Software        string        `mapstructure:"software"`
+		DefaultLifetime time.Duration `mapstructure:"default_lifetime"`
+		MaxLifetime     time.Duration `mapstructure:"max_lifetime"`
+		MaxAllocations  int           `mapstructure:"max_allocations"`
+		Bandwidth       int           `mapstructure:"bandwidth"`
+		Listeners       []string      `mapstructure:"listeners"`
+		Origins         []string      `mapstructure:"origins"`
+	}
+	if keyErr := viper.UnmarshalKey("server.realms", &rawRealms); keyErr != nil {
+		return nil, keyErr
+	}
+	realms := make([]server.Realm, 0, len(rawRealms))
+	for _, r := range rawRealms {
+		if r.Name == "" {
+			return nil, errors.New("blank realm name")
+		}
+		l.Info("realm",
+			zap.String("name", r.Name),
+			zap.Strings("listeners", r.Listeners),
+			zap.Strings("origins", r.Origins),
+		)
+		realms = append(realms, server.Realm{
+			Name:            r.Name,
+			Software:        r.Software,
+			DefaultLifetime: r.DefaultLifetime,
+			MaxLifetime:     r.MaxLifetime,
+			MaxAllocations:  r.MaxAllocations,
+			Bandwidth:       r.Bandwidth,
+			Listeners:       r.Listeners,
+			Origins:         r.Origins,
+		})
+	}
+	return realms, nil
+}
+
+// getAccountingSink initializes accounting sinks from configuration.
+func getAccountingSink(l *zap.Logger) (accounting.Sink, error) {
+	var sinks []accounting.Sink
+	if name := viper.GetString("accounting.file"); name != "" {
+		f, err := accounting.OpenFile(name)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("writing accounting records to file", zap.String("path", name))
+		sinks = append(sinks, f)
+	}
+	if u := viper.GetString("accounting.webhook.url"); u != "" {
+		l.Info("sending accounting records to webhook", zap.String("url", u))
+		sinks = append(sinks, accounting.NewWebhook(accounting.WebhookOptions{
+			Log:     l.Named("webhook"),
+			URL:     u,
+			Timeout: viper.GetDuration("accounting.webhook.timeout"),
+			Queue:   viper.GetInt("accounting.webhook.queue"),
+		}))
+	}
+	return accounting.Tee(sinks...), nil
+}
+
+// getTracer initializes tracer from configuration, returning nil
+// if tracing is disabled.
+func getTracer(l *zap.Logger) (*trace.Tracer, error) {
+	rate := viper.GetFloat64("server.trace.rate")
+	if rate <= 0 {
+		return nil, nil
+	}
+	var exporter trace.Exporter
+	switch e := viper.GetString("server.trace.exporter"); e {
+	case "stdout", "":
+		exporter = trace.NewWriter(os.Stdout)
+	case "otlp":
+		exporter = &trace.OTLP{
+			URL:     viper.GetString("server.trace.otlp.url"),
+			Service: viper.GetString("server.trace.service"),
+			Client:  &http.Client{Timeout: viper.GetDuration("server.trace.otlp.timeout")},
+		}
 	default:
-		return nil, errors.New("unknown default action")
+		return nil, fmt.Errorf("unknown trace exporter %s", e)
 	}
-	l.Info("default action set", zap.Stringer("action", defaultAction))
-	f := filter.NewFilter(defaultAction, rules...)
-	return f, nil
+	l.Info("tracing enabled",
+		zap.Float64("rate", rate),
+		zap.String("exporter", viper.GetString("server.trace.exporter")),
+	)
+	return trace.NewTracer(trace.Options{
+		Log:      l,
+		Exporter: exporter,
+		Rate:     rate,
+	}), nil
+}
+
+// getAccessLog initializes access log from configuration, returning nil
+// if access log is disabled.
+func getAccessLog(l *zap.Logger) (*accesslog.Logger, error) {
+	path := viper.GetString("server.access_log.path")
+	if path == "" {
+		return nil, nil
+	}
+	format, err := accesslog.ParseFormat(viper.GetString("server.access_log.format"))
+	if err != nil {
+		return nil, err
+	}
+	l.Info("writing access log", zap.String("path", path))
+	return accesslog.Open(path, accesslog.Options{
+		Log:    l,
+		Format: format,
+		Rate:   viper.GetFloat64("server.access_log.sampling"),
+		Queue:  viper.GetInt("server.access_log.queue"),
+	})
+}
+
+// getBlocklist initializes blocklist for "client" or "peer" addresses,
+// persisting it to file if path is set.
+func getBlocklist(l *zap.Logger, name string) (*filter.Blocklist, error) {
+	path := viper.GetString("filter." + name + ".blocklist")
+	if path != "" {
+		l.Info("persisting blocklist", zap.String("list", name), zap.String("path", path))
+	}
+	return filter.NewBlocklist(filter.BlocklistOptions{
+		Name: name,
+		Path: path,
+	})
 }
 
-func parseOptions(l *zap.Logger, o *server.Options) error {
+// parseOptions parses reloadable options, returning files that should
+// be watched for changes.
+func parseOptions(l *zap.Logger, o *server.Options) (ruleFiles, error) {
 	o.Realm = viper.GetString("server.realm")
 	o.Workers = viper.GetInt("server.workers")
 	o.AuthForSTUN = viper.GetBool("auth.stun")
+	o.Legacy = viper.GetBool("server.legacy")
 	o.Software = viper.GetString("server.software")
 	o.ReusePort = viper.GetBool("server.reuseport")
-	filterLog := l.Named("filter")
+	o.Bandwidth = viper.GetInt("server.bandwidth")
 	var parseErr error
-	if o.PeerRule, parseErr = parseFilteringRules(filterLog, "peer"); parseErr != nil {
+	if o.Realms, parseErr = parseRealms(l.Named("realms")); parseErr != nil {
+		l.Error("failed to parse realms", zap.Error(parseErr))
+		return nil, parseErr
+	}
+	filterLog := l.Named("filter")
+	files := make(ruleFiles)
+	if o.PeerRule, parseErr = parseFilteringRules(filterLog, "peer", o.Self, files); parseErr != nil {
 		l.Error("failed to parse peer rules", zap.Error(parseErr))
-		return parseErr
+		return nil, parseErr
 	}
-	if o.ClientRule, parseErr = parseFilteringRules(filterLog, "client"); parseErr != nil {
+	if o.ClientRule, parseErr = parseFilteringRules(filterLog, "client", o.Self, files); parseErr != nil {
 		l.Error("failed to parse client rules", zap.Error(parseErr))
-		return parseErr
+		return nil, parseErr
+	}
+	if o.PeerPolicies, parseErr = parsePeerPolicies(filterLog, o.Self, files); parseErr != nil {
+		l.Error("failed to parse peer policies", zap.Error(parseErr))
+		return nil, parseErr
 	}
 	if o.Software != "" {
 		l.Info("will be sending SOFTWARE attribute", zap.String("software", o.Software))
 	}
-	return nil
+	return files, nil
+}
+
+// getDiscovery initializes RFC 5780 NAT behavior discovery group from
+// configuration, returning nil if discovery is disabled.
+func getDiscovery(l *zap.Logger) (*discovery.Group, error) {
+	primary, alternate := viper.GetString("server.discovery.primary"), viper.GetString("server.discovery.alternate")
+	if primary == "" && alternate == "" {
+		return nil, nil
+	}
+	var addrs [2]turn.Addr
+	for i, v := range []string{primary, alternate} {
+		a, err := net.ResolveUDPAddr("udp", normalize(v))
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = turn.Addr{IP: a.IP, Port: a.Port}
+	}
+	g, err := discovery.NewGroup(addrs[0], addrs[1])
+	if err != nil {
+		return nil, err
+	}
+	l.Info("NAT behavior discovery enabled",
+		zap.Stringer("primary", addrs[0]),
+		zap.Stringer("alternate", addrs[1]),
+	)
+	return g, nil
+}
+
+// getMobility initializes RFC 8016 mobility ticket sealer from
+// configuration, returning nil if mobility is disabled.
+func getMobility(l *zap.Logger) (*mobility.Sealer, error) {
+	if !viper.GetBool("server.mobility.enabled") {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(viper.GetString("server.mobility.key"))
+	if err != nil {
+		return nil, fmt.Errorf("bad mobility key: %v", err)
+	}
+	if len(key) == 0 {
+		l.Warn("no key, tickets are valid only until restart")
+	}
+	l.Info("mobility enabled")
+	return mobility.NewSealer(key)
+}
+
+// getCluster initializes cluster node from configuration, returning nil
+// if clustering is disabled. Returned closers should be closed on
+// shutdown, after servers.
+func getCluster(l *zap.Logger) (*cluster.Node, []io.Closer, error) {
+	forward := viper.GetString("server.cluster.forward")
+	if forward == "" {
+		return nil, nil, nil
+	}
+	id := viper.GetString("server.cluster.id")
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, nil, err
+		}
+		id = hostname
+	}
+	var (
+		backend cluster.Backend
+		closers []io.Closer
+		listen  = viper.GetString("server.cluster.backend.listen")
+		url     = viper.GetString("server.cluster.backend.url")
+		token   = viper.GetString("server.cluster.backend.token")
+	)
+	if token == "" {
+		return nil, nil, errors.New("cluster backend token is required")
+	}
+	switch {
+	case listen != "" && url != "":
+		return nil, nil, errors.New("only one of cluster backend listen or url should be set")
+	case listen != "":
+		memory := cluster.NewMemory()
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		backendServer := &http.Server{Handler: cluster.NewBackendHandler(memory, token)}
+		go func() {
+			if serveErr := backendServer.Serve(ln); serveErr != nil && serveErr != http.ErrServerClosed {
+				l.Error("backend failed to serve", zap.Error(serveErr))
+			}
+		}()
+		l.Info("serving backend", zap.Stringer("addr", ln.Addr()))
+		backend = memory
+		closers = append(closers, backendServer)
+	case url != "":
+		remote := cluster.NewRemote(url, token)
+		remote.CacheTTL = viper.GetDuration("server.cluster.backend.cache")
+		backend = remote
+	default:
+		return nil, nil, errors.New("cluster backend listen or url is required")
+	}
+	closeAll := func(closers []io.Closer) {
+		for _, c := range closers {
+			if closeErr := c.Close(); closeErr != nil {
+				l.Warn("failed to close", zap.Error(closeErr))
+			}
+		}
+	}
+	conn, err := net.ListenPacket("udp", forward)
+	if err != nil {
+		closeAll(closers)
+		return nil, nil, err
+	}
+	node, err := cluster.NewNode(cluster.Options{
+		Log:     l,
+		ID:      id,
+		Backend: backend,
+		Conn:    conn,
+		Addr:    viper.GetString("server.cluster.advertise"),
+		Key:     []byte(token),
+	})
+	if err != nil {
+		closeAll(append([]io.Closer{conn}, closers...))
+		return nil, nil, err
+	}
+	l.Info("cluster node started",
+		zap.String("id", id),
+		zap.Stringer("forward", conn.LocalAddr()),
+	)
+	// Node leaves before backend is stopped.
+	return node, append([]io.Closer{node}, closers...), nil
+}
+
+// getRedirect initializes redirect policy from configuration, returning nil
+// if redirect is disabled.
+func getRedirect(l *zap.Logger) (redirect.Policy, error) {
+	var servers []turn.Addr
+	for _, v := range viper.GetStringSlice("server.redirect.servers") {
+		a, err := net.ResolveUDPAddr("udp", normalize(v))
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, turn.Addr{IP: a.IP, Port: a.Port})
+	}
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	policy := viper.GetString("server.redirect.policy")
+	l.Info("redirecting to alternate servers",
+		zap.String("policy", policy),
+		zap.Int("servers", len(servers)),
+	)
+	switch policy {
+	case "round-robin":
+		return redirect.RoundRobin(servers)
+	case "client-hash":
+		return redirect.ClientHash(servers)
+	case "least-loaded":
+		stats := viper.GetStringSlice("server.redirect.stats")
+		if len(stats) != len(servers) {
+			return nil, errors.New("redirect stats urls count should be equal to servers count")
+		}
+		targets := make([]redirect.Target, len(servers))
+		for i := range servers {
+			targets[i] = redirect.Target{Addr: servers[i], Stats: stats[i]}
+		}
+		return redirect.NewLeastLoaded(redirect.LeastLoadedOptions{
+			Log:      l,
+			Targets:  targets,
+			Interval: viper.GetDuration("server.redirect.interval"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown redirect policy %q", policy)
+	}
+}
+
+// drainer gracefully shuts down servers on SIGTERM, SIGINT or management
+// API request.
+type drainer struct {
+	log     *zap.Logger
+	u       *server.Updater
+	timeout time.Duration
+	once    sync.Once
+}
+
+// Notify starts graceful shutdown in background. Subsequent calls
+// are no-op.
+func (d *drainer) Notify() {
+	d.once.Do(func() {
+		d.log.Info("shutting down", zap.Duration("timeout", d.timeout))
+		go func() {
+			if err := d.u.Shutdown(d.timeout); err != nil {
+				d.log.Error("failed to shutdown", zap.Error(err))
+			}
+		}()
+	})
+}
+
+func (d *drainer) subscribe() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-c
+		d.Notify()
+		<-c
+		d.log.Warn("got second signal, exiting immediately")
+		os.Exit(1)
+	}()
 }
 
 var rootCmd = &cobra.Command{
@@ -301,17 +839,131 @@ var rootCmd = &cobra.Command{
 		o := server.Options{
 			Log:      l,
 			Registry: reg,
+			Self:     filter.NewSelf(),
 		}
 		if viper.GetBool("auth.public") {
 			l.Warn("auth is public")
 		} else {
 			o.Auth = auth.NewStatic(staticCredentials)
 		}
-		if parseErr := parseOptions(l, &o); parseErr != nil {
+		files, parseErr := parseOptions(l, &o)
+		if parseErr != nil {
 			l.Fatal("failed to parse", zap.Error(parseErr))
 		}
+		var blocklistErr error
+		if o.ClientBlocklist, blocklistErr = getBlocklist(l.Named("blocklist"), server.BlocklistClient); blocklistErr != nil {
+			l.Fatal("failed to initialize client blocklist", zap.Error(blocklistErr))
+		}
+		if o.PeerBlocklist, blocklistErr = getBlocklist(l.Named("blocklist"), server.BlocklistPeer); blocklistErr != nil {
+			l.Fatal("failed to initialize peer blocklist", zap.Error(blocklistErr))
+		}
+		reg.MustRegister(o.ClientBlocklist, o.PeerBlocklist)
+		accountingSink, accountingErr := getAccountingSink(l.Named("accounting"))
+		if accountingErr != nil {
+			l.Fatal("failed to initialize accounting", zap.Error(accountingErr))
+		}
+		o.Accounting = accountingSink
+		// Closing after all servers are shut down to flush pending records.
+		var closers []io.Closer
+		if c, ok := accountingSink.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+		tracer, tracerErr := getTracer(l.Named("trace"))
+		if tracerErr != nil {
+			l.Fatal("failed to initialize tracing", zap.Error(tracerErr))
+		}
+		if tracer != nil {
+			o.Tracer = tracer
+			closers = append(closers, tracer)
+		}
+		accessLog, accessLogErr := getAccessLog(l.Named("access"))
+		if accessLogErr != nil {
+			l.Fatal("failed to initialize access log", zap.Error(accessLogErr))
+		}
+		if accessLog != nil {
+			o.AccessLog = accessLog
+			closers = append(closers, accessLog)
+		}
+		redirectPolicy, redirectErr := getRedirect(l.Named("redirect"))
+		if redirectErr != nil {
+			l.Fatal("failed to initialize redirect", zap.Error(redirectErr))
+		}
+		if redirectPolicy != nil {
+			o.Redirect = redirectPolicy
+			if c, ok := redirectPolicy.(io.Closer); ok {
+				closers = append(closers, c)
+			}
+		}
+		discoveryGroup, discoveryErr := getDiscovery(l.Named("discovery"))
+		if discoveryErr != nil {
+			l.Fatal("failed to initialize NAT behavior discovery", zap.Error(discoveryErr))
+		}
+		o.Discovery = discoveryGroup
+		sealer, mobilityErr := getMobility(l.Named("mobility"))
+		if mobilityErr != nil {
+			l.Fatal("failed to initialize mobility", zap.Error(mobilityErr))
+		}
+		o.Mobility = sealer
+		clusterNode, clusterClosers, clusterErr := getCluster(l.Named("cluster"))
+		if clusterErr != nil {
+			l.Fatal("failed to initialize cluster", zap.Error(clusterErr))
+		}
+		o.Cluster = clusterNode
+		o.MaxAllocations = viper.GetInt("server.max_allocations")
+		o.MinPort = viper.GetInt("relay.min_port")
+		o.MaxPort = viper.GetInt("relay.max_port")
+		switch mode := viper.GetString("relay.mode"); mode {
+		case "on-demand":
+		case "pool":
+			o.PortPool = true
+		default:
+			l.Fatal("unknown relay mode", zap.String("mode", mode))
+		}
+		relayPolicy, policyErr := parseRelayPolicy(viper.GetString("relay.policy"))
+		if policyErr != nil {
+			l.Fatal("failed to parse relay policy", zap.Error(policyErr))
+		}
+		o.RelayPolicy = relayPolicy
+		relays, relayErr := getRelayConfig(l.Named("relay"))
+		if relayErr != nil {
+			l.Fatal("failed to parse relay config", zap.Error(relayErr))
+		}
+		// Requesting handoff before binding pools, so ports that are held
+		// by previous process are inherited.
+		upgradeSocket := viper.GetString("server.upgrade.socket")
+		inherited := make(map[string]inheritedListener)
+		idlePorts := make(map[string][]*os.File)
+		if upgradeSocket != "" {
+			inherited, idlePorts = requestHandoff(l.Named("upgrade"), upgradeSocket)
+		}
+		var pools map[string]*allocator.SystemPortPooledAllocator
+		if o.PortPool {
+			var poolErr error
+			pools, poolErr = relays.sharePools(l.Named("pool"), o, inherited, idlePorts)
+			if poolErr != nil {
+				l.Fatal("failed to initialize port pools", zap.Error(poolErr))
+			}
+			for _, p := range pools {
+				closers = append(closers, p)
+			}
+		}
+		for ip, files := range idlePorts {
+			l.Warn("inherited pool is not configured, dropping", zap.String("ip", ip))
+			closeFiles(l, files)
+		}
+		o.Capture = capture.NewHub()
 		u := server.NewUpdater(o)
 		n := reload.NewNotifier(l.Named("reload"))
+		w := &fileWatcher{log: l.Named("watch"), notifier: n, files: files}
+		if interval := viper.GetDuration("filter.watch_interval"); interval > 0 {
+			go w.run(interval)
+		}
+		d := &drainer{
+			log:     l.Named("drain"),
+			u:       u,
+			timeout: viper.GetDuration("server.drain.timeout"),
+		}
+		d.subscribe()
 		go func() {
 			for range n.C {
 				l.Info("trying to update config")
@@ -320,20 +972,28 @@ var rootCmd = &cobra.Command{
 					continue
 				}
 				l.Info("config read", zap.String("path", viper.ConfigFileUsed()))
-				newOptions := server.Options{
-					Log:      l,
-					Registry: reg,
-				}
-				if parseErr := parseOptions(l, &newOptions); parseErr != nil {
+				// Keeping non-reloadable options like accounting or tracing.
+				newOptions := o
+				newFiles, parseErr := parseOptions(l, &newOptions)
+				if parseErr != nil {
 					l.Error("failed to parse config", zap.Error(parseErr))
 					continue
 				}
 				u.Set(newOptions)
+				w.set(newFiles)
 				l.Info("config updated")
 			}
 		}()
 		if apiAddr := viper.GetString("api.addr"); len(apiAddr) != 0 {
-			m := manage.NewManager(l.Named("api"), n)
+			m := manage.NewManager(manage.Options{
+				Log:       l.Named("api"),
+				Notifier:  n,
+				Capture:   o.Capture,
+				Ready:     u,
+				Drain:     d,
+				Stats:     u,
+				Blocklist: u,
+			})
 			go func() {
 				l.Info("api listening", zap.String("addr", apiAddr))
 				if listenErr := http.ListenAndServe(apiAddr, m); listenErr != nil {
@@ -345,8 +1005,41 @@ var rootCmd = &cobra.Command{
 			}()
 		}
 
+		snapshotPath := viper.GetString("server.snapshot.path")
+		var snap snapshot.Snapshot
+		if snapshotPath != "" && len(inherited) == 0 {
+			snap = readSnapshot(l.Named("snapshot"), snapshotPath)
+		}
+		takeSnapshot := func(addr string) *server.ListenerState {
+			st, ok := snap.Listener(addr)
+			if !ok {
+				return nil
+			}
+			return &st
+		}
+		takeInherited := func(addr string) *inheritedListener {
+			i, ok := inherited[addr]
+			if !ok {
+				return nil
+			}
+			delete(inherited, addr)
+			return &i
+		}
+		listen := viper.GetStringSlice("server.listen")
+		for _, a := range discoveryGroup.Addrs() {
+			// Listening on all addresses of discovery group.
+			listened := false
+			for _, addr := range listen {
+				if normalize(addr) == a.String() {
+					listened = true
+				}
+			}
+			if !listened {
+				listen = append(listen, a.String())
+			}
+		}
 		wg := new(sync.WaitGroup)
-		for _, addr := range viper.GetStringSlice("server.listen") {
+		for _, addr := range listen {
 			l.Info("got addr", zap.String("addr", addr))
 			normalized := normalize(addr)
 			if strings.HasPrefix(normalized, "0.0.0.0") {
@@ -369,16 +1062,17 @@ var rootCmd = &cobra.Command{
 					}
 					l.Warn("using", zap.Stringer("a", a))
 					wg.Add(1)
-					go func(addr string) {
+					listenAddr := strings.Replace(normalized, "0.0.0.0", a.IP.String(), -1)
+					go func(addr string, i *inheritedListener, st *server.ListenerState) {
 						defer wg.Done()
 						l.Info("gortc/gortcd listening",
 							zap.String("addr", addr),
 							zap.String("network", "udp"),
 						)
-						if lErr := ListenUDPAndServe("udp", addr, u); lErr != nil {
+						if lErr := listenUDPAndServe("udp", addr, u, relays.get(addr), i, st); lErr != nil {
 							l.Fatal("failed to listen", zap.Error(lErr))
 						}
-					}(strings.Replace(normalized, "0.0.0.0", a.IP.String(), -1))
+					}(listenAddr, takeInherited(listenAddr), takeSnapshot(listenAddr))
 				}
 			} else {
 				l.Info("gortc/gortcd listening",
@@ -386,15 +1080,46 @@ var rootCmd = &cobra.Command{
 					zap.String("network", "udp"),
 				)
 				wg.Add(1)
+				i, st := takeInherited(normalized), takeSnapshot(normalized)
 				go func() {
 					defer wg.Done()
-					if logErr = ListenUDPAndServe("udp", normalized, u); logErr != nil {
+					if logErr = listenUDPAndServe("udp", normalized, u, relays.get(normalized), i, st); logErr != nil {
 						l.Fatal("failed to listen", zap.Error(logErr))
 					}
 				}()
 			}
 		}
+		for addr, i := range inherited {
+			l.Warn("inherited listener is not configured, dropping", zap.String("addr", addr))
+			i.close(l)
+		}
+		var snapWriter *snapshot.Writer
+		if snapshotPath != "" {
+			snapWriter = snapshot.NewWriter(snapshot.Options{
+				Log:      l.Named("snapshot"),
+				Name:     snapshotPath,
+				Source:   u,
+				Interval: viper.GetDuration("server.snapshot.interval"),
+			})
+			closers = append(closers, snapWriter)
+		}
+		if upgradeSocket != "" {
+			h, handoffErr := serveHandoff(l.Named("upgrade"), upgradeSocket, u, d, pools, snapWriter)
+			if handoffErr != nil {
+				l.Error("failed to listen for upgrade", zap.Error(handoffErr))
+			} else {
+				l.Info("listening for upgrade", zap.String("socket", upgradeSocket))
+				closers = append([]io.Closer{h}, closers...)
+			}
+		}
 		wg.Wait()
+		closers = append(closers, clusterClosers...)
+		for _, c := range closers {
+			if closeErr := c.Close(); closeErr != nil {
+				l.Error("failed to close", zap.Error(closeErr))
+			}
+		}
+		l.Info("stopped")
 	},
 }
 
@@ -488,6 +1213,21 @@ func init() {
 	viper.SetDefault("auth.stun", false)
 	viper.SetDefault("version", "1")
 	viper.SetDefault("server.reuseport", true)
+	viper.SetDefault("server.trace.service", "gortcd")
+	viper.SetDefault("server.trace.otlp.url", "http://localhost:4318/v1/traces")
+	viper.SetDefault("server.trace.otlp.timeout", "5s")
+	viper.SetDefault("server.drain.timeout", "5m")
+	viper.SetDefault("server.redirect.policy", "round-robin")
+	viper.SetDefault("server.redirect.interval", "5s")
+	viper.SetDefault("server.snapshot.interval", "10s")
+	viper.SetDefault("server.cluster.backend.cache", "1s")
+	viper.SetDefault("relay.mode", "on-demand")
+	viper.SetDefault("filter.peer.deny", []string{
+		"loopback", "private", "link-local", "multicast", "unspecified", "broadcast", "self",
+	})
+	viper.SetDefault("filter.watch_interval", "10s")
+	viper.SetDefault("relay.policy", "round-robin")
+	viper.SetDefault("relay.stun_timeout", "5s")
 }
 
 // Execute starts root command.
@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/turn"
+)
+
+func TestParseRules(t *testing.T) {
+	var (
+		private = turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 25}
+		public  = turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 25}
+		http    = turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 80}
+	)
+	for _, tc := range []struct {
+		Name   string
+		Rule   map[string]interface{}
+		Err    bool
+		Addr   turn.Addr
+		Action filter.Action
+	}{
+		{
+			Name:   "Net",
+			Rule:   map[string]interface{}{"action": "deny", "net": "10.0.0.0/8"},
+			Addr:   private,
+			Action: filter.Deny,
+		},
+		{
+			Name:   "NetMiss",
+			Rule:   map[string]interface{}{"action": "deny", "net": "10.0.0.0/8"},
+			Addr:   public,
+			Action: filter.Pass,
+		},
+		{
+			Name:   "Set",
+			Rule:   map[string]interface{}{"action": "allow", "set": "private"},
+			Addr:   private,
+			Action: filter.Allow,
+		},
+		{
+			Name:   "Ports",
+			Rule:   map[string]interface{}{"action": "deny", "ports": "25"},
+			Addr:   public,
+			Action: filter.Deny,
+		},
+		{
+			Name:   "PortsMiss",
+			Rule:   map[string]interface{}{"action": "deny", "ports": "25"},
+			Addr:   http,
+			Action: filter.Pass,
+		},
+		{
+			Name:   "Proto",
+			Rule:   map[string]interface{}{"action": "allow", "proto": "udp"},
+			Addr:   http,
+			Action: filter.Allow,
+		},
+		{
+			Name: "Blank",
+			Rule: map[string]interface{}{"action": "deny"},
+			Err:  true,
+		},
+		{
+			Name: "BadNet",
+			Rule: map[string]interface{}{"action": "deny", "net": "10.0.0.0/33"},
+			Err:  true,
+		},
+		{
+			Name: "BadPorts",
+			Rule: map[string]interface{}{"action": "deny", "ports": "80-"},
+			Err:  true,
+		},
+		{
+			Name: "BadAction",
+			Rule: map[string]interface{}{"action": "reject", "net": "10.0.0.0/8"},
+			Err:  true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			viper.Reset()
+			defer viper.Reset()
+			viper.Set("filter.peer.rules", []interface{}{tc.Rule})
+			rules, err := parseRules(zap.NewNop(), "peer", filter.NewSelf(), make(ruleFiles))
+			if tc.Err {
+				if err == nil {
+					t.Fatal("should error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 1 {
+				t.Fatalf("unexpected rules count %d", len(rules))
+			}
+			if a := filter.ActionFor(rules[0], tc.Addr, turn.ProtoUDP); a != tc.Action {
+				t.Errorf("%s != %s", a, tc.Action)
+			}
+		})
+	}
+	t.Run("BlankError", func(t *testing.T) {
+		viper.Reset()
+		defer viper.Reset()
+		viper.Set("filter.peer.rules", []interface{}{
+			map[string]interface{}{"action": "allow"},
+		})
+		if _, err := parseRules(zap.NewNop(), "peer", filter.NewSelf(), make(ruleFiles)); err != errBlankRule {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/handoff"
+	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/gortcd/internal/snapshot"
+)
+
+// inheritedListener is listener with allocations received from previous
+// process during binary upgrade.
+type inheritedListener struct {
+	state    server.ListenerState
+	listener *os.File
+	files    []*os.File // passed to Server.Restore
+}
+
+func closeFiles(l *zap.Logger, files []*os.File) {
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			l.Warn("failed to close file", zap.Error(err))
+		}
+	}
+}
+
+func (i inheritedListener) close(l *zap.Logger) {
+	closeFiles(l, append([]*os.File{i.listener}, i.files...))
+}
+
+// requestHandoff receives listeners from previous process that listens
+// on unix socket path, returning them by address, and files of idle ports
+// of shared port pools by pool ip.
+func requestHandoff(l *zap.Logger, path string) (map[string]inheritedListener, map[string][]*os.File) {
+	var (
+		inherited = make(map[string]inheritedListener)
+		idle      = make(map[string][]*os.File)
+	)
+	data, files, err := handoff.Request(path)
+	if err != nil {
+		l.Info("no process to upgrade from", zap.Error(err))
+		return inherited, idle
+	}
+	var st server.HandoffState
+	if err = json.Unmarshal(data, &st); err != nil || st.Version != server.HandoffVersion {
+		l.Error("failed to decode handoff state",
+			zap.Int("v", st.Version),
+			zap.Error(err),
+		)
+		closeFiles(l, files)
+		return inherited, idle
+	}
+	for _, listener := range st.Listeners {
+		n := 1 + listener.Sockets + len(listener.Allocations)
+		if len(files) < n {
+			l.Error("not enough files in handoff", zap.String("addr", listener.Addr))
+			closeFiles(l, files)
+			return inherited, idle
+		}
+		inherited[listener.Addr] = inheritedListener{
+			state:    listener,
+			listener: files[0],
+			files:    files[1:n],
+		}
+		files = files[n:]
+	}
+	for _, pool := range st.Pools {
+		if len(files) < pool.Ports {
+			l.Error("not enough files in handoff", zap.String("pool", pool.IP))
+			break
+		}
+		idle[pool.IP] = files[:pool.Ports]
+		files = files[pool.Ports:]
+	}
+	closeFiles(l, files)
+	l.Info("inherited listeners", zap.Int("n", len(inherited)), zap.Int("pools", len(idle)))
+	return inherited, idle
+}
+
+// serveHandoff passes all listeners and idle ports of shared pools to new
+// process on request and then shuts down remaining ones. Snapshot writer
+// is detached, because new process writes snapshots to the same file.
+func serveHandoff(
+	l *zap.Logger, path string, u *server.Updater, d *drainer,
+	pools map[string]*allocator.SystemPortPooledAllocator, snap *snapshot.Writer,
+) (*handoff.Listener, error) {
+	h, err := handoff.Listen(path, l, func() ([]byte, []*os.File, error) {
+		snap.Detach()
+		// Detaching pools after listeners, so ports of allocations are
+		// not idle.
+		st, files := u.Detach()
+		for ip, p := range pools {
+			idle := p.Detach()
+			st.Pools = append(st.Pools, server.PoolState{IP: ip, Ports: len(idle)})
+			files = append(files, idle...)
+		}
+		data, err := json.Marshal(st)
+		if err != nil {
+			closeFiles(l, files)
+			return nil, nil, err
+		}
+		return data, files, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-h.Done()
+		d.Notify()
+	}()
+	return h, nil
+}
+
+// readSnapshot reads allocations snapshot written before crash, returning
+// blank snapshot if there is none.
+func readSnapshot(l *zap.Logger, path string) snapshot.Snapshot {
+	snap, err := snapshot.Read(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			l.Info("no snapshot to restore")
+		} else {
+			l.Error("failed to read snapshot", zap.Error(err))
+		}
+		return snapshot.Snapshot{}
+	}
+	l.Info("restoring snapshot",
+		zap.Time("t", snap.Time),
+		zap.Int("listeners", len(snap.Listeners)),
+	)
+	return snap
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileStamp is modification time and size of file, zero if file does
+// not exist.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func stampOf(name string) fileStamp {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{mod: info.ModTime(), size: info.Size()}
+}
+
+// ruleFiles are stamps of files that filtering rules are loaded from,
+// taken before reading them.
+type ruleFiles map[string]fileStamp
+
+// fileWatcher requests config reload if any of watched files is changed
+// on disk. Files are polled instead of using inotify, so changes made
+// by replacing symlinks, e.g. in mounted kubernetes config maps, are
+// also detected.
+type fileWatcher struct {
+	log      *zap.Logger
+	notifier interface{ Notify() }
+	mux      sync.Mutex
+	files    ruleFiles
+}
+
+// set replaces watched files.
+func (w *fileWatcher) set(files ruleFiles) {
+	w.mux.Lock()
+	w.files = files
+	w.mux.Unlock()
+}
+
+// check requests reload if any of files is changed.
+func (w *fileWatcher) check() {
+	w.mux.Lock()
+	changed := false
+	for name, stamp := range w.files {
+		current := stampOf(name)
+		if current.mod.Equal(stamp.mod) && current.size == stamp.size {
+			continue
+		}
+		w.log.Info("file changed", zap.String("path", name))
+		// Updating stamp, so failed reload is not retried on every check.
+		w.files[name] = current
+		changed = true
+	}
+	w.mux.Unlock()
+	if changed {
+		w.notifier.Notify()
+	}
+}
+
+// run checks files with provided interval, blocking forever.
+func (w *fileWatcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.check()
+	}
+}
@@ -0,0 +1,44 @@
+// Package cluster implements sharing of allocation ownership between
+// relays behind anycast or ECMP, where packets of client can land on node
+// that does not hold its allocation.
+//
+// Each node has local Allocator shard and forwards packets of allocations
+// owned by other nodes to them, while owners respond to clients directly.
+// Forwarded packets are authenticated by HMAC with shared key and are
+// accepted only from registered forwarding addresses of nodes.
+// Relayed addresses should be unique per node, so peers reach owners
+// without forwarding.
+//
+// Memory backend can be shared between nodes on different hosts by serving
+// it with NewBackendHandler on one of them, while other nodes use Remote.
+// Replicated backends (e.g. on top of raft or gossip) can be plugged in via
+// Backend interface.
+package cluster
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+// ErrOwned means that allocation is owned by another node.
+var ErrOwned = errors.New("allocation is owned by another node")
+
+// Backend stores allocation ownership and node addresses shared between
+// cluster nodes.
+type Backend interface {
+	// Register sets forwarding address of node.
+	Register(node, addr string) error
+	// Addr returns forwarding address of node.
+	Addr(node string) (string, bool)
+	// Claim sets node as owner of allocation for tuple until provided time,
+	// returning ErrOwned if it is owned by another node.
+	Claim(tuple turn.FiveTuple, node string, until time.Time) error
+	// Owner returns node that owns allocation for tuple at provided time.
+	Owner(tuple turn.FiveTuple, at time.Time) (string, bool)
+	// Release removes ownership of node for tuple.
+	Release(tuple turn.FiveTuple, node string) error
+	// Leave removes node and all its ownership.
+	Leave(node string) error
+}
@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1001},
+		Server: turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478},
+		Proto:  turn.ProtoUDP,
+	}
+	now := time.Now()
+	if err := m.Claim(tuple, "a", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Claim(tuple, "b", now.Add(time.Minute)); err != ErrOwned {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if owner, ok := m.Owner(tuple, now); !ok || owner != "a" {
+		t.Fatalf("unexpected owner %q", owner)
+	}
+	if _, ok := m.Owner(tuple, now.Add(time.Hour)); ok {
+		t.Error("ownership should expire")
+	}
+	if err := m.Release(tuple, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Owner(tuple, now); !ok {
+		t.Error("should not be released by non-owner")
+	}
+	if err := m.Leave("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Owner(tuple, now); ok {
+		t.Error("should be released on leave")
+	}
+	if err := m.Claim(tuple, "b", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardEncoding(t *testing.T) {
+	server := turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478}
+	client := turn.Addr{IP: net.ParseIP("2001:db8::1"), Port: 50123}
+	key := []byte("key")
+	b := encodeForward(nil, key, "a", server, client, []byte("data"))
+	node, gotServer, gotClient, data, err := decodeForward(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "a" {
+		t.Errorf("unexpected node %q", node)
+	}
+	if !gotServer.Equal(server) || !gotClient.Equal(client) {
+		t.Errorf("unexpected addresses %s, %s", gotServer, gotClient)
+	}
+	if !bytes.Equal(data, []byte("data")) {
+		t.Errorf("unexpected data %q", data)
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, _, _, err = decodeForward(b[:i], key); err == nil {
+			t.Errorf("should fail on %d bytes", i)
+		}
+	}
+	if _, _, _, _, err = decodeForward(b, []byte("other")); err != errBadMAC {
+		t.Errorf("unexpected error with other key: %v", err)
+	}
+	b[len(b)-forwardMACSize-1] ^= 1
+	if _, _, _, _, err = decodeForward(b, key); err != errBadMAC {
+		t.Errorf("unexpected error on modified packet: %v", err)
+	}
+}
+
+type handlerFunc func(client turn.Addr, data []byte)
+
+func (f handlerFunc) HandleForwarded(client turn.Addr, data []byte) { f(client, data) }
+
+func newNode(t *testing.T, id string, b Backend) *Node {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNode(Options{ID: id, Backend: b, Conn: conn, Key: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNode_Route(t *testing.T) {
+	b := NewMemory()
+	a, c := newNode(t, "a", b), newNode(t, "c", b)
+	defer c.Close()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1001},
+		Server: turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478},
+		Proto:  turn.ProtoUDP,
+	}
+	got := make(chan string, 1)
+	a.Handle(tuple.Server, handlerFunc(func(client turn.Addr, data []byte) {
+		if !client.Equal(tuple.Client) {
+			t.Errorf("unexpected client %s", client)
+		}
+		got <- string(data)
+	}))
+	if c.Route(tuple, []byte("hello")) {
+		t.Fatal("unclaimed tuple should not be routed")
+	}
+	if err := a.Claim(tuple, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if a.Route(tuple, []byte("hello")) {
+		t.Fatal("owned tuple should not be routed")
+	}
+	if !c.Route(tuple, []byte("hello")) {
+		t.Fatal("tuple should be routed to owner")
+	}
+	select {
+	case data := <-got:
+		if data != "hello" {
+			t.Errorf("unexpected data %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+	t.Run("Spoofed", func(t *testing.T) {
+		attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer attacker.Close()
+		aAddr, _ := b.Addr("a")
+		raddr, err := net.ResolveUDPAddr("udp", aAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range [][]byte{
+			// Valid MAC, but source is not registered address of "c".
+			encodeForward(nil, []byte("key"), "c", tuple.Server, tuple.Client, []byte("spoofed")),
+			// Unknown key.
+			encodeForward(nil, []byte("bad"), "c", tuple.Server, tuple.Client, []byte("spoofed")),
+		} {
+			if _, err = attacker.WriteTo(p, raddr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Valid packet to check that spoofed ones were dropped.
+		if !c.Route(tuple, []byte("valid")) {
+			t.Fatal("tuple should be routed to owner")
+		}
+		select {
+		case data := <-got:
+			if data != "valid" {
+				t.Errorf("unexpected data %q", data)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+	})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Route(tuple, []byte("hello")) {
+		t.Error("should not route to closed node")
+	}
+	if _, err := NewNode(Options{ID: "d", Backend: b, Conn: a.conn}); err == nil {
+		t.Error("should fail without key")
+	}
+	var nilNode *Node
+	if nilNode.Route(tuple, nil) || nilNode.Claim(tuple, time.Now()) != nil {
+		t.Error("nil node should not route")
+	}
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/gortc/turn"
+)
+
+// Forwarded packet format:
+//
+//	magic "GRTF" | version | node id length | node id |
+//	server ip length | server ip | server port |
+//	client ip length | client ip | client port | payload | mac
+//
+// Where node id is identifier of sending node and mac is HMAC-SHA256 of
+// all preceding bytes, keyed by shared cluster key.
+const (
+	forwardVersion = 2
+	forwardMagic   = "GRTF"
+	forwardMACSize = sha256.Size
+)
+
+var (
+	errBadForward = errors.New("malformed forwarded packet")
+	errBadMAC     = errors.New("bad MAC of forwarded packet")
+)
+
+func appendAddr(b []byte, a turn.Addr) []byte {
+	ip := a.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b = append(b, byte(len(ip)))
+	b = append(b, ip...)
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+func forwardMAC(key, b []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(b) // #nosec
+	return h.Sum(nil)
+}
+
+func encodeForward(b, key []byte, node string, server, client turn.Addr, data []byte) []byte {
+	b = append(b[:0], forwardMagic...)
+	b = append(b, forwardVersion, byte(len(node)))
+	b = append(b, node...)
+	b = appendAddr(b, server)
+	b = appendAddr(b, client)
+	b = append(b, data...)
+	return append(b, forwardMAC(key, b)...)
+}
+
+func readAddr(b []byte) (turn.Addr, []byte, error) {
+	if len(b) < 1 {
+		return turn.Addr{}, nil, errBadForward
+	}
+	n := int(b[0])
+	if n != net.IPv4len && n != net.IPv6len || len(b) < 1+n+2 {
+		return turn.Addr{}, nil, errBadForward
+	}
+	a := turn.Addr{
+		IP:   net.IP(b[1 : 1+n]),
+		Port: int(binary.BigEndian.Uint16(b[1+n:])),
+	}
+	return a, b[1+n+2:], nil
+}
+
+// decodeForward decodes forwarded packet, checking its MAC with key.
+// Returned values are referencing b.
+func decodeForward(b, key []byte) (node string, server, client turn.Addr, data []byte, err error) {
+	if len(b) < len(forwardMagic)+2+forwardMACSize || string(b[:len(forwardMagic)]) != forwardMagic {
+		return node, server, client, nil, errBadForward
+	}
+	if b[len(forwardMagic)] != forwardVersion {
+		return node, server, client, nil, errBadForward
+	}
+	mac := b[len(b)-forwardMACSize:]
+	b = b[:len(b)-forwardMACSize]
+	if !hmac.Equal(mac, forwardMAC(key, b)) {
+		return node, server, client, nil, errBadMAC
+	}
+	b = b[len(forwardMagic)+1:]
+	n := int(b[0])
+	if len(b) < 1+n {
+		return node, server, client, nil, errBadForward
+	}
+	node = string(b[1 : 1+n])
+	b = b[1+n:]
+	if server, b, err = readAddr(b); err != nil {
+		return node, server, client, nil, err
+	}
+	if client, b, err = readAddr(b); err != nil {
+		return node, server, client, nil, err
+	}
+	return node, server, client, b, nil
+}
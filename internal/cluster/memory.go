@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+type ownership struct {
+	node  string
+	until time.Time
+}
+
+// Memory is in-process Backend that can be shared between nodes in same
+// process, e.g. in tests.
+type Memory struct {
+	mux    sync.RWMutex
+	nodes  map[string]string
+	owners map[string]ownership
+}
+
+// NewMemory initializes and returns new Memory backend.
+func NewMemory() *Memory {
+	return &Memory{
+		nodes:  make(map[string]string),
+		owners: make(map[string]ownership),
+	}
+}
+
+// Register implements Backend.
+func (m *Memory) Register(node, addr string) error {
+	m.mux.Lock()
+	m.nodes[node] = addr
+	m.mux.Unlock()
+	return nil
+}
+
+// Addr implements Backend.
+func (m *Memory) Addr(node string) (string, bool) {
+	m.mux.RLock()
+	addr, ok := m.nodes[node]
+	m.mux.RUnlock()
+	return addr, ok
+}
+
+// Claim implements Backend.
+func (m *Memory) Claim(tuple turn.FiveTuple, node string, until time.Time) error {
+	key := tuple.String()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	o, ok := m.owners[key]
+	if ok && o.node != node && o.until.After(time.Now()) {
+		return ErrOwned
+	}
+	m.owners[key] = ownership{node: node, until: until}
+	return nil
+}
+
+// Owner implements Backend.
+func (m *Memory) Owner(tuple turn.FiveTuple, at time.Time) (string, bool) {
+	m.mux.RLock()
+	o, ok := m.owners[tuple.String()]
+	m.mux.RUnlock()
+	if !ok || !o.until.After(at) {
+		return "", false
+	}
+	return o.node, true
+}
+
+// Release implements Backend.
+func (m *Memory) Release(tuple turn.FiveTuple, node string) error {
+	key := tuple.String()
+	m.mux.Lock()
+	if o, ok := m.owners[key]; ok && o.node == node {
+		delete(m.owners, key)
+	}
+	m.mux.Unlock()
+	return nil
+}
+
+// Leave implements Backend.
+func (m *Memory) Leave(node string) error {
+	m.mux.Lock()
+	delete(m.nodes, node)
+	for key, o := range m.owners {
+		if o.node == node {
+			delete(m.owners, key)
+		}
+	}
+	m.mux.Unlock()
+	return nil
+}
@@ -0,0 +1,322 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gortc/turn"
+)
+
+// Handler handles packets that were forwarded from other nodes.
+type Handler interface {
+	// HandleForwarded handles data that was received from client on
+	// listener of another node. Data is valid only during call.
+	HandleForwarded(client turn.Addr, data []byte)
+}
+
+// Options contain possible settings for Node.
+type Options struct {
+	Log     *zap.Logger
+	ID      string // unique node identifier
+	Backend Backend
+	// Conn is used to exchange forwarded packets between nodes, its
+	// local address is registered in Backend as forwarding address.
+	Conn net.PacketConn
+	// Addr is forwarding address that is reachable by other nodes, e.g.
+	// if Conn listens on all interfaces. Local address of Conn if empty.
+	// Packets are forwarded from Conn, so other nodes should see Addr
+	// as their source address.
+	Addr string
+	// Key is shared secret of cluster that authenticates forwarded
+	// packets, required.
+	Key []byte
+}
+
+// Node is cluster member that holds local shard of allocations and
+// forwards packets of allocations that are owned by other nodes.
+//
+// Nil Node is valid and does not forward anything.
+type Node struct {
+	log      *zap.Logger
+	id       string
+	backend  Backend
+	conn     net.PacketConn
+	key      []byte
+	mux      sync.RWMutex
+	handlers map[string]Handler
+	claimed  map[string]time.Time // tuples claimed by node, until
+	lookups  map[string]bool      // pending ownership lookups
+	wg       sync.WaitGroup
+}
+
+// maxLookups limits count of concurrent ownership lookups.
+const maxLookups = 64
+
+// ownerCache is optional interface of Backend that caches ownership
+// lookups, e.g. Remote, so they are done by Node in background and only
+// cached results are used on packet receive.
+type ownerCache interface {
+	caching() bool
+	cachedOwner(tuple turn.FiveTuple, at time.Time) (node string, found, ok bool)
+	cachedAddr(node string, at time.Time) (string, bool)
+}
+
+// NewNode registers node in backend and starts receiving forwarded packets.
+func NewNode(o Options) (*Node, error) {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if len(o.Key) == 0 {
+		return nil, errors.New("key is required")
+	}
+	if o.ID == "" || len(o.ID) > 255 {
+		return nil, errors.New("id should be from 1 to 255 bytes")
+	}
+	if o.Addr == "" {
+		o.Addr = o.Conn.LocalAddr().String()
+	}
+	if err := o.Backend.Register(o.ID, o.Addr); err != nil {
+		return nil, err
+	}
+	n := &Node{
+		log:      o.Log.With(zap.String("node", o.ID)),
+		id:       o.ID,
+		backend:  o.Backend,
+		conn:     o.Conn,
+		key:      o.Key,
+		handlers: make(map[string]Handler),
+		claimed:  make(map[string]time.Time),
+		lookups:  make(map[string]bool),
+	}
+	n.wg.Add(1)
+	go n.loop()
+	return n, nil
+}
+
+// ID returns node identifier.
+func (n *Node) ID() string {
+	if n == nil {
+		return ""
+	}
+	return n.id
+}
+
+// Handle sets handler for packets forwarded to listener with server address.
+func (n *Node) Handle(server turn.Addr, h Handler) {
+	if n == nil {
+		return
+	}
+	n.mux.Lock()
+	n.handlers[server.String()] = h
+	n.mux.Unlock()
+}
+
+// Remove removes handler for server address.
+func (n *Node) Remove(server turn.Addr) {
+	if n == nil {
+		return
+	}
+	n.mux.Lock()
+	delete(n.handlers, server.String())
+	n.mux.Unlock()
+}
+
+// Claim sets node as owner of allocation for tuple until provided time.
+func (n *Node) Claim(tuple turn.FiveTuple, until time.Time) error {
+	if n == nil {
+		return nil
+	}
+	if err := n.backend.Claim(tuple, n.id, until); err != nil {
+		return err
+	}
+	now := time.Now()
+	n.mux.Lock()
+	if len(n.claimed) >= maxCachedOwners {
+		for k, v := range n.claimed {
+			if !v.After(now) {
+				delete(n.claimed, k)
+			}
+		}
+	}
+	n.claimed[tuple.String()] = until
+	n.mux.Unlock()
+	return nil
+}
+
+// Release removes ownership of allocation for tuple.
+func (n *Node) Release(tuple turn.FiveTuple) {
+	if n == nil {
+		return
+	}
+	n.mux.Lock()
+	delete(n.claimed, tuple.String())
+	n.mux.Unlock()
+	if err := n.backend.Release(tuple, n.id); err != nil {
+		n.log.Warn("failed to release", zap.Stringer("tuple", tuple), zap.Error(err))
+	}
+}
+
+// Route forwards data to node that owns allocation for tuple, returning
+// false if data should be processed locally.
+//
+// Tuples claimed by node are processed locally without backend lookups.
+// If backend caches lookups, Route does not block on them: on cache miss
+// lookup is started in background and data is processed locally, so
+// only first packets of tuple owned by another node can be misrouted,
+// e.g. retransmitted requests are forwarded.
+func (n *Node) Route(tuple turn.FiveTuple, data []byte) bool {
+	if n == nil {
+		return false
+	}
+	now := time.Now()
+	n.mux.RLock()
+	until, claimed := n.claimed[tuple.String()]
+	n.mux.RUnlock()
+	if claimed && until.After(now) {
+		return false
+	}
+	owner, addr, ok := n.resolve(tuple, now)
+	if !ok {
+		return false
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		n.log.Warn("failed to resolve", zap.String("owner", owner), zap.Error(err))
+		return false
+	}
+	buf := encodeForward(make([]byte, 0, len(data)+128), n.key, n.id, tuple.Server, tuple.Client, data)
+	if _, err = n.conn.WriteTo(buf, raddr); err != nil {
+		n.log.Warn("failed to forward", zap.String("owner", owner), zap.Error(err))
+	}
+	return true
+}
+
+// resolve returns owner of tuple and its forwarding address, false if
+// tuple is not owned by another node or owner is unknown yet.
+func (n *Node) resolve(tuple turn.FiveTuple, now time.Time) (owner, addr string, ok bool) {
+	c, isCache := n.backend.(ownerCache)
+	if !isCache || !c.caching() {
+		if owner, ok = n.backend.Owner(tuple, now); !ok || owner == n.id {
+			return "", "", false
+		}
+		if addr, ok = n.backend.Addr(owner); !ok {
+			n.log.Warn("no address for node", zap.String("owner", owner))
+		}
+		return owner, addr, ok
+	}
+	owner, found, cached := c.cachedOwner(tuple, now)
+	if !cached {
+		n.lookup(tuple)
+		return "", "", false
+	}
+	if !found || owner == n.id {
+		return "", "", false
+	}
+	if addr, ok = c.cachedAddr(owner, now); !ok {
+		n.lookup(tuple)
+		return "", "", false
+	}
+	return owner, addr, true
+}
+
+// lookup starts background lookup of tuple owner and its address, so
+// results are cached by backend.
+func (n *Node) lookup(tuple turn.FiveTuple) {
+	key := tuple.String()
+	n.mux.Lock()
+	if n.lookups[key] || len(n.lookups) >= maxLookups {
+		n.mux.Unlock()
+		return
+	}
+	n.lookups[key] = true
+	n.mux.Unlock()
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if owner, ok := n.backend.Owner(tuple, time.Now()); ok && owner != n.id {
+			if _, ok = n.backend.Addr(owner); !ok {
+				n.log.Warn("no address for node", zap.String("owner", owner))
+			}
+		}
+		n.mux.Lock()
+		delete(n.lookups, key)
+		n.mux.Unlock()
+	}()
+}
+
+// registered reports whether addr is forwarding address of node in
+// backend.
+func (n *Node) registered(node string, addr net.Addr) bool {
+	if node == n.id {
+		return false
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	registered, ok := n.backend.Addr(node)
+	if !ok {
+		return false
+	}
+	raddr, err := net.ResolveUDPAddr("udp", registered)
+	if err != nil {
+		return false
+	}
+	return raddr.Port == udpAddr.Port && raddr.IP.Equal(udpAddr.IP)
+}
+
+func (n *Node) loop() {
+	defer n.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		read, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				n.log.Warn("readFrom failed", zap.Error(err))
+			}
+			return
+		}
+		node, server, client, data, err := decodeForward(buf[:read], n.key)
+		if err != nil {
+			n.log.Debug("failed to decode", zap.Stringer("addr", addr), zap.Error(err))
+			continue
+		}
+		if !n.registered(node, addr) {
+			n.log.Debug("source is not registered",
+				zap.String("from", node), zap.Stringer("addr", addr),
+			)
+			continue
+		}
+		n.mux.RLock()
+		h, ok := n.handlers[server.String()]
+		n.mux.RUnlock()
+		if !ok {
+			// Only packets for local listeners are handled, see Handle.
+			if ce := n.log.Check(zapcore.DebugLevel, "no handler"); ce != nil {
+				ce.Write(zap.Stringer("server", server))
+			}
+			continue
+		}
+		h.HandleForwarded(client, data)
+	}
+}
+
+// Close stops receiving forwarded packets and removes node with all its
+// ownership from backend.
+func (n *Node) Close() error {
+	if n == nil {
+		return nil
+	}
+	err := n.backend.Leave(n.id)
+	if closeErr := n.conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	n.wg.Wait()
+	return err
+}
@@ -0,0 +1,355 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+// Backend operations of HTTP protocol between Remote and NewBackendHandler.
+const (
+	opRegister = "register"
+	opAddr     = "addr"
+	opClaim    = "claim"
+	opOwner    = "owner"
+	opRelease  = "release"
+	opLeave    = "leave"
+)
+
+type backendRequest struct {
+	Op    string          `json:"op"`
+	Node  string          `json:"node,omitempty"`
+	Addr  string          `json:"addr,omitempty"`
+	Tuple *turn.FiveTuple `json:"tuple,omitempty"`
+	Time  time.Time       `json:"time,omitempty"`
+}
+
+type backendResponse struct {
+	Node  string    `json:"node,omitempty"`
+	Addr  string    `json:"addr,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+	Found bool      `json:"found,omitempty"`
+	Owned bool      `json:"owned,omitempty"` // ErrOwned
+	Error string    `json:"error,omitempty"`
+}
+
+// ownerUntil is optional interface of Backend that returns ownership
+// expiration, so Remote can cache it.
+type ownerUntil interface {
+	ownerUntil(tuple turn.FiveTuple, at time.Time) (string, time.Time, bool)
+}
+
+func (m *Memory) ownerUntil(tuple turn.FiveTuple, at time.Time) (string, time.Time, bool) {
+	m.mux.RLock()
+	o, ok := m.owners[tuple.String()]
+	m.mux.RUnlock()
+	if !ok || !o.until.After(at) {
+		return "", time.Time{}, false
+	}
+	return o.node, o.until, true
+}
+
+// backendHandler serves Backend for Remote clients.
+type backendHandler struct {
+	backend Backend
+	token   string
+}
+
+// NewBackendHandler returns http.Handler that serves backend to Remote
+// backends of other nodes, e.g. Memory on one of nodes. Requests should
+// have "Authorization: Bearer <token>" header if token is not empty.
+func NewBackendHandler(b Backend, token string) http.Handler {
+	return &backendHandler{backend: b, token: token}
+}
+
+func (h *backendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if h.token != "" && r.Header.Get("Authorization") != "Bearer "+h.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req backendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var (
+		res backendResponse
+		err error
+	)
+	switch req.Op {
+	case opRegister:
+		err = h.backend.Register(req.Node, req.Addr)
+	case opAddr:
+		res.Addr, res.Found = h.backend.Addr(req.Node)
+	case opLeave:
+		err = h.backend.Leave(req.Node)
+	case opClaim, opOwner, opRelease:
+		if req.Tuple == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Op {
+		case opClaim:
+			err = h.backend.Claim(*req.Tuple, req.Node, req.Time)
+		case opRelease:
+			err = h.backend.Release(*req.Tuple, req.Node)
+		default:
+			if o, ok := h.backend.(ownerUntil); ok {
+				res.Node, res.Until, res.Found = o.ownerUntil(*req.Tuple, req.Time)
+			} else {
+				res.Node, res.Found = h.backend.Owner(*req.Tuple, req.Time)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err == ErrOwned {
+		res.Owned = true
+	} else if err != nil {
+		res.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// DefaultCacheTTL is default duration for which Remote caches ownership
+// lookups.
+const DefaultCacheTTL = time.Second
+
+// DefaultOwnerTimeout is default timeout of ownership lookups by Remote.
+const DefaultOwnerTimeout = time.Millisecond * 500
+
+// maxCachedOwners limits count of cached ownership lookups, expired ones
+// are pruned when reached.
+const maxCachedOwners = 1 << 16
+
+type cachedOwner struct {
+	node    string
+	found   bool
+	expires time.Time
+}
+
+type cachedAddr struct {
+	addr    string
+	expires time.Time
+}
+
+// Remote is Backend that is served by NewBackendHandler on another host,
+// so ownership can be shared between nodes on different hosts.
+//
+// Ownership lookups are done for every packet received by node, so
+// results are cached for CacheTTL, and positive ones no longer than
+// ownership is valid. Cached entries for tuple are dropped on local Claim
+// and Release. Node does lookups in background if cache is enabled.
+type Remote struct {
+	URL      string // e.g. http://10.0.0.1:3480
+	Token    string // optional bearer token
+	Client   *http.Client
+	CacheTTL time.Duration // DefaultCacheTTL if zero, negative disables cache
+	// OwnerTimeout limits ownership lookups that should be fast,
+	// DefaultOwnerTimeout if zero.
+	OwnerTimeout time.Duration
+
+	mux    sync.Mutex
+	owners map[string]cachedOwner
+	addrs  map[string]cachedAddr
+}
+
+// NewRemote initializes and returns new Remote backend.
+func NewRemote(url, token string) *Remote {
+	return &Remote{
+		URL:    url,
+		Token:  token,
+		Client: &http.Client{Timeout: time.Second * 5},
+	}
+}
+
+func (r *Remote) do(req backendRequest) (backendResponse, error) {
+	return r.doTimeout(req, 0)
+}
+
+// doTimeout performs request with timeout if it is positive, in addition
+// to timeout of Client.
+func (r *Remote) doTimeout(req backendRequest, timeout time.Duration) (backendResponse, error) {
+	var res backendResponse
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		httpReq = httpReq.WithContext(ctx)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return res, err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return res, errors.New("unexpected status: " + httpRes.Status)
+	}
+	if err = json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+		return res, err
+	}
+	if res.Owned {
+		return res, ErrOwned
+	}
+	if res.Error != "" {
+		return res, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+func (r *Remote) ttl() time.Duration {
+	if r.CacheTTL == 0 {
+		return DefaultCacheTTL
+	}
+	return r.CacheTTL
+}
+
+func (r *Remote) ownerTimeout() time.Duration {
+	if r.OwnerTimeout == 0 {
+		return DefaultOwnerTimeout
+	}
+	return r.OwnerTimeout
+}
+
+func (r *Remote) caching() bool { return r.ttl() > 0 }
+
+func (r *Remote) cachedOwner(tuple turn.FiveTuple, at time.Time) (string, bool, bool) {
+	r.mux.Lock()
+	c, ok := r.owners[tuple.String()]
+	r.mux.Unlock()
+	if !ok || !c.expires.After(at) {
+		return "", false, false
+	}
+	return c.node, c.found, true
+}
+
+func (r *Remote) cachedAddr(node string, at time.Time) (string, bool) {
+	r.mux.Lock()
+	c, ok := r.addrs[node]
+	r.mux.Unlock()
+	if !ok || !c.expires.After(at) {
+		return "", false
+	}
+	return c.addr, true
+}
+
+func (r *Remote) invalidate(tuple turn.FiveTuple) {
+	r.mux.Lock()
+	delete(r.owners, tuple.String())
+	r.mux.Unlock()
+}
+
+// Register implements Backend.
+func (r *Remote) Register(node, addr string) error {
+	_, err := r.do(backendRequest{Op: opRegister, Node: node, Addr: addr})
+	return err
+}
+
+// Addr implements Backend.
+func (r *Remote) Addr(node string) (string, bool) {
+	now := time.Now()
+	ttl := r.ttl()
+	if addr, ok := r.cachedAddr(node, now); ok {
+		return addr, true
+	}
+	res, err := r.do(backendRequest{Op: opAddr, Node: node})
+	if err != nil || !res.Found {
+		return "", false
+	}
+	if ttl > 0 {
+		r.mux.Lock()
+		if r.addrs == nil {
+			r.addrs = make(map[string]cachedAddr)
+		}
+		r.addrs[node] = cachedAddr{addr: res.Addr, expires: now.Add(ttl)}
+		r.mux.Unlock()
+	}
+	return res.Addr, true
+}
+
+// Claim implements Backend.
+func (r *Remote) Claim(tuple turn.FiveTuple, node string, until time.Time) error {
+	r.invalidate(tuple)
+	_, err := r.do(backendRequest{Op: opClaim, Node: node, Tuple: &tuple, Time: until})
+	return err
+}
+
+// Owner implements Backend. Backend errors are treated as no owner, so
+// packets are processed locally.
+func (r *Remote) Owner(tuple turn.FiveTuple, at time.Time) (string, bool) {
+	key := tuple.String()
+	ttl := r.ttl()
+	if ttl > 0 {
+		if node, found, ok := r.cachedOwner(tuple, at); ok {
+			return node, found
+		}
+	}
+	res, err := r.doTimeout(backendRequest{Op: opOwner, Tuple: &tuple, Time: at}, r.ownerTimeout())
+	if err != nil {
+		return "", false
+	}
+	if ttl > 0 {
+		c := cachedOwner{node: res.Node, found: res.Found, expires: at.Add(ttl)}
+		if res.Found && !res.Until.IsZero() && res.Until.Before(c.expires) {
+			c.expires = res.Until
+		}
+		r.mux.Lock()
+		if len(r.owners) >= maxCachedOwners {
+			for k, v := range r.owners {
+				if !v.expires.After(at) {
+					delete(r.owners, k)
+				}
+			}
+		}
+		if r.owners == nil || len(r.owners) >= maxCachedOwners {
+			r.owners = make(map[string]cachedOwner)
+		}
+		r.owners[key] = c
+		r.mux.Unlock()
+	}
+	return res.Node, res.Found
+}
+
+// Release implements Backend.
+func (r *Remote) Release(tuple turn.FiveTuple, node string) error {
+	r.invalidate(tuple)
+	_, err := r.do(backendRequest{Op: opRelease, Node: node, Tuple: &tuple})
+	return err
+}
+
+// Leave implements Backend.
+func (r *Remote) Leave(node string) error {
+	r.mux.Lock()
+	delete(r.addrs, node)
+	r.owners = nil
+	r.mux.Unlock()
+	_, err := r.do(backendRequest{Op: opLeave, Node: node})
+	return err
+}
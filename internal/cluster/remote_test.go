@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+func TestRemote(t *testing.T) {
+	memory := NewMemory()
+	s := httptest.NewServer(NewBackendHandler(memory, "secret"))
+	defer s.Close()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1001},
+		Server: turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478},
+		Proto:  turn.ProtoUDP,
+	}
+	now := time.Now()
+	a, b := NewRemote(s.URL, "secret"), NewRemote(s.URL, "secret")
+	if err := a.Register("a", "10.0.0.2:3479"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := b.Addr("a"); !ok || addr != "10.0.0.2:3479" {
+		t.Errorf("unexpected addr %q", addr)
+	}
+	if _, ok := b.Addr("c"); ok {
+		t.Error("unknown node should not be found")
+	}
+	if err := a.Claim(tuple, "a", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Claim(tuple, "b", now.Add(time.Minute)); err != ErrOwned {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if owner, ok := b.Owner(tuple, now); !ok || owner != "a" {
+		t.Fatalf("unexpected owner %q", owner)
+	}
+	t.Run("Cache", func(t *testing.T) {
+		// Changing ownership directly in backend, so b has stale cache.
+		if err := memory.Release(tuple, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if owner, ok := b.Owner(tuple, now); !ok || owner != "a" {
+			t.Errorf("cached owner expected, got %q", owner)
+		}
+		if _, ok := b.Owner(tuple, now.Add(DefaultCacheTTL)); ok {
+			t.Error("cache should expire")
+		}
+		if err := a.Claim(tuple, "a", now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := b.Owner(tuple, now.Add(DefaultCacheTTL)); ok {
+			t.Error("negative result should be cached")
+		}
+		// Dropping cache on local release.
+		if err := b.Release(tuple, "b"); err != nil {
+			t.Fatal(err)
+		}
+		if owner, ok := b.Owner(tuple, now.Add(DefaultCacheTTL)); !ok || owner != "a" {
+			t.Errorf("unexpected owner %q", owner)
+		}
+	})
+	if err := a.Leave("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := memory.Owner(tuple, now); ok {
+		t.Error("should be released on leave")
+	}
+	t.Run("Unauthorized", func(t *testing.T) {
+		r := NewRemote(s.URL, "")
+		if err := r.Register("c", "10.0.0.3:3479"); err == nil {
+			t.Error("should fail")
+		}
+		if _, ok := r.Owner(tuple, now); ok {
+			t.Error("should not be found")
+		}
+	})
+}
+
+func TestNode_RouteRemote(t *testing.T) {
+	s := httptest.NewServer(NewBackendHandler(NewMemory(), ""))
+	defer s.Close()
+	a, c := newNode(t, "a", NewRemote(s.URL, "")), newNode(t, "c", NewRemote(s.URL, ""))
+	defer a.Close()
+	defer c.Close()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1001},
+		Server: turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478},
+		Proto:  turn.ProtoUDP,
+	}
+	got := make(chan string, 1)
+	a.Handle(tuple.Server, handlerFunc(func(client turn.Addr, data []byte) {
+		got <- string(data)
+	}))
+	if err := a.Claim(tuple, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if a.Route(tuple, []byte("hello")) {
+		t.Fatal("claimed tuple should not be routed")
+	}
+	if len(a.lookups) != 0 {
+		t.Error("claimed tuple should not be looked up")
+	}
+	if c.Route(tuple, []byte("hello")) {
+		t.Fatal("tuple should not be routed before lookup")
+	}
+	// Lookup is done in background.
+	routed := false
+	for i := 0; i < 100 && !routed; i++ {
+		time.Sleep(time.Millisecond * 10)
+		routed = c.Route(tuple, []byte("hello"))
+	}
+	if !routed {
+		t.Fatal("tuple should be routed to owner")
+	}
+	select {
+	case data := <-got:
+		if data != "hello" {
+			t.Errorf("unexpected data %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func TestRemote_OwnerTimeout(t *testing.T) {
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+	r := NewRemote(s.URL, "")
+	r.OwnerTimeout = time.Millisecond * 50
+	start := time.Now()
+	if _, ok := r.Owner(turn.FiveTuple{}, start); ok {
+		t.Error("should not be found")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lookup took %s", d)
+	}
+}
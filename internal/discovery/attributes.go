@@ -0,0 +1,243 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gortc/stun"
+)
+
+// Attributes from RFC 5780 NAT Behavior Discovery.
+const (
+	AttrChangeRequest  stun.AttrType = 0x0003 // CHANGE-REQUEST
+	AttrPadding        stun.AttrType = 0x0026 // PADDING
+	AttrResponsePort   stun.AttrType = 0x0027 // RESPONSE-PORT
+	AttrResponseOrigin stun.AttrType = 0x802b // RESPONSE-ORIGIN
+	AttrOtherAddress   stun.AttrType = 0x802c // OTHER-ADDRESS
+)
+
+// Attributes from RFC 3489 that are superseded by RESPONSE-ORIGIN and
+// OTHER-ADDRESS.
+const (
+	AttrSourceAddress  stun.AttrType = 0x0004 // SOURCE-ADDRESS
+	AttrChangedAddress stun.AttrType = 0x0005 // CHANGED-ADDRESS
+)
+
+// Flags of CHANGE-REQUEST attribute.
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+const (
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// ErrBadLength means that attribute value has unexpected length.
+var ErrBadLength = errors.New("bad attribute length")
+
+// ChangeRequest represents CHANGE-REQUEST attribute, requesting server
+// to send response from alternate IP address and/or port.
+//
+// RFC 5780 Section 7.2
+type ChangeRequest struct {
+	ChangeIP   bool
+	ChangePort bool
+}
+
+// AddTo adds CHANGE-REQUEST to message.
+func (c ChangeRequest) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	if c.ChangeIP {
+		v[3] |= changeIP
+	}
+	if c.ChangePort {
+		v[3] |= changePort
+	}
+	m.Add(AttrChangeRequest, v)
+	return nil
+}
+
+// GetFrom decodes CHANGE-REQUEST from message.
+func (c *ChangeRequest) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrChangeRequest)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return ErrBadLength
+	}
+	c.ChangeIP = v[3]&changeIP != 0
+	c.ChangePort = v[3]&changePort != 0
+	return nil
+}
+
+// ResponsePort represents RESPONSE-PORT attribute, requesting server to
+// send response to that port of client address.
+//
+// RFC 5780 Section 7.5
+type ResponsePort int
+
+// AddTo adds RESPONSE-PORT to message.
+func (p ResponsePort) AddTo(m *stun.Message) error {
+	v := make([]byte, 4) // 2 bytes of padding
+	binary.BigEndian.PutUint16(v, uint16(p))
+	m.Add(AttrResponsePort, v)
+	return nil
+}
+
+// GetFrom decodes RESPONSE-PORT from message.
+func (p *ResponsePort) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrResponsePort)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return ErrBadLength
+	}
+	*p = ResponsePort(binary.BigEndian.Uint16(v))
+	return nil
+}
+
+// ResponseOrigin represents RESPONSE-ORIGIN attribute, the address from
+// which response is sent.
+//
+// RFC 5780 Section 7.3
+type ResponseOrigin struct {
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds RESPONSE-ORIGIN to message.
+func (a *ResponseOrigin) AddTo(m *stun.Message) error {
+	return addAddr(m, AttrResponseOrigin, a.IP, a.Port)
+}
+
+// GetFrom decodes RESPONSE-ORIGIN from message.
+func (a *ResponseOrigin) GetFrom(m *stun.Message) (err error) {
+	a.IP, a.Port, err = getAddr(m, AttrResponseOrigin)
+	return err
+}
+
+func (a ResponseOrigin) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// OtherAddress represents OTHER-ADDRESS attribute, the address that
+// differs from address of listener by both IP and port.
+//
+// RFC 5780 Section 7.4
+type OtherAddress struct {
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds OTHER-ADDRESS to message.
+func (a *OtherAddress) AddTo(m *stun.Message) error {
+	return addAddr(m, AttrOtherAddress, a.IP, a.Port)
+}
+
+// GetFrom decodes OTHER-ADDRESS from message.
+func (a *OtherAddress) GetFrom(m *stun.Message) (err error) {
+	a.IP, a.Port, err = getAddr(m, AttrOtherAddress)
+	return err
+}
+
+func (a OtherAddress) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// SourceAddress represents RFC 3489 SOURCE-ADDRESS attribute, the address
+// from which response is sent.
+//
+// RFC 3489 Section 11.2.5
+type SourceAddress struct {
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds SOURCE-ADDRESS to message.
+func (a *SourceAddress) AddTo(m *stun.Message) error {
+	return addAddr(m, AttrSourceAddress, a.IP, a.Port)
+}
+
+// GetFrom decodes SOURCE-ADDRESS from message.
+func (a *SourceAddress) GetFrom(m *stun.Message) (err error) {
+	a.IP, a.Port, err = getAddr(m, AttrSourceAddress)
+	return err
+}
+
+func (a SourceAddress) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// ChangedAddress represents RFC 3489 CHANGED-ADDRESS attribute, the
+// address from which response would be sent if both IP and port were
+// changed by CHANGE-REQUEST.
+//
+// RFC 3489 Section 11.2.3
+type ChangedAddress struct {
+	IP   net.IP
+	Port int
+}
+
+// AddTo adds CHANGED-ADDRESS to message.
+func (a *ChangedAddress) AddTo(m *stun.Message) error {
+	return addAddr(m, AttrChangedAddress, a.IP, a.Port)
+}
+
+// GetFrom decodes CHANGED-ADDRESS from message.
+func (a *ChangedAddress) GetFrom(m *stun.Message) (err error) {
+	a.IP, a.Port, err = getAddr(m, AttrChangedAddress)
+	return err
+}
+
+func (a ChangedAddress) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// addAddr adds attribute in MAPPED-ADDRESS format.
+func addAddr(m *stun.Message, t stun.AttrType, ip net.IP, port int) error {
+	family := byte(familyIPv4)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if len(ip) == net.IPv6len {
+		family = familyIPv6
+	} else {
+		return stun.ErrBadIPLength
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(port))
+	copy(v[4:], ip)
+	m.Add(t, v)
+	return nil
+}
+
+// getAddr decodes attribute in MAPPED-ADDRESS format.
+func getAddr(m *stun.Message, t stun.AttrType) (net.IP, int, error) {
+	v, err := m.Get(t)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(v) < 4 {
+		return nil, 0, ErrBadLength
+	}
+	ipLen := net.IPv4len
+	switch v[1] {
+	case familyIPv4:
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, 0, fmt.Errorf("bad address family %d", v[1])
+	}
+	if len(v) != 4+ipLen {
+		return nil, 0, ErrBadLength
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, v[4:])
+	return ip, int(binary.BigEndian.Uint16(v[2:4])), nil
+}
@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+func TestAttributes(t *testing.T) {
+	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+		ChangeRequest{ChangeIP: true},
+		ResponsePort(5000),
+		&ResponseOrigin{IP: net.IPv4(203, 0, 113, 1), Port: 3478},
+		&OtherAddress{IP: net.ParseIP("2001:db8::1"), Port: 3479},
+	)
+	decoded := &stun.Message{Raw: m.Raw}
+	if err := decoded.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		change ChangeRequest
+		port   ResponsePort
+		origin ResponseOrigin
+		other  OtherAddress
+	)
+	if err := decoded.Parse(&change, &port, &origin, &other); err != nil {
+		t.Fatal(err)
+	}
+	if !change.ChangeIP || change.ChangePort {
+		t.Errorf("unexpected CHANGE-REQUEST %+v", change)
+	}
+	if port != 5000 {
+		t.Errorf("unexpected RESPONSE-PORT %d", port)
+	}
+	if origin.String() != "203.0.113.1:3478" {
+		t.Errorf("unexpected RESPONSE-ORIGIN %s", origin)
+	}
+	if !other.IP.Equal(net.ParseIP("2001:db8::1")) || other.Port != 3479 {
+		t.Errorf("unexpected OTHER-ADDRESS %s", other)
+	}
+	t.Run("BadLength", func(t *testing.T) {
+		m := new(stun.Message)
+		m.Add(AttrChangeRequest, []byte{1})
+		m.Add(AttrResponsePort, []byte{1})
+		m.Add(AttrOtherAddress, []byte{0, familyIPv4, 0, 1, 127})
+		if err := change.GetFrom(m); err != ErrBadLength {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := port.GetFrom(m); err != ErrBadLength {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := other.GetFrom(m); err != ErrBadLength {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestGroup(t *testing.T) {
+	var (
+		primary   = turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 3478}
+		alternate = turn.Addr{IP: net.IPv4(203, 0, 113, 2), Port: 3479}
+	)
+	if _, err := NewGroup(primary, turn.Addr{IP: alternate.IP, Port: primary.Port}); err == nil {
+		t.Error("should error on same port")
+	}
+	g, err := NewGroup(primary, alternate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Addrs()) != 4 {
+		t.Errorf("unexpected addrs %v", g.Addrs())
+	}
+	for _, tc := range []struct {
+		change ChangeRequest
+		addr   turn.Addr
+	}{
+		{ChangeRequest{}, primary},
+		{ChangeRequest{ChangeIP: true}, turn.Addr{IP: alternate.IP, Port: primary.Port}},
+		{ChangeRequest{ChangePort: true}, turn.Addr{IP: primary.IP, Port: alternate.Port}},
+		{ChangeRequest{ChangeIP: true, ChangePort: true}, alternate},
+	} {
+		addr, ok := g.Changed(primary, tc.change)
+		if !ok || !addr.Equal(tc.addr) {
+			t.Errorf("%+v: got %s, expected %s", tc.change, addr, tc.addr)
+		}
+	}
+	if other, ok := g.Other(alternate); !ok || !other.Equal(primary) {
+		t.Errorf("unexpected other address %s", other)
+	}
+	outside := turn.Addr{IP: net.IPv4(203, 0, 113, 3), Port: 3478}
+	if g.Contains(outside) {
+		t.Error("should not contain address")
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	g.Add(outside, conn)
+	if _, ok := g.Conn(outside); ok {
+		t.Error("address outside of group should be ignored")
+	}
+	g.Add(alternate, conn)
+	if c, ok := g.Conn(alternate); !ok || c != conn {
+		t.Error("conn not found")
+	}
+	g.Remove(alternate)
+	if _, ok := g.Conn(alternate); ok {
+		t.Error("conn should be removed")
+	}
+	t.Run("Nil", func(t *testing.T) {
+		var g *Group
+		g.Add(primary, conn)
+		g.Remove(primary)
+		if g.Contains(primary) || len(g.Addrs()) != 0 {
+			t.Error("nil group should be empty")
+		}
+		if _, ok := g.Other(primary); ok {
+			t.Error("nil group should have no other address")
+		}
+		if _, ok := g.Conn(primary); ok {
+			t.Error("nil group should have no conns")
+		}
+	})
+}
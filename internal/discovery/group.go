@@ -0,0 +1,140 @@
+// Package discovery implements RFC 5780 NAT Behavior Discovery, where
+// Binding responses are sent from alternate IP address and/or port of
+// server on client request.
+//
+// Server has primary and alternate IP addresses and primary and alternate
+// ports, so Group coordinates four listeners that are combinations of them.
+//
+// Attributes of RFC 3489 that are superseded by RFC 5780 are also provided
+// for backward compatibility with classic STUN clients.
+package discovery
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/gortc/turn"
+)
+
+// Group is set of four listeners that are used for NAT behavior discovery.
+//
+// Nil Group is valid and has no listeners.
+type Group struct {
+	ips   [2]net.IP
+	ports [2]int
+	mux   sync.RWMutex
+	conns map[string]net.PacketConn
+}
+
+// NewGroup initializes and returns Group from primary and alternate
+// addresses that should differ by both IP and port.
+func NewGroup(primary, alternate turn.Addr) (*Group, error) {
+	if primary.IP.Equal(alternate.IP) || primary.Port == alternate.Port {
+		return nil, errors.New("primary and alternate addresses should differ by IP and port")
+	}
+	return &Group{
+		ips:   [2]net.IP{primary.IP, alternate.IP},
+		ports: [2]int{primary.Port, alternate.Port},
+		conns: make(map[string]net.PacketConn),
+	}, nil
+}
+
+// Addrs returns addresses of all four listeners of group.
+func (g *Group) Addrs() []turn.Addr {
+	if g == nil {
+		return nil
+	}
+	addrs := make([]turn.Addr, 0, 4)
+	for _, ip := range g.ips {
+		for _, port := range g.ports {
+			addrs = append(addrs, turn.Addr{IP: ip, Port: port})
+		}
+	}
+	return addrs
+}
+
+// index returns indexes of IP and port of addr, false if addr is not
+// listener of group.
+func (g *Group) index(addr turn.Addr) (ip, port int, ok bool) {
+	ip, port = -1, -1
+	for i := range g.ips {
+		if g.ips[i].Equal(addr.IP) {
+			ip = i
+		}
+		if g.ports[i] == addr.Port {
+			port = i
+		}
+	}
+	return ip, port, ip >= 0 && port >= 0
+}
+
+// Add sets connection of listener with provided address, ignoring
+// addresses that are not in group.
+func (g *Group) Add(addr turn.Addr, conn net.PacketConn) {
+	if g == nil {
+		return
+	}
+	if _, _, ok := g.index(addr); !ok {
+		return
+	}
+	g.mux.Lock()
+	g.conns[addr.String()] = conn
+	g.mux.Unlock()
+}
+
+// Remove removes connection of listener with provided address.
+func (g *Group) Remove(addr turn.Addr) {
+	if g == nil {
+		return
+	}
+	g.mux.Lock()
+	delete(g.conns, addr.String())
+	g.mux.Unlock()
+}
+
+// Contains reports whether addr is address of listener in group.
+func (g *Group) Contains(addr turn.Addr) bool {
+	if g == nil {
+		return false
+	}
+	_, _, ok := g.index(addr)
+	return ok
+}
+
+// Other returns address of listener that differs from addr by both IP and
+// port, false if addr is not in group.
+func (g *Group) Other(addr turn.Addr) (turn.Addr, bool) {
+	return g.Changed(addr, ChangeRequest{ChangeIP: true, ChangePort: true})
+}
+
+// Changed returns address of listener that differs from addr as requested
+// by CHANGE-REQUEST, false if addr is not in group.
+func (g *Group) Changed(addr turn.Addr, c ChangeRequest) (turn.Addr, bool) {
+	if g == nil {
+		return turn.Addr{}, false
+	}
+	ip, port, ok := g.index(addr)
+	if !ok {
+		return turn.Addr{}, false
+	}
+	if c.ChangeIP {
+		ip = 1 - ip
+	}
+	if c.ChangePort {
+		port = 1 - port
+	}
+	return turn.Addr{IP: g.ips[ip], Port: g.ports[port]}, true
+}
+
+// Conn returns connection of listener with provided address, false if
+// listener is not added.
+func (g *Group) Conn(addr turn.Addr) (net.PacketConn, bool) {
+	if g == nil {
+		return nil, false
+	}
+	g.mux.RLock()
+	conn, ok := g.conns[addr.String()]
+	g.mux.RUnlock()
+	return conn, ok
+}
@@ -0,0 +1,262 @@
+package filter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gortc/turn"
+)
+
+// BlockEntry is deny entry of Blocklist.
+type BlockEntry struct {
+	Net     string    `json:"net"`
+	Reason  string    `json:"reason,omitempty"`
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"` // zero if entry does not expire
+	Hits    uint64    `json:"hits"`
+}
+
+type blockEntry struct {
+	hits    uint64 // atomic, first for alignment
+	net     *net.IPNet
+	reason  string
+	added   time.Time
+	expires time.Time
+}
+
+func (e *blockEntry) expired(t time.Time) bool {
+	return !e.expires.IsZero() && !t.Before(e.expires)
+}
+
+func (e *blockEntry) entry() BlockEntry {
+	return BlockEntry{
+		Net:     e.net.String(),
+		Reason:  e.reason,
+		Added:   e.added,
+		Expires: e.expires,
+		Hits:    atomic.LoadUint64(&e.hits),
+	}
+}
+
+// BlocklistOptions contain possible settings for Blocklist.
+type BlocklistOptions struct {
+	Name   string            // value of "list" metric label
+	Path   string            // entries are not persisted if blank
+	Labels prometheus.Labels // constant metric labels
+}
+
+// Blocklist is Rule that denies addresses from subnets of temporary
+// entries that are managed in runtime, passing any other address.
+// It is intended to be layered in front of configured List.
+//
+// Nil Blocklist passes any address.
+type Blocklist struct {
+	hits    uint64 // atomic, first for alignment
+	mux     sync.RWMutex
+	entries []*blockEntry
+	path    string
+	now     func() time.Time
+	metrics map[string]*prometheus.Desc
+}
+
+// NewBlocklist initializes and returns new Blocklist, reading entries
+// from Path if it exists.
+func NewBlocklist(o BlocklistOptions) (*Blocklist, error) {
+	labels := prometheus.Labels{"list": o.Name}
+	for k, v := range o.Labels {
+		labels[k] = v
+	}
+	b := &Blocklist{
+		path: o.Path,
+		now:  time.Now,
+		metrics: map[string]*prometheus.Desc{
+			"hits": prometheus.NewDesc("gortcd_blocklist_hits_total",
+				"Total number of addresses denied by blocklist.", []string{}, labels),
+			"entries": prometheus.NewDesc("gortcd_blocklist_entries",
+				"Number of active blocklist entries.", []string{}, labels),
+		},
+	}
+	if b.path == "" {
+		return b, nil
+	}
+	buf, err := ioutil.ReadFile(b.path) // #nosec
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []BlockEntry
+	if err = json.Unmarshal(buf, &entries); err != nil {
+		return nil, err
+	}
+	now := b.now()
+	for _, e := range entries {
+		_, subnet, parseErr := net.ParseCIDR(e.Net)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		entry := &blockEntry{
+			net:     subnet,
+			reason:  e.Reason,
+			added:   e.Added,
+			expires: e.Expires,
+			hits:    e.Hits,
+		}
+		if entry.expired(now) {
+			continue
+		}
+		b.entries = append(b.entries, entry)
+	}
+	return b, nil
+}
+
+// Action implements Rule.
+func (b *Blocklist) Action(addr turn.Addr) Action {
+	if b == nil {
+		return Pass
+	}
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	for _, e := range b.entries {
+		if !e.net.Contains(addr.IP) || e.expired(b.now()) {
+			continue
+		}
+		atomic.AddUint64(&e.hits, 1)
+		atomic.AddUint64(&b.hits, 1)
+		return Deny
+	}
+	return Pass
+}
+
+// Add adds deny entry for subnet that expires after ttl, replacing
+// existing entry for same subnet. Entry does not expire if ttl is 0.
+func (b *Blocklist) Add(subnet *net.IPNet, ttl time.Duration, reason string) error {
+	now := b.now()
+	e := &blockEntry{
+		net:    subnet,
+		reason: reason,
+		added:  now,
+	}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.prune(now)
+	for i := range b.entries {
+		if b.entries[i].net.String() == subnet.String() {
+			b.entries[i] = e
+			return b.save()
+		}
+	}
+	b.entries = append(b.entries, e)
+	return b.save()
+}
+
+// Remove removes entry for subnet, returning false if there were none.
+func (b *Blocklist) Remove(subnet *net.IPNet) (bool, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.prune(b.now())
+	for i := range b.entries {
+		if b.entries[i].net.String() != subnet.String() {
+			continue
+		}
+		b.entries = append(b.entries[:i], b.entries[i+1:]...)
+		return true, b.save()
+	}
+	return false, nil
+}
+
+// Entries returns list of entries that are not expired.
+func (b *Blocklist) Entries() []BlockEntry {
+	if b == nil {
+		return nil
+	}
+	now := b.now()
+	var entries []BlockEntry
+	b.mux.RLock()
+	for _, e := range b.entries {
+		if e.expired(now) {
+			continue
+		}
+		entries = append(entries, e.entry())
+	}
+	b.mux.RUnlock()
+	return entries
+}
+
+// prune removes expired entries. Should be called under lock.
+func (b *Blocklist) prune(t time.Time) {
+	entries := b.entries[:0]
+	for _, e := range b.entries {
+		if e.expired(t) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	for i := len(entries); i < len(b.entries); i++ {
+		b.entries[i] = nil
+	}
+	b.entries = entries
+}
+
+// save atomically writes entries to path if set. Should be called
+// under lock.
+func (b *Blocklist) save() error {
+	if b.path == "" {
+		return nil
+	}
+	entries := make([]BlockEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e.entry())
+	}
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()           // #nosec
+		os.Remove(f.Name()) // #nosec
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name()) // #nosec
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
+
+// Describe implements Collector.
+func (b *Blocklist) Describe(c chan<- *prometheus.Desc) {
+	for _, d := range b.metrics {
+		c <- d
+	}
+}
+
+// Collect implements Collector.
+func (b *Blocklist) Collect(c chan<- prometheus.Metric) {
+	c <- prometheus.MustNewConstMetric(
+		b.metrics["hits"],
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&b.hits)),
+	)
+	c <- prometheus.MustNewConstMetric(
+		b.metrics["entries"],
+		prometheus.GaugeValue,
+		float64(len(b.Entries())),
+	)
+}
@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gortc/turn"
+)
+
+func mustParseNet(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnet
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist.json")
+	b, err := NewBlocklist(BlocklistOptions{Name: "client", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	b.now = func() time.Time { return now }
+	var (
+		addr  = turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+		other = turn.Addr{IP: net.IPv4(10, 1, 0, 1), Port: 1234}
+	)
+	if b.Action(addr) != Pass {
+		t.Error("empty blocklist should pass")
+	}
+	if err = b.Add(mustParseNet(t, "10.0.0.0/24"), time.Minute, "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Add(mustParseNet(t, "192.168.0.0/16"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.Action(addr) != Deny {
+		t.Error("should deny")
+	}
+	if b.Action(other) != Pass {
+		t.Error("should pass")
+	}
+	entries := b.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries[0].Hits != 1 || entries[0].Reason != "abuse" || !entries[0].Expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	if !entries[1].Expires.IsZero() {
+		t.Error("entry without ttl should not expire")
+	}
+	t.Run("Persist", func(t *testing.T) {
+		loaded, loadErr := NewBlocklist(BlocklistOptions{Path: path})
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		}
+		if len(loaded.Entries()) != 2 {
+			t.Errorf("unexpected entries %+v", loaded.Entries())
+		}
+		if loaded.Action(addr) != Deny {
+			t.Error("loaded blocklist should deny")
+		}
+	})
+	t.Run("Expire", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		if b.Action(addr) != Pass {
+			t.Error("expired entry should pass")
+		}
+		if len(b.Entries()) != 1 {
+			t.Errorf("unexpected entries %+v", b.Entries())
+		}
+	})
+	t.Run("Remove", func(t *testing.T) {
+		removed, removeErr := b.Remove(mustParseNet(t, "192.168.0.0/16"))
+		if removeErr != nil || !removed {
+			t.Fatal("should remove", removeErr)
+		}
+		if removed, _ = b.Remove(mustParseNet(t, "192.168.0.0/16")); removed {
+			t.Error("should not remove twice")
+		}
+		loaded, loadErr := NewBlocklist(BlocklistOptions{Path: path})
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		}
+		if len(loaded.Entries()) != 0 {
+			t.Errorf("unexpected entries %+v", loaded.Entries())
+		}
+	})
+	t.Run("Metrics", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		if regErr := reg.Register(b); regErr != nil {
+			t.Fatal(regErr)
+		}
+		families, gatherErr := reg.Gather()
+		if gatherErr != nil {
+			t.Fatal(gatherErr)
+		}
+		for _, f := range families {
+			if f.GetName() != "gortcd_blocklist_hits_total" {
+				continue
+			}
+			if v := f.GetMetric()[0].GetCounter().GetValue(); v != 1 {
+				t.Errorf("unexpected hits %f", v)
+			}
+			return
+		}
+		t.Error("hits metric not found")
+	})
+}
+
+func TestBlocklist_Nil(t *testing.T) {
+	var b *Blocklist
+	if b.Action(turn.Addr{IP: net.IPv4(10, 0, 0, 1)}) != Pass {
+		t.Error("nil blocklist should pass")
+	}
+	if len(b.Entries()) != 0 {
+		t.Error("nil blocklist should be empty")
+	}
+}
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gortc/turn"
+)
+
+// ProtoRule is Rule that also depends on transport protocol.
+type ProtoRule interface {
+	Rule
+	ProtoAction(addr turn.Addr, proto turn.Protocol) Action
+}
+
+// ActionFor returns action of rule for address with transport protocol,
+// falling back to Action if rule does not depend on protocol.
+func ActionFor(r Rule, addr turn.Addr, proto turn.Protocol) Action {
+	if p, ok := r.(ProtoRule); ok {
+		return p.ProtoAction(addr, proto)
+	}
+	return r.Action(addr)
+}
+
+// PortRange is inclusive range of ports.
+type PortRange struct {
+	Min, Max int
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Contains reports whether port is in range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// ParsePorts parses comma-separated list of ports and port ranges,
+// e.g. "25", "80,443" or "1024-65535".
+func ParsePorts(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		bounds := strings.SplitN(v, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", v)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("bad port %q", v)
+			}
+		}
+		if min < 0 || max > 65535 || min > max {
+			return nil, fmt.Errorf("bad port range %q", v)
+		}
+		ranges = append(ranges, PortRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+// protoTCP is IANA assigned protocol number for TCP.
+const protoTCP turn.Protocol = 6
+
+// ParseProto parses transport protocol name, "udp" or "tcp".
+func ParseProto(s string) (turn.Protocol, error) {
+	switch strings.ToLower(s) {
+	case "udp":
+		return turn.ProtoUDP, nil
+	case "tcp":
+		return protoTCP, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", s)
+	}
+}
+
+// Condition restricts rule to ports and transport protocol.
+type Condition struct {
+	Ports []PortRange   // any port if empty
+	Proto turn.Protocol // any protocol if zero
+}
+
+type conditionRule struct {
+	rule Rule
+	cond Condition
+}
+
+func (r conditionRule) matchPort(port int) bool {
+	if len(r.cond.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.cond.Ports {
+		if p.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Action implements Rule. Rules with protocol condition are not matched
+// if protocol is unknown.
+func (r conditionRule) Action(addr turn.Addr) Action {
+	if r.cond.Proto != 0 || !r.matchPort(addr.Port) {
+		return Pass
+	}
+	return r.rule.Action(addr)
+}
+
+// ProtoAction implements ProtoRule.
+func (r conditionRule) ProtoAction(addr turn.Addr, proto turn.Protocol) Action {
+	if r.cond.Proto != 0 && r.cond.Proto != proto {
+		return Pass
+	}
+	if !r.matchPort(addr.Port) {
+		return Pass
+	}
+	return ActionFor(r.rule, addr, proto)
+}
+
+// Restrict returns rule that applies r only to addresses that match
+// condition, returning Pass for others.
+func Restrict(r Rule, c Condition) Rule {
+	return conditionRule{rule: r, cond: c}
+}
+
+type staticRule Action
+
+func (r staticRule) Action(addr turn.Addr) Action { return Action(r) }
+
+// StaticRule returns rule that applies action to any address, e.g. to
+// be restricted by Restrict.
+func StaticRule(action Action) Rule {
+	return staticRule(action)
+}
@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gortc/turn"
+)
+
+func TestParsePorts(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []PortRange
+	}{
+		{"25", []PortRange{{25, 25}}},
+		{"80, 443", []PortRange{{80, 80}, {443, 443}}},
+		{"1024-65535", []PortRange{{1024, 65535}}},
+	} {
+		t.Run(tc.In, func(t *testing.T) {
+			ranges, err := ParsePorts(tc.In)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) != len(tc.Out) {
+				t.Fatalf("unexpected ranges %v", ranges)
+			}
+			for i := range ranges {
+				if ranges[i] != tc.Out[i] {
+					t.Errorf("%s != %s", ranges[i], tc.Out[i])
+				}
+			}
+		})
+	}
+	for _, in := range []string{"", "a", "1-b", "10-1", "65536", "-1"} {
+		if _, err := ParsePorts(in); err == nil {
+			t.Errorf("%q: should error", in)
+		}
+	}
+}
+
+func TestParseProto(t *testing.T) {
+	if p, err := ParseProto("UDP"); err != nil || p != turn.ProtoUDP {
+		t.Errorf("unexpected %s, %v", p, err)
+	}
+	if _, err := ParseProto("tcp"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseProto("sctp"); err == nil {
+		t.Error("should error")
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	subnet, err := StaticNetRule(Allow, "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowHigh := Restrict(subnet, Condition{
+		Ports: []PortRange{{1024, 65535}},
+		Proto: turn.ProtoUDP,
+	})
+	denySMTP := Restrict(StaticRule(Deny), Condition{
+		Ports: []PortRange{{25, 25}},
+	})
+	f := NewFilter(Deny, denySMTP, allowHigh)
+	for _, tc := range []struct {
+		Name   string
+		Addr   turn.Addr
+		Proto  turn.Protocol
+		Action Action
+	}{
+		{"HighUDP", turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}, turn.ProtoUDP, Allow},
+		{"HighTCP", turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}, protoTCP, Deny},
+		{"Low", turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}, turn.ProtoUDP, Deny},
+		{"OtherNet", turn.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, turn.ProtoUDP, Deny},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if a := ActionFor(f, tc.Addr, tc.Proto); a != tc.Action {
+				t.Errorf("%s != %s", a, tc.Action)
+			}
+		})
+	}
+	t.Run("SMTP", func(t *testing.T) {
+		f := NewFilter(Allow, denySMTP)
+		if a := f.Action(turn.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 25}); a != Deny {
+			t.Errorf("unexpected %s", a)
+		}
+		if a := f.Action(turn.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 26}); a != Allow {
+			t.Errorf("unexpected %s", a)
+		}
+	})
+	t.Run("UnknownProto", func(t *testing.T) {
+		if a := allowHigh.Action(turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}); a != Pass {
+			t.Errorf("rule with protocol should not match, got %s", a)
+		}
+	})
+}
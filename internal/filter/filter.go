@@ -96,11 +96,58 @@ func (f *List) Action(addr turn.Addr) Action {
 	return f.action
 }
 
+// ProtoAction implements ProtoRule.
+func (f *List) ProtoAction(addr turn.Addr, proto turn.Protocol) Action {
+	for i := range f.rules {
+		a := ActionFor(f.rules[i], addr, proto)
+		if a == Pass {
+			continue
+		}
+		return a
+	}
+	return f.action
+}
+
 // NewFilter initializes and returns new List with provided default action
 // and rule list.
+//
+// Consecutive static subnet rules are merged into Trie, preserving
+// first-match semantics.
 func NewFilter(action Action, rules ...Rule) *List {
 	return &List{
-		rules:  rules,
+		rules:  mergeSubnetRules(rules),
 		action: action,
 	}
 }
+
+// trieMinRules is minimum count of consecutive subnet rules that are
+// merged into Trie, see BenchmarkList_Action.
+const trieMinRules = 2
+
+func mergeSubnetRules(rules []Rule) []Rule {
+	var merged []Rule
+	for i := 0; i < len(rules); {
+		j := i
+		for j < len(rules) {
+			if _, ok := rules[j].(subnetRule); !ok {
+				break
+			}
+			j++
+		}
+		if j-i < trieMinRules {
+			if j == i {
+				j++
+			}
+			merged = append(merged, rules[i:j]...)
+			i = j
+			continue
+		}
+		t := NewTrie()
+		for _, r := range rules[i:j] {
+			t.Add(r.(subnetRule).action, r.(subnetRule).net)
+		}
+		merged = append(merged, t)
+		i = j
+	}
+	return merged
+}
@@ -1,6 +1,8 @@
 package filter
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
 	"testing"
 
@@ -144,3 +146,145 @@ func TestFilter_Allowed(t *testing.T) {
 		})
 	}
 }
+
+// randomSubnetRules returns n static rules for random subnets, some of
+// them nested or duplicated.
+func randomSubnetRules(rnd *rand.Rand, n int) []Rule {
+	rules := make([]Rule, 0, n)
+	for i := 0; i < n; i++ {
+		var (
+			ip   net.IP
+			bits int
+		)
+		if rnd.Intn(4) == 0 {
+			ip = make(net.IP, net.IPv6len)
+			ip[0] = 0x20
+			bits = 128
+		} else {
+			ip = make(net.IP, net.IPv4len)
+			ip[0] = 10
+			bits = 32
+		}
+		rnd.Read(ip[1:3]) // #nosec
+		if rnd.Intn(2) == 0 {
+			rnd.Read(ip[3:]) // #nosec
+		}
+		mask := net.CIDRMask(8+rnd.Intn(bits-7), bits)
+		action := Allow
+		switch rnd.Intn(3) {
+		case 0:
+			action = Deny
+		case 1:
+			action = Pass
+		}
+		rules = append(rules, subnetRule{
+			action: action,
+			net:    &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+		})
+	}
+	return rules
+}
+
+func randomAddr(rnd *rand.Rand, rules []Rule) turn.Addr {
+	// Picking address close to one of subnets to hit nested rules.
+	r := rules[rnd.Intn(len(rules))].(subnetRule)
+	ip := append(net.IP(nil), r.net.IP...)
+	ip[len(ip)-1] ^= byte(rnd.Intn(4))
+	if rnd.Intn(8) == 0 {
+		ip[1] ^= byte(rnd.Intn(256))
+	}
+	if len(ip) == net.IPv4len && rnd.Intn(2) == 0 {
+		ip = ip.To16()
+	}
+	return turn.Addr{IP: ip}
+}
+
+func TestTrie(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, trieMinRules, 100, 5000} {
+		rules := randomSubnetRules(rnd, n)
+		var (
+			linear = &List{action: Deny, rules: rules}
+			merged = NewFilter(Deny, rules...)
+		)
+		if n >= trieMinRules {
+			if _, ok := merged.rules[0].(*Trie); !ok || len(merged.rules) != 1 {
+				t.Fatal("rules should be merged into trie")
+			}
+		}
+		for i := 0; i < 10000; i++ {
+			addr := randomAddr(rnd, rules)
+			if got, expected := merged.Action(addr), linear.Action(addr); got != expected {
+				t.Fatalf("%d rules: %s: got %s, expected %s", n, addr, got, expected)
+			}
+		}
+	}
+	t.Run("Mixed", func(t *testing.T) {
+		rules := randomSubnetRules(rnd, 3*trieMinRules)
+		rules = append(rules[:trieMinRules:trieMinRules], append([]Rule{AllowAll}, rules[trieMinRules:]...)...)
+		f := NewFilter(Deny, rules...)
+		if len(f.rules) != 3 {
+			t.Fatalf("unexpected rules count %d", len(f.rules))
+		}
+		if _, ok := f.rules[1].(allowAll); !ok {
+			t.Error("rule order should be preserved")
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		tr := NewTrie()
+		if tr.Action(turn.Addr{IP: net.IPv4(10, 0, 0, 1)}) != Pass {
+			t.Error("empty trie should pass")
+		}
+		if tr.Action(turn.Addr{}) != Pass {
+			t.Error("nil address should pass")
+		}
+		_, all, err := net.ParseCIDR("0.0.0.0/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Add(Deny, all)
+		tr.Add(Allow, all)
+		if tr.Len() != 2 {
+			t.Error("unexpected length")
+		}
+		if tr.Action(turn.Addr{IP: net.IPv4(10, 0, 0, 1)}) != Deny {
+			t.Error("first added subnet should match")
+		}
+		if tr.Action(turn.Addr{IP: net.ParseIP("2001:db8::1")}) != Pass {
+			t.Error("IPv6 address should not match IPv4 subnet")
+		}
+	})
+}
+
+func BenchmarkList_Action(b *testing.B) {
+	for _, n := range []int{1, 2, 4, trieMinRules, 32, 1000, 50000} {
+		rnd := rand.New(rand.NewSource(1))
+		rules := randomSubnetRules(rnd, n)
+		addrs := make([]turn.Addr, 1024)
+		for i := range addrs {
+			addrs[i] = randomAddr(rnd, rules)
+		}
+		for _, bc := range []struct {
+			name string
+			list *List
+		}{
+			{"Linear", &List{action: Deny, rules: rules}},
+			{"Trie", &List{action: Deny, rules: []Rule{trieFrom(rules)}}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					bc.list.Action(addrs[i%len(addrs)])
+				}
+			})
+		}
+	}
+}
+
+func trieFrom(rules []Rule) *Trie {
+	t := NewTrie()
+	for _, r := range rules {
+		t.Add(r.(subnetRule).action, r.(subnetRule).net)
+	}
+	return t
+}
@@ -0,0 +1,67 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// ParsePrefixList parses list of subnets with one CIDR or IP address
+// per line. Empty lines and comments starting with "#" are ignored.
+func ParsePrefixList(r io.Reader) ([]*net.IPNet, error) {
+	var (
+		subnets []*net.IPNet
+		s       = bufio.NewScanner(r)
+	)
+	for line := 1; s.Scan(); line++ {
+		v := s.Text()
+		if i := strings.IndexByte(v, '#'); i >= 0 {
+			v = v[:i]
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: bad address %q", line, v)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			subnets = append(subnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, s.Err()
+}
+
+// LoadPrefixList reads prefix list from file with provided name, see
+// ParsePrefixList, and returns Trie that applies action to all subnets
+// of list.
+func LoadPrefixList(action Action, name string) (*Trie, error) {
+	f, err := os.Open(name) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // #nosec
+	subnets, err := ParsePrefixList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	t := NewTrie()
+	for _, subnet := range subnets {
+		t.Add(action, subnet)
+	}
+	return t, nil
+}
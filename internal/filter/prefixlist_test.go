@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gortc/turn"
+)
+
+func TestParsePrefixList(t *testing.T) {
+	subnets, err := ParsePrefixList(strings.NewReader(`# bogons
+0.0.0.0/8
+10.0.0.0/8 # private
+
+  192.0.2.1
+2001:db8::/32
+2001:db8::1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range subnets {
+		got = append(got, s.String())
+	}
+	expected := "0.0.0.0/8 10.0.0.0/8 192.0.2.1/32 2001:db8::/32 2001:db8::1/128"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("unexpected subnets %v", got)
+	}
+	for _, in := range []string{
+		"10.0.0.0/33",
+		"10.0.0.0/8\nbad",
+		"10.0.0.0/8 10.1.0.0/16",
+	} {
+		if _, err = ParsePrefixList(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: should fail", in)
+		}
+	}
+}
+
+func TestLoadPrefixList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefixlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "list.txt")
+	if _, err = LoadPrefixList(Deny, name); err == nil {
+		t.Error("should fail on missing file")
+	}
+	if err = ioutil.WriteFile(name, []byte("10.0.0.0/8\n2001:db8::/32\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadPrefixList(Deny, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 2 {
+		t.Errorf("unexpected length %d", r.Len())
+	}
+	for _, tc := range []struct {
+		ip     net.IP
+		action Action
+	}{
+		{net.IPv4(10, 1, 2, 3), Deny},
+		{net.IPv4(11, 1, 2, 3), Pass},
+		{net.ParseIP("2001:db8::1"), Deny},
+		{net.ParseIP("2001:db9::1"), Pass},
+	} {
+		if a := r.Action(turn.Addr{IP: tc.ip}); a != tc.action {
+			t.Errorf("%s: got %s, expected %s", tc.ip, a, tc.action)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/gortc/turn"
+)
+
+// SetSelf is name of dynamic set of server own addresses.
+const SetSelf = "self"
+
+// sets are named sets of networks.
+var sets = map[string][]string{
+	"loopback":    {"127.0.0.0/8", "::1/128"},
+	"private":     {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"},
+	"link-local":  {"169.254.0.0/16", "fe80::/10"},
+	"multicast":   {"224.0.0.0/4", "ff00::/8"},
+	"unspecified": {"0.0.0.0/8", "::/128"},
+	"broadcast":   {"255.255.255.255/32"},
+}
+
+// Sets returns names of available sets.
+func Sets() []string {
+	names := []string{SetSelf}
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type netsRule struct {
+	action Action
+	nets   []*net.IPNet
+}
+
+func (r netsRule) Action(addr turn.Addr) Action {
+	for _, n := range r.nets {
+		if n.Contains(addr.IP) {
+			return r.action
+		}
+	}
+	return Pass
+}
+
+// SetRule returns rule that applies action to addresses from named set.
+// The "self" set requires self to be non-nil.
+func SetRule(action Action, name string, self *Self) (Rule, error) {
+	if name == SetSelf {
+		if self == nil {
+			return nil, fmt.Errorf("set %q is not available", name)
+		}
+		return selfRule{action: action, self: self}, nil
+	}
+	subnets, ok := sets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown set %q", name)
+	}
+	r := netsRule{action: action}
+	for _, subnet := range subnets {
+		_, parsedNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		r.nets = append(r.nets, parsedNet)
+	}
+	return r, nil
+}
+
+// Self is dynamic set of server own addresses, e.g. listener and relay
+// addresses. Addresses are reference counted, so same address can be
+// added by multiple servers.
+//
+// Nil Self is valid and empty.
+type Self struct {
+	mux sync.RWMutex
+	ips map[string]int
+}
+
+// NewSelf initializes and returns new empty Self.
+func NewSelf() *Self {
+	return &Self{
+		ips: make(map[string]int),
+	}
+}
+
+// Add adds ip to set.
+func (s *Self) Add(ip net.IP) {
+	if s == nil || ip == nil {
+		return
+	}
+	s.mux.Lock()
+	s.ips[ip.String()]++
+	s.mux.Unlock()
+}
+
+// Remove removes ip from set.
+func (s *Self) Remove(ip net.IP) {
+	if s == nil || ip == nil {
+		return
+	}
+	key := ip.String()
+	s.mux.Lock()
+	if s.ips[key] <= 1 {
+		delete(s.ips, key)
+	} else {
+		s.ips[key]--
+	}
+	s.mux.Unlock()
+}
+
+// Contains reports whether ip is in set.
+func (s *Self) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	s.mux.RLock()
+	_, ok := s.ips[ip.String()]
+	s.mux.RUnlock()
+	return ok
+}
+
+type selfRule struct {
+	action Action
+	self   *Self
+}
+
+func (r selfRule) Action(addr turn.Addr) Action {
+	if r.self.Contains(addr.IP) {
+		return r.action
+	}
+	return Pass
+}
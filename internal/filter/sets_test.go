@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gortc/turn"
+)
+
+func TestSetRule(t *testing.T) {
+	for _, tc := range []struct {
+		Set    string
+		IP     net.IP
+		Action Action
+	}{
+		{"loopback", net.IPv4(127, 0, 0, 1), Deny},
+		{"loopback", net.IPv6loopback, Deny},
+		{"loopback", net.IPv4(10, 0, 0, 1), Pass},
+		{"private", net.IPv4(10, 1, 2, 3), Deny},
+		{"private", net.IPv4(172, 31, 0, 1), Deny},
+		{"private", net.IPv4(172, 32, 0, 1), Pass},
+		{"link-local", net.IPv4(169, 254, 169, 254), Deny},
+		{"multicast", net.IPv4(239, 1, 1, 1), Deny},
+		{"unspecified", net.IPv4zero, Deny},
+		{"broadcast", net.IPv4bcast, Deny},
+		{"broadcast", net.IPv4(203, 0, 113, 1), Pass},
+	} {
+		t.Run(tc.Set+"/"+tc.IP.String(), func(t *testing.T) {
+			r, err := SetRule(Deny, tc.Set, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := r.Action(turn.Addr{IP: tc.IP}); a != tc.Action {
+				t.Errorf("%s != %s", a, tc.Action)
+			}
+		})
+	}
+	t.Run("Unknown", func(t *testing.T) {
+		if _, err := SetRule(Deny, "bad", nil); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("SelfRequired", func(t *testing.T) {
+		if _, err := SetRule(Deny, SetSelf, nil); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Sets", func(t *testing.T) {
+		for _, name := range Sets() {
+			if _, err := SetRule(Deny, name, NewSelf()); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	})
+}
+
+func TestSelf(t *testing.T) {
+	var (
+		s    = NewSelf()
+		ip   = net.IPv4(203, 0, 113, 1)
+		addr = turn.Addr{IP: ip, Port: 3478}
+	)
+	r, err := SetRule(Deny, SetSelf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action(addr) != Pass {
+		t.Error("empty set should not match")
+	}
+	s.Add(ip)
+	s.Add(ip.To4())
+	if r.Action(addr) != Deny {
+		t.Error("should match added address")
+	}
+	s.Remove(ip)
+	if r.Action(addr) != Deny {
+		t.Error("address should be reference counted")
+	}
+	s.Remove(ip)
+	if r.Action(addr) != Pass {
+		t.Error("removed address should not match")
+	}
+	var nilSelf *Self
+	nilSelf.Add(ip)
+	if nilSelf.Contains(ip) {
+		t.Error("nil set should be empty")
+	}
+}
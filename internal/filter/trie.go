@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"net"
+
+	"github.com/gortc/turn"
+)
+
+type trieNode struct {
+	children [2]*trieNode
+	set      bool
+	index    int // order of subnet, lower is added earlier
+	action   Action
+}
+
+// Trie is Rule that matches address against subnets in binary radix
+// trie, returning action of first added subnet that contains address,
+// or Pass if none. Lookup cost depends only on address length, so it
+// is suitable for large prefix lists.
+//
+// Trie is not safe for concurrent Add and Action calls.
+type Trie struct {
+	v4, v6 trieNode
+	n      int
+}
+
+// NewTrie initializes and returns empty Trie.
+func NewTrie() *Trie {
+	return &Trie{}
+}
+
+// Len returns count of added subnets.
+func (t *Trie) Len() int {
+	return t.n
+}
+
+// Add adds subnet with action. If address is contained in multiple
+// subnets, action of subnet that was added first is applied. Subnets
+// with Pass action are ignored.
+func (t *Trie) Add(action Action, subnet *net.IPNet) {
+	if action == Pass {
+		return
+	}
+	ones, bits := subnet.Mask.Size()
+	root, ip := &t.v6, subnet.IP.To16()
+	if bits == 8*net.IPv4len {
+		root, ip = &t.v4, subnet.IP.To4()
+	}
+	if ip == nil || bits != 8*len(ip) {
+		// Non-canonical mask, never matches in net.IPNet.Contains too.
+		return
+	}
+	n := root
+	for i := 0; i < ones; i++ {
+		b := ip[i/8] >> uint(7-i%8) & 1
+		if n.children[b] == nil {
+			n.children[b] = new(trieNode)
+		}
+		n = n.children[b]
+	}
+	index := t.n
+	t.n++
+	if n.set {
+		// Keeping first added action.
+		return
+	}
+	n.set = true
+	n.index = index
+	n.action = action
+}
+
+// Action implements Rule.
+func (t *Trie) Action(addr turn.Addr) Action {
+	n, ip := &t.v6, addr.IP
+	if v4 := ip.To4(); v4 != nil {
+		n, ip = &t.v4, v4
+	} else if len(ip) != net.IPv6len {
+		return Pass
+	}
+	var (
+		found  bool
+		index  int
+		action = Pass
+	)
+	for i := 0; n != nil; i++ {
+		if n.set && (!found || n.index < index) {
+			found, index, action = true, n.index, n.action
+		}
+		if i == 8*len(ip) {
+			break
+		}
+		n = n.children[ip[i/8]>>uint(7-i%8)&1]
+	}
+	return action
+}
@@ -0,0 +1,183 @@
+// Package handoff implements passing of state and open sockets between
+// processes over unix socket, allowing binary upgrade without closing
+// listening and relayed sockets.
+//
+// Old process listens on unix socket and new process connects to it.
+// Old process then sends state and file descriptors (with SCM_RIGHTS)
+// and waits for acknowledgement from new process.
+package handoff
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrNotSupported means that handoff is not supported on current platform.
+var ErrNotSupported = errors.New("handoff is not supported")
+
+// maxBatch is maximum count of file descriptors in single message.
+const maxBatch = 64
+
+// Provider returns state and files that are passed to new process.
+// Files are closed after handoff attempt.
+type Provider func() (state []byte, files []*os.File, err error)
+
+// Listener passes state and files from Provider to the first process
+// that requests handoff.
+type Listener struct {
+	log      *zap.Logger
+	l        *net.UnixListener
+	provider Provider
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Listen listens on unix socket path for handoff request. Existing socket
+// file is removed.
+func Listen(path string, log *zap.Logger, p Provider) (*Listener, error) {
+	if log == nil {
+		log = zap.NewNop()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Socket is created in private directory and moved to path only after
+	// its permissions are restricted, so other users can't connect to it
+	// in between.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".handoff")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			log.Warn("failed to remove temporary directory", zap.Error(removeErr))
+		}
+	}()
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// New process listens on same path after handoff.
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err != nil {
+		_ = l.Close() // #nosec
+		return nil, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		_ = l.Close() // #nosec
+		return nil, err
+	}
+	h := &Listener{
+		log:      log,
+		l:        l,
+		provider: p,
+		done:     make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.loop()
+	return h, nil
+}
+
+// Done is closed after successful handoff.
+func (h *Listener) Done() <-chan struct{} { return h.done }
+
+// Close stops listening.
+func (h *Listener) Close() error {
+	err := h.l.Close()
+	h.wg.Wait()
+	return err
+}
+
+func (h *Listener) loop() {
+	defer h.wg.Done()
+	for {
+		conn, err := h.l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		h.log.Info("got handoff request")
+		if err = h.serve(conn); err != nil {
+			h.log.Error("handoff failed", zap.Error(err))
+			continue
+		}
+		h.log.Info("handoff done")
+		close(h.done)
+		return
+	}
+}
+
+func (h *Listener) serve(conn *net.UnixConn) error {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			h.log.Warn("failed to close conn", zap.Error(err))
+		}
+	}()
+	state, files, err := h.provider()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			if closeErr := f.Close(); closeErr != nil {
+				h.log.Warn("failed to close file", zap.Error(closeErr))
+			}
+		}
+	}()
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(files)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(state)))
+	if _, err = conn.Write(append(header, state...)); err != nil {
+		return err
+	}
+	if err = sendFiles(conn, files); err != nil {
+		return err
+	}
+	// Waiting for acknowledgement.
+	ack := make([]byte, 1)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Request connects to process that listens on unix socket path and
+// receives state and files from it.
+func Request(path string) (state []byte, files []*os.File, err error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close() // #nosec
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	count := int(binary.BigEndian.Uint32(header[0:4]))
+	state = make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err = io.ReadFull(conn, state); err != nil {
+		return nil, nil, err
+	}
+	if files, err = receiveFiles(conn, count); err != nil {
+		return nil, nil, err
+	}
+	if _, err = conn.Write([]byte{1}); err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	return state, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close() // #nosec
+	}
+}
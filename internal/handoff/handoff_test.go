@@ -0,0 +1,90 @@
+//+build !windows
+
+package handoff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upgrade.sock")
+	// More connections than maxBatch to check batching.
+	var (
+		conns []*net.UDPConn
+		files []*os.File
+	)
+	for i := 0; i < maxBatch+3; i++ {
+		conn, listenErr := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if listenErr != nil {
+			t.Fatal(listenErr)
+		}
+		defer conn.Close()
+		f, fileErr := conn.File()
+		if fileErr != nil {
+			t.Fatal(fileErr)
+		}
+		conns = append(conns, conn)
+		files = append(files, f)
+	}
+	state := []byte(`{"state":1}`)
+	l, err := Listen(path, nil, func() ([]byte, []*os.File, error) {
+		return state, files, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("unexpected permissions %s", perm)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".handoff*")); len(matches) != 0 {
+		t.Errorf("temporary directory should be removed: %v", matches)
+	}
+	gotState, gotFiles, err := Request(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("handoff not done")
+	}
+	if !bytes.Equal(gotState, state) {
+		t.Errorf("unexpected state %s", gotState)
+	}
+	if len(gotFiles) != len(conns) {
+		t.Fatalf("got %d files, expected %d", len(gotFiles), len(conns))
+	}
+	for i, f := range gotFiles {
+		conn, connErr := net.FilePacketConn(f)
+		f.Close()
+		if connErr != nil {
+			t.Fatal(connErr)
+		}
+		if conn.LocalAddr().String() != conns[i].LocalAddr().String() {
+			t.Errorf("%d: unexpected addr %s", i, conn.LocalAddr())
+		}
+		conn.Close()
+	}
+}
+
+func TestRequestNoListener(t *testing.T) {
+	if _, _, err := Request(filepath.Join(os.TempDir(), "gortcd-handoff-missing.sock")); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,63 @@
+//+build !windows
+
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+func sendFiles(conn *net.UnixConn, files []*os.File) error {
+	for len(files) > 0 {
+		n := len(files)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		fds := make([]int, n)
+		for i, f := range files[:n] {
+			fds[i] = int(f.Fd())
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{byte(n)}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+		files = files[n:]
+	}
+	return nil
+}
+
+func receiveFiles(conn *net.UnixConn, count int) ([]*os.File, error) {
+	var (
+		files = make([]*os.File, 0, count)
+		buf   = make([]byte, 1)
+		oob   = make([]byte, syscall.CmsgSpace(maxBatch*4))
+	)
+	for len(files) < count {
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		for i := range messages {
+			fds, parseErr := syscall.ParseUnixRights(&messages[i])
+			if parseErr != nil {
+				closeFiles(files)
+				return nil, parseErr
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+		if len(messages) == 0 {
+			closeFiles(files)
+			return nil, errors.New("no file descriptors in message")
+		}
+	}
+	return files, nil
+}
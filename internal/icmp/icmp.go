@@ -0,0 +1,100 @@
+// Package icmp implements relaying of ICMP errors to TURN clients as
+// described in RFC 8656, where ICMP packets that are received on relayed
+// address in response to data sent to peer are passed to client in Data
+// indication with ICMP attribute.
+//
+// ICMP errors are read from socket error queue, that is supported only
+// on Linux.
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gortc/stun"
+)
+
+// AttrICMP is ICMP attribute type.
+//
+// RFC 8656 Section 18.13
+const AttrICMP stun.AttrType = 0x8004
+
+const attrSize = 8 // 2 bytes reserved, type, code and 4 bytes of data
+
+// ErrBadLength means that ICMP attribute value has unexpected length.
+var ErrBadLength = errors.New("bad ICMP attribute length")
+
+// ErrNotSupported means that reading ICMP errors is not supported for
+// connection or platform.
+var ErrNotSupported = errors.New("ICMP errors are not supported")
+
+// Error represents ICMP attribute, the ICMP error that was received in
+// response to data sent to peer.
+type Error struct {
+	Type uint8
+	Code uint8
+	// Data is next-hop MTU for "Packet Too Big" and "Fragmentation
+	// Needed" errors, zero otherwise.
+	Data uint32
+}
+
+func (e Error) String() string {
+	return fmt.Sprintf("type %d, code %d, data %d", e.Type, e.Code, e.Data)
+}
+
+// AddTo adds ICMP attribute to message.
+func (e Error) AddTo(m *stun.Message) error {
+	v := make([]byte, attrSize)
+	v[2] = e.Type
+	v[3] = e.Code
+	binary.BigEndian.PutUint32(v[4:], e.Data)
+	m.Add(AttrICMP, v)
+	return nil
+}
+
+// GetFrom decodes ICMP attribute from message.
+func (e *Error) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrICMP)
+	if err != nil {
+		return err
+	}
+	if len(v) != attrSize {
+		return ErrBadLength
+	}
+	e.Type = v[2]
+	e.Code = v[3]
+	e.Data = binary.BigEndian.Uint32(v[4:])
+	return nil
+}
+
+// ICMP types that are relayed to clients.
+const (
+	typeDestinationUnreachable = 3  // ICMPv4
+	typeTimeExceeded           = 11 // ICMPv4
+
+	typeV6DestinationUnreachable = 1 // ICMPv6
+	typeV6PacketTooBig           = 2 // ICMPv6
+	typeV6TimeExceeded           = 3 // ICMPv6
+
+	codeFragmentationNeeded = 4 // of ICMPv4 Destination Unreachable
+)
+
+// relayed reports whether ICMP error of provided type should be relayed
+// to client.
+//
+// RFC 8656 Section 11.5
+func relayed(v6 bool, t uint8) bool {
+	if v6 {
+		return t == typeV6DestinationUnreachable || t == typeV6PacketTooBig || t == typeV6TimeExceeded
+	}
+	return t == typeDestinationUnreachable || t == typeTimeExceeded
+}
+
+// hasMTU reports whether ICMP error carries next-hop MTU.
+func hasMTU(v6 bool, t, c uint8) bool {
+	if v6 {
+		return t == typeV6PacketTooBig
+	}
+	return t == typeDestinationUnreachable && c == codeFragmentationNeeded
+}
@@ -0,0 +1,145 @@
+//+build linux
+
+package icmp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/gortc/turn"
+)
+
+// Origins of extended error, see linux/errqueue.h.
+const (
+	originICMP  = 2
+	originICMP6 = 3
+)
+
+// sockExtendedErr is sock_extended_err from linux/errqueue.h.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+func rawConn(conn net.PacketConn) (syscall.RawConn, error) {
+	c, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return c.SyscallConn()
+}
+
+// Enable enables queueing of ICMP errors for UDP connection, so they can
+// be read by Read.
+func Enable(conn net.PacketConn) error {
+	raw, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err = raw.Control(func(fd uintptr) {
+		domain, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		if domain == syscall.AF_INET6 {
+			// Errors for IPv4-mapped peers of dual-stack socket are
+			// queued by IPV6_RECVERR.
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Read reads all queued errors of connection, calling f with every ICMP
+// error that should be relayed and address of peer to which data was sent.
+// Returns count of read errors.
+//
+// Connection should be enabled by Enable, otherwise nothing is read.
+func Read(conn net.PacketConn, f func(e Error, peer turn.Addr)) (int, error) {
+	raw, err := rawConn(conn)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		count   int
+		readErr error
+		buf     = make([]byte, 1) // payload is not used
+		oob     = make([]byte, 128)
+	)
+	if err = raw.Read(func(fd uintptr) bool {
+		for {
+			_, oobn, _, from, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN {
+				return true
+			}
+			if err != nil {
+				readErr = err
+				return true
+			}
+			count++
+			e, ok := parse(oob[:oobn])
+			if !ok {
+				continue
+			}
+			var peer turn.Addr
+			switch a := from.(type) {
+			case *syscall.SockaddrInet4:
+				peer.IP = net.IPv4(a.Addr[0], a.Addr[1], a.Addr[2], a.Addr[3])
+				peer.Port = a.Port
+			case *syscall.SockaddrInet6:
+				peer.IP = make(net.IP, net.IPv6len)
+				copy(peer.IP, a.Addr[:])
+				peer.Port = a.Port
+			default:
+				continue
+			}
+			f(e, peer)
+		}
+	}); err != nil {
+		return count, err
+	}
+	return count, readErr
+}
+
+// parse returns ICMP error from control messages of error queue, false if
+// there is no ICMP error that should be relayed.
+func parse(oob []byte) (Error, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return Error{}, false
+	}
+	for _, m := range msgs {
+		isErr := (m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR) ||
+			(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR)
+		if !isErr || len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+			continue
+		}
+		ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+		if ee.Origin != originICMP && ee.Origin != originICMP6 {
+			// Local error, e.g. EMSGSIZE.
+			continue
+		}
+		v6 := ee.Origin == originICMP6
+		if !relayed(v6, ee.Type) {
+			continue
+		}
+		e := Error{Type: ee.Type, Code: ee.Code}
+		if hasMTU(v6, ee.Type, ee.Code) {
+			e.Data = ee.Info
+		}
+		return e, true
+	}
+	return Error{}, false
+}
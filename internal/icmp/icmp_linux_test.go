@@ -0,0 +1,66 @@
+//+build linux
+
+package icmp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+func TestRead(t *testing.T) {
+	// Port of closed connection is unreachable.
+	closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.LocalAddr().(*net.UDPAddr)
+	if err = closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = Enable(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.WriteTo([]byte("hello"), unreachable); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = conn.ReadFrom(make([]byte, 64)); err == nil {
+		t.Fatal("should fail")
+	}
+	var (
+		errs  []Error
+		peers []turn.Addr
+	)
+	n, err := Read(conn, func(e Error, peer turn.Addr) {
+		errs = append(errs, e)
+		peers = append(peers, peer)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(errs) != 1 {
+		t.Fatalf("unexpected count %d (%d relayed)", n, len(errs))
+	}
+	if errs[0] != (Error{Type: 3, Code: 3}) {
+		t.Errorf("unexpected error %s", errs[0])
+	}
+	if !peers[0].Equal(turn.Addr{IP: unreachable.IP, Port: unreachable.Port}) {
+		t.Errorf("unexpected peer %s", peers[0])
+	}
+	n, err = Read(conn, func(e Error, peer turn.Addr) {
+		t.Error("unexpected error")
+	})
+	if err != nil || n != 0 {
+		t.Errorf("queue should be empty: %d, %v", n, err)
+	}
+}
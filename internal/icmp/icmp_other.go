@@ -0,0 +1,21 @@
+//+build !linux
+
+package icmp
+
+import (
+	"net"
+
+	"github.com/gortc/turn"
+)
+
+// Enable enables queueing of ICMP errors for UDP connection, so they can
+// be read by Read. Not supported on this platform.
+func Enable(conn net.PacketConn) error {
+	return ErrNotSupported
+}
+
+// Read reads all queued errors of connection. Not supported on this
+// platform.
+func Read(conn net.PacketConn, f func(e Error, peer turn.Addr)) (int, error) {
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,58 @@
+package icmp
+
+import (
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestError(t *testing.T) {
+	e := Error{Type: 3, Code: 4, Data: 1280}
+	m := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), e)
+	var decoded Error
+	if err := decoded.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != e {
+		t.Errorf("unexpected %s", decoded)
+	}
+	t.Run("BadLength", func(t *testing.T) {
+		m := stun.New()
+		m.Add(AttrICMP, []byte{1, 2, 3})
+		if err := decoded.GetFrom(m); err != ErrBadLength {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Missing", func(t *testing.T) {
+		if err := decoded.GetFrom(stun.New()); err != stun.ErrAttributeNotFound {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestRelayed(t *testing.T) {
+	for _, tc := range []struct {
+		v6      bool
+		t, c    uint8
+		relayed bool
+		mtu     bool
+	}{
+		{t: 3, c: 3, relayed: true},
+		{t: 3, c: 4, relayed: true, mtu: true},
+		{t: 11, relayed: true},
+		{t: 0},
+		{t: 5},
+		{v6: true, t: 1, relayed: true},
+		{v6: true, t: 2, relayed: true, mtu: true},
+		{v6: true, t: 3, relayed: true},
+		{v6: true, t: 4},
+		{v6: true, t: 128},
+	} {
+		if v := relayed(tc.v6, tc.t); v != tc.relayed {
+			t.Errorf("relayed(%v, %d) = %v", tc.v6, tc.t, v)
+		}
+		if v := hasMTU(tc.v6, tc.t, tc.c); v != tc.mtu {
+			t.Errorf("hasMTU(%v, %d, %d) = %v", tc.v6, tc.t, tc.c, v)
+		}
+	}
+}
@@ -2,11 +2,22 @@
 package manage
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/turn"
 )
 
 // Notifier wraps notify method.
@@ -14,10 +25,33 @@ type Notifier interface {
 	Notify()
 }
 
+// ReadinessChecker wraps Ready method that returns nil if server is ready
+// to serve requests.
+type ReadinessChecker interface {
+	Ready() error
+}
+
+// StatsProvider wraps Stats method that returns allocation statistics.
+type StatsProvider interface {
+	Stats() allocator.Stats
+}
+
+// Blocklist wraps methods for management of named blocklists.
+type Blocklist interface {
+	Block(name string, subnet *net.IPNet, ttl time.Duration, reason string) (int, error)
+	Unblock(name string, subnet *net.IPNet) (bool, error)
+	Blocked(name string) ([]filter.BlockEntry, error)
+}
+
 // Manager handles http management endpoints.
 type Manager struct {
-	notifier Notifier
-	l        *zap.Logger
+	notifier  Notifier
+	ready     ReadinessChecker
+	drain     Notifier
+	stats     StatsProvider
+	blocklist Blocklist
+	capture   *capture.Hub
+	l         *zap.Logger
 }
 
 func (m Manager) fprintln(w io.Writer, a ...interface{}) {
@@ -26,6 +60,213 @@ func (m Manager) fprintln(w io.Writer, a ...interface{}) {
 	}
 }
 
+// Capture limits.
+const (
+	defaultCaptureDuration = time.Second * 10
+	maxCaptureDuration     = time.Minute * 5
+	defaultCaptureSize     = 10 * 1024 * 1024
+	maxCaptureSize         = 100 * 1024 * 1024
+)
+
+// parseSubnet parses CIDR or single IP address as subnet.
+func parseSubnet(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+			v += "/32"
+		} else {
+			v += "/128"
+		}
+	}
+	_, subnet, err := net.ParseCIDR(v)
+	return subnet, err
+}
+
+func parseCaptureRequest(r *http.Request) (capture.Filter, capture.Limits, error) {
+	var (
+		f = capture.Filter{}
+		l = capture.Limits{
+			Duration: defaultCaptureDuration,
+			Bytes:    defaultCaptureSize,
+		}
+		q = r.URL.Query()
+	)
+	if v := q.Get("client"); v != "" {
+		subnet, err := parseSubnet(v)
+		if err != nil {
+			return f, l, err
+		}
+		f.Client = subnet
+	}
+	if v := q.Get("allocation"); v != "" {
+		a, err := net.ResolveUDPAddr("udp", v)
+		if err != nil {
+			return f, l, err
+		}
+		f.Allocation = &turn.Addr{IP: a.IP, Port: a.Port}
+	}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return f, l, err
+		}
+		l.Duration = d
+	}
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, l, err
+		}
+		l.Bytes = n
+	}
+	if l.Duration <= 0 || l.Duration > maxCaptureDuration {
+		return f, l, fmt.Errorf("duration should be in (0, %s]", maxCaptureDuration)
+	}
+	if l.Bytes <= 0 || l.Bytes > maxCaptureSize {
+		return f, l, fmt.Errorf("size should be in (0, %d]", maxCaptureSize)
+	}
+	return f, l, nil
+}
+
+func (m Manager) serveCapture(w http.ResponseWriter, r *http.Request) {
+	if m.capture == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		m.fprintln(w, "capture is not available")
+		return
+	}
+	f, l, err := parseCaptureRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		m.fprintln(w, "bad capture request:", err)
+		return
+	}
+	m.l.Info("starting capture",
+		zap.String("query", r.URL.RawQuery),
+		zap.Duration("duration", l.Duration),
+		zap.Int64("size", l.Bytes),
+	)
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", `attachment; filename="gortcd.pcapng"`)
+	w.WriteHeader(http.StatusOK)
+	if captureErr := m.capture.Capture(r.Context(), w, f, l); captureErr != nil {
+		m.l.Warn("capture failed", zap.Error(captureErr))
+		return
+	}
+	m.l.Info("capture done")
+}
+
+func (m Manager) serveReady(w http.ResponseWriter) {
+	if m.ready != nil {
+		if err := m.ready.Ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			m.fprintln(w, "not ready:", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	m.fprintln(w, "ready")
+}
+
+func (m Manager) serveStats(w http.ResponseWriter) {
+	if m.stats == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		m.fprintln(w, "stats are not available")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(m.stats.Stats()); err != nil {
+		m.l.Warn("failed to write", zap.Error(err))
+	}
+}
+
+// serveBlocklist handles /blocklist/{name} endpoint:
+//
+//	GET lists entries,
+//	POST adds entry, e.g. ?net=10.0.0.0/8&ttl=1h&reason=abuse,
+//	DELETE removes entry, e.g. ?net=10.0.0.0/8.
+func (m Manager) serveBlocklist(w http.ResponseWriter, r *http.Request) {
+	if m.blocklist == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		m.fprintln(w, "blocklist is not available")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/blocklist/")
+	if name != server.BlocklistClient && name != server.BlocklistPeer {
+		w.WriteHeader(http.StatusNotFound)
+		m.fprintln(w, "blocklist not found")
+		return
+	}
+	if r.Method == http.MethodGet {
+		entries, err := m.blocklist.Blocked(name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			m.fprintln(w, "failed to list blocklist:", err)
+			return
+		}
+		if entries == nil {
+			entries = []filter.BlockEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if encodeErr := json.NewEncoder(w).Encode(entries); encodeErr != nil {
+			m.l.Warn("failed to write", zap.Error(encodeErr))
+		}
+		return
+	}
+	q := r.URL.Query()
+	subnet, err := parseSubnet(q.Get("net"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		m.fprintln(w, "bad net:", err)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var ttl time.Duration
+		if v := q.Get("ttl"); v != "" {
+			if ttl, err = time.ParseDuration(v); err != nil || ttl < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				m.fprintln(w, "bad ttl:", v)
+				return
+			}
+		}
+		reason := q.Get("reason")
+		killed, blockErr := m.blocklist.Block(name, subnet, ttl, reason)
+		if blockErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			m.fprintln(w, "failed to block:", blockErr)
+			return
+		}
+		m.l.Info("blocked",
+			zap.String("list", name),
+			zap.Stringer("net", subnet),
+			zap.Duration("ttl", ttl),
+			zap.String("reason", reason),
+			zap.Int("killed", killed),
+		)
+		w.WriteHeader(http.StatusOK)
+		m.fprintln(w, "blocked", subnet, "killed", killed, "allocations")
+	case http.MethodDelete:
+		removed, unblockErr := m.blocklist.Unblock(name, subnet)
+		if unblockErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			m.fprintln(w, "failed to unblock:", unblockErr)
+			return
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			m.fprintln(w, "entry not found")
+			return
+		}
+		m.l.Info("unblocked", zap.String("list", name), zap.Stringer("net", subnet))
+		w.WriteHeader(http.StatusOK)
+		m.fprintln(w, "unblocked", subnet)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		m.fprintln(w, "method not allowed")
+	}
+}
+
 // ServeHTTP implements http.Handler.
 func (m Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
@@ -34,16 +275,59 @@ func (m Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		m.notifier.Notify()
 		m.fprintln(w, "server will be reloaded soon")
+	case "/capture":
+		m.serveCapture(w, r)
+	case "/drain":
+		if m.drain == nil {
+			w.WriteHeader(http.StatusNotImplemented)
+			m.fprintln(w, "drain is not available")
+			return
+		}
+		m.l.Info("got drain request")
+		w.WriteHeader(http.StatusOK)
+		m.drain.Notify()
+		m.fprintln(w, "server is draining")
+	case "/stats":
+		m.serveStats(w)
+	case "/healthz":
+		w.WriteHeader(http.StatusOK)
+		m.fprintln(w, "ok")
+	case "/readyz":
+		m.serveReady(w)
 	default:
+		if strings.HasPrefix(r.URL.Path, "/blocklist/") {
+			m.serveBlocklist(w, r)
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		m.fprintln(w, "management endpoint not found")
 	}
 }
 
+// Options contain possible settings for Manager.
+type Options struct {
+	Log      *zap.Logger
+	Notifier Notifier
+	Capture  *capture.Hub     // capture endpoint is disabled if nil
+	Ready    ReadinessChecker // always ready if nil
+	Drain    Notifier         // drain endpoint is disabled if nil
+	Stats    StatsProvider    // stats endpoint is disabled if nil
+	// Blocklist endpoint is disabled if nil.
+	Blocklist Blocklist
+}
+
 // NewManager initializes and returns Manager.
-func NewManager(l *zap.Logger, n Notifier) Manager {
+func NewManager(o Options) Manager {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
 	return Manager{
-		l:        l,
-		notifier: n,
+		l:         o.Log,
+		notifier:  o.Notifier,
+		capture:   o.Capture,
+		ready:     o.Ready,
+		drain:     o.Drain,
+		stats:     o.Stats,
+		blocklist: o.Blocklist,
 	}
 }
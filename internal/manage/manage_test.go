@@ -1,14 +1,22 @@
 package manage
 
 import (
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/filter"
 )
 
 type notifierFunc func()
@@ -24,7 +32,7 @@ func (errWriter) Write(p []byte) (n int, err error) {
 func TestManager_ErrorLogging(t *testing.T) {
 	notifier := notifierFunc(func() {})
 	core, logs := observer.New(zapcore.WarnLevel)
-	m := NewManager(zap.New(core), notifier)
+	m := NewManager(Options{Log: zap.New(core), Notifier: notifier})
 	m.fprintln(errWriter{}, "test")
 	if logs.Len() != 1 {
 		t.Error("unexpected log entry count")
@@ -36,7 +44,7 @@ func TestManager_ServeHTTP(t *testing.T) {
 	notifier := notifierFunc(func() {
 		notified = true
 	})
-	s := httptest.NewServer(NewManager(zap.NewNop(), notifier))
+	s := httptest.NewServer(NewManager(Options{Log: zap.NewNop(), Notifier: notifier}))
 	defer s.Close()
 	c := s.Client()
 	res, err := c.Get("http://" + s.Listener.Addr().String() + "/reload")
@@ -57,3 +65,234 @@ func TestManager_ServeHTTP(t *testing.T) {
 		t.Error("bad status")
 	}
 }
+
+func TestManager_capture(t *testing.T) {
+	hub := capture.NewHub()
+	s := httptest.NewServer(NewManager(Options{
+		Notifier: notifierFunc(func() {}),
+		Capture:  hub,
+	}))
+	defer s.Close()
+	c := s.Client()
+	t.Run("BadRequest", func(t *testing.T) {
+		for _, q := range []string{
+			"client=bad",
+			"allocation=bad",
+			"duration=1h",
+			"duration=bad",
+			"size=0",
+			"size=bad",
+		} {
+			res, err := c.Get(s.URL + "/capture?" + q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: unexpected status %d", q, res.StatusCode)
+			}
+		}
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		disabled := httptest.NewServer(NewManager(Options{}))
+		defer disabled.Close()
+		res, err := disabled.Client().Get(disabled.URL + "/capture")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusNotImplemented {
+			t.Errorf("unexpected status %d", res.StatusCode)
+		}
+	})
+	res, err := c.Get(s.URL + "/capture?client=127.0.0.1&duration=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) < 4 || body[0] != 0x0A || body[3] != 0x0A {
+		t.Error("unexpected pcapng header")
+	}
+}
+
+type readyFunc func() error
+
+func (f readyFunc) Ready() error { return f() }
+
+func TestManager_health(t *testing.T) {
+	var readyErr error
+	s := httptest.NewServer(NewManager(Options{
+		Notifier: notifierFunc(func() {}),
+		Ready:    readyFunc(func() error { return readyErr }),
+	}))
+	defer s.Close()
+	c := s.Client()
+	for _, tc := range []struct {
+		path   string
+		err    error
+		status int
+	}{
+		{"/healthz", nil, http.StatusOK},
+		{"/healthz", io.ErrUnexpectedEOF, http.StatusOK},
+		{"/readyz", nil, http.StatusOK},
+		{"/readyz", io.ErrUnexpectedEOF, http.StatusServiceUnavailable},
+	} {
+		readyErr = tc.err
+		res, err := c.Get(s.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: unexpected status %d", tc.path, res.StatusCode)
+		}
+		if closeErr := res.Body.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}
+}
+
+func TestManager_drain(t *testing.T) {
+	s := httptest.NewServer(NewManager(Options{
+		Notifier: notifierFunc(func() {}),
+	}))
+	defer s.Close()
+	res, err := s.Client().Get(s.URL + "/drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+	drained := false
+	s.Config.Handler = NewManager(Options{
+		Notifier: notifierFunc(func() {}),
+		Drain:    notifierFunc(func() { drained = true }),
+	})
+	res, err = s.Client().Get(s.URL + "/drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+	if !drained {
+		t.Error("drain not requested")
+	}
+}
+
+type statsFunc func() allocator.Stats
+
+func (f statsFunc) Stats() allocator.Stats { return f() }
+
+func TestManager_stats(t *testing.T) {
+	s := httptest.NewServer(NewManager(Options{
+		Notifier: notifierFunc(func() {}),
+		Stats: statsFunc(func() allocator.Stats {
+			return allocator.Stats{Allocations: 3, Permissions: 2, Bindings: 1}
+		}),
+	}))
+	defer s.Close()
+	res, err := s.Client().Get(s.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var got allocator.Stats
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Allocations != 3 || got.Permissions != 2 || got.Bindings != 1 {
+		t.Errorf("unexpected stats %+v", got)
+	}
+}
+
+type blocklistStub struct {
+	entries map[string]filter.BlockEntry
+}
+
+func (b *blocklistStub) Block(name string, subnet *net.IPNet, ttl time.Duration, reason string) (int, error) {
+	b.entries[name+" "+subnet.String()] = filter.BlockEntry{Net: subnet.String(), Reason: reason}
+	return 1, nil
+}
+
+func (b *blocklistStub) Unblock(name string, subnet *net.IPNet) (bool, error) {
+	_, ok := b.entries[name+" "+subnet.String()]
+	delete(b.entries, name+" "+subnet.String())
+	return ok, nil
+}
+
+func (b *blocklistStub) Blocked(name string) ([]filter.BlockEntry, error) {
+	var entries []filter.BlockEntry
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func TestManager_blocklist(t *testing.T) {
+	b := &blocklistStub{entries: make(map[string]filter.BlockEntry)}
+	s := httptest.NewServer(NewManager(Options{
+		Notifier:  notifierFunc(func() {}),
+		Blocklist: b,
+	}))
+	defer s.Close()
+	c := s.Client()
+	do := func(method, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closeErr := res.Body.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		return res.StatusCode
+	}
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/blocklist/client?net=10.0.0.0/8&ttl=1h&reason=abuse", http.StatusOK},
+		{http.MethodPost, "/blocklist/peer?net=10.0.0.1", http.StatusOK},
+		{http.MethodPost, "/blocklist/peer?net=bad", http.StatusBadRequest},
+		{http.MethodPost, "/blocklist/peer?net=10.0.0.1&ttl=bad", http.StatusBadRequest},
+		{http.MethodPost, "/blocklist/unknown?net=10.0.0.1", http.StatusNotFound},
+		{http.MethodPut, "/blocklist/peer?net=10.0.0.1", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/blocklist/peer?net=10.0.0.1/32", http.StatusOK},
+		{http.MethodDelete, "/blocklist/peer?net=10.0.0.1/32", http.StatusNotFound},
+	} {
+		if status := do(tc.method, tc.path); status != tc.status {
+			t.Errorf("%s %s: unexpected status %d", tc.method, tc.path, status)
+		}
+	}
+	res, err := c.Get(s.URL + "/blocklist/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var entries []filter.BlockEntry
+	if err = json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Net != "10.0.0.0/8" || entries[0].Reason != "abuse" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	disabled := httptest.NewServer(NewManager(Options{}))
+	defer disabled.Close()
+	res, err = disabled.Client().Get(disabled.URL + "/blocklist/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+}
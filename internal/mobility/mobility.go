@@ -0,0 +1,126 @@
+// Package mobility implements RFC 8016 Mobility with TURN, where client
+// can move allocation to new five-tuple, e.g. after switching network,
+// by refreshing it with ticket that was issued by server.
+package mobility
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// AttrMobilityTicket is MOBILITY-TICKET attribute type.
+//
+// RFC 8016 Section 3.4
+const AttrMobilityTicket stun.AttrType = 0x8030
+
+// CodeMobilityForbidden is returned if mobility is requested, but not
+// allowed by server.
+//
+// RFC 8016 Section 3.5
+const CodeMobilityForbidden stun.ErrorCode = 405
+
+// MobilityForbidden sets ERROR-CODE with CodeMobilityForbidden, that has
+// no default reason in stun package.
+var MobilityForbidden stun.Setter = &stun.ErrorCodeAttribute{
+	Code:   CodeMobilityForbidden,
+	Reason: []byte("Mobility Forbidden"),
+}
+
+// Ticket represents MOBILITY-TICKET attribute. Client sends empty ticket
+// in Allocate request to request mobility and ticket that was issued by
+// server in Refresh request to move allocation.
+type Ticket []byte
+
+// AddTo adds MOBILITY-TICKET to message.
+func (t Ticket) AddTo(m *stun.Message) error {
+	m.Add(AttrMobilityTicket, t)
+	return nil
+}
+
+// GetFrom decodes MOBILITY-TICKET from message.
+func (t *Ticket) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrMobilityTicket)
+	if err != nil {
+		return err
+	}
+	*t = append((*t)[:0], v...)
+	return nil
+}
+
+// Claims are allocation details that are sealed in ticket.
+type Claims struct {
+	Tuple    turn.FiveTuple `json:"tuple"`
+	Username string         `json:"username"`
+	Realm    string         `json:"realm"`
+}
+
+// ErrInvalidTicket means that ticket can't be opened by Sealer, e.g. it
+// was issued with another key or modified.
+var ErrInvalidTicket = errors.New("invalid mobility ticket")
+
+// Sealer issues and opens tickets, authenticating and encrypting claims
+// with AES-GCM, so they are opaque for clients.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// KeySize is size of key that is generated by NewSealer if not provided.
+const KeySize = 32
+
+// NewSealer initializes and returns Sealer with provided AES key of 16, 24
+// or 32 bytes. Random key is generated if key is empty, so tickets are
+// valid only until restart.
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) == 0 {
+		key = make([]byte, KeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal returns ticket with claims.
+func (s *Sealer) Seal(c Claims) (Ticket, error) {
+	plaintext, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open returns claims of ticket.
+func (s *Sealer) Open(t Ticket) (Claims, error) {
+	var c Claims
+	if len(t) < s.aead.NonceSize() {
+		return c, ErrInvalidTicket
+	}
+	nonceSize := s.aead.NonceSize()
+	plaintext, err := s.aead.Open(nil, t[:nonceSize], t[nonceSize:], nil)
+	if err != nil {
+		return c, ErrInvalidTicket
+	}
+	if err = json.Unmarshal(plaintext, &c); err != nil {
+		return c, ErrInvalidTicket
+	}
+	return c, nil
+}
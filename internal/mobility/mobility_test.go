@@ -0,0 +1,65 @@
+package mobility
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+func TestSealer(t *testing.T) {
+	s, err := NewSealer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := Claims{
+		Tuple: turn.FiveTuple{
+			Client: turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 5000},
+			Server: turn.Addr{IP: net.IPv4(203, 0, 113, 2), Port: 3478},
+			Proto:  turn.ProtoUDP,
+		},
+		Username: "user",
+		Realm:    "realm",
+	}
+	ticket, err := s.Seal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, ticket)
+	var decoded Ticket
+	if err = decoded.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := s.Open(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opened.Tuple.Equal(claims.Tuple) || opened.Username != claims.Username || opened.Realm != claims.Realm {
+		t.Errorf("unexpected claims %+v", opened)
+	}
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := append(Ticket(nil), ticket...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := s.Open(tampered); err != ErrInvalidTicket {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := s.Open(Ticket{1, 2, 3}); err != ErrInvalidTicket {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("OtherKey", func(t *testing.T) {
+		other, err := NewSealer(make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Open(ticket); err != ErrInvalidTicket {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("BadKey", func(t *testing.T) {
+		if _, err := NewSealer(make([]byte, 10)); err == nil {
+			t.Error("should error")
+		}
+	})
+}
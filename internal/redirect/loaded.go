@@ -0,0 +1,164 @@
+package redirect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+// Target is server that can be selected by LeastLoaded policy.
+type Target struct {
+	Addr turn.Addr
+	// Stats is URL of management API stats endpoint of server,
+	// e.g. "http://203.0.113.1:3257/stats".
+	Stats string
+}
+
+// LeastLoadedOptions contain possible settings for LeastLoaded.
+type LeastLoadedOptions struct {
+	Log      *zap.Logger
+	Targets  []Target
+	Client   *http.Client
+	Interval time.Duration // stats polling interval
+}
+
+// LeastLoaded is Policy that picks server with minimum count of allocations,
+// periodically polling stats endpoints of servers. Servers with failed
+// stats requests are not selected.
+type LeastLoaded struct {
+	log      *zap.Logger
+	targets  []Target
+	client   *http.Client
+	interval time.Duration
+	mux      sync.RWMutex
+	loads    []int // allocations count or -1 if unknown
+	close    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Pick implements Policy.
+func (l *LeastLoaded) Pick(client turn.Addr) (turn.Addr, bool) {
+	var (
+		best = -1
+		min  = 0
+	)
+	l.mux.RLock()
+	for i, load := range l.loads {
+		if load < 0 {
+			continue
+		}
+		if best < 0 || load < min {
+			best, min = i, load
+		}
+	}
+	l.mux.RUnlock()
+	if best < 0 {
+		return turn.Addr{}, false
+	}
+	return l.targets[best].Addr, true
+}
+
+type stats struct {
+	Allocations int `json:"allocations"`
+}
+
+func (l *LeastLoaded) fetch(url string) (int, error) {
+	res, err := l.client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			l.log.Warn("failed to close body", zap.Error(closeErr))
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	var s stats
+	if err = json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return 0, err
+	}
+	return s.Allocations, nil
+}
+
+// Update polls stats endpoints of all servers.
+func (l *LeastLoaded) Update() {
+	loads := make([]int, len(l.targets))
+	for i, t := range l.targets {
+		load, err := l.fetch(t.Stats)
+		if err != nil {
+			l.log.Warn("failed to get stats",
+				zap.Stringer("server", t.Addr),
+				zap.String("url", t.Stats),
+				zap.Error(err),
+			)
+			load = -1
+		}
+		loads[i] = load
+	}
+	l.mux.Lock()
+	l.loads = loads
+	l.mux.Unlock()
+}
+
+func (l *LeastLoaded) loop() {
+	defer l.wg.Done()
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.Update()
+		case <-l.close:
+			return
+		}
+	}
+}
+
+// Close stops polling.
+func (l *LeastLoaded) Close() error {
+	close(l.close)
+	l.wg.Wait()
+	return nil
+}
+
+// NewLeastLoaded initializes LeastLoaded policy, performs first stats update
+// and starts polling.
+func NewLeastLoaded(o LeastLoadedOptions) (*LeastLoaded, error) {
+	if len(o.Targets) == 0 {
+		return nil, ErrNoServers
+	}
+	for _, t := range o.Targets {
+		if t.Stats == "" {
+			return nil, errors.New("no stats url for " + t.Addr.String())
+		}
+	}
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: time.Second}
+	}
+	if o.Interval == 0 {
+		o.Interval = time.Second * 5
+	}
+	l := &LeastLoaded{
+		log:      o.Log,
+		targets:  o.Targets,
+		client:   o.Client,
+		interval: o.Interval,
+		close:    make(chan struct{}),
+	}
+	l.Update()
+	l.wg.Add(1)
+	go l.loop()
+	return l, nil
+}
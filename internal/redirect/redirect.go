@@ -0,0 +1,56 @@
+// Package redirect implements selection of alternate server for
+// redirecting clients with 300 (Try Alternate) response.
+package redirect
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/gortc/turn"
+)
+
+// Policy selects alternate server for client.
+type Policy interface {
+	// Pick returns alternate server for client or false if there is
+	// no available server.
+	Pick(client turn.Addr) (turn.Addr, bool)
+}
+
+// ErrNoServers means that policy is initialized without servers.
+var ErrNoServers = errors.New("no servers for redirect")
+
+type roundRobin struct {
+	servers []turn.Addr
+	n       uint32
+}
+
+func (r *roundRobin) Pick(client turn.Addr) (turn.Addr, bool) {
+	n := atomic.AddUint32(&r.n, 1)
+	return r.servers[int(n-1)%len(r.servers)], true
+}
+
+// RoundRobin returns Policy that cycles through servers.
+func RoundRobin(servers []turn.Addr) (Policy, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	return &roundRobin{servers: servers}, nil
+}
+
+type clientHash []turn.Addr
+
+func (h clientHash) Pick(client turn.Addr) (turn.Addr, bool) {
+	f := fnv.New32a()
+	_, _ = f.Write(client.IP) // #nosec
+	return h[int(f.Sum32()%uint32(len(h)))], true
+}
+
+// ClientHash returns Policy that picks server by client IP hash, so
+// same client is always redirected to same server.
+func ClientHash(servers []turn.Addr) (Policy, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	return clientHash(servers), nil
+}
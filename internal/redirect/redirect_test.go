@@ -0,0 +1,100 @@
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gortc/turn"
+)
+
+var servers = []turn.Addr{
+	{IP: net.IPv4(10, 0, 0, 1), Port: 3478},
+	{IP: net.IPv4(10, 0, 0, 2), Port: 3478},
+	{IP: net.IPv4(10, 0, 0, 3), Port: 3478},
+}
+
+func TestRoundRobin(t *testing.T) {
+	if _, err := RoundRobin(nil); err != ErrNoServers {
+		t.Error("unexpected error")
+	}
+	p, err := RoundRobin(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := turn.Addr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	for i := 0; i < len(servers)*2; i++ {
+		a, ok := p.Pick(client)
+		if !ok {
+			t.Fatal("not picked")
+		}
+		if !a.Equal(servers[i%len(servers)]) {
+			t.Errorf("%d: unexpected %s", i, a)
+		}
+	}
+}
+
+func TestClientHash(t *testing.T) {
+	if _, err := ClientHash(nil); err != ErrNoServers {
+		t.Error("unexpected error")
+	}
+	p, err := ClientHash(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		client := turn.Addr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 1234}
+		a, _ := p.Pick(client)
+		client.Port++
+		if b, _ := p.Pick(client); !a.Equal(b) {
+			t.Error("same client IP should be redirected to same server")
+		}
+		picked[a.String()] = true
+	}
+	if len(picked) != len(servers) {
+		t.Errorf("only %d servers picked", len(picked))
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	var targets []Target
+	for i, load := range []int{10, 5, -1} {
+		load := load
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if load < 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, `{"allocations":%d}`, load)
+		}))
+		defer s.Close()
+		targets = append(targets, Target{Addr: servers[i], Stats: s.URL})
+	}
+	if _, err := NewLeastLoaded(LeastLoadedOptions{}); err != ErrNoServers {
+		t.Error("unexpected error")
+	}
+	if _, err := NewLeastLoaded(LeastLoadedOptions{
+		Targets: []Target{{Addr: servers[0]}},
+	}); err == nil {
+		t.Error("should error without stats url")
+	}
+	p, err := NewLeastLoaded(LeastLoadedOptions{
+		Targets:  targets,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	a, ok := p.Pick(turn.Addr{})
+	if !ok {
+		t.Fatal("not picked")
+	}
+	if !a.Equal(servers[1]) {
+		t.Errorf("unexpected %s", a)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/filter"
+)
+
+// Blocklist names.
+const (
+	BlocklistClient = "client"
+	BlocklistPeer   = "peer"
+)
+
+func (u *Updater) blocklist(name string) (*filter.Blocklist, error) {
+	var b *filter.Blocklist
+	switch name {
+	case BlocklistClient:
+		b = u.Get().ClientBlocklist
+	case BlocklistPeer:
+		b = u.Get().PeerBlocklist
+	default:
+		return nil, errors.Errorf("unknown blocklist %q", name)
+	}
+	if b == nil {
+		return nil, errors.Errorf("blocklist %q is not enabled", name)
+	}
+	return b, nil
+}
+
+// Block adds deny entry for subnet to blocklist with provided name
+// and kills allocations that match it, i.e. allocations of clients from
+// subnet for client blocklist or allocations having permissions for
+// peers from subnet for peer blocklist. Returns killed allocations count.
+func (u *Updater) Block(name string, subnet *net.IPNet, ttl time.Duration, reason string) (int, error) {
+	b, err := u.blocklist(name)
+	if err != nil {
+		return 0, err
+	}
+	if err = b.Add(subnet, ttl, reason); err != nil {
+		return 0, errors.Wrap(err, "failed to add entry")
+	}
+	match := func(a allocator.AllocationState) bool {
+		return subnet.Contains(a.Tuple.Client.IP)
+	}
+	if name == BlocklistPeer {
+		match = func(a allocator.AllocationState) bool {
+			for _, p := range a.Permissions {
+				if subnet.Contains(p.Addr.IP) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	killed := 0
+	u.mux.RLock()
+	for _, s := range u.listeners {
+		killed += s.kill(match)
+	}
+	u.mux.RUnlock()
+	return killed, nil
+}
+
+// Unblock removes entry for subnet from blocklist with provided name,
+// returning false if there were none.
+func (u *Updater) Unblock(name string, subnet *net.IPNet) (bool, error) {
+	b, err := u.blocklist(name)
+	if err != nil {
+		return false, err
+	}
+	return b.Remove(subnet)
+}
+
+// Blocked returns entries of blocklist with provided name.
+func (u *Updater) Blocked(name string) ([]filter.BlockEntry, error) {
+	b, err := u.blocklist(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.Entries(), nil
+}
+
+// kill removes allocations that match, returning removed count.
+func (s *Server) kill(match func(a allocator.AllocationState) bool) int {
+	killed := 0
+	for _, a := range s.allocs.Export() {
+		if !match(a) {
+			continue
+		}
+		if err := s.allocs.Kill(a.Tuple); err != nil {
+			// Allocation can be already removed concurrently.
+			s.log.Debug("failed to kill allocation", zap.Stringer("tuple", a.Tuple), zap.Error(err))
+			continue
+		}
+		s.cluster.Release(a.Tuple)
+		s.log.Info("killed blocked allocation", zap.Stringer("tuple", a.Tuple))
+		killed++
+	}
+	return killed
+}
@@ -1,33 +1,84 @@
 package server
 
 import (
-	"time"
-
+	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/filter"
-	"github.com/gortc/stun"
+	"github.com/gortc/turn"
 )
 
 type config struct {
-	realm           stun.Realm
-	maxLifetime     time.Duration
-	defaultLifetime time.Duration
-	workers         int
-	authForSTUN     bool
-	debugCollect    bool
-	software        stun.Software
-	peerFilter      filter.Rule
-	clientFilter    filter.Rule
+	realm        *realmConfig // default realm of listener
+	realms       map[string]*realmConfig
+	origins      map[string]*realmConfig
+	workers      int
+	authForSTUN  bool
+	legacy       bool
+	debugCollect bool
+	peerFilter   filter.Rule
+	peerPolicies map[allocator.Session]filter.Rule
+	clientFilter filter.Rule
+}
+
+func newConfig(options Options, listener turn.Addr) config {
+	c := config{
+		realm:        newRealmConfig(options, Realm{Name: options.Realm}),
+		workers:      options.Workers,
+		authForSTUN:  options.AuthForSTUN,
+		legacy:       options.Legacy,
+		clientFilter: withBlocklist(options.ClientBlocklist, options.ClientRule),
+		peerFilter:   withBlocklist(options.PeerBlocklist, options.PeerRule),
+	}
+	if len(options.Realms) > 0 {
+		c.realms = make(map[string]*realmConfig, len(options.Realms)+1)
+		c.origins = make(map[string]*realmConfig)
+		c.realms[c.realm.name] = c.realm
+		for _, r := range options.Realms {
+			rc := newRealmConfig(options, r)
+			c.realms[r.Name] = rc
+			for _, origin := range r.Origins {
+				c.origins[origin] = rc
+			}
+			if hasListener(r.Listeners, listener) {
+				c.realm = rc
+			}
+		}
+	}
+	if len(options.PeerPolicies) > 0 {
+		peerRule := options.PeerRule
+		if peerRule == nil {
+			peerRule = filter.AllowAll
+		}
+		c.peerPolicies = make(map[allocator.Session]filter.Rule, len(options.PeerPolicies))
+		for _, p := range options.PeerPolicies {
+			key := allocator.Session{Username: p.Username, Realm: p.Realm}
+			c.peerPolicies[key] = withBlocklist(options.PeerBlocklist,
+				filter.NewFilter(filter.Deny, p.Rule, peerRule),
+			)
+		}
+	}
+	return c
+}
+
+// peerRule returns peer filtering rule for session, selecting policy of
+// user, then policy of realm and falling back to peer filter.
+func (c config) peerRule(s allocator.Session) filter.Rule {
+	if len(c.peerPolicies) == 0 {
+		return c.peerFilter
+	}
+	if r, ok := c.peerPolicies[s]; ok {
+		return r
+	}
+	if r, ok := c.peerPolicies[allocator.Session{Realm: s.Realm}]; ok {
+		return r
+	}
+	return c.peerFilter
 }
 
-func newConfig(options Options) config {
-	return config{
-		maxLifetime:     time.Hour,
-		defaultLifetime: time.Minute,
-		workers:         options.Workers,
-		authForSTUN:     options.AuthForSTUN,
-		software:        stun.NewSoftware(options.Software),
-		clientFilter:    options.ClientRule,
-		peerFilter:      options.PeerRule,
-		realm:           stun.NewRealm(options.Realm),
+// withBlocklist returns rule that denies addresses from blocklist before
+// applying r.
+func withBlocklist(b *filter.Blocklist, r filter.Rule) filter.Rule {
+	if b == nil {
+		return r
 	}
+	return filter.NewFilter(filter.Deny, b, r)
 }
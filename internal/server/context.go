@@ -5,7 +5,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/gortcd/internal/trace"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
@@ -44,16 +46,27 @@ type context struct {
 	cdata     *turn.ChannelData
 	nonce     stun.Nonce
 	realm     stun.Realm
+	tenant    *realmConfig // realm of request, nil if not selected
+	username  stun.Username
 	integrity stun.MessageIntegrity
-	buf       []byte // buf request
+	span      *trace.Span // nil if not sampled
+	decoded   bool        // request is decoded STUN message
+	buf       []byte      // buf request
 }
 
+// allowPeer reports whether peer rule for authenticated user allows
+// peer address.
 func (c *context) allowPeer(addr turn.Addr) bool {
-	return c.cfg.peerFilter.Action(addr) == filter.Allow
+	rule := c.cfg.peerRule(allocator.Session{
+		Username: c.username.String(),
+		Realm:    c.realm.String(),
+	})
+	// Relayed transport is always UDP.
+	return filter.ActionFor(rule, addr, turn.ProtoUDP) == filter.Allow
 }
 
 func (c *context) allowClient(addr turn.Addr) bool {
-	return c.cfg.clientFilter.Action(addr) == filter.Allow
+	return filter.ActionFor(c.cfg.clientFilter, addr, c.proto) == filter.Allow
 }
 
 func (c *context) setTuple() {
@@ -76,7 +89,11 @@ func (c *context) reset() {
 	c.setTuple()
 	c.nonce = c.nonce[:0]
 	c.realm = c.realm[:0]
+	c.tenant = nil
+	c.username = c.username[:0]
 	c.integrity = nil
+	c.span = nil
+	c.decoded = false
 	c.buf = c.buf[:cap(c.buf)]
 	for i := range c.buf {
 		c.buf[i] = 0
@@ -115,8 +132,8 @@ func (c *context) build(class stun.MessageClass, method stun.Method, s ...stun.S
 	if err := c.apply(&c.nonce, &c.realm); err != nil {
 		return err
 	}
-	if len(c.cfg.software) > 0 {
-		if err := c.cfg.software.AddTo(c.response); err != nil {
+	if c.tenant != nil && len(c.tenant.software) > 0 {
+		if err := c.tenant.software.AddTo(c.response); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+
+	"github.com/gortc/gortcd/internal/discovery"
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// processDiscoveryBinding processes Binding request on listener of NAT
+// behavior discovery group as described in RFC 5780 Section 6.1, sending
+// response from listener that is requested by CHANGE-REQUEST to port that
+// is requested by RESPONSE-PORT.
+func (s *Server) processDiscoveryBinding(ctx *context) error {
+	var (
+		change discovery.ChangeRequest
+		port   discovery.ResponsePort
+	)
+	if err := change.GetFrom(ctx.request); err != nil && err != stun.ErrAttributeNotFound {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	portErr := port.GetFrom(ctx.request)
+	if portErr != nil && portErr != stun.ErrAttributeNotFound {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	origin, ok := s.changeOrigin(ctx, change)
+	if !ok {
+		// Listener is not available, so server can't change address.
+		return ctx.buildErr(stun.CodeUnknownAttribute,
+			stun.UnknownAttributes{discovery.AttrChangeRequest},
+		)
+	}
+	other, _ := s.discovery.Other(ctx.server)
+	if err := ctx.buildOk(
+		(*stun.XORMappedAddress)(&ctx.client),
+		&discovery.ResponseOrigin{IP: origin.IP, Port: origin.Port},
+		&discovery.OtherAddress{IP: other.IP, Port: other.Port},
+	); err != nil {
+		return err
+	}
+	if portErr == nil {
+		ctx.addr = &net.UDPAddr{IP: ctx.client.IP, Port: int(port)}
+	}
+	return nil
+}
+
+// changeOrigin selects listener from which response is sent as requested
+// by CHANGE-REQUEST, replacing connection of ctx if needed. Returns false
+// if listener is not available.
+func (s *Server) changeOrigin(ctx *context, change discovery.ChangeRequest) (turn.Addr, bool) {
+	if !change.ChangeIP && !change.ChangePort {
+		return ctx.server, true
+	}
+	origin, ok := s.discovery.Changed(ctx.server, change)
+	if !ok {
+		return turn.Addr{}, false
+	}
+	conn, ok := s.discovery.Conn(origin)
+	if !ok {
+		return turn.Addr{}, false
+	}
+	ctx.conn = conn
+	return origin, true
+}
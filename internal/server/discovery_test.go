@@ -0,0 +1,149 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gortc/gortcd/internal/discovery"
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// listenPair listens on same port of both IP addresses.
+func listenPair(t *testing.T, a, b net.IP) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		connA, err := net.ListenUDP("udp", &net.UDPAddr{IP: a})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := connA.LocalAddr().(*net.UDPAddr).Port
+		connB, err := net.ListenUDP("udp", &net.UDPAddr{IP: b, Port: port})
+		if err == nil {
+			return connA, connB
+		}
+		if closeErr := connA.Close(); closeErr != nil {
+			t.Fatal(closeErr)
+		}
+	}
+	t.Skipf("failed to listen on same port of %s and %s", a, b)
+	return nil, nil
+}
+
+func TestServer_discovery(t *testing.T) {
+	primaryIP, alternateIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+	if conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: alternateIP}); err != nil {
+		t.Skipf("loopback alias %s is not available: %v", alternateIP, err)
+	} else if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	primaryA, alternateA := listenPair(t, primaryIP, alternateIP)
+	primaryB, alternateB := listenPair(t, primaryIP, alternateIP)
+	var (
+		portA = primaryA.LocalAddr().(*net.UDPAddr).Port
+		portB = primaryB.LocalAddr().(*net.UDPAddr).Port
+	)
+	g, err := discovery.NewGroup(
+		turn.Addr{IP: primaryIP, Port: portA},
+		turn.Addr{IP: alternateIP, Port: portB},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*net.UDPConn{primaryA, alternateA, primaryB, alternateB} {
+		s, stop := newServer(t, Options{Conn: conn, Discovery: g, Software: "gortcd:test"})
+		defer stop()
+		go s.Serve()
+		for atomic.LoadInt32(&s.serving) == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	client, clientAddr := listenUDP(t)
+	defer client.Close()
+	other, otherAddr := listenUDP(t)
+	defer other.Close()
+	do := func(t *testing.T, conn *net.UDPConn, setters ...stun.Setter) (*stun.Message, turn.Addr) {
+		t.Helper()
+		request := stun.MustBuild(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, setters...)...)
+		if _, err := client.WriteTo(request.Raw, &net.UDPAddr{IP: primaryIP, Port: portA}); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &stun.Message{Raw: buf[:n]}
+		if err = response.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if response.TransactionID != request.TransactionID {
+			t.Fatal("unexpected transaction id")
+		}
+		udpAddr := from.(*net.UDPAddr)
+		return response, turn.Addr{IP: udpAddr.IP, Port: udpAddr.Port}
+	}
+	for _, tc := range []struct {
+		name   string
+		change discovery.ChangeRequest
+		origin turn.Addr
+	}{
+		{"NoChange", discovery.ChangeRequest{}, turn.Addr{IP: primaryIP, Port: portA}},
+		{"ChangePort", discovery.ChangeRequest{ChangePort: true}, turn.Addr{IP: primaryIP, Port: portB}},
+		{"ChangeIP", discovery.ChangeRequest{ChangeIP: true}, turn.Addr{IP: alternateIP, Port: portA}},
+		{"ChangeBoth", discovery.ChangeRequest{ChangeIP: true, ChangePort: true}, turn.Addr{IP: alternateIP, Port: portB}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			response, from := do(t, client, tc.change)
+			if !from.Equal(tc.origin) {
+				t.Errorf("response from %s, expected %s", from, tc.origin)
+			}
+			var (
+				mapped stun.XORMappedAddress
+				origin discovery.ResponseOrigin
+				otherA discovery.OtherAddress
+			)
+			if err := response.Parse(&mapped, &origin, &otherA); err != nil {
+				t.Fatal(err)
+			}
+			if mapped.Port != clientAddr.Port {
+				t.Errorf("unexpected mapped address %s", mapped)
+			}
+			if !from.Equal(turn.Addr{IP: origin.IP, Port: origin.Port}) {
+				t.Errorf("unexpected RESPONSE-ORIGIN %s", origin)
+			}
+			if !otherA.IP.Equal(alternateIP) || otherA.Port != portB {
+				t.Errorf("unexpected OTHER-ADDRESS %s", otherA)
+			}
+		})
+	}
+	t.Run("ResponsePort", func(t *testing.T) {
+		response, _ := do(t, other,
+			discovery.ChangeRequest{ChangePort: true},
+			discovery.ResponsePort(otherAddr.Port),
+		)
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(response); err != nil {
+			t.Fatal(err)
+		}
+		if mapped.Port != clientAddr.Port {
+			t.Errorf("unexpected mapped address %s", mapped)
+		}
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		g.Remove(turn.Addr{IP: alternateIP, Port: portB})
+		response, _ := do(t, client, discovery.ChangeRequest{ChangeIP: true, ChangePort: true})
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(response); err != nil {
+			t.Fatal(err)
+		}
+		if code.Code != stun.CodeUnknownAttribute {
+			t.Errorf("unexpected code %s", code)
+		}
+	})
+}
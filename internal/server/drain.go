@@ -0,0 +1,50 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// drainPollInterval is interval of checking for remaining allocations
+// during Shutdown.
+const drainPollInterval = time.Millisecond * 100
+
+// Drain switches server to drain mode, where new allocations are rejected
+// with 300 (Try Alternate) or 508 (Insufficient Capacity) while existing
+// ones are still served.
+func (s *Server) Drain() {
+	if atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		s.log.Info("draining")
+	}
+}
+
+// Draining reports whether server is in drain mode.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// overloaded reports whether server has reached MaxAllocations. Only
+// allocations of this listener are counted, see Options.MaxAllocations.
+func (s *Server) overloaded() bool {
+	return s.maxAllocs > 0 && s.allocs.Count() >= s.maxAllocs
+}
+
+// Shutdown drains server and waits until all allocations expire or timeout
+// is reached, then closes server, removing remaining allocations.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.Drain()
+	deadline := time.Now().Add(timeout)
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for now := time.Now(); now.Before(deadline); now = <-t.C {
+		if s.allocs.Stats().Allocations == 0 {
+			break
+		}
+	}
+	if n := s.allocs.Stats().Allocations; n > 0 {
+		s.log.Warn("drain timeout, removing allocations", zap.Int("n", n))
+	}
+	return s.Close()
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/auth"
+)
+
+// ListenerState is serializable state of server that is passed to new
+// process during binary upgrade.
+type ListenerState struct {
+	Addr string `json:"addr"`
+	// Sockets is count of additional listener sockets on same port, see
+	// Options.ReusePort.
+	Sockets     int                         `json:"sockets,omitempty"`
+	Allocations []allocator.AllocationState `json:"allocations,omitempty"`
+	Nonces      []auth.NonceState           `json:"nonces,omitempty"`
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+func fileOf(conn net.PacketConn) (*os.File, error) {
+	f, ok := conn.(filer)
+	if !ok {
+		return nil, errors.Errorf("%T does not provide file", conn)
+	}
+	return f.File()
+}
+
+// Detach closes server without removing allocations, returning its state
+// and duplicated files of listener, additional listener sockets and
+// relayed connections of allocations, in same order. Allocations which
+// connections can't be duplicated are dropped.
+//
+// Caller is responsible for closing returned files.
+func (s *Server) Detach() (ListenerState, []*os.File, error) {
+	st := ListenerState{
+		Addr: s.conn.LocalAddr().String(),
+	}
+	listener, err := fileOf(s.conn)
+	if err != nil {
+		return st, nil, errors.Wrap(err, "failed to get listener file")
+	}
+	files := []*os.File{listener}
+	for _, conn := range s.conns {
+		f, fileErr := fileOf(conn)
+		if fileErr != nil {
+			s.log.Warn("dropping listener socket", zap.Error(fileErr))
+			continue
+		}
+		st.Sockets++
+		files = append(files, f)
+	}
+	states, conns := s.allocs.Detach()
+	for i := range states {
+		f, fileErr := fileOf(conns[i])
+		if fileErr != nil {
+			s.log.Warn("dropping allocation",
+				zap.Stringer("tuple", states[i].Tuple),
+				zap.Error(fileErr),
+			)
+		} else {
+			st.Allocations = append(st.Allocations, states[i])
+			files = append(files, f)
+		}
+		// Closing relayed connection in current process.
+		if removeErr := s.ports.Remove(states[i].RelayedAddr, states[i].Tuple.Proto); removeErr != nil {
+			s.log.Warn("failed to remove", zap.Error(removeErr))
+		}
+	}
+	if n, ok := s.nonce.(interface{ Export() []auth.NonceState }); ok {
+		st.Nonces = n.Export()
+	}
+	if closeErr := s.Close(); closeErr != nil {
+		s.log.Warn("failed to close", zap.Error(closeErr))
+	}
+	s.log.Info("detached", zap.Int("allocations", len(st.Allocations)))
+	return st, files, nil
+}
+
+// Restore restores state of detached server, using provided files of
+// additional listener sockets followed by files of relayed connections
+// in same order as allocations. Files are closed. Should be called
+// before Serve, which reads inherited listener sockets instead of
+// creating new ones.
+func (s *Server) Restore(st ListenerState, files []*os.File) error {
+	if len(files) != st.Sockets+len(st.Allocations) {
+		return errors.New("files count mismatch")
+	}
+	for _, f := range files[:st.Sockets] {
+		conn, err := net.FilePacketConn(f)
+		if closeErr := f.Close(); closeErr != nil {
+			s.log.Warn("failed to close file", zap.Error(closeErr))
+		}
+		if err != nil {
+			s.log.Warn("failed to restore listener socket", zap.Error(err))
+			continue
+		}
+		s.conns = append(s.conns, conn)
+	}
+	files = files[st.Sockets:]
+	conns := make([]net.PacketConn, len(files))
+	for i, f := range files {
+		conn, err := net.FilePacketConn(f)
+		if closeErr := f.Close(); closeErr != nil {
+			s.log.Warn("failed to close file", zap.Error(closeErr))
+		}
+		if err != nil {
+			s.log.Warn("failed to restore relayed conn", zap.Error(err))
+			continue
+		}
+		conns[i] = conn
+	}
+	s.restore(st, conns)
+	return nil
+}
+
+// restore adds allocations from state with corresponding relayed
+// connections, skipping ones with nil connection, and restores nonces.
+func (s *Server) restore(st ListenerState, conns []net.PacketConn) {
+	restored := 0
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		if err := s.allocs.Restore(st.Allocations[i], conn, s); err != nil {
+			s.log.Warn("failed to restore allocation", zap.Error(err))
+			if closeErr := conn.Close(); closeErr != nil {
+				s.log.Warn("failed to close", zap.Error(closeErr))
+			}
+			continue
+		}
+		if err := s.cluster.Claim(st.Allocations[i].Tuple, st.Allocations[i].Timeout); err != nil {
+			s.log.Warn("failed to claim restored allocation", zap.Error(err))
+		}
+		restored++
+	}
+	if n, ok := s.nonce.(interface{ Restore([]auth.NonceState) }); ok {
+		n.Restore(st.Nonces)
+	}
+	s.log.Info("restored", zap.Int("allocations", restored))
+}
+
+// HandoffVersion is current version of HandoffState format.
+const HandoffVersion = 2
+
+// HandoffState is state of all servers that is passed to new process
+// during binary upgrade.
+type HandoffState struct {
+	Version   int             `json:"version"`
+	Listeners []ListenerState `json:"listeners"`
+	// Pools are port pools that are shared between listeners, files of
+	// their idle ports follow files of listeners.
+	Pools []PoolState `json:"pools,omitempty"`
+}
+
+// PoolState is state of port pool that is passed to new process during
+// binary upgrade.
+type PoolState struct {
+	IP    string `json:"ip"`
+	Ports int    `json:"ports"` // count of idle port files
+}
+
+// Detach detaches all subscribed servers, see Server.Detach. Returned
+// files contain listener file followed by additional listener socket
+// files and relayed connection files for each listener, in same order
+// as listener states.
+//
+// Servers that failed to detach are still subscribed and serving.
+func (u *Updater) Detach() (HandoffState, []*os.File) {
+	st := HandoffState{Version: HandoffVersion}
+	u.mux.Lock()
+	listeners := u.listeners
+	u.listeners = nil
+	u.mux.Unlock()
+	var files []*os.File
+	for _, s := range listeners {
+		listenerState, listenerFiles, err := s.Detach()
+		if err != nil {
+			s.log.Error("failed to detach", zap.Error(err))
+			u.Subscribe(s)
+			continue
+		}
+		st.Listeners = append(st.Listeners, listenerState)
+		files = append(files, listenerFiles...)
+	}
+	return st, files
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gortc/gortcd/internal/discovery"
+	"github.com/gortc/stun"
+)
+
+// legacyHeaderSize is size of RFC 3489 message header with 128-bit
+// transaction ID.
+const legacyHeaderSize = 20
+
+var magicCookie = []byte{0x21, 0x12, 0xA4, 0x42}
+
+// isLegacyBinding reports whether b looks like RFC 3489 Binding request,
+// i.e. message without magic cookie. Such messages start with two zero
+// bits, so they are never confused with ChannelData.
+func isLegacyBinding(b []byte) bool {
+	if len(b) < legacyHeaderSize || stun.IsMessage(b) {
+		return false
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != stun.BindingRequest.Value() {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(b[2:4]))
+	return size%4 == 0 && legacyHeaderSize+size == len(b)
+}
+
+// processLegacyBinding responds to RFC 3489 Binding request with
+// MAPPED-ADDRESS, SOURCE-ADDRESS and CHANGED-ADDRESS. CHANGE-REQUEST is
+// supported if listener is in NAT behavior discovery group, otherwise
+// CHANGED-ADDRESS is address of listener.
+func (s *Server) processLegacyBinding(ctx *context) error {
+	if ctx.cfg.authForSTUN {
+		// Classic STUN clients can't authenticate.
+		return nil
+	}
+	// Magic cookie is first 32 bits of legacy transaction ID, so
+	// replacing it to decode request and restoring in response.
+	var cookie [4]byte
+	copy(cookie[:], ctx.request.Raw[4:8])
+	copy(ctx.request.Raw[4:8], magicCookie)
+	if err := ctx.request.Decode(); err != nil {
+		if ce := s.log.Check(zapcore.DebugLevel, "failed to decode legacy request"); ce != nil {
+			ce.Write(zap.Stringer("addr", ctx.client), zap.Error(err))
+		}
+		return nil
+	}
+	ctx.decoded = true
+	s.startSpan(ctx)
+	var change discovery.ChangeRequest
+	if err := change.GetFrom(ctx.request); err != nil && err != stun.ErrAttributeNotFound {
+		return nil
+	}
+	origin, ok := s.changeOrigin(ctx, change)
+	if !ok {
+		return nil
+	}
+	changed, ok := s.discovery.Other(ctx.server)
+	if !ok {
+		changed = ctx.server
+	}
+	ctx.response.Reset()
+	ctx.response.Type = stun.BindingSuccess
+	ctx.response.TransactionID = ctx.request.TransactionID
+	ctx.response.WriteHeader()
+	if err := ctx.apply(
+		&stun.MappedAddress{IP: ctx.client.IP, Port: ctx.client.Port},
+		&discovery.SourceAddress{IP: origin.IP, Port: origin.Port},
+		&discovery.ChangedAddress{IP: changed.IP, Port: changed.Port},
+	); err != nil {
+		return err
+	}
+	copy(ctx.response.Raw[4:8], cookie[:])
+	return nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gortc/gortcd/internal/discovery"
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// legacyRequest returns RFC 3489 Binding request without magic cookie.
+func legacyRequest(setters ...stun.Setter) []byte {
+	m := stun.MustBuild(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, setters...)...)
+	copy(m.Raw[4:8], []byte{1, 2, 3, 4})
+	return m.Raw
+}
+
+func TestIsLegacyBinding(t *testing.T) {
+	cdata := &turn.ChannelData{Number: 0x4000, Data: make([]byte, 16)}
+	cdata.Encode()
+	truncated := legacyRequest(stun.NewSoftware("software"))
+	for _, tc := range []struct {
+		name  string
+		b     []byte
+		match bool
+	}{
+		{"Legacy", legacyRequest(), true},
+		{"LegacyWithAttribute", legacyRequest(discovery.ChangeRequest{ChangeIP: true}), true},
+		{"Modern", stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw, false},
+		{"ChannelData", cdata.Raw, false},
+		{"Truncated", truncated[:len(truncated)-4], false},
+		{"Short", []byte{0, 1, 0, 0}, false},
+	} {
+		if isLegacyBinding(tc.b) != tc.match {
+			t.Errorf("%s: should match: %v", tc.name, tc.match)
+		}
+	}
+}
+
+func TestServer_legacy(t *testing.T) {
+	s, stop := newServer(t)
+	defer stop()
+	do := func(t *testing.T, raw []byte) (*context, error) {
+		ctx := newAllocateContext(s)
+		ctx.cdata = new(turn.ChannelData)
+		ctx.server = s.addr
+		ctx.request.Raw = append(ctx.request.Raw[:0], raw...)
+		return ctx, s.process(ctx)
+	}
+	t.Run("Disabled", func(t *testing.T) {
+		if _, err := do(t, legacyRequest()); err != errNotSTUNMessage {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	s.setOptions(Options{Realm: "realm", Legacy: true})
+	t.Run("Enabled", func(t *testing.T) {
+		request := legacyRequest()
+		ctx, err := do(t, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := ctx.response.Raw
+		if !bytes.Equal(raw[4:legacyHeaderSize], request[4:legacyHeaderSize]) {
+			t.Error("transaction ID should be same as in request")
+		}
+		// Decoding as RFC 5389 message to parse attributes.
+		response := &stun.Message{Raw: append([]byte(nil), raw...)}
+		copy(response.Raw[4:8], magicCookie)
+		if err = response.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if response.Type != stun.BindingSuccess {
+			t.Errorf("unexpected type %s", response.Type)
+		}
+		var (
+			mapped  stun.MappedAddress
+			source  discovery.SourceAddress
+			changed discovery.ChangedAddress
+		)
+		if err = response.Parse(&mapped, &source, &changed); err != nil {
+			t.Fatal(err)
+		}
+		if !ctx.client.Equal(turn.Addr{IP: mapped.IP, Port: mapped.Port}) {
+			t.Errorf("unexpected MAPPED-ADDRESS %s", mapped)
+		}
+		if !s.addr.Equal(turn.Addr{IP: source.IP, Port: source.Port}) {
+			t.Errorf("unexpected SOURCE-ADDRESS %s", source)
+		}
+		if !s.addr.Equal(turn.Addr{IP: changed.IP, Port: changed.Port}) {
+			t.Errorf("unexpected CHANGED-ADDRESS %s", changed)
+		}
+		if response.Contains(stun.AttrXORMappedAddress) || response.Contains(stun.AttrSoftware) {
+			t.Error("unexpected RFC 5389 attribute")
+		}
+	})
+	t.Run("ChangeRequest", func(t *testing.T) {
+		// Listener is not in discovery group, so address can't be changed.
+		ctx, err := do(t, legacyRequest(discovery.ChangeRequest{ChangePort: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ctx.response.Raw) != 0 {
+			t.Error("unexpected response")
+		}
+	})
+	t.Run("Modern", func(t *testing.T) {
+		ctx, err := do(t, stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mapped stun.XORMappedAddress
+		if err = mapped.GetFrom(ctx.response); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("AuthForSTUN", func(t *testing.T) {
+		s.setOptions(Options{Realm: "realm", Legacy: true, AuthForSTUN: true})
+		ctx, err := do(t, legacyRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ctx.response.Raw) != 0 {
+			t.Error("unexpected response")
+		}
+	})
+}
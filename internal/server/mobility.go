@@ -0,0 +1,100 @@
+package server
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/cluster"
+	"github.com/gortc/gortcd/internal/mobility"
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// ticketSealer issues and opens mobility tickets, implemented by
+// mobility.Sealer.
+type ticketSealer interface {
+	Seal(c mobility.Claims) (mobility.Ticket, error)
+	Open(t mobility.Ticket) (mobility.Claims, error)
+}
+
+// issueTicket returns MOBILITY-TICKET for allocation of ctx.
+func (s *Server) issueTicket(ctx *context) (mobility.Ticket, error) {
+	return s.mobility.Seal(mobility.Claims{
+		Tuple:    ctx.tuple,
+		Username: ctx.username.String(),
+		Realm:    ctx.realm.String(),
+	})
+}
+
+// moveAllocation moves allocation of ticket that is presented in Refresh
+// request to tuple of ctx as described in RFC 8016 Section 3.2, returning
+// previous tuple of allocation or error code if request should be rejected.
+//
+// Move is rolled back on failure, so allocation is left untouched if error
+// code is returned. Request should be finished by completeMove or
+// revertMove if returned tuple is not the tuple of ctx.
+func (s *Server) moveAllocation(ctx *context, ticket mobility.Ticket, timeout time.Time) (turn.FiveTuple, stun.Setter) {
+	if s.mobility == nil {
+		return ctx.tuple, mobility.MobilityForbidden
+	}
+	claims, err := s.mobility.Open(ticket)
+	if err != nil {
+		return ctx.tuple, stun.CodeBadRequest
+	}
+	if claims.Username != ctx.username.String() || claims.Realm != ctx.realm.String() {
+		// Allocation can be moved only by its owner.
+		return ctx.tuple, stun.CodeWrongCredentials
+	}
+	if claims.Tuple.Equal(ctx.tuple) {
+		return ctx.tuple, nil
+	}
+	span := ctx.span.Child("allocator.Move")
+	err = s.allocs.Move(claims.Tuple, ctx.tuple)
+	span.SetError(err)
+	span.Finish()
+	switch err {
+	case nil:
+		// Moved.
+	case allocator.ErrAllocationMismatch, allocator.ErrAllocationNotFound:
+		return ctx.tuple, stun.CodeAllocMismatch
+	default:
+		s.log.Error("failed to move allocation", zap.Error(err))
+		return ctx.tuple, stun.CodeServerError
+	}
+	if err = s.cluster.Claim(ctx.tuple, timeout); err != nil {
+		if moveErr := s.allocs.Move(ctx.tuple, claims.Tuple); moveErr != nil {
+			s.log.Error("failed to move allocation back", zap.Error(moveErr))
+		}
+		if err == cluster.ErrOwned {
+			return ctx.tuple, stun.CodeAllocMismatch
+		}
+		s.log.Error("failed to claim moved allocation", zap.Error(err))
+		return ctx.tuple, stun.CodeServerError
+	}
+	return claims.Tuple, nil
+}
+
+// completeMove finishes move of allocation after Refresh request is
+// successfully processed.
+func (s *Server) completeMove(from, to turn.FiveTuple) {
+	s.log.Info("allocation moved",
+		zap.Stringer("from", from),
+		zap.Stringer("to", to),
+	)
+	s.cluster.Release(from)
+	// Client is authenticated by nonce of new tuple, so nonce of previous
+	// one is not needed anymore.
+	if n, ok := s.nonce.(interface{ Remove(turn.FiveTuple) }); ok {
+		n.Remove(from)
+	}
+}
+
+// revertMove moves allocation back if Refresh request is failed.
+func (s *Server) revertMove(from, to turn.FiveTuple) {
+	if err := s.allocs.Move(to, from); err != nil && err != allocator.ErrAllocationNotFound {
+		s.log.Error("failed to move allocation back", zap.Error(err))
+	}
+	s.cluster.Release(to)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gortc/gortcd/internal/accounting"
+	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/mobility"
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// failingSealer fails to issue tickets.
+type failingSealer struct {
+	*mobility.Sealer
+}
+
+func (failingSealer) Seal(c mobility.Claims) (mobility.Ticket, error) {
+	return nil, errors.New("failed")
+}
+
+type accountingFunc func(r accounting.Record) error
+
+func (f accountingFunc) Account(r accounting.Record) error { return f(r) }
+
+func TestServer_mobility(t *testing.T) {
+	sealer, err := mobility.NewSealer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonces := auth.NewNonceAuth(0)
+	var records []accounting.Record
+	s, stop := newServer(t, Options{
+		Realm:        "realm",
+		Mobility:     sealer,
+		NonceManager: nonces,
+		Accounting: accountingFunc(func(r accounting.Record) error {
+			records = append(records, r)
+			return nil
+		}),
+		Auth: auth.NewStatic([]auth.StaticCredential{
+			{Username: "username", Password: "secret", Realm: "realm"},
+			{Username: "other", Password: "secret", Realm: "realm"},
+		}),
+	})
+	defer stop()
+	newContext := func(port int) *context {
+		ctx := newAllocateContext(s)
+		ctx.client.Port = port
+		ctx.setTuple()
+		return ctx
+	}
+	// do performs authenticated request of user.
+	do := func(t *testing.T, ctx *context, user string, setters ...stun.Setter) {
+		t.Helper()
+		process := func(setters ...stun.Setter) {
+			t.Helper()
+			m := stun.MustBuild(append([]stun.Setter{stun.TransactionID}, setters...)...)
+			ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+			if err := s.process(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		username := stun.NewUsername(user)
+		process(append(setters, username)...)
+		var (
+			realm stun.Realm
+			nonce stun.Nonce
+		)
+		if err := ctx.response.Parse(&realm, &nonce); err != nil {
+			t.Fatal(err)
+		}
+		i := stun.NewLongTermIntegrity(user, realm.String(), "secret")
+		process(append(setters, username, realm, nonce, i)...)
+	}
+	code := func(t *testing.T, ctx *context) stun.ErrorCode {
+		t.Helper()
+		var c stun.ErrorCodeAttribute
+		if err := c.GetFrom(ctx.response); err != nil {
+			return 0
+		}
+		return c.Code
+	}
+	ctx := newContext(34567)
+	do(t, ctx, "username", turn.AllocateRequest, turn.RequestedTransportUDP, mobility.Ticket{})
+	var ticket mobility.Ticket
+	if err = ticket.GetFrom(ctx.response); err != nil {
+		t.Fatalf("no ticket in %s: %v", ctx.response, err)
+	}
+	if len(ticket) == 0 {
+		t.Fatal("blank ticket")
+	}
+	t.Run("WrongCredentials", func(t *testing.T) {
+		ctx := newContext(34570)
+		do(t, ctx, "other", turn.RefreshRequest, ticket)
+		if c := code(t, ctx); c != stun.CodeWrongCredentials {
+			t.Errorf("unexpected code %d", c)
+		}
+	})
+	t.Run("BadTicket", func(t *testing.T) {
+		ctx := newContext(34570)
+		do(t, ctx, "username", turn.RefreshRequest, mobility.Ticket("bad"))
+		if c := code(t, ctx); c != stun.CodeBadRequest {
+			t.Errorf("unexpected code %d", c)
+		}
+	})
+	moved := newContext(34568)
+	do(t, moved, "username", turn.RefreshRequest, ticket)
+	if c := code(t, moved); c != 0 {
+		t.Fatalf("unexpected code %d", c)
+	}
+	var (
+		newTicket mobility.Ticket
+		lifetime  turn.Lifetime
+	)
+	if err = moved.response.Parse(&newTicket, &lifetime); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime.Duration != time.Minute {
+		t.Errorf("unexpected lifetime %s", lifetime)
+	}
+	states := s.allocs.Export()
+	if len(states) != 1 || !states[0].Tuple.Equal(moved.tuple) {
+		t.Errorf("allocation should be moved to %s", moved.tuple)
+	}
+	for _, n := range nonces.Export() {
+		if n.Tuple.Equal(ctx.tuple) {
+			t.Error("nonce of previous tuple should be removed")
+		}
+	}
+	t.Run("PreviousTicket", func(t *testing.T) {
+		ctx := newContext(34569)
+		do(t, ctx, "username", turn.RefreshRequest, ticket)
+		if c := code(t, ctx); c != stun.CodeAllocMismatch {
+			t.Errorf("unexpected code %d", c)
+		}
+	})
+	t.Run("Back", func(t *testing.T) {
+		do(t, ctx, "username", turn.RefreshRequest, newTicket)
+		if c := code(t, ctx); c != 0 {
+			t.Fatalf("unexpected code %d", c)
+		}
+		if states := s.allocs.Export(); !states[0].Tuple.Equal(ctx.tuple) {
+			t.Errorf("allocation should be moved to %s", ctx.tuple)
+		}
+	})
+	t.Run("SealError", func(t *testing.T) {
+		s.mobility = failingSealer{Sealer: sealer}
+		defer func() { s.mobility = sealer }()
+		allocate := newContext(34571)
+		do(t, allocate, "username", turn.AllocateRequest, turn.RequestedTransportUDP, mobility.Ticket{})
+		if c := code(t, allocate); c != stun.CodeServerError {
+			t.Errorf("unexpected code %d", c)
+		}
+		if n := s.allocs.Stats().Allocations; n != 1 {
+			t.Errorf("allocation should be removed, got %d allocations", n)
+		}
+		if len(records) == 0 || records[len(records)-1].Client != allocate.tuple.Client.String() {
+			t.Fatal("no accounting record")
+		}
+		if r := records[len(records)-1].Reason; r != accounting.Failed {
+			t.Errorf("unexpected reason %s", r)
+		}
+		// Refresh with ticket of same tuple.
+		do(t, ctx, "username", turn.RefreshRequest, ticket)
+		if c := code(t, ctx); c != stun.CodeServerError {
+			t.Errorf("unexpected code %d", c)
+		}
+		// Move is reverted if ticket is not issued.
+		moved := newContext(34572)
+		do(t, moved, "username", turn.RefreshRequest, ticket)
+		if c := code(t, moved); c != stun.CodeServerError {
+			t.Errorf("unexpected code %d", c)
+		}
+		if states := s.allocs.Export(); len(states) != 1 || !states[0].Tuple.Equal(ctx.tuple) {
+			t.Errorf("allocation should be left on %s", ctx.tuple)
+		}
+		found := false
+		for _, n := range nonces.Export() {
+			if n.Tuple.Equal(ctx.tuple) {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("nonce of previous tuple should be kept")
+		}
+	})
+	t.Run("Forbidden", func(t *testing.T) {
+		s, stop := newServer(t)
+		defer stop()
+		ctx := newAllocateContext(s)
+		m := stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+			turn.RequestedTransportUDP, mobility.Ticket{},
+		)
+		ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+		if err := s.process(ctx); err != nil {
+			t.Fatal(err)
+		}
+		// Unauthenticated request is rejected with 401 first.
+		if c := code(t, ctx); c != stun.CodeUnauthorised {
+			t.Fatalf("unexpected code %d", c)
+		}
+		var (
+			realm stun.Realm
+			nonce stun.Nonce
+		)
+		if err := ctx.response.Parse(&realm, &nonce); err != nil {
+			t.Fatal(err)
+		}
+		username := stun.NewUsername("username")
+		m = stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+			turn.RequestedTransportUDP, mobility.Ticket{}, username, realm, nonce,
+			stun.NewLongTermIntegrity("username", "realm", "secret"),
+		)
+		ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+		if err := s.process(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if c := code(t, ctx); c != mobility.CodeMobilityForbidden {
+			t.Errorf("unexpected code %d", c)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/stun"
+)
+
+// selfTestTimeout is maximum duration of STUN Binding self-test.
+const selfTestTimeout = time.Second
+
+// Ready returns nil if server is ready to process requests, checking that
+// it is serving and not draining, has free relay ports and workers, and
+// responds to STUN Binding request.
+func (s *Server) Ready() error {
+	if atomic.LoadInt32(&s.serving) == 0 {
+		return errors.New("not serving")
+	}
+	if s.Draining() {
+		return errors.New("draining")
+	}
+	if s.ports.FreePorts() == 0 {
+		return errors.New("no free relay ports")
+	}
+	if s.pool.saturated() {
+		return errors.New("worker pool is saturated")
+	}
+	if err := s.selfTest(selfTestTimeout); err != nil {
+		return errors.Wrap(err, "self-test failed")
+	}
+	return nil
+}
+
+// selfTest sends STUN Binding request to server listener and waits
+// for any response to it, so error responses (e.g. if AuthForSTUN is set)
+// are considered successful.
+func (s *Server) selfTest(timeout time.Duration) error {
+	addr := &net.UDPAddr{IP: s.addr.IP, Port: s.addr.Port}
+	if addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			s.log.Warn("failed to close self-test conn", zap.Error(closeErr))
+		}
+	}()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if _, err = conn.Write(req.Raw); err != nil {
+		return err
+	}
+	buf := make([]byte, 1024)
+	res := new(stun.Message)
+	for {
+		n, readErr := conn.Read(buf)
+		if readErr != nil {
+			return readErr
+		}
+		res.Raw = buf[:n]
+		if decodeErr := res.Decode(); decodeErr != nil {
+			continue
+		}
+		if res.TransactionID == req.TransactionID {
+			return nil
+		}
+	}
+}
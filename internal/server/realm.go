@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// Realm is configuration of tenant. Realm of request is selected by
+// REALM attribute that is presented by client if realm is known, then by
+// ORIGIN attribute, then by listener address, falling back to realm from
+// Options. Zero values fall back to server-wide settings.
+//
+// Peer filtering policies of realm are set by PeerPolicies.
+type Realm struct {
+	Name            string
+	Software        string        // SOFTWARE attribute value
+	DefaultLifetime time.Duration // lifetime if not requested by client
+	MaxLifetime     time.Duration
+	// MaxAllocations is the allocations quota of realm on listener, 486
+	// (Allocation Quota Reached) is returned if reached. Not limited if 0.
+	MaxAllocations int
+	// Bandwidth is cap of relayed bytes per second in each direction for
+	// every allocation of realm, data that exceeds it is dropped.
+	Bandwidth int
+	Listeners []string // addresses of listeners with realm as default
+	Origins   []string // values of ORIGIN attribute that select realm
+}
+
+// Default lifetimes of allocations and permissions.
+const (
+	defaultLifetime    = time.Minute
+	defaultMaxLifetime = time.Hour
+)
+
+// realmConfig is per-realm part of config.
+type realmConfig struct {
+	name            string
+	realm           stun.Realm
+	software        stun.Software
+	maxLifetime     time.Duration
+	defaultLifetime time.Duration
+	maxAllocations  int
+	bandwidth       int
+}
+
+func newRealmConfig(o Options, r Realm) *realmConfig {
+	c := &realmConfig{
+		name:            r.Name,
+		realm:           stun.NewRealm(r.Name),
+		software:        stun.NewSoftware(o.Software),
+		maxLifetime:     defaultMaxLifetime,
+		defaultLifetime: defaultLifetime,
+		maxAllocations:  r.MaxAllocations,
+		bandwidth:       o.Bandwidth,
+	}
+	if r.Software != "" {
+		c.software = stun.NewSoftware(r.Software)
+	}
+	if r.MaxLifetime > 0 {
+		c.maxLifetime = r.MaxLifetime
+	}
+	if r.DefaultLifetime > 0 {
+		c.defaultLifetime = r.DefaultLifetime
+	}
+	if c.defaultLifetime > c.maxLifetime {
+		c.defaultLifetime = c.maxLifetime
+	}
+	if r.Bandwidth > 0 {
+		c.bandwidth = r.Bandwidth
+	}
+	return c
+}
+
+// hasListener reports whether one of addresses resolves to listener.
+func hasListener(addrs []string, listener turn.Addr) bool {
+	for _, v := range addrs {
+		a, err := net.ResolveUDPAddr("udp", v)
+		if err != nil {
+			continue
+		}
+		if listener.Equal(turn.Addr{IP: a.IP, Port: a.Port}) {
+			return true
+		}
+	}
+	return false
+}
+
+// blankRealm is used for zero config.
+var blankRealm = &realmConfig{
+	maxLifetime:     defaultMaxLifetime,
+	defaultLifetime: defaultLifetime,
+}
+
+// selectRealm returns realm of request, see Realm.
+func (c config) selectRealm(m *stun.Message) *realmConfig {
+	if c.realm == nil {
+		return blankRealm
+	}
+	if len(c.realms) == 0 {
+		return c.realm
+	}
+	if v, err := m.Get(stun.AttrRealm); err == nil {
+		if r, ok := c.realms[string(v)]; ok {
+			return r
+		}
+	}
+	if v, err := m.Get(stun.AttrOrigin); err == nil {
+		if r, ok := c.origins[string(v)]; ok {
+			return r
+		}
+	}
+	return c.realm
+}
+
+// realmOf returns configuration of realm with provided name, or default
+// realm if not found.
+func (c config) realmOf(name string) *realmConfig {
+	if r, ok := c.realms[name]; ok {
+		return r
+	}
+	return c.realm
+}
@@ -3,6 +3,11 @@ package server
 import (
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gortc/gortcd/internal/allocator"
 )
 
 // Updater handles options update.
@@ -34,6 +39,76 @@ func (u *Updater) Subscribe(s *Server) {
 	u.mux.Unlock()
 }
 
+// Ready returns nil if every subscribed server is ready.
+func (u *Updater) Ready() error {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	if len(u.listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	for _, s := range u.listeners {
+		if err := s.Ready(); err != nil {
+			return errors.Wrapf(err, "listener %s", s.addr)
+		}
+	}
+	return nil
+}
+
+// Stats returns allocation statistics summed over all subscribed servers.
+func (u *Updater) Stats() allocator.Stats {
+	var stats allocator.Stats
+	u.mux.RLock()
+	for _, s := range u.listeners {
+		listenerStats := s.allocs.Stats()
+		stats.Allocations += listenerStats.Allocations
+		stats.Permissions += listenerStats.Permissions
+		stats.Bindings += listenerStats.Bindings
+		for realm, r := range listenerStats.Realms {
+			if stats.Realms == nil {
+				stats.Realms = make(map[string]allocator.RealmStats)
+			}
+			stats.Realms[realm] = stats.Realms[realm].Add(r)
+		}
+	}
+	u.mux.RUnlock()
+	return stats
+}
+
+// Drain switches every subscribed server to drain mode.
+func (u *Updater) Drain() {
+	u.mux.RLock()
+	for _, s := range u.listeners {
+		s.Drain()
+	}
+	u.mux.RUnlock()
+}
+
+// Shutdown gracefully shuts down every subscribed server in parallel,
+// see Server.Shutdown.
+func (u *Updater) Shutdown(timeout time.Duration) error {
+	u.mux.RLock()
+	listeners := append([]*Server(nil), u.listeners...)
+	u.mux.RUnlock()
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(listeners))
+	)
+	for i, s := range listeners {
+		wg.Add(1)
+		go func(i int, s *Server) {
+			defer wg.Done()
+			errs[i] = s.Shutdown(timeout)
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "listener %s", listeners[i].addr)
+		}
+	}
+	return nil
+}
+
 // NewUpdater initializes new updater from options.
 func NewUpdater(o Options) *Updater {
 	u := &Updater{}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/hex"
 	"io"
 	"net"
 	"runtime"
@@ -15,21 +16,34 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/gortc/gortcd/internal/accesslog"
+	"github.com/gortc/gortcd/internal/accounting"
 	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/capture"
+	"github.com/gortc/gortcd/internal/cluster"
+	"github.com/gortc/gortcd/internal/discovery"
 	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/gortcd/internal/mobility"
+	"github.com/gortc/gortcd/internal/redirect"
+	"github.com/gortc/gortcd/internal/trace"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
 
 // Server is RFC 5389 basic server implementation.
 //
-// Current implementation is UDP only and not ALTERNATE-SERVER.
-// It does not support backwards compatibility with RFC 3489.
+// Current implementation is UDP only.
+// Backwards compatibility with RFC 3489 is limited to Binding requests
+// and is enabled by Options.Legacy.
 type Server struct {
 	addr      turn.Addr
 	log       *zap.Logger
 	allocs    *allocator.Allocator
+	ports     *allocator.NetAllocator
+	pools     []io.Closer // port allocators owned by server
+	self      *filter.Self
+	selfIPs   []net.IP
 	conn      net.PacketConn
 	auth      Auth
 	nonce     NonceManager
@@ -37,8 +51,18 @@ type Server struct {
 	wg        sync.WaitGroup
 	handlers  map[stun.MessageType]handleFunc
 	pool      *workerPool
-	conns     []io.Closer
+	conns     []net.PacketConn // additional sockets on same port
 	reusePort bool
+	tracer    *trace.Tracer
+	accessLog *accesslog.Logger
+	capture   *capture.Hub
+	serving   int32
+	draining  int32
+	redirect  redirect.Policy
+	maxAllocs int
+	cluster   *cluster.Node
+	discovery *discovery.Group
+	mobility  ticketSealer
 	cfg       atomic.Value
 }
 
@@ -46,6 +70,11 @@ func (s *Server) config() config {
 	return s.cfg.Load().(config)
 }
 
+// peerRule returns current peer filtering rule for allocation session.
+func (s *Server) peerRule(session allocator.Session) filter.Rule {
+	return s.config().peerRule(session)
+}
+
 // setOptions updates subset of current server configuration.
 //
 // Currently supported:
@@ -54,8 +83,22 @@ func (s *Server) config() config {
 //	* Realm
 //	* PeerRule
 //	* ClientRule
+//	* PeerPolicies
+//	* Realms
+//	* Bandwidth
+//	* Legacy
 func (s *Server) setOptions(opt Options) {
-	s.cfg.Store(newConfig(opt))
+	s.cfg.Store(newConfig(opt, s.addr))
+}
+
+// bandwidth returns bandwidth cap of allocations of session.
+func (s *Server) bandwidth(session allocator.Session) int {
+	return s.config().realmOf(session.Realm).bandwidth
+}
+
+// maxAllocations returns allocations quota of realm of session.
+func (s *Server) maxAllocations(session allocator.Session) int {
+	return s.config().realmOf(session.Realm).maxAllocations
 }
 
 // Options is set of available options for Server.
@@ -68,6 +111,7 @@ type Options struct {
 	CollectRate   time.Duration
 	ManualStart   bool // don't start bg activity
 	AuthForSTUN   bool // require auth for binding requests
+	Legacy        bool // respond to RFC 3489 binding requests if no AuthForSTUN
 	Workers       int  // maximum workers count
 	Registry      MetricsRegistry
 	Labels        prometheus.Labels
@@ -75,7 +119,70 @@ type Options struct {
 	NonceManager  NonceManager  // optional nonce manager implementation
 	PeerRule      filter.Rule
 	ClientRule    filter.Rule // filtering rule for listeners
-	ReusePort     bool        // spawn more sockets on same port if available
+	// PeerBlocklist and ClientBlocklist are checked before PeerRule and
+	// ClientRule, see Updater.Block.
+	PeerBlocklist   *filter.Blocklist
+	ClientBlocklist *filter.Blocklist
+	// PeerPolicies are checked before PeerRule for allocations and
+	// requests of matching users or realms.
+	PeerPolicies []PeerPolicy
+	// Realms are tenants with own settings, see Realm. Settings of
+	// server-wide Realm are taken from options.
+	Realms []Realm
+	// Bandwidth is cap of relayed bytes per second in each direction for
+	// every allocation, not limited if 0.
+	Bandwidth  int
+	Self       *filter.Self // listener and relay addresses are added to it
+	ReusePort  bool         // spawn more sockets on same port if available
+	Accounting accounting.Sink
+	Tracer     *trace.Tracer     // no tracing if nil
+	AccessLog  *accesslog.Logger // no access log if nil
+	Capture    *capture.Hub      // optional packet capture
+	// Redirect selects ALTERNATE-SERVER for Allocate requests that are
+	// rejected during drain or overload, 508 (Insufficient Capacity)
+	// is returned instead if nil or if Auth is nil.
+	Redirect redirect.Policy
+	// MaxAllocations is the allocations count of listener on which it is
+	// considered overloaded, not limited if 0. Every listener has own
+	// allocations, so limit is not shared between listeners.
+	MaxAllocations int
+	// MinPort and MaxPort limit range of relayed ports, ephemeral ports
+	// are used if MaxPort is 0.
+	MinPort int
+	MaxPort int
+	// PortPool enables pre-allocation of all ports of range on start
+	// instead of binding them on demand. Pools that are initialized by
+	// server are per listener, so relays without port allocator should
+	// not be shared between listeners on same IP.
+	PortPool bool
+	// Relays are addresses on which relayed ports are bound, listener
+	// address is used if empty. External address of relay is advertised
+	// to clients in XOR-RELAYED-ADDRESS, e.g. public address of 1:1 NAT.
+	// Port allocator of relay is initialized from MinPort, MaxPort and
+	// PortPool if nil, otherwise it can be shared between servers and
+	// is not closed by server.
+	Relays      []allocator.Relay
+	RelayPolicy allocator.RelayPolicy
+	// Cluster shares ownership of allocations with other relays that
+	// receive packets for same listener address, e.g. behind anycast.
+	// Packets of allocations owned by other nodes are forwarded to them.
+	Cluster *cluster.Node
+	// Discovery enables RFC 5780 NAT behavior discovery if listener is
+	// in group, so Binding responses can be sent from other listeners.
+	Discovery *discovery.Group
+	// Mobility enables RFC 8016 mobility, so allocations can be moved to
+	// new 5-tuple by Refresh request with ticket that is issued by Sealer.
+	// Mobility is forbidden if nil.
+	Mobility *mobility.Sealer
+}
+
+// PeerPolicy is peer filtering rule for authenticated user or for all
+// users of realm if Username is blank. Addresses that are passed by rule
+// are filtered by PeerRule, user policy takes precedence over realm one.
+type PeerPolicy struct {
+	Username string
+	Realm    string
+	Rule     filter.Rule
 }
 
 // Auth represents message authenticator.
@@ -108,17 +215,10 @@ func New(o Options) (*Server, error) {
 		o.Labels = prometheus.Labels{}
 	}
 	o.Labels["addr"] = o.Conn.LocalAddr().String()
-	netAlloc, err := allocator.NewNetAllocator(
-		o.Log.Named("port"), o.Conn.LocalAddr(), allocator.SystemPortAllocator{},
-	)
+	netAlloc, pools, err := newRelayAllocator(o)
 	if err != nil {
 		return nil, err
 	}
-	allocs := allocator.NewAllocator(allocator.Options{
-		Log:    o.Log.Named("allocator"),
-		Conn:   netAlloc,
-		Labels: o.Labels,
-	})
 	if o.NonceManager == nil {
 		o.NonceManager = auth.NewNonceAuth(o.NonceDuration)
 	}
@@ -132,19 +232,48 @@ func New(o Options) (*Server, error) {
 		auth:      o.Auth,
 		nonce:     o.NonceManager,
 		conn:      o.Conn,
-		allocs:    allocs,
+		ports:     netAlloc,
+		pools:     pools,
 		close:     make(chan struct{}),
 		reusePort: reuseport.Available() && o.ReusePort,
+		tracer:    o.Tracer,
+		accessLog: o.AccessLog,
+		capture:   o.Capture,
+		redirect:  o.Redirect,
+		maxAllocs: o.MaxAllocations,
+		cluster:   o.Cluster,
+		discovery: o.Discovery,
+		self:      o.Self,
+		selfIPs:   selfIPs(o),
+	}
+	if o.Mobility != nil {
+		s.mobility = o.Mobility
+	}
+	s.allocs = allocator.NewAllocator(allocator.Options{
+		Log:        o.Log.Named("allocator"),
+		Conn:       netAlloc,
+		Labels:     o.Labels,
+		Accounting: o.Accounting,
+		Capture:    o.Capture,
+		PeerRule:   s.peerRule,
+		Bandwidth:  s.bandwidth,
+
+		MaxAllocations: s.maxAllocations,
+	})
+	for _, ip := range s.selfIPs {
+		s.self.Add(ip)
 	}
-	s.cfg.Store(newConfig(o))
-	s.setHandlers()
 	if a, ok := o.Conn.LocalAddr().(*net.UDPAddr); ok {
 		s.addr.IP = a.IP
 		s.addr.Port = a.Port
 	} else {
 		return nil, errors.New("unexpected local addr")
 	}
+	s.cfg.Store(newConfig(o, s.addr))
+	s.setHandlers()
 	s.log = o.Log.With(zap.Stringer("server", s.addr))
+	s.cluster.Handle(s.addr, s)
+	s.discovery.Add(s.addr, s.conn)
 	if !o.ManualStart {
 		s.Start(o.CollectRate)
 	}
@@ -161,6 +290,86 @@ func New(o Options) (*Server, error) {
 	return s, nil
 }
 
+// selfIPs returns listener and relay addresses of server.
+func selfIPs(o Options) []net.IP {
+	var ips []net.IP
+	if a, ok := o.Conn.LocalAddr().(*net.UDPAddr); ok {
+		ips = append(ips, a.IP)
+	}
+	for _, r := range o.Relays {
+		ips = append(ips, r.IP)
+		if r.External != nil {
+			ips = append(ips, r.External)
+		}
+	}
+	return ips
+}
+
+// newRelayAllocator initializes relayed ports allocator for listener,
+// also returning port allocators that were initialized for it.
+func newRelayAllocator(o Options) (*allocator.NetAllocator, []io.Closer, error) {
+	listener, ok := o.Conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, nil, errors.New("unexpected local addr")
+	}
+	var pools []io.Closer
+	relays := append([]allocator.Relay(nil), o.Relays...)
+	if len(relays) == 0 {
+		relays = append(relays, allocator.Relay{IP: listener.IP})
+	}
+	for i := range relays {
+		if relays[i].Ports != nil {
+			continue
+		}
+		ports, err := newPortAllocator(o, relays[i].IP)
+		if err != nil {
+			closePools(o.Log, pools)
+			return nil, nil, errors.Wrapf(err, "failed to initialize port allocator for %s", relays[i].IP)
+		}
+		if c, isCloser := ports.(io.Closer); isCloser {
+			pools = append(pools, c)
+		}
+		relays[i].Ports = ports
+	}
+	a, err := allocator.NewRelayAllocator(allocator.RelayOptions{
+		Log:      o.Log.Named("port"),
+		Relays:   relays,
+		Policy:   o.RelayPolicy,
+		Listener: listener.IP,
+	})
+	if err != nil {
+		closePools(o.Log, pools)
+		return nil, nil, err
+	}
+	return a, pools, nil
+}
+
+func closePools(l *zap.Logger, pools []io.Closer) {
+	for _, p := range pools {
+		if err := p.Close(); err != nil {
+			l.Warn("failed to close port pool", zap.Error(err))
+		}
+	}
+}
+
+func newPortAllocator(o Options, ip net.IP) (allocator.NetPortAllocator, error) {
+	if !o.PortPool {
+		return allocator.SystemPortAllocator{
+			MinPort: o.MinPort,
+			MaxPort: o.MaxPort,
+		}, nil
+	}
+	if o.MaxPort == 0 {
+		return nil, errors.New("port range is required for pool")
+	}
+	return allocator.NewSystemPortPooledAllocator(allocator.PooledOptions{
+		Log:     o.Log.Named("pool"),
+		IP:      ip,
+		MinPort: o.MinPort,
+		MaxPort: o.MaxPort,
+	})
+}
+
 // Start starts background activity.
 func (s *Server) Start(rate time.Duration) {
 	s.startCollect(rate)
@@ -194,10 +403,13 @@ func (s *Server) collect(t time.Time) {
 	s.allocs.Prune(t)
 }
 
-// Close stops background activity.
+// Close stops background activity, closes connections and removes
+// all allocations.
 func (s *Server) Close() error {
-	// TODO(ar): Free resources.
+	serving := atomic.SwapInt32(&s.serving, 0) == 1
 	close(s.close)
+	s.cluster.Remove(s.addr)
+	s.discovery.Remove(s.addr)
 	s.log.Debug("closing")
 	if err := s.conn.Close(); err != nil {
 		s.log.Warn("failed to close connection", zap.Error(err))
@@ -208,7 +420,20 @@ func (s *Server) Close() error {
 		}
 	}
 	s.wg.Wait()
-	return nil
+	if serving {
+		s.pool.Stop()
+	}
+	if s.cluster != nil {
+		for _, a := range s.allocs.Export() {
+			s.cluster.Release(a.Tuple)
+		}
+	}
+	err := s.allocs.Close()
+	closePools(s.log, s.pools)
+	for _, ip := range s.selfIPs {
+		s.self.Remove(ip)
+	}
+	return err
 }
 
 var (
@@ -223,6 +448,8 @@ func (s *Server) process(ctx *context) error {
 		return s.processMessage(ctx)
 	case turn.IsChannelData(ctx.request.Raw):
 		return s.processChannelData(ctx)
+	case ctx.cfg.legacy && isLegacyBinding(ctx.request.Raw):
+		return s.processLegacyBinding(ctx)
 	default:
 		if ce := s.log.Check(zapcore.DebugLevel, "not looks like stun message"); ce != nil {
 			ce.Write(zap.Stringer("addr", ctx.client))
@@ -256,23 +483,80 @@ func (s *Server) serveConn(ctx *context) error {
 		if processErr != errNotSTUNMessage {
 			s.log.Error("process failed", zap.Error(processErr))
 		}
+		ctx.span.SetError(processErr)
+		s.finishTransaction(ctx)
 		return nil
 	}
 	if len(ctx.response.Raw) == 0 {
 		// Indication.
+		s.finishTransaction(ctx)
 		return nil
 	}
 	if setErr := ctx.conn.SetWriteDeadline(ctx.time.Add(time.Second)); setErr != nil {
 		s.log.Warn("failed to set deadline", zap.Error(setErr))
 	}
 	_, writeErr := ctx.conn.WriteTo(ctx.response.Raw, ctx.addr)
+	if writeErr == nil {
+		s.capture.Packet(ctx.client, ctx.server, ctx.client, ctx.response.Raw)
+	}
 	if writeErr != nil && !isErrConnClosed(writeErr) {
 		s.log.Warn("writeTo failed", zap.Error(writeErr))
+		ctx.span.SetError(writeErr)
+		s.finishTransaction(ctx)
 		return writeErr
 	}
+	s.finishTransaction(ctx)
 	return nil
 }
 
+// startSpan starts root span for STUN transaction if sampled.
+func (s *Server) startSpan(ctx *context) {
+	ctx.span = s.tracer.Start(ctx.request.Type.String())
+	if ctx.span == nil {
+		return
+	}
+	ctx.span.SetAttributes(
+		trace.String("stun.method", ctx.request.Type.Method.String()),
+		trace.String("stun.class", ctx.request.Type.Class.String()),
+		trace.String("stun.transaction_id", hex.EncodeToString(ctx.request.TransactionID[:])),
+		trace.String("net.peer.ip", ctx.client.IP.String()),
+		trace.Int("net.peer.port", ctx.client.Port),
+		trace.String("net.host", ctx.server.String()),
+	)
+}
+
+// finishTransaction finishes span and writes access log entry
+// for STUN transaction if any.
+func (s *Server) finishTransaction(ctx *context) {
+	if !ctx.decoded {
+		return
+	}
+	logged := s.accessLog.Sampled()
+	if ctx.span == nil && !logged {
+		return
+	}
+	var code stun.ErrorCodeAttribute
+	if ctx.response.Type.Class == stun.ClassErrorResponse {
+		if err := code.GetFrom(ctx.response); err != nil {
+			ctx.span.SetError(err)
+		}
+	}
+	if logged {
+		s.accessLog.Log(accesslog.Entry{
+			Time:     ctx.time,
+			Client:   ctx.client.String(),
+			Method:   ctx.request.Type.String(),
+			Username: ctx.username.String(),
+			Code:     int(code.Code),
+			Latency:  time.Since(ctx.time),
+		})
+	}
+	if ctx.span != nil {
+		ctx.span.SetAttributes(trace.Int("stun.result_code", int(code.Code)))
+		ctx.span.Finish()
+	}
+}
+
 func isErrConnClosed(err error) bool {
 	return strings.HasSuffix(err.Error(), "use of closed network connection")
 }
@@ -297,32 +581,87 @@ func (s *Server) worker(conn net.PacketConn) {
 			break
 		}
 
-		// Preparing context.
-		ctx := acquireContext()
-		ctx.conn = conn
-		ctx.buf = ctx.buf[:cap(ctx.buf)]
-		copy(ctx.buf, buf)
-		ctx.addr = addr
-		ctx.buf = ctx.buf[:n]
-		ctx.server = s.addr
-		ctx.cfg = s.config()
-
-		for i := 0; i < 7; i++ {
-			if s.pool.Serve(ctx) {
-				break
+		if s.capture.Active() {
+			if udpAddr, ok := addr.(*net.UDPAddr); ok {
+				client := turn.Addr{IP: udpAddr.IP, Port: udpAddr.Port}
+				s.capture.Packet(client, client, s.addr, buf[:n])
 			}
-			s.log.Warn("not enough workers")
-			time.Sleep(time.Millisecond * 300)
 		}
+		if s.route(addr, buf[:n]) {
+			continue
+		}
+		s.dispatch(conn, addr, buf[:n])
+	}
+}
+
+// route forwards data to cluster node that owns allocation of client,
+// returning false if data should be processed locally.
+func (s *Server) route(addr net.Addr, data []byte) bool {
+	if s.cluster == nil {
+		return false
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
 	}
+	return s.cluster.Route(turn.FiveTuple{
+		Client: turn.Addr{IP: udpAddr.IP, Port: udpAddr.Port},
+		Server: s.addr,
+		Proto:  turn.ProtoUDP,
+	}, data)
+}
+
+// dispatch passes copy of data received from addr on conn to worker pool.
+func (s *Server) dispatch(conn net.PacketConn, addr net.Addr, data []byte) {
+	// Preparing context.
+	ctx := acquireContext()
+	ctx.conn = conn
+	ctx.buf = ctx.buf[:cap(ctx.buf)]
+	copy(ctx.buf, data)
+	ctx.addr = addr
+	ctx.buf = ctx.buf[:len(data)]
+	ctx.server = s.addr
+	ctx.cfg = s.config()
+
+	for i := 0; i < 7; i++ {
+		if s.pool.Serve(ctx) {
+			break
+		}
+		s.log.Warn("not enough workers")
+		time.Sleep(time.Millisecond * 300)
+	}
+}
+
+// HandleForwarded implements cluster.Handler, processing data that was
+// received by another cluster node. Responses are sent directly to client.
+func (s *Server) HandleForwarded(client turn.Addr, data []byte) {
+	if atomic.LoadInt32(&s.serving) == 0 {
+		return
+	}
+	addr := &net.UDPAddr{
+		IP:   append(net.IP(nil), client.IP...),
+		Port: client.Port,
+	}
+	s.capture.Packet(client, client, s.addr, data)
+	s.dispatch(s.conn, addr, data)
 }
 
 // Serve reads packets from connections and responds to BINDING requests.
 func (s *Server) Serve() error {
 	s.pool.Start()
-	for i := 0; i < runtime.GOMAXPROCS(-1); i++ {
+	inherited := len(s.conns)
+	workers := runtime.GOMAXPROCS(-1)
+	if inherited > workers {
+		// Every inherited socket should be read.
+		workers = inherited
+	}
+	for i := 0; i < workers; i++ {
 		s.wg.Add(1)
-		if s.reusePort {
+		switch {
+		case i < inherited:
+			s.log.Info("using inherited socket for worker", zap.Int("w", i))
+			go s.worker(s.conns[i])
+		case s.reusePort:
 			s.log.Info("reusing port for worker", zap.Int("w", i))
 			laddr := s.conn.LocalAddr()
 			conn, err := reuseport.ListenPacket(laddr.Network(), laddr.String())
@@ -333,10 +672,11 @@ func (s *Server) Serve() error {
 				s.conns = append(s.conns, conn)
 			}
 			go s.worker(conn)
-		} else {
+		default:
 			go s.worker(s.conn)
 		}
 	}
+	atomic.StoreInt32(&s.serving, 1)
 	s.wg.Wait()
 	return nil
 }
@@ -10,6 +10,9 @@ import (
 
 	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/cluster"
+	"github.com/gortc/gortcd/internal/icmp"
+	"github.com/gortc/gortcd/internal/mobility"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
@@ -54,50 +57,165 @@ func (s *Server) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr) {
 		d.Encode()
 		if _, err := s.conn.WriteTo(d.Raw, destination); err != nil {
 			l.Error("failed to write", zap.Error(err))
+		} else {
+			s.capture.Packet(t.Client, s.addr, t.Client, d.Raw)
 		}
 		l.Debug("sent data via channel", zap.Stringer("n", n))
 		return
 	}
+	s.sendDataIndication(l, t, turn.Data(d), turn.PeerAddress(a))
+}
+
+// HandlePeerICMP implements allocator.ICMPHandler, relaying ICMP error
+// to client in Data indication without data.
+//
+// RFC 8656 Section 11.5
+func (s *Server) HandlePeerICMP(e icmp.Error, t turn.FiveTuple, a turn.Addr) {
+	l := s.log.With(
+		zap.Stringer("t", t),
+		zap.Stringer("addr", a),
+		zap.Stringer("icmp", e),
+	)
+	if !s.allocs.HasPermission(t, a) {
+		l.Debug("no permission for icmp")
+		return
+	}
+	l.Debug("got peer icmp")
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		l.Error("failed to SetWriteDeadline", zap.Error(err))
+	}
+	s.sendDataIndication(l, t, turn.PeerAddress(a), e)
+}
+
+// sendDataIndication sends Data indication with provided attributes to
+// client of allocation.
+func (s *Server) sendDataIndication(l *zap.Logger, t turn.FiveTuple, setters ...stun.Setter) {
 	m := stun.New()
-	if err := m.Build(
+	setters = append([]stun.Setter{
 		stun.TransactionID,
 		stun.NewType(stun.MethodData, stun.ClassIndication),
-		turn.Data(d), turn.PeerAddress(a),
-		stun.Fingerprint,
-	); err != nil {
+	}, setters...)
+	if err := m.Build(append(setters, stun.Fingerprint)...); err != nil {
 		l.Error("failed to build", zap.Error(err))
 		return
 	}
+	destination := &net.UDPAddr{
+		IP:   t.Client.IP,
+		Port: t.Client.Port,
+	}
 	if _, err := s.conn.WriteTo(m.Raw, destination); err != nil {
 		l.Error("failed to write", zap.Error(err))
+	} else {
+		s.capture.Packet(t.Client, s.addr, t.Client, m.Raw)
 	}
 	l.Debug("sent data from peer", zap.Stringer("m", m))
 }
 
 func (s *Server) processBindingRequest(ctx *context) error {
+	if s.discovery.Contains(ctx.server) {
+		return s.processDiscoveryBinding(ctx)
+	}
 	return ctx.buildOk(
 		(*stun.XORMappedAddress)(&ctx.client),
 	)
 }
 
+// dontFragmentUnknown is set if DF bit can't be set for relayed packets,
+// so DONT-FRAGMENT is treated as unknown comprehension-required attribute
+// as described in RFC 5766 Section 6.2.
+var dontFragmentUnknown = stun.UnknownAttributes{stun.AttrDontFragment}
+
 func (s *Server) processAllocateRequest(ctx *context) error {
 	var (
 		transport turn.RequestedTransport
 	)
+	if s.Draining() || s.overloaded() {
+		// Using ALTERNATE-SERVER only for authenticated requests as
+		// required by RFC 5389 Section 11.
+		if s.redirect == nil || s.auth == nil {
+			return ctx.buildErr(stun.CodeInsufficientCapacity)
+		}
+		alt, ok := s.redirect.Pick(ctx.client)
+		if !ok {
+			return ctx.buildErr(stun.CodeInsufficientCapacity)
+		}
+		return ctx.buildErr(stun.CodeTryAlternate, &stun.AlternateServer{
+			IP:   alt.IP,
+			Port: alt.Port,
+		})
+	}
 	if err := transport.GetFrom(ctx.request); err != nil {
 		return ctx.buildErr(stun.CodeBadRequest)
 	}
-	lifetime := ctx.cfg.defaultLifetime
-	relayedAddr, err := s.allocs.New(ctx.tuple, ctx.time.Add(lifetime), s)
-	switch err {
+	var ticket mobility.Ticket
+	mobile := ticket.GetFrom(ctx.request) == nil
+	if mobile && s.mobility == nil {
+		return ctx.buildErr(mobility.MobilityForbidden)
+	}
+	dontFragment := turn.DontFragment.IsSet(ctx.request)
+	if dontFragment && !allocator.DontFragmentSupported {
+		return ctx.buildErr(stun.CodeUnknownAttribute, dontFragmentUnknown)
+	}
+	lifetime := ctx.tenant.defaultLifetime
+	session := allocator.Session{
+		Username: ctx.username.String(),
+		Realm:    ctx.realm.String(),
+	}
+	if err := s.cluster.Claim(ctx.tuple, ctx.time.Add(lifetime)); err != nil {
+		if err == cluster.ErrOwned {
+			return ctx.buildErr(stun.CodeAllocMismatch)
+		}
+		s.log.Warn("failed to claim allocation", zap.Error(err))
+		return ctx.buildErr(stun.CodeServerError)
+	}
+	span := ctx.span.Child("allocator.New")
+	relayedAddr, err := s.allocs.NewWithSession(ctx.tuple, session, ctx.time.Add(lifetime), s)
+	if err == nil && dontFragment {
+		if err = s.allocs.DontFragment(ctx.tuple); err != nil {
+			if failErr := s.allocs.Fail(ctx.tuple); failErr != nil {
+				s.log.Warn("failed to remove allocation", zap.Error(failErr))
+			}
+			if err != allocator.ErrDontFragmentNotSupported {
+				s.log.Warn("failed to set DF", zap.Error(err))
+			}
+			err = allocator.ErrDontFragmentNotSupported
+		}
+	}
+	span.SetError(err)
+	span.Finish()
+	if err != nil && err != allocator.ErrAllocationMismatch {
+		s.cluster.Release(ctx.tuple)
+	}
+	if err == nil {
+		relayedAddr.IP = s.ports.External(relayedAddr.IP)
+	}
+	switch errors.Cause(err) {
 	case nil:
-		return ctx.buildOk(
+		setters := []stun.Setter{
 			(*stun.XORMappedAddress)(&ctx.tuple.Client),
 			(*turn.RelayedAddress)(&relayedAddr),
 			turn.Lifetime{Duration: lifetime},
-		)
+		}
+		if mobile {
+			if ticket, err = s.issueTicket(ctx); err != nil {
+				s.log.Error("failed to issue ticket", zap.Error(err))
+				if failErr := s.allocs.Fail(ctx.tuple); failErr != nil {
+					s.log.Warn("failed to remove allocation", zap.Error(failErr))
+				}
+				s.cluster.Release(ctx.tuple)
+				return ctx.buildErr(stun.CodeServerError)
+			}
+			setters = append(setters, ticket)
+		}
+		return ctx.buildOk(setters...)
 	case allocator.ErrAllocationMismatch:
 		return ctx.buildErr(stun.CodeAllocMismatch)
+	case allocator.ErrQuotaReached:
+		return ctx.buildErr(stun.CodeAllocQuotaReached)
+	case allocator.ErrNoFreePorts:
+		return ctx.buildErr(stun.CodeInsufficientCapacity)
+	case allocator.ErrDontFragmentNotSupported:
+		return ctx.buildErr(stun.CodeUnknownAttribute, dontFragmentUnknown)
 	default:
 		s.log.Warn("failed to allocate", zap.Error(err))
 		return ctx.buildErr(stun.CodeServerError)
@@ -109,20 +227,63 @@ func (s *Server) processRefreshRequest(ctx *context) error {
 		lifetime turn.Lifetime
 		allocErr error
 	)
-	if err := ctx.request.Parse(&lifetime); err != nil && err != stun.ErrAttributeNotFound {
-		return errors.Wrap(err, "failed to parse")
+	lifetimeErr := lifetime.GetFrom(ctx.request)
+	if lifetimeErr != nil && lifetimeErr != stun.ErrAttributeNotFound {
+		return errors.Wrap(lifetimeErr, "failed to parse")
 	}
+	if lifetime.Duration > ctx.tenant.maxLifetime {
+		lifetime.Duration = ctx.tenant.maxLifetime
+	}
+	var ticket mobility.Ticket
+	mobile := ticket.GetFrom(ctx.request) == nil
+	from := ctx.tuple
+	if mobile {
+		if lifetimeErr == stun.ErrAttributeNotFound {
+			lifetime.Duration = ctx.tenant.defaultLifetime
+		}
+		var code stun.Setter
+		if from, code = s.moveAllocation(ctx, ticket, ctx.time.Add(lifetime.Duration)); code != nil {
+			return ctx.buildErr(code)
+		}
+	}
+	span := ctx.span.Child("allocator.Refresh")
 	switch lifetime.Duration {
 	case 0:
 		allocErr = s.allocs.Remove(ctx.tuple)
+		if allocErr == nil {
+			s.cluster.Release(ctx.tuple)
+		}
 	default:
 		timeout := ctx.time.Add(lifetime.Duration)
 		allocErr = s.allocs.Refresh(ctx.tuple, timeout)
+		if allocErr == nil {
+			allocErr = s.cluster.Claim(ctx.tuple, timeout)
+		}
+	}
+	span.SetError(allocErr)
+	span.Finish()
+	var ticketErr error
+	if allocErr == nil && mobile && lifetime.Duration > 0 {
+		ticket, ticketErr = s.issueTicket(ctx)
+	}
+	if !from.Equal(ctx.tuple) {
+		if allocErr == nil && ticketErr == nil {
+			s.completeMove(from, ctx.tuple)
+		} else {
+			s.revertMove(from, ctx.tuple)
+		}
 	}
 	switch allocErr {
 	case nil:
+		if ticketErr != nil {
+			s.log.Error("failed to issue ticket", zap.Error(ticketErr))
+			return ctx.buildErr(stun.CodeServerError)
+		}
+		if mobile && lifetime.Duration > 0 {
+			return ctx.buildOk(&lifetime, ticket)
+		}
 		return ctx.buildOk(&lifetime)
-	case allocator.ErrAllocationMismatch:
+	case allocator.ErrAllocationMismatch, cluster.ErrOwned:
 		return ctx.buildErr(stun.CodeAllocMismatch)
 	default:
 		s.log.Error("failed to process refresh request", zap.Error(allocErr))
@@ -140,12 +301,12 @@ func (s *Server) processCreatePermissionRequest(ctx *context) error {
 	}
 	switch err := lifetime.GetFrom(ctx.request); err {
 	case nil:
-		max := ctx.cfg.maxLifetime
+		max := ctx.tenant.maxLifetime
 		if lifetime.Duration > max {
 			lifetime.Duration = max
 		}
 	case stun.ErrAttributeNotFound:
-		lifetime.Duration = ctx.cfg.defaultLifetime
+		lifetime.Duration = ctx.tenant.defaultLifetime
 	default:
 		return errors.Wrap(err, "failed to get lifetime")
 	}
@@ -158,7 +319,11 @@ func (s *Server) processCreatePermissionRequest(ctx *context) error {
 		// Sending 403 (Forbidden) as described in RFC 5766 Section 9.1.
 		return ctx.buildErr(stun.CodeForbidden)
 	}
-	switch err := s.allocs.CreatePermission(ctx.tuple, peerAddr, timeout); err {
+	span := ctx.span.Child("allocator.CreatePermission")
+	err := s.allocs.CreatePermission(ctx.tuple, peerAddr, timeout)
+	span.SetError(err)
+	span.Finish()
+	switch err {
 	case allocator.ErrAllocationMismatch:
 		return ctx.buildErr(stun.CodeAllocMismatch)
 	case nil:
@@ -178,7 +343,18 @@ func (s *Server) processSendIndication(ctx *context) error {
 		return errors.Wrap(err, "failed to parse send indication")
 	}
 	s.log.Debug("sending data", zap.Stringer("to", addr))
-	if err := s.sendByPermission(ctx, turn.Addr(addr), data); err != nil {
+	span := ctx.span.Child("allocator.Send")
+	err := s.sendByPermission(ctx, turn.Addr(addr), data, turn.DontFragment.IsSet(ctx.request))
+	span.SetError(err)
+	span.Finish()
+	switch err {
+	case nil:
+	case allocator.ErrPeerForbidden:
+		s.log.Debug("peer is forbidden", zap.Stringer("addr", addr))
+	case allocator.ErrDontFragmentNotSupported:
+		// Discarding as described in RFC 5766 Section 10.2.
+		s.log.Debug("DF is not supported", zap.Stringer("addr", addr))
+	default:
 		s.log.Warn("send failed",
 			zap.Error(err),
 		)
@@ -197,14 +373,18 @@ func (s *Server) processChannelBinding(ctx *context) error {
 	}
 	var (
 		peerAddr = turn.Addr(addr)
-		lifetime = ctx.cfg.defaultLifetime
+		lifetime = ctx.tenant.defaultLifetime
 		timeout  = ctx.time.Add(lifetime)
 	)
 	if !ctx.allowPeer(peerAddr) {
 		// Sending 403 (Forbidden) as described in RFC 5766 Section 9.1.
 		return ctx.buildErr(stun.CodeForbidden)
 	}
-	switch err := s.allocs.ChannelBind(ctx.tuple, number, peerAddr, timeout); err {
+	span := ctx.span.Child("allocator.ChannelBind")
+	err := s.allocs.ChannelBind(ctx.tuple, number, peerAddr, timeout)
+	span.SetError(err)
+	span.Finish()
+	switch err {
 	case allocator.ErrAllocationMismatch:
 		return ctx.buildErr(stun.CodeAllocMismatch)
 	case nil:
@@ -227,7 +407,14 @@ func (s *Server) processChannelData(ctx *context) error {
 			zap.Int("len", ctx.cdata.Length),
 		)
 	}
-	return s.sendByBinding(ctx, ctx.cdata.Number, ctx.cdata.Data)
+	err := s.sendByBinding(ctx, ctx.cdata.Number, ctx.cdata.Data)
+	if err == allocator.ErrPeerForbidden {
+		if ce := s.log.Check(zapcore.DebugLevel, "peer is forbidden"); ce != nil {
+			ce.Write(zap.Int("channel", int(ctx.cdata.Number)))
+		}
+		return nil
+	}
+	return err
 }
 
 func (s *Server) needAuth(ctx *context) bool {
@@ -250,7 +437,10 @@ func (s *Server) processMessage(ctx *context) error {
 		}
 		return nil
 	}
-	ctx.realm = ctx.cfg.realm
+	ctx.decoded = true
+	ctx.tenant = ctx.cfg.selectRealm(ctx.request)
+	ctx.realm = ctx.tenant.realm
+	s.startSpan(ctx)
 	if ce := s.log.Check(zapcore.DebugLevel, "got message"); ce != nil {
 		ce.Write(zap.Stringer("m", ctx.request), zap.Stringer("addr", ctx.client))
 	}
@@ -267,7 +457,10 @@ func (s *Server) processMessage(ctx *context) error {
 		if nonceGetErr != nil && nonceGetErr != stun.ErrAttributeNotFound {
 			return ctx.buildErr(stun.CodeBadRequest)
 		}
+		nonceSpan := ctx.span.Child("nonce.check")
 		validNonce, nonceErr := s.nonce.Check(ctx.tuple, ctx.nonce, ctx.time)
+		nonceSpan.SetError(nonceErr)
+		nonceSpan.Finish()
 		if nonceErr != nil && nonceErr != auth.ErrStaleNonce {
 			s.log.Error("nonce error", zap.Error(nonceErr))
 			return ctx.buildErr(stun.CodeServerError)
@@ -284,9 +477,16 @@ func (s *Server) processMessage(ctx *context) error {
 		if nonceErr == auth.ErrStaleNonce {
 			return ctx.buildErr(stun.CodeStaleNonce)
 		}
-		switch integrity, err := s.auth.Auth(ctx.request); err {
+		authSpan := ctx.span.Child("auth")
+		integrity, err := s.auth.Auth(ctx.request)
+		authSpan.SetError(err)
+		authSpan.Finish()
+		switch err {
 		case nil:
 			ctx.integrity = integrity
+			if getErr := ctx.username.GetFrom(ctx.request); getErr != nil {
+				return ctx.buildErr(stun.CodeBadRequest)
+			}
 		default:
 			if ce := s.log.Check(zapcore.DebugLevel, "failed to auth"); ce != nil {
 				ce.Write(zap.Stringer("addr", ctx.client), zap.Stringer("req", ctx.request),
@@ -299,7 +499,11 @@ func (s *Server) processMessage(ctx *context) error {
 	// Selecting handler based on request message type.
 	h, ok := s.handlers[ctx.request.Type]
 	if ok {
-		return h(ctx)
+		handlerSpan := ctx.span.Child("handler")
+		err := h(ctx)
+		handlerSpan.SetError(err)
+		handlerSpan.Finish()
+		return err
 	}
 	s.log.Warn("unsupported request type", zap.Stringer("t", ctx.request.Type))
 	return ctx.buildErr(stun.CodeBadRequest)
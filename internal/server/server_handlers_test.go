@@ -2,9 +2,15 @@ package server
 
 import (
 	"net"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/filter"
+	"github.com/gortc/gortcd/internal/icmp"
+	"github.com/gortc/gortcd/internal/redirect"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
@@ -89,6 +95,23 @@ func TestServer_processAllocationRequest(t *testing.T) {
 				t.Error("bad lifetime")
 			}
 		})
+		t.Run("MaxLifetime", func(t *testing.T) {
+			m = stun.MustBuild(stun.TransactionID, turn.RefreshRequest,
+				turn.Lifetime{Duration: defaultMaxLifetime * 10},
+				username, realm, nonce, peer, i, stun.Fingerprint,
+			)
+			ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+			if err := s.process(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var lifetime turn.Lifetime
+			if getErr := lifetime.GetFrom(ctx.response); getErr != nil {
+				t.Fatal(getErr)
+			}
+			if lifetime.Duration != defaultMaxLifetime {
+				t.Errorf("lifetime %s should be clamped", lifetime)
+			}
+		})
 		t.Run("Dealloc", func(t *testing.T) {
 			m = stun.MustBuild(stun.TransactionID, turn.RefreshRequest,
 				turn.Lifetime{},
@@ -132,3 +155,689 @@ func TestServer_processAllocationRequest(t *testing.T) {
 		}
 	})
 }
+
+func TestServer_drainAndRedirect(t *testing.T) {
+	s, _ := newServer(t)
+	var (
+		username = stun.NewUsername("username")
+		ctx      = &context{
+			cfg:      s.config(),
+			request:  new(stun.Message),
+			response: new(stun.Message),
+			client:   turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567},
+			proto:    turn.ProtoUDP,
+		}
+	)
+	ctx.setTuple()
+	do := func(setters ...stun.Setter) {
+		t.Helper()
+		m := stun.MustBuild(setters...)
+		ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+		if err := s.process(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	do(stun.TransactionID, turn.AllocateRequest, username, stun.Fingerprint)
+	var (
+		realm stun.Realm
+		nonce stun.Nonce
+	)
+	if err := ctx.response.Parse(&realm, &nonce); err != nil {
+		t.Fatal(err)
+	}
+	i := stun.NewLongTermIntegrity("username", realm.String(), "secret")
+	allocate := []stun.Setter{stun.TransactionID, turn.AllocateRequest,
+		turn.RequestedTransportUDP, username, realm, nonce, i, stun.Fingerprint,
+	}
+	do(allocate...)
+	if ctx.response.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", ctx.response)
+	}
+	var code stun.ErrorCodeAttribute
+	s.maxAllocs = 1
+	do(allocate...)
+	if err := code.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if code.Code != stun.CodeInsufficientCapacity {
+		t.Errorf("unexpected code %d on overload", code.Code)
+	}
+	// Allocations are counted per listener.
+	other, stopOther := newServer(t, Options{Realm: "realm", MaxAllocations: 1})
+	defer stopOther()
+	if other.overloaded() {
+		t.Error("other listener should not be overloaded")
+	}
+	s.maxAllocs = 0
+	s.Drain()
+	if !s.Draining() {
+		t.Fatal("should be draining")
+	}
+	do(allocate...)
+	if err := code.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if code.Code != stun.CodeInsufficientCapacity {
+		t.Errorf("unexpected code %d", code.Code)
+	}
+	alternate := turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 3478}
+	policy, err := redirect.RoundRobin([]turn.Addr{alternate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.redirect = policy
+	do(allocate...)
+	if err := code.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if code.Code != stun.CodeTryAlternate {
+		t.Errorf("unexpected code %d", code.Code)
+	}
+	var alt stun.AlternateServer
+	if err := alt.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if !alt.IP.Equal(alternate.IP) || alt.Port != alternate.Port {
+		t.Errorf("unexpected alternate server %s:%d", alt.IP, alt.Port)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Fatalf("existing allocation should be kept, got %d", n)
+	}
+	if err := s.Shutdown(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.allocs.Stats().Allocations; n != 0 {
+		t.Errorf("allocations should be removed on shutdown, got %d", n)
+	}
+}
+
+// allocate performs authenticated Allocate request from ctx.client.
+// allocate performs authenticated Allocate request with optional
+// attributes.
+func allocate(t *testing.T, s *Server, ctx *context, setters ...stun.Setter) {
+	t.Helper()
+	do := func(setters ...stun.Setter) {
+		t.Helper()
+		m := stun.MustBuild(setters...)
+		ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+		if err := s.process(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	username := stun.NewUsername("username")
+	do(stun.TransactionID, turn.AllocateRequest, username, stun.Fingerprint)
+	var (
+		realm stun.Realm
+		nonce stun.Nonce
+	)
+	if err := ctx.response.Parse(&realm, &nonce); err != nil {
+		t.Fatal(err)
+	}
+	i := stun.NewLongTermIntegrity("username", realm.String(), "secret")
+	do(append([]stun.Setter{stun.TransactionID, turn.AllocateRequest, turn.RequestedTransportUDP},
+		append(setters, username, realm, nonce, i, stun.Fingerprint)...)...,
+	)
+}
+
+func newAllocateContext(s *Server) *context {
+	ctx := &context{
+		cfg:      s.config(),
+		request:  new(stun.Message),
+		response: new(stun.Message),
+		client:   turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567},
+		proto:    turn.ProtoUDP,
+	}
+	ctx.setTuple()
+	return ctx
+}
+
+func TestServer_portPoolExhaustion(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		PortPool: true,
+		MinPort:  34040,
+		MaxPort:  34040,
+	})
+	defer stop()
+	ctx := newAllocateContext(s)
+	// Occupying the only port of pool.
+	other := ctx.tuple
+	other.Client.Port++
+	relayed, err := s.allocs.New(other, time.Now().Add(time.Minute), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Port != 34040 {
+		t.Fatalf("unexpected relayed port %d", relayed.Port)
+	}
+	allocate(t, s, ctx)
+	var code stun.ErrorCodeAttribute
+	if err = code.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if code.Code != stun.CodeInsufficientCapacity {
+		t.Errorf("unexpected code %d", code.Code)
+	}
+}
+
+func TestServer_externalIP(t *testing.T) {
+	external := net.IPv4(203, 0, 113, 1)
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Relays: []allocator.Relay{
+			{IP: net.IPv4(127, 0, 0, 1), External: external},
+		},
+	})
+	defer stop()
+	ctx := newAllocateContext(s)
+	allocate(t, s, ctx)
+	var relayed turn.RelayedAddress
+	if err := relayed.GetFrom(ctx.response); err != nil {
+		t.Fatal(err)
+	}
+	if !relayed.IP.Equal(external) {
+		t.Errorf("unexpected relayed address %s", relayed)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Fatalf("unexpected allocations count %d", n)
+	}
+	for _, a := range s.allocs.Export() {
+		if !a.RelayedAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("relayed port should be bound on relay ip, got %s", a.RelayedAddr)
+		}
+	}
+}
+
+func TestServer_peerFilter(t *testing.T) {
+	self := filter.NewSelf()
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Self:  self,
+	})
+	if !self.Contains(s.addr.IP) {
+		t.Error("listener address should be added to self")
+	}
+	ctx := newAllocateContext(s)
+	ctx.cdata = new(turn.ChannelData)
+	peer, peerAddr := listenUDP(t)
+	defer peer.Close()
+	peerTurnAddr := turn.Addr{IP: peerAddr.IP, Port: peerAddr.Port}
+	if _, err := s.allocs.New(ctx.tuple, time.Now().Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	n := turn.ChannelNumber(0x4000)
+	if err := s.allocs.ChannelBind(ctx.tuple, n, peerTurnAddr, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	if err := s.sendByBinding(ctx, n, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendByPermission(ctx, peerTurnAddr, data, false); err != nil {
+		t.Fatal(err)
+	}
+	// Peer is on same address as listener.
+	rule, err := filter.SetRule(filter.Deny, filter.SetSelf, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setOptions(Options{Realm: "realm", PeerRule: filter.NewFilter(filter.Allow, rule)})
+	if err = s.sendByBinding(ctx, n, data); err != allocator.ErrPeerForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = s.sendByPermission(ctx, peerTurnAddr, data, false); err != allocator.ErrPeerForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+	stop()
+	if self.Contains(s.addr.IP) {
+		t.Error("listener address should be removed from self on close")
+	}
+}
+
+func TestServer_icmp(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ICMP errors are supported only on linux")
+	}
+	s, stop := newServer(t)
+	defer stop()
+	client, clientAddr := listenUDP(t)
+	defer client.Close()
+	ctx := newAllocateContext(s)
+	ctx.client = turn.Addr{IP: clientAddr.IP, Port: clientAddr.Port}
+	ctx.setTuple()
+	// Port of closed connection is unreachable.
+	peer, peerAddr := listenUDP(t)
+	if err := peer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	peerTurnAddr := turn.Addr{IP: peerAddr.IP, Port: peerAddr.Port}
+	if _, err := s.allocs.New(ctx.tuple, time.Now().Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("NoPermission", func(t *testing.T) {
+		if err := client.SetReadDeadline(time.Now().Add(time.Millisecond * 50)); err != nil {
+			t.Fatal(err)
+		}
+		s.HandlePeerICMP(icmp.Error{Type: 3, Code: 3}, ctx.tuple, peerTurnAddr)
+		if _, _, err := client.ReadFrom(make([]byte, 1024)); err == nil {
+			t.Error("should not be relayed without permission")
+		}
+	})
+	if err := s.allocs.CreatePermission(ctx.tuple, peerTurnAddr, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	m := new(stun.Message)
+	// Sending until relayed connection is ready to read ICMP errors.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 10):
+				_ = s.sendByPermission(ctx, peerTurnAddr, []byte("hello"), false)
+			}
+		}
+	}()
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Raw = buf[:n]
+	if err = m.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != stun.NewType(stun.MethodData, stun.ClassIndication) {
+		t.Fatalf("unexpected type %s", m.Type)
+	}
+	var (
+		e    icmp.Error
+		addr turn.PeerAddress
+		data turn.Data
+	)
+	if err = m.Parse(&e, &addr); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != 3 || e.Code != 3 {
+		t.Errorf("unexpected ICMP error %s", e)
+	}
+	if !turn.Addr(addr).Equal(peerTurnAddr) {
+		t.Errorf("unexpected peer %s", addr)
+	}
+	if err = data.GetFrom(m); err == nil {
+		t.Error("DATA should not be present")
+	}
+}
+
+func TestServer_dontFragment(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		portPool bool
+	}{
+		{name: "System"},
+		{name: "PortPool", portPool: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, stop := newServer(t, Options{
+				Realm:    "realm",
+				PortPool: tc.portPool,
+				MinPort:  34050,
+				MaxPort:  34060,
+			})
+			defer stop()
+			ctx := newAllocateContext(s)
+			allocate(t, s, ctx, turn.DontFragment)
+			if !allocator.DontFragmentSupported {
+				var (
+					code    stun.ErrorCodeAttribute
+					unknown stun.UnknownAttributes
+				)
+				if err := ctx.response.Parse(&code, &unknown); err != nil {
+					t.Fatal(err)
+				}
+				if code.Code != stun.CodeUnknownAttribute || len(unknown) != 1 || unknown[0] != stun.AttrDontFragment {
+					t.Errorf("unexpected response %s", ctx.response)
+				}
+				return
+			}
+			if ctx.response.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("unexpected response %s", ctx.response)
+			}
+			states := s.allocs.Export()
+			if len(states) != 1 || !states[0].DontFragment {
+				t.Error("DF should be set for allocation")
+			}
+			peer, peerAddr := listenUDP(t)
+			defer peer.Close()
+			peerTurnAddr := turn.Addr{IP: peerAddr.IP, Port: peerAddr.Port}
+			if err := s.allocs.CreatePermission(ctx.tuple, peerTurnAddr, time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			m := stun.MustBuild(stun.TransactionID, turn.SendIndication,
+				turn.Data("hello"), turn.PeerAddress(peerTurnAddr), turn.DontFragment,
+			)
+			ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+			if err := s.process(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := peer.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1024)
+			n, _, err := peer.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "hello" {
+				t.Errorf("unexpected data %q", buf[:n])
+			}
+		})
+	}
+}
+
+func TestServer_blocklist(t *testing.T) {
+	newBlocklist := func(name string) *filter.Blocklist {
+		b, err := filter.NewBlocklist(filter.BlocklistOptions{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	o := Options{
+		Realm:           "realm",
+		ClientBlocklist: newBlocklist(BlocklistClient),
+		PeerBlocklist:   newBlocklist(BlocklistPeer),
+	}
+	s, stop := newServer(t, o)
+	defer stop()
+	u := NewUpdater(o)
+	u.Subscribe(s)
+	ctx := newAllocateContext(s)
+	peer := turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 5000}
+	if !ctx.allowClient(ctx.client) || !ctx.allowPeer(peer) {
+		t.Fatal("should be allowed before block")
+	}
+	_, peerNet, err := net.ParseCIDR("203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientNet, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.allocs.New(ctx.tuple, time.Now().Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Peer", func(t *testing.T) {
+		killed, blockErr := u.Block(BlocklistPeer, peerNet, time.Minute, "test")
+		if blockErr != nil {
+			t.Fatal(blockErr)
+		}
+		if killed != 0 {
+			t.Error("allocation without permission for peer should not be killed")
+		}
+		if ctx.cfg = s.config(); ctx.allowPeer(peer) {
+			t.Error("blocked peer should be denied")
+		}
+		if _, err = u.Unblock(BlocklistPeer, peerNet); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.cfg = s.config(); !ctx.allowPeer(peer) {
+			t.Error("unblocked peer should be allowed")
+		}
+		if err = s.allocs.CreatePermission(ctx.tuple, peer, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if killed, blockErr = u.Block(BlocklistPeer, peerNet, 0, ""); blockErr != nil {
+			t.Fatal(blockErr)
+		}
+		if killed != 1 || s.allocs.Stats().Allocations != 0 {
+			t.Errorf("allocation should be killed, killed %d", killed)
+		}
+	})
+	t.Run("Client", func(t *testing.T) {
+		if _, err = s.allocs.New(ctx.tuple, time.Now().Add(time.Minute), s); err != nil {
+			t.Fatal(err)
+		}
+		killed, blockErr := u.Block(BlocklistClient, clientNet, time.Minute, "")
+		if blockErr != nil {
+			t.Fatal(blockErr)
+		}
+		if killed != 1 || s.allocs.Stats().Allocations != 0 {
+			t.Errorf("allocation should be killed, killed %d", killed)
+		}
+		if ctx.cfg = s.config(); ctx.allowClient(ctx.client) {
+			t.Error("blocked client should be denied")
+		}
+		entries, listErr := u.Blocked(BlocklistClient)
+		if listErr != nil {
+			t.Fatal(listErr)
+		}
+		if len(entries) != 1 || entries[0].Hits != 1 {
+			t.Errorf("unexpected entries %+v", entries)
+		}
+	})
+	if _, err = u.Block("unknown", clientNet, 0, ""); err == nil {
+		t.Error("should fail for unknown blocklist")
+	}
+}
+
+func TestServer_peerPolicy(t *testing.T) {
+	mustRule := func(r filter.Rule, err error) filter.Rule {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		PeerRule: filter.NewFilter(filter.Allow, mustRule(filter.ForbidNet("127.0.0.0/8"))),
+		PeerPolicies: []PeerPolicy{
+			{Username: "internal", Realm: "realm", Rule: filter.NewFilter(filter.Pass,
+				mustRule(filter.AllowNet("127.0.0.0/8")),
+			)},
+			{Realm: "realm", Rule: filter.NewFilter(filter.Pass,
+				mustRule(filter.ForbidNet("192.0.2.0/24")),
+			)},
+		},
+	})
+	defer stop()
+	peer, peerAddr := listenUDP(t)
+	defer peer.Close()
+	var (
+		peerTurnAddr = turn.Addr{IP: peerAddr.IP, Port: peerAddr.Port}
+		docAddr      = turn.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+		publicAddr   = turn.Addr{IP: net.IPv4(203, 0, 113, 1), Port: 5000}
+	)
+	for _, tc := range []struct {
+		username string
+		realm    string
+		peer     turn.Addr
+		allowed  bool
+	}{
+		{"internal", "realm", peerTurnAddr, true},
+		{"internal", "realm", docAddr, true}, // realm policy is not applied
+		{"public", "realm", peerTurnAddr, false},
+		{"public", "realm", docAddr, false},
+		{"public", "realm", publicAddr, true},
+		{"internal", "other", peerTurnAddr, false},
+		{"internal", "other", docAddr, true},
+	} {
+		ctx := newAllocateContext(s)
+		ctx.username = stun.NewUsername(tc.username)
+		ctx.realm = stun.NewRealm(tc.realm)
+		if ctx.allowPeer(tc.peer) != tc.allowed {
+			t.Errorf("%s@%s: %s should be allowed: %v", tc.username, tc.realm, tc.peer, tc.allowed)
+		}
+	}
+	// Data path uses policy of allocation session.
+	ctx := newAllocateContext(s)
+	ctx.cdata = new(turn.ChannelData)
+	session := allocator.Session{Username: "internal", Realm: "realm"}
+	if _, err := s.allocs.NewWithSession(ctx.tuple, session, time.Now().Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	n := turn.ChannelNumber(0x4000)
+	if err := s.allocs.ChannelBind(ctx.tuple, n, peerTurnAddr, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	if err := s.sendByBinding(ctx, n, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendByPermission(ctx, peerTurnAddr, data, false); err != nil {
+		t.Fatal(err)
+	}
+	// Policy is removed on reload.
+	s.setOptions(Options{
+		Realm:    "realm",
+		PeerRule: filter.NewFilter(filter.Allow, mustRule(filter.ForbidNet("127.0.0.0/8"))),
+	})
+	if err := s.sendByBinding(ctx, n, data); err != allocator.ErrPeerForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := s.sendByPermission(ctx, peerTurnAddr, data, false); err != allocator.ErrPeerForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestServer_realms(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:     "realm",
+		Software:  "gortcd:test",
+		Bandwidth: 1000,
+		Auth: auth.NewStatic([]auth.StaticCredential{
+			{Username: "username", Password: "secret", Realm: "realm"},
+			{Username: "username", Password: "secret", Realm: "tenant"},
+		}),
+		Realms: []Realm{{
+			Name:            "tenant",
+			Software:        "tenant:test",
+			DefaultLifetime: 2 * time.Minute,
+			MaxAllocations:  1,
+			Bandwidth:       100,
+			Origins:         []string{"https://tenant.example.com"},
+		}},
+	})
+	defer stop()
+	origin := stun.RawAttribute{
+		Type:  stun.AttrOrigin,
+		Value: []byte("https://tenant.example.com"),
+	}
+	do := func(ctx *context, setters ...stun.Setter) {
+		t.Helper()
+		m := stun.MustBuild(append([]stun.Setter{stun.TransactionID, turn.AllocateRequest}, setters...)...)
+		ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+		if err := s.process(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	username := stun.NewUsername("username")
+	for _, tc := range []struct {
+		name     string
+		setters  []stun.Setter
+		realm    string
+		software string
+	}{
+		{"Default", nil, "realm", "gortcd:test"},
+		{"Origin", []stun.Setter{origin}, "tenant", "tenant:test"},
+		{"UnknownOrigin", []stun.Setter{stun.RawAttribute{
+			Type: stun.AttrOrigin, Value: []byte("https://example.com"),
+		}}, "realm", "gortcd:test"},
+		{"Presented", []stun.Setter{stun.NewRealm("tenant")}, "tenant", "tenant:test"},
+		{"UnknownPresented", []stun.Setter{stun.NewRealm("unknown")}, "realm", "gortcd:test"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newAllocateContext(s)
+			do(ctx, append(tc.setters, username)...)
+			var (
+				realm    stun.Realm
+				software stun.Software
+			)
+			if err := ctx.response.Parse(&realm, &software); err != nil {
+				t.Fatal(err)
+			}
+			if realm.String() != tc.realm {
+				t.Errorf("realm %q, expected %q", realm, tc.realm)
+			}
+			if software.String() != tc.software {
+				t.Errorf("software %q, expected %q", software, tc.software)
+			}
+		})
+	}
+	allocateTenant := func(ctx *context) {
+		t.Helper()
+		do(ctx, origin, username)
+		var nonce stun.Nonce
+		if err := nonce.GetFrom(ctx.response); err != nil {
+			t.Fatal(err)
+		}
+		i := stun.NewLongTermIntegrity("username", "tenant", "secret")
+		do(ctx, turn.RequestedTransportUDP, username, stun.NewRealm("tenant"), nonce, i)
+	}
+	ctx := newAllocateContext(s)
+	allocateTenant(ctx)
+	var lifetime turn.Lifetime
+	if err := lifetime.GetFrom(ctx.response); err != nil {
+		t.Fatalf("%s: %v", ctx.response, err)
+	}
+	if lifetime.Duration != 2*time.Minute {
+		t.Errorf("unexpected lifetime %s", lifetime)
+	}
+	if bw := s.bandwidth(allocator.Session{Realm: "tenant"}); bw != 100 {
+		t.Errorf("unexpected tenant bandwidth %d", bw)
+	}
+	if bw := s.bandwidth(allocator.Session{Realm: "realm"}); bw != 1000 {
+		t.Errorf("unexpected default bandwidth %d", bw)
+	}
+	t.Run("Quota", func(t *testing.T) {
+		ctx := newAllocateContext(s)
+		ctx.client.Port++
+		ctx.setTuple()
+		allocateTenant(ctx)
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(ctx.response); err != nil {
+			t.Fatal(err)
+		}
+		if code.Code != stun.CodeAllocQuotaReached {
+			t.Errorf("unexpected code %s", code)
+		}
+		// Quota is per realm.
+		allocate(t, s, ctx)
+		if ctx.response.Type.Class != stun.ClassSuccessResponse {
+			t.Errorf("unexpected response %s", ctx.response)
+		}
+	})
+	stats := s.allocs.Stats()
+	if stats.Realms["tenant"].Allocations != 1 || stats.Realms["realm"].Allocations != 1 {
+		t.Errorf("unexpected realm stats %+v", stats.Realms)
+	}
+}
+
+func TestNewConfig_listenerRealm(t *testing.T) {
+	o := Options{
+		Realm: "realm",
+		Realms: []Realm{
+			{Name: "a", Listeners: []string{"127.0.0.1:3478"}},
+			{Name: "b", Listeners: []string{"127.0.0.2:3478"}},
+		},
+	}
+	for _, tc := range []struct {
+		listener turn.Addr
+		realm    string
+	}{
+		{turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}, "a"},
+		{turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 3478}, "b"},
+		{turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 3479}, "realm"},
+	} {
+		if c := newConfig(o, tc.listener); c.realm.name != tc.realm {
+			t.Errorf("%s: realm %q, expected %q", tc.listener, c.realm.name, tc.realm)
+		}
+	}
+}
@@ -15,15 +15,22 @@ func (s *Server) sendByBinding(ctx *context, n turn.ChannelNumber, data []byte)
 	return err
 }
 
+// sendByPermission sends data to peer, setting DF bit of packet if
+// dontFragment is true.
 func (s *Server) sendByPermission(
 	ctx *context,
 	addr turn.Addr,
 	data []byte,
+	dontFragment bool,
 ) error {
 	s.log.Debug("searching for allocation",
 		zap.Stringer("tuple", ctx.tuple),
 		zap.Stringer("addr", addr),
 	)
+	if dontFragment {
+		_, err := s.allocs.SendDontFragment(ctx.tuple, addr, data)
+		return err
+	}
 	_, err := s.allocs.Send(ctx.tuple, addr, data)
 	return err
 }
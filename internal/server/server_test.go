@@ -1,16 +1,29 @@
 package server
 
 import (
+	"bufio"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-reuseport"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest/observer"
 
+	"github.com/gortc/gortcd/internal/accesslog"
+	"github.com/gortc/gortcd/internal/allocator"
 	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/cluster"
 	"github.com/gortc/gortcd/internal/testutil"
+	"github.com/gortc/gortcd/internal/trace"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
@@ -180,3 +193,518 @@ func TestServer_badFingerprint(t *testing.T) {
 		t.Error("unexpected success")
 	}
 }
+
+func TestServer_tracing(t *testing.T) {
+	exporter := new(trace.Memory)
+	tracer := trace.NewTracer(trace.Options{
+		Exporter: exporter,
+		Rate:     1,
+		Interval: time.Millisecond * 10,
+	})
+	defer tracer.Close()
+	serverConn, serverAddr := listenUDP(t)
+	s, stop := newServer(t, Options{
+		Conn:   serverConn,
+		Realm:  "realm",
+		Tracer: tracer,
+	})
+	defer stop()
+	go func() {
+		if err := s.Serve(); err != nil {
+			t.Error(err)
+		}
+	}()
+	c, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+		turn.RequestedTransportUDP, stun.Fingerprint,
+	)
+	if _, err = c.Write(m.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	if _, err = c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		root     *trace.SpanData
+		spans    []trace.SpanData
+		deadline = time.Now().Add(time.Second * 5)
+	)
+	for root == nil && time.Now().Before(deadline) {
+		// Root span is finished after response is sent.
+		time.Sleep(time.Millisecond * 10)
+		spans = exporter.Spans()
+		for i := range spans {
+			if spans[i].ParentID == nil {
+				root = &spans[i]
+			}
+		}
+	}
+	if root == nil {
+		t.Fatal("no root span")
+	}
+	attrs := map[string]interface{}{}
+	for _, a := range root.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["stun.method"] != stun.MethodAllocate.String() {
+		t.Errorf("unexpected method %v", attrs["stun.method"])
+	}
+	if attrs["stun.transaction_id"] != hex.EncodeToString(m.TransactionID[:]) {
+		t.Errorf("unexpected transaction id %v", attrs["stun.transaction_id"])
+	}
+	if attrs["stun.result_code"] != int64(stun.CodeUnauthorised) {
+		t.Errorf("unexpected result code %v", attrs["stun.result_code"])
+	}
+	if attrs["net.peer.ip"] != "127.0.0.1" {
+		t.Errorf("unexpected client ip %v", attrs["net.peer.ip"])
+	}
+	names := map[string]bool{}
+	for _, span := range spans {
+		names[span.Name] = true
+	}
+	if !names["nonce.check"] {
+		t.Error("no nonce check span")
+	}
+}
+
+func TestServer_accessLog(t *testing.T) {
+	r, w := io.Pipe()
+	accessLog := accesslog.New(accesslog.Options{Writer: w})
+	serverConn, serverAddr := listenUDP(t)
+	s, stop := newServer(t, Options{
+		Conn:      serverConn,
+		Realm:     "realm",
+		AccessLog: accessLog,
+	})
+	defer stop()
+	go func() {
+		if err := s.Serve(); err != nil {
+			t.Error(err)
+		}
+	}()
+	c, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+		turn.RequestedTransportUDP, stun.Fingerprint,
+	)
+	if _, err = c.Write(m.Raw); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 7 {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if fields[1] != c.LocalAddr().String() {
+		t.Errorf("unexpected client %s", fields[1])
+	}
+	if fields[2]+" "+fields[3] != turn.AllocateRequest.String() {
+		t.Errorf("unexpected method %s", fields[2])
+	}
+	if fields[5] != strconv.Itoa(int(stun.CodeUnauthorised)) {
+		t.Errorf("unexpected code %s", fields[5])
+	}
+	r.Close()
+	accessLog.Close()
+}
+
+func TestServer_Ready(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:       "realm",
+		AuthForSTUN: true,
+	})
+	defer stop()
+	u := NewUpdater(Options{})
+	if err := u.Ready(); err == nil {
+		t.Error("updater without listeners should not be ready")
+	}
+	u.Subscribe(s)
+	if err := u.Ready(); err == nil {
+		t.Error("server should not be ready before Serve")
+	}
+	go func() {
+		if err := s.Serve(); err != nil {
+			t.Error(err)
+		}
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		err := u.Ready()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServer_DetachRestore(t *testing.T) {
+	old, _ := newServer(t)
+	client, clientAddr := listenUDP(t)
+	defer client.Close()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: clientAddr.IP, Port: clientAddr.Port},
+		Server: old.addr,
+		Proto:  turn.ProtoUDP,
+	}
+	relayed, err := old.allocs.New(tuple, time.Now().Add(time.Minute), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, _ := old.nonce.Check(tuple, nil, time.Now())
+	st, files, err := old.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || len(st.Allocations) != 1 || len(st.Nonces) != 1 {
+		t.Fatalf("unexpected state: %d files, %+v", len(files), st)
+	}
+	conn, err := net.FilePacketConn(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = files[0].Close(); err != nil {
+		t.Error(err)
+	}
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Conn:  conn,
+	})
+	defer stop()
+	if err = s.Restore(st, files[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Fatalf("unexpected allocations count %d", n)
+	}
+	if _, checkErr := s.nonce.Check(tuple, nonce, time.Now()); checkErr != nil {
+		t.Errorf("nonce not restored: %v", checkErr)
+	}
+	// Data from peer should be relayed to client via new server.
+	peer, _ := listenUDP(t)
+	defer peer.Close()
+	if _, err = peer.WriteTo([]byte("hello"), &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &stun.Message{Raw: buf[:n]}
+	if err = m.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var data turn.Data
+	if err = data.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("unexpected data %q", data)
+	}
+}
+
+func TestServer_DetachRestoreReusePort(t *testing.T) {
+	if !reuseport.Available() {
+		t.Skip("SO_REUSEPORT is not available")
+	}
+	conn, err := reuseport.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr()
+	old, _ := newServer(t, Options{
+		Realm:     "realm",
+		Conn:      conn,
+		ReusePort: true,
+	})
+	go func() {
+		if serveErr := old.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	for atomic.LoadInt32(&old.serving) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sockets := len(old.conns)
+	if sockets == 0 {
+		t.Fatal("no additional sockets")
+	}
+	st, files, err := old.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Sockets != sockets || len(files) != 1+sockets {
+		t.Fatalf("unexpected state: %d files, %+v", len(files), st)
+	}
+	if conn, err = net.FilePacketConn(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = files[0].Close(); err != nil {
+		t.Error(err)
+	}
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Conn:  conn,
+	})
+	defer stop()
+	if err = s.Restore(st, files[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.conns) != sockets {
+		t.Fatalf("unexpected sockets count %d", len(s.conns))
+	}
+	for _, c := range s.conns {
+		if c.LocalAddr().String() != addr.String() {
+			t.Errorf("unexpected socket addr %s", c.LocalAddr())
+		}
+	}
+}
+
+func TestServer_DetachRestorePool(t *testing.T) {
+	const minPort, maxPort = 34100, 34103
+	ip := net.IPv4(127, 0, 0, 1)
+	oldPool, err := allocator.NewSystemPortPooledAllocator(allocator.PooledOptions{
+		IP: ip, MinPort: minPort, MaxPort: maxPort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldPool.Close()
+	old, _ := newServer(t, Options{
+		Realm:    "realm",
+		PortPool: true,
+		Relays:   []allocator.Relay{{IP: ip, Ports: oldPool}},
+	})
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: ip, Port: 5000},
+		Server: old.addr,
+		Proto:  turn.ProtoUDP,
+	}
+	relayed, err := old.allocs.New(tuple, time.Now().Add(time.Minute), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, files, err := old.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := oldPool.Detach()
+	if len(idle) != maxPort-minPort {
+		t.Fatalf("unexpected idle ports count %d", len(idle))
+	}
+	var inherited []*net.UDPConn
+	for _, f := range idle {
+		c, fileErr := net.FilePacketConn(f)
+		if fileErr != nil {
+			t.Fatal(fileErr)
+		}
+		if err = f.Close(); err != nil {
+			t.Error(err)
+		}
+		inherited = append(inherited, c.(*net.UDPConn))
+	}
+	// Ports are still bound in detached pool if not inherited.
+	pool, err := allocator.NewSystemPortPooledAllocator(allocator.PooledOptions{
+		IP: ip, MinPort: minPort, MaxPort: maxPort,
+		Inherited: inherited,
+		Reserved:  []int{relayed.Port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if n := pool.FreePorts(); n != len(idle) {
+		t.Fatalf("unexpected free ports %d", n)
+	}
+	conn, err := net.FilePacketConn(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = files[0].Close(); err != nil {
+		t.Error(err)
+	}
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		Conn:     conn,
+		PortPool: true,
+		Relays:   []allocator.Relay{{IP: ip, Ports: pool}},
+	})
+	defer stop()
+	if err = s.Restore(st, files[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Fatalf("unexpected allocations count %d", n)
+	}
+	if _, err = pool.AllocateAddr(relayed); err == nil {
+		t.Error("port of restored allocation should be allocated")
+	}
+	if err = s.allocs.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.FreePorts(); n != len(idle)+1 {
+		t.Errorf("port of restored allocation is not returned to pool, %d free", n)
+	}
+}
+
+func TestServer_RestoreSnapshot(t *testing.T) {
+	old, stopOld := newServer(t)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+		Server: old.addr,
+		Proto:  turn.ProtoUDP,
+	}
+	now := time.Now()
+	relayed, err := old.allocs.New(tuple, now.Add(time.Minute), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := tuple
+	expired.Client.Port++
+	if _, err = old.allocs.New(expired, now.Add(time.Second), old); err != nil {
+		t.Fatal(err)
+	}
+	st := old.Snapshot()
+	if len(st.Allocations) != 2 {
+		t.Fatalf("unexpected allocations count %d", len(st.Allocations))
+	}
+	// Relayed ports are freed, like after crash.
+	stopOld()
+	s, stop := newServer(t)
+	defer stop()
+	s.RestoreSnapshot(st, now.Add(time.Second*2))
+	restored := s.allocs.Export()
+	if len(restored) != 1 {
+		t.Fatalf("unexpected restored allocations count %d", len(restored))
+	}
+	if !restored[0].Tuple.Equal(tuple) || !restored[0].RelayedAddr.Equal(relayed) {
+		t.Errorf("unexpected allocation %+v", restored[0])
+	}
+	// Port should be bound again.
+	if _, listenErr := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: relayed.IP, Port: relayed.Port,
+	}); listenErr == nil {
+		t.Error("relayed port should be bound")
+	}
+}
+
+func TestServer_clusterForward(t *testing.T) {
+	memory := cluster.NewMemory()
+	backendServer := httptest.NewServer(cluster.NewBackendHandler(cluster.NewMemory(), "token"))
+	defer backendServer.Close()
+	for _, tc := range []struct {
+		name    string
+		backend func() cluster.Backend
+	}{
+		{
+			name:    "Memory",
+			backend: func() cluster.Backend { return memory },
+		},
+		{
+			// Nodes share backend that is served over localhost.
+			name:    "Remote",
+			backend: func() cluster.Backend { return cluster.NewRemote(backendServer.URL, "token") },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testClusterForward(t, tc.backend)
+		})
+	}
+}
+
+func testClusterForward(t *testing.T, backend func() cluster.Backend) {
+	newNode := func(id string) *cluster.Node {
+		conn, _ := listenUDP(t)
+		n, err := cluster.NewNode(cluster.Options{ID: id, Backend: backend(), Conn: conn, Key: []byte("key")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	nodeA, nodeB := newNode("a"), newNode("b")
+	defer nodeA.Close()
+	defer nodeB.Close()
+	a, stopA := newServer(t, Options{Realm: "realm", Cluster: nodeA})
+	defer stopA()
+	b, stopB := newServer(t, Options{Realm: "realm", Cluster: nodeB})
+	defer stopB()
+	go a.Serve()
+	go b.Serve()
+	for atomic.LoadInt32(&a.serving) == 0 || atomic.LoadInt32(&b.serving) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Both servers are expected to share listener address in production,
+	// emulating it by handling address of b on node a.
+	nodeA.Handle(b.addr, a)
+	client, clientAddr := listenUDP(t)
+	defer client.Close()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: clientAddr.IP, Port: clientAddr.Port},
+		Server: b.addr,
+		Proto:  turn.ProtoUDP,
+	}
+	if err := nodeA.Claim(tuple, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	request := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	var (
+		buf  = make([]byte, 1024)
+		n    int
+		from net.Addr
+		err  error
+	)
+	// Ownership lookup of remote backend is done in background, so
+	// request is retransmitted until it is forwarded to owner.
+	for i := 0; i < 10; i++ {
+		if _, err = client.WriteTo(request.Raw, &net.UDPAddr{IP: b.addr.IP, Port: b.addr.Port}); err != nil {
+			t.Fatal(err)
+		}
+		if err = client.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+			t.Fatal(err)
+		}
+		if n, from, err = client.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		if from.(*net.UDPAddr).Port == a.addr.Port {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if udpAddr := from.(*net.UDPAddr); udpAddr.Port != a.addr.Port {
+		t.Errorf("response should be sent by owner, got %s", from)
+	}
+	response := &stun.Message{Raw: buf[:n]}
+	if err = response.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if response.TransactionID != request.TransactionID {
+		t.Error("unexpected transaction id")
+	}
+	var mapped stun.XORMappedAddress
+	if err = mapped.GetFrom(response); err != nil {
+		t.Fatal(err)
+	}
+	if mapped.Port != clientAddr.Port {
+		t.Errorf("unexpected mapped address %s", mapped)
+	}
+}
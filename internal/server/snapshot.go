@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/turn"
+)
+
+// Snapshot returns current state of server.
+func (s *Server) Snapshot() ListenerState {
+	st := ListenerState{
+		Addr:        s.conn.LocalAddr().String(),
+		Allocations: s.allocs.Export(),
+	}
+	if n, ok := s.nonce.(interface{ Export() []auth.NonceState }); ok {
+		st.Nonces = n.Export()
+	}
+	return st
+}
+
+// RestoreSnapshot restores state from snapshot, binding relayed connections
+// on same addresses. Expired allocations and allocations which addresses
+// are not available are skipped.
+func (s *Server) RestoreSnapshot(st ListenerState, now time.Time) {
+	conns := make([]net.PacketConn, len(st.Allocations))
+	for i, a := range st.Allocations {
+		if !a.Timeout.After(now) || a.Tuple.Proto != turn.ProtoUDP {
+			continue
+		}
+		conn, err := s.ports.Listen(a.RelayedAddr)
+		if err != nil {
+			s.log.Warn("failed to bind relayed addr",
+				zap.Stringer("tuple", a.Tuple),
+				zap.Stringer("raddr", a.RelayedAddr),
+				zap.Error(err),
+			)
+			continue
+		}
+		conns[i] = conn
+	}
+	s.restore(st, conns)
+}
+
+// Snapshot returns current state of all subscribed servers.
+func (u *Updater) Snapshot() []ListenerState {
+	u.mux.RLock()
+	states := make([]ListenerState, 0, len(u.listeners))
+	for _, s := range u.listeners {
+		states = append(states, s.Snapshot())
+	}
+	u.mux.RUnlock()
+	return states
+}
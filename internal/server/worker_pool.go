@@ -126,6 +126,15 @@ func (wp *workerPool) clean(scratch *[]*workerChan) {
 	}
 }
 
+// saturated reports whether all workers are busy and no more workers
+// can be started.
+func (wp *workerPool) saturated() bool {
+	wp.lock.Lock()
+	saturated := len(wp.ready) == 0 && wp.workersCount >= wp.MaxWorkersCount
+	wp.lock.Unlock()
+	return saturated
+}
+
 func (wp *workerPool) Serve(c *context) bool {
 	ch := wp.getCh()
 	if ch == nil {
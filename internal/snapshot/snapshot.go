@@ -0,0 +1,189 @@
+// Package snapshot implements periodic saving of server state to local
+// file, so allocations can be restored after crash-restart.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/server"
+)
+
+// Version is current version of snapshot format.
+const Version = 1
+
+// Snapshot is state of all listeners at some time.
+type Snapshot struct {
+	Version   int                    `json:"version"`
+	Time      time.Time              `json:"time"`
+	Listeners []server.ListenerState `json:"listeners"`
+}
+
+// Listener returns state of listener with provided address.
+func (s Snapshot) Listener(addr string) (server.ListenerState, bool) {
+	for _, l := range s.Listeners {
+		if l.Addr == addr {
+			return l, true
+		}
+	}
+	return server.ListenerState{}, false
+}
+
+// UnsupportedVersionError means that snapshot has unsupported version.
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported snapshot version %d", e.Version)
+}
+
+// Write atomically writes snapshot to file with provided name.
+func Write(name string, s Snapshot) error {
+	s.Version = Version
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()           // #nosec
+		os.Remove(f.Name()) // #nosec
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name()) // #nosec
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Read reads snapshot from file with provided name.
+func Read(name string) (Snapshot, error) {
+	var s Snapshot
+	buf, err := ioutil.ReadFile(name) // #nosec
+	if err != nil {
+		return s, err
+	}
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return s, err
+	}
+	if s.Version != Version {
+		return s, UnsupportedVersionError{Version: s.Version}
+	}
+	return s, nil
+}
+
+// Source returns state of listeners.
+type Source interface {
+	Snapshot() []server.ListenerState
+}
+
+// Writer periodically writes snapshots of Source to file.
+type Writer struct {
+	log      *zap.Logger
+	name     string
+	source   Source
+	close    chan struct{}
+	stopOnce sync.Once
+	mux      sync.Mutex
+	detached bool
+	wg       sync.WaitGroup
+}
+
+// Options contain possible settings for Writer.
+type Options struct {
+	Log      *zap.Logger
+	Name     string // file name
+	Source   Source
+	Interval time.Duration
+}
+
+// NewWriter initializes Writer and starts writing snapshots.
+func NewWriter(o Options) *Writer {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Interval == 0 {
+		o.Interval = time.Second * 10
+	}
+	w := &Writer{
+		log:    o.Log,
+		name:   o.Name,
+		source: o.Source,
+		close:  make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.loop(o.Interval)
+	return w
+}
+
+func (w *Writer) write(t time.Time) {
+	s := Snapshot{
+		Time:      t,
+		Listeners: w.source.Snapshot(),
+	}
+	if err := Write(w.name, s); err != nil {
+		w.log.Error("failed to write snapshot", zap.Error(err))
+	}
+}
+
+func (w *Writer) loop(interval time.Duration) {
+	defer w.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			w.write(now)
+		case <-w.close:
+			return
+		}
+	}
+}
+
+func (w *Writer) stop() {
+	w.stopOnce.Do(func() {
+		close(w.close)
+	})
+	w.wg.Wait()
+}
+
+// Detach stops writing and keeps snapshot file, e.g. when state is passed
+// to new process during binary upgrade, that writes to the same file.
+// Snapshot file is not removed on Close after Detach.
+func (w *Writer) Detach() {
+	if w == nil {
+		return
+	}
+	w.mux.Lock()
+	w.detached = true
+	w.mux.Unlock()
+	w.stop()
+}
+
+// Close stops writing and removes snapshot file, because state is not
+// valid after clean shutdown, unless writer was detached.
+func (w *Writer) Close() error {
+	w.stop()
+	w.mux.Lock()
+	detached := w.detached
+	w.mux.Unlock()
+	if detached {
+		return nil
+	}
+	if err := os.Remove(w.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/auth"
+	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/turn"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func testSnapshot() Snapshot {
+	now := time.Date(2018, 5, 12, 10, 11, 12, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+		Server: turn.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 3478},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{IP: net.IPv4(10, 0, 0, 3), Port: 6000}
+	return Snapshot{
+		Version: Version,
+		Time:    now,
+		Listeners: []server.ListenerState{
+			{
+				Addr: "10.0.0.2:3478",
+				Allocations: []allocator.AllocationState{
+					{
+						Tuple:       tuple,
+						Session:     allocator.Session{Username: "user", Realm: "realm"},
+						RelayedAddr: turn.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 50000},
+						Permissions: []allocator.Permission{
+							{Addr: peer, Timeout: now.Add(time.Minute * 5), Binding: 0x4001},
+						},
+						Peers:   []turn.Addr{peer},
+						Started: now.Add(-time.Minute),
+						Timeout: now.Add(time.Minute * 10),
+						Usage:   allocator.Usage{ToPeerBytes: 100, ToPeerPackets: 1},
+					},
+				},
+				Nonces: []auth.NonceState{
+					{Tuple: tuple, Value: "nonce", ValidUntil: now.Add(time.Hour)},
+				},
+			},
+		},
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	name := filepath.Join(dir, "state.json")
+	s := testSnapshot()
+	if err := Write(name, s); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("not equal after round-trip:\n%+v\n%+v", got, s)
+	}
+	if _, ok := got.Listener("10.0.0.2:3478"); !ok {
+		t.Error("listener not found")
+	}
+	if _, ok := got.Listener("10.0.0.2:3479"); ok {
+		t.Error("unexpected listener")
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	name := filepath.Join(dir, "state.json")
+	t.Run("NotExist", func(t *testing.T) {
+		if _, err := Read(name); !os.IsNotExist(err) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		s := testSnapshot()
+		s.Version = Version + 1
+		buf, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Read(name)
+		if _, ok := err.(UnsupportedVersionError); !ok {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+type sourceFunc func() []server.ListenerState
+
+func (f sourceFunc) Snapshot() []server.ListenerState { return f() }
+
+func TestWriter(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	name := filepath.Join(dir, "state.json")
+	w := NewWriter(Options{
+		Name:     name,
+		Interval: time.Millisecond * 10,
+		Source: sourceFunc(func() []server.ListenerState {
+			return testSnapshot().Listeners
+		}),
+	})
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s, err := Read(name)
+		if err == nil {
+			if len(s.Listeners) != 1 {
+				t.Error("unexpected listeners count")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("snapshot should be removed on close")
+	}
+}
+
+func TestWriter_Detach(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	name := filepath.Join(dir, "state.json")
+	if err := Write(name, testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(Options{
+		Name:     name,
+		Interval: time.Millisecond * 10,
+		Source: sourceFunc(func() []server.ListenerState {
+			return testSnapshot().Listeners
+		}),
+	})
+	w.Detach()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(name); err != nil {
+		t.Errorf("snapshot should be kept after detach: %v", err)
+	}
+	var nilWriter *Writer
+	nilWriter.Detach()
+}
@@ -0,0 +1,196 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Memory is Exporter that stores all spans in memory, useful for tests.
+type Memory struct {
+	mux   sync.Mutex
+	spans []SpanData
+}
+
+// Export implements Exporter.
+func (m *Memory) Export(spans []SpanData) error {
+	m.mux.Lock()
+	m.spans = append(m.spans, spans...)
+	m.mux.Unlock()
+	return nil
+}
+
+// Spans returns copy of all exported spans.
+func (m *Memory) Spans() []SpanData {
+	m.mux.Lock()
+	spans := make([]SpanData, len(m.spans))
+	copy(spans, m.spans)
+	m.mux.Unlock()
+	return spans
+}
+
+// Writer is Exporter that writes spans as JSON lines, e.g. to stdout.
+type Writer struct {
+	mux sync.Mutex
+	enc *json.Encoder
+}
+
+// Export implements Exporter.
+func (w *Writer) Export(spans []SpanData) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for i := range spans {
+		if err := w.enc.Encode(spans[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewWriter initializes and returns new Writer exporter.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// OTLP exports spans to OpenTelemetry collector via OTLP/HTTP
+// with JSON encoding.
+type OTLP struct {
+	URL     string // e.g. http://localhost:4318/v1/traces
+	Service string // service.name resource attribute
+	Client  *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      ID              `json:"traceId"`
+	SpanID       ID              `json:"spanId"`
+	ParentSpanID ID              `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+func toOTLPAttribute(a Attribute) otlpAttribute {
+	v := otlpAttribute{Key: a.Key}
+	switch t := a.Value.(type) {
+	case string:
+		v.Value.StringValue = &t
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		v.Value.IntValue = &s
+	case float64:
+		v.Value.DoubleValue = &t
+	case bool:
+		v.Value.BoolValue = &t
+	}
+	return v
+}
+
+func (o *OTLP) request(spans []SpanData) otlpRequest {
+	var (
+		rs    otlpResourceSpans
+		scope otlpScopeSpans
+	)
+	rs.Resource.Attributes = append(rs.Resource.Attributes,
+		toOTLPAttribute(String("service.name", o.Service)),
+	)
+	scope.Scope.Name = "gortcd"
+	for _, s := range spans {
+		// Only root span is transaction that was received by server.
+		kind := otlpKindServer
+		if len(s.ParentID) > 0 {
+			kind = otlpKindInternal
+		}
+		span := otlpSpan{
+			TraceID:      s.TraceID,
+			SpanID:       s.SpanID,
+			ParentSpanID: s.ParentID,
+			Name:         s.Name,
+			Kind:         kind,
+			Start:        strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:       otlpStatus{Code: otlpStatusOK},
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		for _, a := range s.Attributes {
+			span.Attributes = append(span.Attributes, toOTLPAttribute(a))
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	rs.ScopeSpans = append(rs.ScopeSpans, scope)
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// Export implements Exporter.
+func (o *OTLP) Export(spans []SpanData) error {
+	body, err := json.Marshal(o.request(spans))
+	if err != nil {
+		return err
+	}
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Post(o.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if closeErr := res.Body.Close(); closeErr != nil {
+		return closeErr
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("unexpected status: " + res.Status)
+	}
+	return nil
+}
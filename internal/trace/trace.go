@@ -0,0 +1,275 @@
+// Package trace implements lightweight tracing of STUN transactions.
+//
+// Spans are exported in batches via Exporter, see OTLP for OpenTelemetry
+// compatible exporter.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathRand "math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ID is trace or span identifier.
+type ID []byte
+
+func (i ID) String() string { return hex.EncodeToString(i) }
+
+// MarshalText implements encoding.TextMarshaler.
+func (i ID) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (i *ID) UnmarshalText(text []byte) error {
+	v := make(ID, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(v, text); err != nil {
+		return err
+	}
+	*i = v
+	return nil
+}
+
+func newID(size int) ID {
+	id := make(ID, size)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// Attribute is key-value pair that describes span. Supported values are
+// string, int64, float64 and bool.
+type Attribute struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// String returns string attribute.
+func String(k, v string) Attribute { return Attribute{Key: k, Value: v} }
+
+// Int returns integer attribute.
+func Int(k string, v int) Attribute { return Attribute{Key: k, Value: int64(v)} }
+
+// Bool returns boolean attribute.
+func Bool(k string, v bool) Attribute { return Attribute{Key: k, Value: v} }
+
+// SpanData is finished span.
+type SpanData struct {
+	Name       string      `json:"name"`
+	TraceID    ID          `json:"trace_id"`
+	SpanID     ID          `json:"span_id"`
+	ParentID   ID          `json:"parent_id,omitempty"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Span represents single operation within trace.
+//
+// All methods are no-op on nil Span, which is returned for unsampled
+// transactions.
+type Span struct {
+	tracer *Tracer
+	mux    sync.Mutex
+	data   SpanData
+}
+
+// SetAttributes adds attributes to span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+	s.mux.Unlock()
+}
+
+// SetError marks span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	s.data.Error = err.Error()
+	s.mux.Unlock()
+}
+
+// Child starts new span that has s as parent.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		tracer: s.tracer,
+		data: SpanData{
+			Name:     name,
+			TraceID:  s.data.TraceID,
+			SpanID:   newID(8),
+			ParentID: s.data.SpanID,
+			Start:    time.Now(),
+		},
+	}
+}
+
+// Finish ends span and passes it to exporter.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.data.End = time.Now()
+	d := s.data
+	s.mux.Unlock()
+	s.tracer.enqueue(d)
+}
+
+// Exporter exports finished spans.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Options contain possible settings for Tracer.
+type Options struct {
+	Log      *zap.Logger
+	Exporter Exporter
+	Rate     float64       // sampling rate from 0 to 1
+	Batch    int           // maximum spans count in single export
+	Interval time.Duration // maximum delay before export
+	Queue    int           // maximum count of pending spans
+}
+
+// Tracer starts root spans for sampled transactions and exports
+// finished spans in background.
+type Tracer struct {
+	log      *zap.Logger
+	exporter Exporter
+	rate     float64
+	batch    int
+	interval time.Duration
+	queue    chan SpanData
+	closed   bool
+	closeMux sync.RWMutex
+	wg       sync.WaitGroup
+	randMux  sync.Mutex
+	rand     *mathRand.Rand
+}
+
+func (t *Tracer) sample() bool {
+	if t.rate >= 1 {
+		return true
+	}
+	t.randMux.Lock()
+	v := t.rand.Float64()
+	t.randMux.Unlock()
+	return v < t.rate
+}
+
+// Start returns new root span or nil if t is nil or transaction
+// is not sampled.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil || t.rate <= 0 || !t.sample() {
+		return nil
+	}
+	return &Span{
+		tracer: t,
+		data: SpanData{
+			Name:    name,
+			TraceID: newID(16),
+			SpanID:  newID(8),
+			Start:   time.Now(),
+		},
+	}
+}
+
+func (t *Tracer) enqueue(d SpanData) {
+	t.closeMux.RLock()
+	defer t.closeMux.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- d:
+	default:
+		t.log.Warn("span dropped: queue is full")
+	}
+}
+
+func (t *Tracer) export(spans []SpanData) {
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(spans); err != nil {
+		t.log.Error("failed to export spans", zap.Error(err), zap.Int("n", len(spans)))
+	}
+}
+
+func (t *Tracer) loop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	spans := make([]SpanData, 0, t.batch)
+	for {
+		select {
+		case d, ok := <-t.queue:
+			if !ok {
+				t.export(spans)
+				return
+			}
+			spans = append(spans, d)
+			if len(spans) < t.batch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(spans)
+		spans = make([]SpanData, 0, t.batch)
+	}
+}
+
+// Close exports all pending spans and stops background activity.
+//
+// Spans that are finished after Close are dropped.
+func (t *Tracer) Close() error {
+	t.closeMux.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.closeMux.Unlock()
+	t.wg.Wait()
+	return nil
+}
+
+// NewTracer initializes and starts new Tracer.
+func NewTracer(o Options) *Tracer {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Batch == 0 {
+		o.Batch = 512
+	}
+	if o.Interval == 0 {
+		o.Interval = time.Second * 5
+	}
+	if o.Queue == 0 {
+		o.Queue = 2048
+	}
+	t := &Tracer{
+		log:      o.Log,
+		exporter: o.Exporter,
+		rate:     o.Rate,
+		batch:    o.Batch,
+		interval: o.Interval,
+		queue:    make(chan SpanData, o.Queue),
+		rand:     mathRand.New(mathRand.NewSource(time.Now().UnixNano())), // #nosec
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t
+}
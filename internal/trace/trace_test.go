@@ -0,0 +1,145 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNilSpan(t *testing.T) {
+	var tracer *Tracer
+	s := tracer.Start("test")
+	if s != nil {
+		t.Fatal("should be nil")
+	}
+	c := s.Child("child")
+	c.SetAttributes(String("k", "v"))
+	c.SetError(errors.New("test"))
+	c.Finish()
+	s.Finish()
+}
+
+func TestTracer(t *testing.T) {
+	m := new(Memory)
+	tracer := NewTracer(Options{Exporter: m, Rate: 1})
+	s := tracer.Start("root")
+	c := s.Child("child")
+	c.SetError(errors.New("failed"))
+	c.Finish()
+	s.SetAttributes(String("k", "v"), Int("n", 1), Bool("b", true))
+	s.Finish()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	spans := m.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected spans count %d", len(spans))
+	}
+	child, root := spans[0], spans[1]
+	if !bytes.Equal(child.TraceID, root.TraceID) {
+		t.Error("trace id mismatch")
+	}
+	if !bytes.Equal(child.ParentID, root.SpanID) {
+		t.Error("parent id mismatch")
+	}
+	if child.Error != "failed" {
+		t.Errorf("unexpected error %q", child.Error)
+	}
+	if len(root.Attributes) != 3 {
+		t.Error("unexpected attributes")
+	}
+	if root.End.Before(root.Start) {
+		t.Error("bad timing")
+	}
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	m := new(Memory)
+	tracer := NewTracer(Options{Exporter: m, Rate: 0.5})
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if s := tracer.Start("root"); s != nil {
+			sampled++
+		}
+	}
+	if sampled < 300 || sampled > 700 {
+		t.Errorf("unexpected sampled count %d", sampled)
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	off := NewTracer(Options{Exporter: m})
+	if off.Start("root") != nil {
+		t.Error("should not sample with zero rate")
+	}
+	if err := off.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	if err := w.Export([]SpanData{{Name: "a", TraceID: ID{1, 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["trace_id"] != "0102" {
+		t.Errorf("unexpected trace id %v", v["trace_id"])
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var got otlpRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected content type")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+	e := &OTLP{URL: s.URL, Service: "gortcd", Client: s.Client()}
+	if err := e.Export([]SpanData{
+		{Name: "a", TraceID: make(ID, 16), SpanID: make(ID, 8), Attributes: []Attribute{Int("n", 10)}},
+		{Name: "b", TraceID: make(ID, 16), SpanID: make(ID, 8), ParentID: make(ID, 8), Error: "failed"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatal("unexpected request")
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("unexpected spans count %d", len(spans))
+	}
+	if v := spans[0].Attributes[0].Value.IntValue; v == nil || *v != "10" {
+		t.Error("unexpected int attribute")
+	}
+	if spans[1].Status.Code != otlpStatusError || spans[1].Status.Message != "failed" {
+		t.Error("unexpected status")
+	}
+	if spans[0].Kind != otlpKindServer {
+		t.Errorf("root span kind should be server, got %d", spans[0].Kind)
+	}
+	if spans[1].Kind != otlpKindInternal {
+		t.Errorf("child span kind should be internal, got %d", spans[1].Kind)
+	}
+	t.Run("BadStatus", func(t *testing.T) {
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer bad.Close()
+		e := &OTLP{URL: bad.URL, Client: bad.Client()}
+		if err := e.Export([]SpanData{{Name: "a"}}); err == nil {
+			t.Error("should error")
+		}
+	})
+}